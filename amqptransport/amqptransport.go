@@ -0,0 +1,286 @@
+// Package amqptransport carries the posts and round trip responses of
+// post2post over AMQP, e.g. RabbitMQ
+package amqptransport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pgdad/post2post"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Channel is the part of the AMQP channel API the AMQP transport and
+// service use; *amqp091.Channel implements it
+type Channel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	ConsumeWithContext(ctx context.Context, queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Transport performs round trips over AMQP, e.g. RabbitMQ: posts are
+// published to a request queue and responses consumed from a reply queue of
+// this transport, matched by correlation ID. Neither side needs to accept
+// connections.
+type Transport struct {
+	channel      Channel
+	requestQueue string
+
+	mu         sync.Mutex
+	replyQueue string
+	pending    map[string]chan *post2post.RoundTripResponse
+	cancel     context.CancelFunc
+	feed       post2post.ResponseFeed
+}
+
+var _ post2post.Transport = (*Transport)(nil)
+
+// New returns a transport publishing posts to requestQueue on channel. An
+// exclusive reply queue is declared on the first round trip.
+func New(channel Channel, requestQueue string) *Transport {
+	return &Transport{
+		channel:      channel,
+		requestQueue: requestQueue,
+		pending:      make(map[string]chan *post2post.RoundTripResponse),
+	}
+}
+
+// RoundTrip publishes payload and waits for its response until ctx is done.
+// Like RoundTripPost, failures are reported in the response rather than as
+// an error, with Timeout set when the deadline passed. The request expires
+// in the queue at the deadline. The error is only for payloads that cannot
+// be encoded.
+func (t *Transport) RoundTrip(ctx context.Context, payload interface{}, tailnetKey string) (*post2post.RoundTripResponse, error) {
+	requestID := post2post.PayloadRequestID(payload)
+	body, err := json.Marshal(post2post.PostData{
+		Payload:    payload,
+		RequestID:  requestID,
+		TailnetKey: tailnetKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	replyQueue, err := t.ensureReplyQueue()
+	if err != nil {
+		return post2post.FailedResponse(requestID, err), nil
+	}
+	responseChan := make(chan *post2post.RoundTripResponse, 1)
+	t.mu.Lock()
+	t.pending[requestID] = responseChan
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, requestID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.publish(ctx, requestID, replyQueue, body); err != nil {
+		return post2post.FailedResponse(requestID, err), nil
+	}
+
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-ctx.Done():
+		return post2post.FailedResponse(requestID, post2post.ErrRoundTripTimeout), nil
+	}
+}
+
+// Send publishes post to the request queue for a server using the
+// transport. Round trip posts name the reply queue as their reply-to queue.
+func (t *Transport) Send(ctx context.Context, post *post2post.Post) error {
+	body, err := json.Marshal(post.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	replyQueue := ""
+	if post.RoundTrip {
+		if replyQueue, err = t.ensureReplyQueue(); err != nil {
+			return err
+		}
+	}
+	return t.publish(ctx, post.Data.RequestID, replyQueue, body)
+}
+
+// ReceiveResponses consumes the reply queue and delivers the replies no
+// round trip of the transport itself waits for, for a server using the
+// transport
+func (t *Transport) ReceiveResponses(ctx context.Context) (<-chan *post2post.RoundTripResponse, error) {
+	if _, err := t.ensureReplyQueue(); err != nil {
+		return nil, err
+	}
+	return t.feed.Start(ctx), nil
+}
+
+// publish publishes a post to the request queue, expiring at the deadline
+// of ctx
+func (t *Transport) publish(ctx context.Context, requestID, replyQueue string, body []byte) error {
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: requestID,
+		ReplyTo:       replyQueue,
+		Timestamp:     time.Now(),
+		Body:          body,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+	if err := t.channel.PublishWithContext(ctx, "", t.requestQueue, false, false, msg); err != nil {
+		return fmt.Errorf("failed to publish request: %w", err)
+	}
+	return nil
+}
+
+// Close stops consuming the reply queue. Round trips still waiting time out.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+	t.replyQueue = ""
+	return nil
+}
+
+// ensureReplyQueue declares and consumes the reply queue if not done yet,
+// and returns its name
+func (t *Transport) ensureReplyQueue() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.replyQueue != "" {
+		return t.replyQueue, nil
+	}
+	queue, err := t.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare reply queue: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, err := t.channel.ConsumeWithContext(ctx, queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		cancel()
+		return "", fmt.Errorf("failed to consume reply queue: %w", err)
+	}
+	t.replyQueue = queue.Name
+	t.cancel = cancel
+	go t.consumeReplies(queue.Name, deliveries)
+	return queue.Name, nil
+}
+
+// consumeReplies hands each reply to the round trip waiting for its
+// correlation ID until the deliveries end, e.g. when the channel closes
+func (t *Transport) consumeReplies(queue string, deliveries <-chan amqp.Delivery) {
+	for delivery := range deliveries {
+		var response post2post.RoundTripResponse
+		if err := json.Unmarshal(delivery.Body, &response); err != nil {
+			log.Printf("AMQP transport: Ignoring invalid reply %s: %v", delivery.CorrelationId, err)
+			continue
+		}
+		response.RequestID = delivery.CorrelationId
+		response.SetErr()
+
+		t.mu.Lock()
+		responseChan, ok := t.pending[delivery.CorrelationId]
+		t.mu.Unlock()
+		if !ok && t.feed.Deliver(&response) {
+			continue
+		}
+		if !ok {
+			log.Printf("AMQP transport: No round trip is waiting for reply %s", delivery.CorrelationId)
+			continue
+		}
+		select {
+		case responseChan <- &response:
+		default:
+		}
+	}
+
+	// Declare a new reply queue on the next round trip
+	t.mu.Lock()
+	if t.replyQueue == queue {
+		t.replyQueue = ""
+	}
+	t.mu.Unlock()
+}
+
+// Serve consumes posts from requestQueue on channel until ctx is done,
+// processing them with processor as posts to /webhook are, or echoing them
+// back if it is nil. Each response is published to the post's reply-to
+// queue with its correlation ID, and the post is acknowledged once its
+// response is published, so posts of a receiver that dies are redelivered.
+// The request queue is declared durable if it does not exist.
+func Serve(ctx context.Context, channel Channel, requestQueue string, processor post2post.PayloadProcessor) error {
+	if _, err := channel.QueueDeclare(requestQueue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare request queue: %w", err)
+	}
+	deliveries, err := channel.ConsumeWithContext(ctx, requestQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume request queue: %w", err)
+	}
+	log.Printf("Consuming posts from AMQP queue: %s", requestQueue)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case delivery, ok := <-deliveries:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("AMQP queue %s closed", requestQueue)
+			}
+			handleDelivery(ctx, channel, delivery, processor)
+		}
+	}
+}
+
+// handleDelivery processes one post and publishes its response
+func handleDelivery(ctx context.Context, channel Channel, delivery amqp.Delivery, processor post2post.PayloadProcessor) {
+	var requestData post2post.PostData
+	if err := json.Unmarshal(delivery.Body, &requestData); err != nil {
+		log.Printf("AMQP service: Rejecting invalid post %s: %v", delivery.CorrelationId, err)
+		delivery.Reject(false)
+		return
+	}
+	if requestData.RequestID == "" {
+		requestData.RequestID = delivery.CorrelationId
+	}
+
+	callback := post2post.ProcessPost(processor, requestData)
+	response := callback.RoundTripResponse()
+
+	if delivery.ReplyTo == "" {
+		// Nobody waits for the response
+		delivery.Ack(false)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		body, _ = json.Marshal(post2post.RoundTripResponse{
+			RequestID: requestData.RequestID,
+			Error:     fmt.Sprintf("failed to marshal response: %v", err),
+		})
+	}
+	err = channel.PublishWithContext(ctx, "", delivery.ReplyTo, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: delivery.CorrelationId,
+		Timestamp:     time.Now(),
+		Body:          body,
+	})
+	if err != nil {
+		log.Printf("AMQP service: Failed to publish response %s: %v", delivery.CorrelationId, err)
+		delivery.Nack(false, true)
+		return
+	}
+	delivery.Ack(false)
+}
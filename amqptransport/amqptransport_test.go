@@ -0,0 +1,162 @@
+package amqptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// processorFunc adapts a function to a payload processor
+type processorFunc func(payload interface{}, requestID string) (interface{}, error)
+
+func (f processorFunc) Process(payload interface{}, requestID string) (interface{}, error) {
+	return f(payload, requestID)
+}
+
+// fakeChannel routes messages published to the default exchange into
+// in-memory queues
+type fakeChannel struct {
+	mu     sync.Mutex
+	queues map[string]chan amqp.Delivery
+	next   int
+	acks   map[string]string
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{queues: make(map[string]chan amqp.Delivery), acks: make(map[string]string)}
+}
+
+func (c *fakeChannel) queue(name string) chan amqp.Delivery {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q, ok := c.queues[name]
+	if !ok {
+		q = make(chan amqp.Delivery, 16)
+		c.queues[name] = q
+	}
+	return q
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == "" {
+		c.mu.Lock()
+		c.next++
+		name = fmt.Sprintf("amq.gen-%d", c.next)
+		c.mu.Unlock()
+	}
+	c.queue(name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) ConsumeWithContext(ctx context.Context, queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return c.queue(queue), nil
+}
+
+func (c *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.queue(key) <- amqp.Delivery{
+		Acknowledger:  &fakeAcknowledger{channel: c, id: msg.CorrelationId},
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		Expiration:    msg.Expiration,
+		Body:          msg.Body,
+	}
+	return nil
+}
+
+// fakeAcknowledger records how each delivery was settled
+type fakeAcknowledger struct {
+	channel *fakeChannel
+	id      string
+}
+
+func (a *fakeAcknowledger) settle(how string) error {
+	a.channel.mu.Lock()
+	defer a.channel.mu.Unlock()
+	a.channel.acks[a.id] = how
+	return nil
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error { return a.settle("ack") }
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.settle("nack")
+}
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error { return a.settle("reject") }
+
+func TestTransport(t *testing.T) {
+	channel := newFakeChannel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, channel, "post2post-requests", processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			if payload == "fail" {
+				return nil, errors.New("bad payload")
+			}
+			return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+		}))
+	}()
+
+	transport := New(channel, "post2post-requests")
+	defer transport.Close()
+
+	payload := struct {
+		RequestID string `json:"request_id"`
+		Message   string `json:"message"`
+	}{RequestID: "req-amqp", Message: "hello"}
+	rtCtx, rtCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer rtCancel()
+	response, err := transport.RoundTrip(rtCtx, payload, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Success || response.RequestID != "req-amqp" {
+		t.Fatalf("RoundTrip() = %+v, want success for req-amqp", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+	channel.mu.Lock()
+	settled := channel.acks["req-amqp"]
+	channel.mu.Unlock()
+	if settled != "ack" {
+		t.Errorf("post was settled with %q, want ack", settled)
+	}
+
+	// A processing error fails the round trip
+	response, err = transport.RoundTrip(rtCtx, "fail", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad payload" {
+		t.Errorf("RoundTrip() = %+v, want a processing error", response)
+	}
+
+	// Without a receiver the round trip times out
+	lonely := New(channel, "nobody-listens")
+	defer lonely.Close()
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	response, err = lonely.RoundTrip(shortCtx, "hello", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Timeout {
+		t.Errorf("RoundTrip() = %+v, want a timeout", response)
+	}
+	request := <-channel.queue("nobody-listens")
+	if request.Expiration == "" || request.ReplyTo == "" || request.CorrelationId != response.RequestID {
+		t.Errorf("request = %+v, want an expiration, reply-to queue and correlation ID", request)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"time"
+)
+
+// multipartPostField is the form field of the JSON post in a multipart post
+const multipartPostField = "post"
+
+// maxAttachmentMemory bounds the attachments of a multipart post kept in
+// memory; larger ones are stored in temporary files while processing
+const maxAttachmentMemory = 32 << 20
+
+// errAttachmentsTransport fails posts with attachments over a transport
+// other than HTTP
+var errAttachmentsTransport = errors.New("attachments require the HTTP transport")
+
+// Attachment is a binary attachment of a post, sent as a part of a
+// multipart/form-data post next to the JSON post instead of base64 in the
+// payload
+type Attachment struct {
+	// Name is the form field name of the part
+	Name string
+	// Filename is the file name of the part, Name if empty
+	Filename string
+	// ContentType defaults to application/octet-stream
+	ContentType string
+	// Reader is read for the content when sending, and reads the received
+	// content while processing
+	Reader io.Reader
+	// Size is the size of a received attachment
+	Size int64
+}
+
+// PostWithAttachments posts the payload with attachments as a multipart
+// post to the configured URL
+func (s *Server) PostWithAttachments(payload interface{}, tailnetKey string, attachments ...Attachment) error {
+	return s.postJSON(payload, tailnetKey, "", postOptions{attachments: attachments})
+}
+
+// RoundTripPostWithAttachments performs a round trip posting the payload
+// with attachments as a multipart post. Processors read the attachments from
+// ProcessorContext.Attachments.
+func (s *Server) RoundTripPostWithAttachments(payload interface{}, tailnetKey string, timeout time.Duration, attachments ...Attachment) (*RoundTripResponse, error) {
+	return s.roundTripPost("", payload, tailnetKey, "", timeout, postOptions{attachments: attachments})
+}
+
+// checkAttachments fails posting attachments over transports other than HTTP
+func checkAttachments(transport Transport, attachments []Attachment) error {
+	if _, ok := transport.(httpTransport); !ok && len(attachments) > 0 {
+		return errAttachmentsTransport
+	}
+	return nil
+}
+
+// encodeMultipartPost encodes data as the JSON part of a multipart post
+// followed by a part per attachment, returning the body and its
+// Content-Type
+func encodeMultipartPost(data PostData, attachments []Attachment) ([]byte, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": multipartPostField}))
+	header.Set("Content-Type", "application/json")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(jsonData)
+
+	for _, attachment := range attachments {
+		if attachment.Name == "" || attachment.Name == multipartPostField {
+			return nil, "", fmt.Errorf("invalid attachment name %q", attachment.Name)
+		}
+		filename := attachment.Filename
+		if filename == "" {
+			filename = attachment.Name
+		}
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     attachment.Name,
+			"filename": filename,
+		}))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if attachment.Reader != nil {
+			if _, err := io.Copy(part, attachment.Reader); err != nil {
+				return nil, "", fmt.Errorf("failed to read attachment %s: %w", attachment.Name, err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+// isMultipartPost reports whether r is a multipart/form-data post
+func isMultipartPost(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// decodeMultipartPost decodes the JSON post and the attachments of a
+// multipart post, ordered by name. The attachments are readable until
+// cleanup is called.
+func decodeMultipartPost(r *http.Request) (PostData, []Attachment, func(), error) {
+	if err := r.ParseMultipartForm(maxAttachmentMemory); err != nil {
+		return PostData{}, nil, nil, fmt.Errorf("invalid multipart post: %w", err)
+	}
+	form := r.MultipartForm
+
+	var data PostData
+	values := form.Value[multipartPostField]
+	if len(values) != 1 {
+		form.RemoveAll()
+		return PostData{}, nil, nil, fmt.Errorf("multipart post needs one %q part", multipartPostField)
+	}
+	if err := json.Unmarshal([]byte(values[0]), &data); err != nil {
+		form.RemoveAll()
+		return PostData{}, nil, nil, fmt.Errorf("invalid %q part: %w", multipartPostField, err)
+	}
+
+	var attachments []Attachment
+	var files []multipart.File
+	cleanup := func() {
+		for _, file := range files {
+			file.Close()
+		}
+		form.RemoveAll()
+	}
+	names := make([]string, 0, len(form.File))
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, header := range form.File[name] {
+			file, err := header.Open()
+			if err != nil {
+				cleanup()
+				return PostData{}, nil, nil, fmt.Errorf("failed to open attachment %s: %w", name, err)
+			}
+			files = append(files, file)
+			attachments = append(attachments, Attachment{
+				Name:        name,
+				Filename:    header.Filename,
+				ContentType: header.Header.Get("Content-Type"),
+				Reader:      file,
+				Size:        header.Size,
+			})
+		}
+	}
+	return data, attachments, cleanup, nil
+}
@@ -0,0 +1,99 @@
+package post2post
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// attachmentsProcessor returns the attachments of each post with their
+// content
+type attachmentsProcessor struct{}
+
+func (a *attachmentsProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return nil, errors.New("no context")
+}
+
+func (a *attachmentsProcessor) ProcessWithContext(payload interface{}, context ProcessorContext) (interface{}, error) {
+	var attachments []interface{}
+	for _, attachment := range context.Attachments {
+		content, err := io.ReadAll(attachment.Reader)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, map[string]interface{}{
+			"name":         attachment.Name,
+			"filename":     attachment.Filename,
+			"content_type": attachment.ContentType,
+			"size":         attachment.Size,
+			"content":      content,
+		})
+	}
+	return map[string]interface{}{"payload": payload, "attachments": attachments}, nil
+}
+
+func TestRoundTripPostWithAttachments(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(&attachmentsProcessor{})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	archive := []byte{0x1f, 0x8b, 0x00, 0xff, 0x10}
+	response, err := sender.RoundTripPostWithAttachments(map[string]interface{}{"kind": "upload"}, "", 5*time.Second,
+		Attachment{Name: "notes", Filename: "notes.txt", ContentType: "text/plain", Reader: bytes.NewBufferString("hello")},
+		Attachment{Name: "archive", Reader: bytes.NewReader(archive)},
+	)
+	if err != nil {
+		t.Fatalf("RoundTripPostWithAttachments() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPostWithAttachments() = %+v, want success", response)
+	}
+
+	result := response.Payload.(map[string]interface{})
+	if result["payload"].(map[string]interface{})["kind"] != "upload" {
+		t.Errorf("payload = %v, want the posted payload", result["payload"])
+	}
+	attachments := result["attachments"].([]interface{})
+	if len(attachments) != 2 {
+		t.Fatalf("attachments = %v, want 2", attachments)
+	}
+	// Attachments are ordered by name; JSON carries the content as base64
+	want := []map[string]interface{}{
+		{"name": "archive", "filename": "archive", "content_type": "application/octet-stream", "size": float64(len(archive)), "content": "H4sA/xA="},
+		{"name": "notes", "filename": "notes.txt", "content_type": "text/plain", "size": float64(5), "content": "aGVsbG8="},
+	}
+	for i, attachment := range attachments {
+		for key, value := range want[i] {
+			if got := attachment.(map[string]interface{})[key]; got != value {
+				t.Errorf("attachment %d %s = %v, want %v", i, key, got, value)
+			}
+		}
+	}
+
+	// Other transports cannot carry attachments
+	sender.WithTransport(NewJSONRPCTransport(receiver.GetURL()+"/jsonrpc", "upload", nil))
+	if err := sender.PostWithAttachments("payload", "", Attachment{Name: "file"}); !errors.Is(err, errAttachmentsTransport) {
+		t.Errorf("PostWithAttachments() = %v, want %v", err, errAttachmentsTransport)
+	}
+
+	// Multipart posts need the JSON part
+	resp, err := http.Post(receiver.GetURL()+"/webhook", "multipart/form-data; boundary=x", bytes.NewBufferString("--x--\r\n"))
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("multipart post without a post part status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
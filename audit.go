@@ -0,0 +1,109 @@
+package post2post
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// auditTimeout bounds recording a round trip in an audit sink
+const auditTimeout = 10 * time.Second
+
+// AuditRecord is the audit record of a round trip
+type AuditRecord struct {
+	RequestID string `json:"request_id"`
+	// Destination is the post URL of the round trip
+	Destination string `json:"destination"`
+	// PayloadHash is the hex SHA-256 of the payload in JSON, proving what
+	// was requested without keeping it
+	PayloadHash string `json:"payload_hash"`
+	// Initiator is the tailnet identity the round trip was posted through,
+	// or the tailnet or host name of the server
+	Initiator string           `json:"initiator"`
+	Outcome   RoundTripOutcome `json:"outcome"`
+	// Error and StatusCode describe a failed round trip
+	Error      string    `json:"error,omitempty"`
+	StatusCode int       `json:"status_code,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// AuditSink records the audit records of round trips, e.g. to prove to
+// compliance teams what credentials or data were requested and when.
+// FileAuditSink, HTTPAuditSink and SQLiteAuditSink are provided.
+type AuditSink interface {
+	Record(ctx context.Context, record AuditRecord) error
+}
+
+// WithAuditLog records every round trip of the server in sinks once it
+// ends, before its response is returned. Failures to record are logged.
+// Without sinks round trips are not audited.
+func (s *Server) WithAuditLog(sinks ...AuditSink) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auditSinks = append([]AuditSink(nil), sinks...)
+	return s
+}
+
+// auditRoundTrip records the round trip of payload to postURL through
+// identity, started at started and answered with response, in the audit
+// sinks
+func (s *Server) auditRoundTrip(postURL, identity string, payload interface{}, started time.Time, response *RoundTripResponse) {
+	s.mu.RLock()
+	sinks := s.auditSinks
+	s.mu.RUnlock()
+	if len(sinks) == 0 || response == nil {
+		return
+	}
+
+	record := AuditRecord{
+		RequestID:   response.RequestID,
+		Destination: postURL,
+		PayloadHash: payloadHash(payload),
+		Initiator:   s.auditInitiator(postURL, identity),
+		Outcome:     response.Outcome(),
+		Error:       response.Error,
+		StatusCode:  response.StatusCode,
+		StartedAt:   started.UTC(),
+		FinishedAt:  time.Now().UTC(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	for _, sink := range sinks {
+		if err := sink.Record(ctx, record); err != nil {
+			log.Printf("Warning: failed to record round trip %s in the audit log: %v", record.RequestID, err)
+		}
+	}
+}
+
+// auditInitiator returns the initiator of a round trip to postURL through
+// identity
+func (s *Server) auditInitiator(postURL, identity string) string {
+	if identity := s.resolveTailnetIdentity(postURL, identity); identity != "" {
+		return identity
+	}
+	s.mu.RLock()
+	dnsName := s.tailnetDNSName
+	s.mu.RUnlock()
+	if dnsName != "" {
+		return dnsName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// payloadHash returns the hex SHA-256 of payload in JSON, "" if it cannot
+// be marshaled
+func payloadHash(payload interface{}) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,139 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileAuditSink appends audit records to a file as JSON lines
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditSink returns a sink appending to the file at path, created
+// with mode 0600 if needed
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// Record appends record as a JSON line and syncs the file
+func (f *FileAuditSink) Record(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file
+func (f *FileAuditSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// HTTPAuditSink posts each audit record as JSON to a URL, e.g. a log
+// collector
+type HTTPAuditSink struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// NewHTTPAuditSink returns a sink posting to url with header, e.g. for
+// authorization
+func NewHTTPAuditSink(url string, header http.Header) *HTTPAuditSink {
+	return &HTTPAuditSink{
+		url:    url,
+		header: header.Clone(),
+		client: &http.Client{Timeout: auditTimeout},
+	}
+}
+
+// Record posts record, failing unless it is accepted with a 2xx status
+func (h *HTTPAuditSink) Record(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range h.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post audit record: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit record rejected with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sqliteAuditSchema creates the audit table of SQLiteAuditSink
+const sqliteAuditSchema = `CREATE TABLE IF NOT EXISTS post2post_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	payload_hash TEXT NOT NULL,
+	initiator TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT NOT NULL,
+	status_code INTEGER NOT NULL,
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL
+)`
+
+// SQLiteAuditSink inserts audit records into the post2post_audit table of
+// a SQLite database
+type SQLiteAuditSink struct {
+	db *sql.DB
+}
+
+// NewSQLiteAuditSink returns a sink inserting into db, opened with a SQLite
+// driver of the application's choice such as modernc.org/sqlite or
+// github.com/mattn/go-sqlite3, and creates the post2post_audit table if
+// needed. Timestamps are stored as RFC 3339 text in UTC.
+func NewSQLiteAuditSink(db *sql.DB) (*SQLiteAuditSink, error) {
+	if _, err := db.Exec(sqliteAuditSchema); err != nil {
+		return nil, fmt.Errorf("failed to create audit table: %w", err)
+	}
+	return &SQLiteAuditSink{db: db}, nil
+}
+
+// Record inserts record
+func (a *SQLiteAuditSink) Record(ctx context.Context, record AuditRecord) error {
+	_, err := a.db.ExecContext(ctx, `INSERT INTO post2post_audit
+		(request_id, destination, payload_hash, initiator, outcome, error, status_code, started_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.RequestID, record.Destination, record.PayloadHash, record.Initiator, string(record.Outcome),
+		record.Error, record.StatusCode, record.StartedAt.Format(time.RFC3339Nano), record.FinishedAt.Format(time.RFC3339Nano))
+	if err != nil {
+		return fmt.Errorf("failed to insert audit record: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package post2post
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryAuditSink keeps the records in memory
+type memoryAuditSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (m *memoryAuditSink) Record(ctx context.Context, record AuditRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestServer_WithAuditLog(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer failing.Close()
+
+	sink := &memoryAuditSink{}
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook").WithAuditLog(sink)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	before := time.Now()
+	payload := map[string]string{"role": "arn:aws:iam::123456789012:role/Reader"}
+	response, err := sender.RoundTripPostWithTimeout(payload, "", 5*time.Second)
+	if err != nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, %v, want success", response, err)
+	}
+	failed, err := sender.RoundTripPostToURL(failing.URL, payload, "", 5*time.Second)
+	if err != nil || failed.Success {
+		t.Fatalf("RoundTripPostToURL() = %+v, %v, want a failure", failed, err)
+	}
+
+	if len(sink.records) != 2 {
+		t.Fatalf("%d audit records, want 2", len(sink.records))
+	}
+	record := sink.records[0]
+	if record.RequestID != response.RequestID || record.Destination != receiver.GetURL()+"/webhook" || record.Outcome != OutcomeSuccess {
+		t.Errorf("audit record = %+v, want the successful round trip", record)
+	}
+	if record.PayloadHash != payloadHash(payload) || len(record.PayloadHash) != 64 {
+		t.Errorf("PayloadHash = %q, want the SHA-256 of the payload", record.PayloadHash)
+	}
+	if hostname, _ := os.Hostname(); record.Initiator != hostname {
+		t.Errorf("Initiator = %q, want the host name %q", record.Initiator, hostname)
+	}
+	if record.StartedAt.Before(before) || record.FinishedAt.Before(record.StartedAt) {
+		t.Errorf("audit record timestamps %s - %s, want after %s", record.StartedAt, record.FinishedAt, before)
+	}
+	record = sink.records[1]
+	if record.Destination != failing.URL || record.Outcome != OutcomeError || record.StatusCode != http.StatusForbidden || record.Error == "" {
+		t.Errorf("audit record = %+v, want the rejected round trip", record)
+	}
+}
+
+// testAuditRecord is an audit record for the sink tests
+var testAuditRecord = AuditRecord{
+	RequestID:   "req_1",
+	Destination: "https://receiver.example.com/webhook",
+	PayloadHash: payloadHash("hello"),
+	Initiator:   "sender",
+	Outcome:     OutcomeTimeout,
+	Error:       "timeout waiting for response",
+	StartedAt:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	FinishedAt:  time.Date(2025, 1, 2, 3, 4, 35, 0, time.UTC),
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink() failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sink.Record(context.Background(), testAuditRecord); err != nil {
+			t.Fatalf("Record() failed: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("audit log mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record != testAuditRecord {
+			t.Errorf("line %d = %s, want the record", lines, scanner.Text())
+		}
+	}
+	if lines != 2 {
+		t.Errorf("%d lines, want 2", lines)
+	}
+}
+
+func TestHTTPAuditSink(t *testing.T) {
+	records := make(chan AuditRecord, 1)
+	status := http.StatusAccepted
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var record AuditRecord
+		json.Unmarshal(body, &record)
+		records <- record
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	sink := NewHTTPAuditSink(collector.URL, http.Header{"Authorization": {"Bearer token"}})
+	if err := sink.Record(context.Background(), testAuditRecord); err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	if record := <-records; record != testAuditRecord {
+		t.Errorf("posted record = %+v, want %+v", record, testAuditRecord)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Record(context.Background(), testAuditRecord); err == nil {
+		t.Error("Record() rejected by the collector succeeded")
+	}
+	<-records
+}
+
+// recordingDB is a database/sql connector recording the statements executed
+// on it, standing in for SQLite
+type recordingDB struct {
+	mu    sync.Mutex
+	execs []recordedExec
+}
+
+// recordedExec is a statement executed on a recordingDB
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *recordingDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return recordingConn{db: d}, nil
+}
+func (d *recordingDB) Driver() driver.Driver { return nil }
+
+// recordingConn executes statements on a recordingDB
+type recordingConn struct {
+	db *recordingDB
+}
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c recordingConn) Close() error { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs = append(c.db.execs, recordedExec{query: query, args: values})
+	return driver.RowsAffected(1), nil
+}
+
+func TestSQLiteAuditSink(t *testing.T) {
+	recorder := &recordingDB{}
+	db := sql.OpenDB(recorder)
+	defer db.Close()
+
+	sink, err := NewSQLiteAuditSink(db)
+	if err != nil {
+		t.Fatalf("NewSQLiteAuditSink() failed: %v", err)
+	}
+	if err := sink.Record(context.Background(), testAuditRecord); err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+
+	if len(recorder.execs) != 2 {
+		t.Fatalf("executed %d statements, want the schema and an insert", len(recorder.execs))
+	}
+	// The table is created only if it does not exist yet
+	if schema := recorder.execs[0]; schema.query != sqliteAuditSchema || !strings.Contains(schema.query, "IF NOT EXISTS") {
+		t.Errorf("schema statement = %q", schema.query)
+	}
+	insert := recorder.execs[1]
+	want := []driver.Value{
+		testAuditRecord.RequestID, testAuditRecord.Destination, testAuditRecord.PayloadHash, testAuditRecord.Initiator,
+		string(testAuditRecord.Outcome), testAuditRecord.Error, int64(testAuditRecord.StatusCode),
+		testAuditRecord.StartedAt.Format(time.RFC3339Nano), testAuditRecord.FinishedAt.Format(time.RFC3339Nano),
+	}
+	if !strings.HasPrefix(insert.query, "INSERT INTO post2post_audit") || !reflect.DeepEqual(insert.args, want) {
+		t.Errorf("insert = %q %v, want the record's fields %v", insert.query, insert.args, want)
+	}
+}
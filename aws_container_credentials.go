@@ -0,0 +1,186 @@
+package post2post
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// containerCredentialsTimeout bounds a single credentials request
+const containerCredentialsTimeout = 2 * time.Minute
+
+// ContainerCredentialsServerConfig holds configuration for the container
+// credentials endpoint
+type ContainerCredentialsServerConfig struct {
+	Provider  aws.CredentialsProvider // Source of the served credentials, e.g. an AWSCredentialsProvider
+	Addr      string                  // Loopback listen address (optional, default 127.0.0.1 on a random port)
+	Path      string                  // Credentials path (optional, default /credentials)
+	AuthToken string                  // Required Authorization header value (optional, recommended)
+}
+
+// ContainerCredentialsServer serves credentials over the ECS container
+// credentials protocol, so any AWS SDK can use them by setting
+// AWS_CONTAINER_CREDENTIALS_FULL_URI (and AWS_CONTAINER_AUTHORIZATION_TOKEN)
+type ContainerCredentialsServer struct {
+	config ContainerCredentialsServerConfig
+
+	mu       sync.Mutex
+	listener net.Listener
+	server   *http.Server
+}
+
+// containerCredentials is the response of the container credentials protocol
+type containerCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration,omitempty"`
+}
+
+// NewContainerCredentialsServer creates a container credentials endpoint.
+// It only listens on loopback addresses, as the SDKs require for plain HTTP.
+func NewContainerCredentialsServer(config ContainerCredentialsServerConfig) (*ContainerCredentialsServer, error) {
+	if config.Provider == nil {
+		return nil, fmt.Errorf("credentials provider is required")
+	}
+	if config.Addr == "" {
+		config.Addr = "127.0.0.1:0"
+	}
+	if config.Path == "" {
+		config.Path = "/credentials"
+	}
+	if config.Path[0] != '/' {
+		return nil, fmt.Errorf("path must start with /, got %q", config.Path)
+	}
+
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("listen address must be a loopback address, got %s", config.Addr)
+	}
+
+	return &ContainerCredentialsServer{config: config}, nil
+}
+
+// Start starts listening for credentials requests
+func (s *ContainerCredentialsServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != nil {
+		return fmt.Errorf("container credentials server is already running")
+	}
+
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(s.config.Path, s)
+	s.listener = listener
+	s.server = &http.Server{Handler: mux}
+
+	log.Printf("Container credentials endpoint listening on: %s", s.url())
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Container credentials server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops the endpoint
+func (s *ContainerCredentialsServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return fmt.Errorf("container credentials server is not running")
+	}
+	err := s.server.Close()
+	s.server = nil
+	s.listener = nil
+	return err
+}
+
+// URL returns the value for AWS_CONTAINER_CREDENTIALS_FULL_URI, or "" if the
+// endpoint is not running
+func (s *ContainerCredentialsServer) URL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.url()
+}
+
+// url returns the endpoint URL; the caller holds s.mu
+func (s *ContainerCredentialsServer) url() string {
+	if s.listener == nil {
+		return ""
+	}
+	return "http://" + s.listener.Addr().String() + s.config.Path
+}
+
+// Env returns the environment variables that point AWS SDKs in a child
+// process at this endpoint
+func (s *ContainerCredentialsServer) Env() []string {
+	env := []string{"AWS_CONTAINER_CREDENTIALS_FULL_URI=" + s.URL()}
+	if s.config.AuthToken != "" {
+		env = append(env, "AWS_CONTAINER_AUTHORIZATION_TOKEN="+s.config.AuthToken)
+	}
+	return env
+}
+
+// ServeHTTP answers a container credentials request. It can also be mounted
+// on another server.
+func (s *ContainerCredentialsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeContainerError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is supported")
+		return
+	}
+	if s.config.AuthToken != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.config.AuthToken)) != 1 {
+		writeContainerError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid authorization token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), containerCredentialsTimeout)
+	defer cancel()
+
+	creds, err := s.config.Provider.Retrieve(ctx)
+	if err != nil {
+		log.Printf("Container credentials request failed: %v", err)
+		writeContainerError(w, http.StatusInternalServerError, "CredentialsUnavailable", err.Error())
+		return
+	}
+
+	response := containerCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+	}
+	if creds.CanExpire {
+		response.Expiration = creds.Expires.UTC().Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeContainerError writes an error in the format the SDKs parse
+func writeContainerError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
@@ -0,0 +1,106 @@
+package post2post
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+)
+
+func TestContainerCredentialsServer(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	fail := false
+	source := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		if fail {
+			return aws.Credentials{}, errors.New("lambda unavailable")
+		}
+		return aws.Credentials{
+			AccessKeyID:     "AKIACONTAINER",
+			SecretAccessKey: "secret",
+			SessionToken:    "token",
+			CanExpire:       true,
+			Expires:         expires,
+		}, nil
+	})
+
+	server, err := NewContainerCredentialsServer(ContainerCredentialsServerConfig{
+		Provider:  source,
+		AuthToken: "test-token",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	if !strings.HasPrefix(server.URL(), "http://127.0.0.1:") || !strings.HasSuffix(server.URL(), "/credentials") {
+		t.Errorf("unexpected URL %s", server.URL())
+	}
+	if env := server.Env(); len(env) != 2 || env[1] != "AWS_CONTAINER_AUTHORIZATION_TOKEN=test-token" {
+		t.Errorf("unexpected environment %v", env)
+	}
+
+	// The SDK's container credentials client reads the credentials
+	client := endpointcreds.New(server.URL(), func(o *endpointcreds.Options) {
+		o.AuthorizationToken = "test-token"
+	})
+	creds, err := client.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("SDK Retrieve() failed: %v", err)
+	}
+	if creds.AccessKeyID != "AKIACONTAINER" || creds.SessionToken != "token" || !creds.Expires.Equal(expires) {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	// Requests without the token are rejected
+	resp, err := http.Get(server.URL())
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+
+	// Provider errors are reported to the SDK
+	fail = true
+	if _, err := client.Retrieve(context.Background()); err == nil || !strings.Contains(err.Error(), "lambda unavailable") {
+		t.Errorf("expected the provider error, got %v", err)
+	}
+}
+
+func TestNewContainerCredentialsServerValidation(t *testing.T) {
+	source := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, nil
+	})
+
+	tests := []struct {
+		name    string
+		config  ContainerCredentialsServerConfig
+		wantErr bool
+	}{
+		{"defaults", ContainerCredentialsServerConfig{Provider: source}, false},
+		{"localhost", ContainerCredentialsServerConfig{Provider: source, Addr: "localhost:9911"}, false},
+		{"ipv6 loopback", ContainerCredentialsServerConfig{Provider: source, Addr: "[::1]:9911"}, false},
+		{"missing provider", ContainerCredentialsServerConfig{}, true},
+		{"all interfaces", ContainerCredentialsServerConfig{Provider: source, Addr: ":9911"}, true},
+		{"public address", ContainerCredentialsServerConfig{Provider: source, Addr: "10.0.0.1:9911"}, true},
+		{"relative path", ContainerCredentialsServerConfig{Provider: source, Path: "credentials"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewContainerCredentialsServer(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewContainerCredentialsServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package post2post
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errLockBusy is returned by tryLockFile when another process holds the lock
+var errLockBusy = errors.New("lock held by another process")
+
+// lockFile takes an exclusive advisory lock on the file at path, creating it
+// if needed, waiting up to timeout for another process to release it. The
+// operating system releases the lock when its holder exits, so a crashed
+// process never leaves the cache locked. The lock file itself is left in
+// place: removing it would let a waiter lock a file no one else can see.
+func lockFile(path string, timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := tryLockFile(f)
+		if err == nil {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !errors.Is(err, errLockBusy) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for cache lock %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
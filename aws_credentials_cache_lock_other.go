@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows)
+
+package post2post
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLockFile fails on platforms without advisory file locks, so refreshes
+// are not serialized across processes there
+func tryLockFile(f *os.File) error {
+	return errors.New("advisory file locks are not supported on this platform")
+}
+
+// unlockFile does nothing on platforms without advisory file locks
+func unlockFile(f *os.File) {}
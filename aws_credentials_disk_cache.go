@@ -0,0 +1,253 @@
+package post2post
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// diskCacheVersion is the schema version of the cache files
+const diskCacheVersion = 1
+
+// diskCacheLockTimeout bounds how long a refresh waits for another process
+// holding the cache lock
+const diskCacheLockTimeout = time.Minute
+
+// ErrCacheMiss is returned by a CredentialsCacheStore that has no entry for a key
+var ErrCacheMiss = errors.New("credentials cache miss")
+
+// CredentialsCacheStore persists serialized DiskCacheEntry values outside the
+// process, e.g. in files. It is the cache backend interface: the
+// credentialscache module provides backends keeping entries in the OS
+// keyring or encrypted, so that only programs using them depend on their
+// libraries.
+type CredentialsCacheStore interface {
+	// Load returns the data stored under key, or ErrCacheMiss
+	Load(key string) ([]byte, error)
+	// Save stores data under key, replacing any previous value
+	Save(key string, data []byte) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(key string) error
+}
+
+// CredentialsCacheLocker is implemented by stores that can serialize
+// refreshes across processes
+type CredentialsCacheLocker interface {
+	// Lock takes the refresh lock for key and returns its release function
+	Lock(key string) (func(), error)
+}
+
+// CredentialsCacheFiler is implemented by stores keeping entries in files,
+// such as NewFileCacheStore's and stores wrapping one
+type CredentialsCacheFiler interface {
+	// Path returns the file holding the entry for key
+	Path(key string) string
+}
+
+// DiskCacheEntry is the JSON schema of a credentials cache entry
+type DiskCacheEntry struct {
+	Version         int       `json:"version"`
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token"`
+	Expires         time.Time `json:"expires"`
+	CachedAt        time.Time `json:"cached_at"`
+	RoleARN         string    `json:"role_arn"`
+	LambdaURL       string    `json:"lambda_url"`
+	SessionName     string    `json:"session_name"`
+}
+
+// credentialsCache stores one provider's credentials in a store shared by
+// all processes using the same Lambda, role and session name
+type credentialsCache struct {
+	store       CredentialsCacheStore
+	key         string
+	roleARN     string
+	lambdaURL   string
+	sessionName string
+}
+
+// fileCacheStore stores each entry as a JSON file in dir
+type fileCacheStore struct {
+	dir string
+}
+
+// NewFileCacheStore returns a CredentialsCacheStore that keeps each entry in
+// a file in dir. It serializes refreshes across processes with lock files.
+func NewFileCacheStore(dir string) CredentialsCacheStore {
+	return &fileCacheStore{dir: dir}
+}
+
+// WithDiskCache persists credentials as JSON files in dir so they survive
+// restarts and are shared between processes. Refreshes are serialized with a
+// lock file, so concurrent processes make a single Lambda round trip.
+func (p *AWSCredentialsProvider) WithDiskCache(dir string) *AWSCredentialsProvider {
+	return p.WithCredentialsCache(&fileCacheStore{dir: dir})
+}
+
+// WithCredentialsCache persists credentials in store so they survive
+// restarts and are shared between processes. Refreshes are serialized across
+// processes if the store implements CredentialsCacheLocker.
+func (p *AWSCredentialsProvider) WithCredentialsCache(store CredentialsCacheStore) *AWSCredentialsProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cache = &credentialsCache{
+		store:       store,
+		key:         CredentialsCacheKey(p.lambdaURL, p.roleARN, p.sessionName),
+		roleARN:     p.roleARN,
+		lambdaURL:   p.lambdaURL,
+		sessionName: p.sessionName,
+	}
+	return p
+}
+
+// GetDiskCachePath returns the cache file path, or "" if credentials are not
+// cached in files
+func (p *AWSCredentialsProvider) GetDiskCachePath() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.cache == nil {
+		return ""
+	}
+	filer, ok := p.cache.store.(CredentialsCacheFiler)
+	if !ok {
+		return ""
+	}
+	return filer.Path(p.cache.key)
+}
+
+// CredentialsCacheKey derives the key under which providers for the same
+// Lambda, role and session name share cached credentials
+func CredentialsCacheKey(lambdaURL, roleARN, sessionName string) string {
+	sum := sha256.Sum256([]byte(lambdaURL + "\n" + roleARN + "\n" + sessionName))
+	return "post2post-" + hex.EncodeToString(sum[:8])
+}
+
+// load returns the cached credentials. A missing, unreadable or mismatched
+// entry is treated as a cache miss.
+func (c *credentialsCache) load() (aws.Credentials, bool) {
+	data, err := c.store.Load(c.key)
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			log.Printf("Warning: failed to read credentials cache %s: %v", c.key, err)
+		}
+		return aws.Credentials{}, false
+	}
+
+	var entry DiskCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("Invalid credentials cache %s, ignoring: %v", c.key, err)
+		return aws.Credentials{}, false
+	}
+	if entry.Version != diskCacheVersion || entry.RoleARN != c.roleARN || entry.LambdaURL != c.lambdaURL || entry.SessionName != c.sessionName {
+		return aws.Credentials{}, false
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     entry.AccessKeyID,
+		SecretAccessKey: entry.SecretAccessKey,
+		SessionToken:    entry.SessionToken,
+		Source:          "Post2PostAWSCredentialsProvider",
+		CanExpire:       true,
+		Expires:         entry.Expires,
+	}, true
+}
+
+// save stores the credentials
+func (c *credentialsCache) save(creds aws.Credentials) error {
+	entry := DiskCacheEntry{
+		Version:         diskCacheVersion,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expires:         creds.Expires,
+		CachedAt:        time.Now(),
+		RoleARN:         c.roleARN,
+		LambdaURL:       c.lambdaURL,
+		SessionName:     c.sessionName,
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cached credentials: %w", err)
+	}
+	return c.store.Save(c.key, data)
+}
+
+// remove deletes the cached credentials
+func (c *credentialsCache) remove() error {
+	return c.store.Delete(c.key)
+}
+
+// lock takes the cross-process refresh lock if the store supports one
+func (c *credentialsCache) lock() (func(), error) {
+	locker, ok := c.store.(CredentialsCacheLocker)
+	if !ok {
+		return func() {}, nil
+	}
+	return locker.Lock(c.key)
+}
+
+// Path implements CredentialsCacheFiler
+func (s *fileCacheStore) Path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// Load reads the file for key
+func (s *fileCacheStore) Load(key string) ([]byte, error) {
+	data, err := os.ReadFile(s.Path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Save writes the file atomically so readers never see a partial file
+func (s *fileCacheStore) Save(key string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, ".post2post-cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path(key)); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the file for key
+func (s *fileCacheStore) Delete(key string) error {
+	if err := os.Remove(s.Path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove cache file: %w", err)
+	}
+	return nil
+}
+
+// Lock takes an advisory lock on a lock file next to the cache file, so only
+// one process refreshes while the others wait and then read its result
+func (s *fileCacheStore) Lock(key string) (func(), error) {
+	return lockFile(filepath.Join(s.dir, key+".lock"), diskCacheLockTimeout)
+}
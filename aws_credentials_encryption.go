@@ -0,0 +1,207 @@
+package post2post
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// Credentials encryption schemes; the scheme follows from the type of the
+// requester's public key
+const (
+	CredentialsEncryptionX25519 = "X25519-HKDF-SHA256-AES256GCM"
+	CredentialsEncryptionRSA    = "RSA-OAEP-SHA256-AES256GCM"
+)
+
+// credentialsEncryptionInfo is the HKDF info of the X25519 scheme
+const credentialsEncryptionInfo = "post2post credentials v1"
+
+// minCredentialsRSAKeyBits is the smallest RSA key credentials are encrypted to
+const minCredentialsRSAKeyBits = 2048
+
+// EncryptedCredentials is the Credentials block of an assume role result
+// encrypted to the requester's public key, so only the requester can read
+// it. The plaintext is the JSON of the STS credentials and the request ID is
+// authenticated with it.
+type EncryptedCredentials struct {
+	Scheme string `json:"scheme"`
+	// EphemeralPublicKey is the Lambda's X25519 key for the key agreement
+	EphemeralPublicKey []byte `json:"ephemeral_public_key,omitempty"`
+	// EncryptedKey is the AES key encrypted with RSA-OAEP
+	EncryptedKey []byte `json:"encrypted_key,omitempty"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// generateCredentialsKey returns an ephemeral X25519 key pair, with the
+// public key as base64 PKIX for the request
+func generateCredentialsKey() (*ecdh.PrivateKey, string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate credentials key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(privateKey.PublicKey())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode credentials key: %w", err)
+	}
+	return privateKey, base64.StdEncoding.EncodeToString(der), nil
+}
+
+// parseCredentialsPublicKey decodes a base64 PKIX X25519 or RSA public key
+func parseCredentialsPublicKey(encoded string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("credentials public key is not base64: %w", err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("credentials public key is not a PKIX public key: %w", err)
+	}
+	switch key := publicKey.(type) {
+	case *ecdh.PublicKey:
+		if key.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("credentials public key must be X25519 or RSA")
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minCredentialsRSAKeyBits {
+			return nil, fmt.Errorf("RSA credentials public key must be at least %d bits", minCredentialsRSAKeyBits)
+		}
+	default:
+		return nil, fmt.Errorf("credentials public key must be X25519 or RSA")
+	}
+	return publicKey, nil
+}
+
+// encryptCredentials encrypts credentials to the base64 PKIX public key for
+// the request requestID, as the Lambda does
+func encryptCredentials(encodedPublicKey, requestID string, credentials *types.Credentials) (*EncryptedCredentials, error) {
+	publicKey, err := parseCredentialsPublicKey(encodedPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+
+	encrypted := &EncryptedCredentials{}
+	var key []byte
+	switch publicKey := publicKey.(type) {
+	case *ecdh.PublicKey:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+		}
+		encrypted.Scheme = CredentialsEncryptionX25519
+		encrypted.EphemeralPublicKey = ephemeral.PublicKey().Bytes()
+		key, err = x25519CredentialsKey(ephemeral, publicKey, encrypted.EphemeralPublicKey, publicKey.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PublicKey:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		encrypted.Scheme = CredentialsEncryptionRSA
+		encrypted.EncryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt key: %w", err)
+		}
+	}
+
+	aead, err := credentialsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, plaintext, []byte(requestID))
+	return encrypted, nil
+}
+
+// decryptCredentials decrypts credentials encrypted for the request
+// requestID with the requester's X25519 or RSA private key
+func decryptCredentials(privateKey crypto.PrivateKey, requestID string, encrypted *EncryptedCredentials) (*types.Credentials, error) {
+	var key []byte
+	var err error
+	switch privateKey := privateKey.(type) {
+	case *ecdh.PrivateKey:
+		if encrypted.Scheme != CredentialsEncryptionX25519 {
+			return nil, fmt.Errorf("unexpected credentials encryption scheme %q", encrypted.Scheme)
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(encrypted.EphemeralPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral public key: %w", err)
+		}
+		key, err = x25519CredentialsKey(privateKey, ephemeral, encrypted.EphemeralPublicKey, privateKey.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PrivateKey:
+		if encrypted.Scheme != CredentialsEncryptionRSA {
+			return nil, fmt.Errorf("unexpected credentials encryption scheme %q", encrypted.Scheme)
+		}
+		key, err = rsa.DecryptOAEP(sha256.New(), nil, privateKey, encrypted.EncryptedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported credentials private key %T", privateKey)
+	}
+
+	aead, err := credentialsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(encrypted.Nonce))
+	}
+	plaintext, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, []byte(requestID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+
+	var credentials types.Credentials
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted credentials: %w", err)
+	}
+	return &credentials, nil
+}
+
+// x25519CredentialsKey derives the AES key from the X25519 shared secret,
+// salted with both public keys
+func x25519CredentialsKey(privateKey *ecdh.PrivateKey, peer *ecdh.PublicKey, ephemeralPublicKey, recipientPublicKey []byte) ([]byte, error) {
+	shared, err := privateKey.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+	salt := append(append([]byte(nil), ephemeralPublicKey...), recipientPublicKey...)
+	key, err := hkdf.Key(sha256.New, shared, salt, credentialsEncryptionInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	return key, nil
+}
+
+// credentialsAEAD returns AES-256-GCM with key
+func credentialsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
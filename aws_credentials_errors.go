@@ -0,0 +1,62 @@
+package post2post
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error categories of a failed credentials request. Match them with
+// errors.Is; use errors.As with *CredentialsError for the details.
+var (
+	// ErrTimeout means the Lambda's response did not arrive in time
+	ErrTimeout = errors.New("timed out waiting for the credentials Lambda")
+	// ErrLambdaUnavailable means the Lambda could not be reached or failed
+	// with a server error
+	ErrLambdaUnavailable = errors.New("credentials Lambda unavailable")
+	// ErrLambdaRejected means the Lambda refused the request, e.g. because
+	// the role or callback URL is not allowed
+	ErrLambdaRejected = errors.New("credentials Lambda rejected the request")
+	// ErrAssumeRoleDenied means the Lambda accepted the request but STS did
+	// not issue credentials for the role
+	ErrAssumeRoleDenied = errors.New("credentials Lambda could not assume the role")
+)
+
+// CredentialsError describes a failed credentials request. It unwraps to its
+// Kind, so errors.Is(err, ErrAssumeRoleDenied) works on any returned error.
+type CredentialsError struct {
+	Kind            error  // One of the Err* categories above
+	RoleARN         string // Role the credentials were requested for
+	RequestID       string // post2post request ID
+	LambdaRequestID string // Lambda invocation ID, when the Lambda answered
+	StatusCode      int    // HTTP status of a rejected request
+	Code            string // STS error code, e.g. "AccessDenied"
+	Message         string // Error reported by the Lambda or the transport
+}
+
+func (e *CredentialsError) Error() string {
+	msg := e.Kind.Error()
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+
+	var details []string
+	if e.RoleARN != "" {
+		details = append(details, "role "+e.RoleARN)
+	}
+	if e.Code != "" {
+		details = append(details, "code "+e.Code)
+	}
+	if e.StatusCode != 0 {
+		details = append(details, fmt.Sprintf("status %d", e.StatusCode))
+	}
+	if e.LambdaRequestID != "" {
+		details = append(details, "Lambda request "+e.LambdaRequestID)
+	}
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+	return msg
+}
+
+func (e *CredentialsError) Unwrap() error { return e.Kind }
@@ -0,0 +1,72 @@
+package post2post
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// defaultChainProvider resolves the AWS SDK default credential chain on
+// first use
+type defaultChainProvider struct {
+	once     sync.Once
+	provider aws.CredentialsProvider
+	err      error
+}
+
+// StaticCredentialsFallback returns a fallback provider for fixed access keys
+func StaticCredentialsFallback(accessKeyID, secretAccessKey, sessionToken string) aws.CredentialsProvider {
+	return credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken)
+}
+
+// DefaultChainFallback returns a fallback provider using the AWS SDK default
+// credential chain (environment, shared config files, SSO, IMDS). Do not use
+// it when the default chain itself runs the post2post credential process.
+func DefaultChainFallback() aws.CredentialsProvider {
+	return &defaultChainProvider{}
+}
+
+// Retrieve implements aws.CredentialsProvider
+func (d *defaultChainProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	d.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			d.err = fmt.Errorf("failed to load default AWS config: %w", err)
+			return
+		}
+		if cfg.Credentials == nil {
+			d.err = fmt.Errorf("default AWS config has no credentials")
+			return
+		}
+		d.provider = cfg.Credentials
+	})
+	if d.err != nil {
+		return aws.Credentials{}, d.err
+	}
+	return d.provider.Retrieve(ctx)
+}
+
+// retrieveFallback consults the fallback providers in order after the
+// post2post path failed with err. Fallback credentials are not cached, so
+// the next Retrieve tries post2post again.
+func (p *AWSCredentialsProvider) retrieveFallback(ctx context.Context, err error) (aws.Credentials, error) {
+	if len(p.fallbacks) == 0 || ctx.Err() != nil {
+		return aws.Credentials{}, err
+	}
+
+	for i, fallback := range p.fallbacks {
+		creds, fallbackErr := fallback.Retrieve(ctx)
+		if fallbackErr != nil {
+			log.Printf("Fallback credentials provider %d of %d failed: %v", i+1, len(p.fallbacks), fallbackErr)
+			continue
+		}
+		log.Printf("WARNING: Failed to retrieve AWS credentials through post2post, using fallback provider %d: %v", i+1, err)
+		return creds, nil
+	}
+	return aws.Credentials{}, fmt.Errorf("%w (all %d fallback providers failed)", err, len(p.fallbacks))
+}
@@ -0,0 +1,280 @@
+package post2post
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Credentials file writer defaults
+const (
+	defaultCredentialsFileProfile = "post2post"
+	defaultFileRefreshBefore      = 10 * time.Minute
+	defaultFileRetryInterval      = 30 * time.Second
+)
+
+// CredentialsFileWriterConfig holds configuration for the shared credentials
+// file writer
+type CredentialsFileWriterConfig struct {
+	Provider aws.CredentialsProvider // Source of the credentials, e.g. an AWSCredentialsProvider
+	Profile  string                  // Profile to write (optional, default "post2post")
+	// Path is the credentials file (optional, default AWS_SHARED_CREDENTIALS_FILE
+	// or ~/.aws/credentials)
+	Path string
+	// RefreshBefore is how long before expiry Start rewrites the profile
+	// (optional, default 10 minutes)
+	RefreshBefore time.Duration
+	// RetryInterval is how long Start waits after a failed refresh
+	// (optional, default 30s)
+	RetryInterval time.Duration
+}
+
+// CredentialsFileWriter renders credentials into a profile of the shared
+// credentials file for tools that cannot use a credential_process. Other
+// profiles and comments in the file are preserved.
+type CredentialsFileWriter struct {
+	config CredentialsFileWriterConfig
+
+	// Serializes writes to the file
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewCredentialsFileWriter creates a writer for config.Profile
+func NewCredentialsFileWriter(config CredentialsFileWriterConfig) (*CredentialsFileWriter, error) {
+	if config.Provider == nil {
+		return nil, fmt.Errorf("credentials provider is required")
+	}
+	if config.Profile == "" {
+		config.Profile = defaultCredentialsFileProfile
+	}
+	if strings.ContainsAny(config.Profile, "[]\r\n") {
+		return nil, fmt.Errorf("invalid profile name %q", config.Profile)
+	}
+	if config.Path == "" {
+		config.Path = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if config.Path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user home directory: %w", err)
+		}
+		config.Path = filepath.Join(homeDir, ".aws", "credentials")
+	}
+	if config.RefreshBefore < 0 || config.RetryInterval < 0 {
+		return nil, fmt.Errorf("refresh and retry intervals must not be negative")
+	}
+	if config.RefreshBefore == 0 {
+		config.RefreshBefore = defaultFileRefreshBefore
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultFileRetryInterval
+	}
+
+	return &CredentialsFileWriter{config: config}, nil
+}
+
+// GetPath returns the credentials file path
+func (w *CredentialsFileWriter) GetPath() string {
+	return w.config.Path
+}
+
+// Write retrieves credentials and writes them to the profile, returning them
+func (w *CredentialsFileWriter) Write(ctx context.Context) (aws.Credentials, error) {
+	creds, err := w.config.Provider.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	existing, err := os.ReadFile(w.config.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return aws.Credentials{}, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	data := renderCredentialsProfile(existing, w.config.Profile, creds)
+	if err := writeFileAtomic(w.config.Path, data); err != nil {
+		return aws.Credentials{}, err
+	}
+
+	log.Printf("Wrote AWS credentials to profile %s in %s", w.config.Profile, w.config.Path)
+	return creds, nil
+}
+
+// Start writes the profile and keeps it fresh in the background until Stop
+// is called or ctx is done. The first write's error is returned.
+func (w *CredentialsFileWriter) Start(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cancel != nil {
+		return fmt.Errorf("credentials file writer is already running")
+	}
+
+	creds, err := w.Write(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	go w.refreshLoop(ctx, creds, w.done)
+	return nil
+}
+
+// Stop stops the background refresh; the profile is left in place
+func (w *CredentialsFileWriter) Stop() {
+	w.mu.Lock()
+	cancel, done := w.cancel, w.done
+	w.cancel, w.done = nil, nil
+	w.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// refreshLoop rewrites the profile RefreshBefore ahead of each expiry
+func (w *CredentialsFileWriter) refreshLoop(ctx context.Context, creds aws.Credentials, done chan struct{}) {
+	defer close(done)
+
+	for {
+		if !creds.CanExpire {
+			return
+		}
+		wait := time.Until(creds.Expires.Add(-w.config.RefreshBefore))
+		if wait < 0 {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		next, err := w.Write(ctx)
+		for err != nil {
+			log.Printf("Warning: failed to refresh credentials file, retrying in %s: %v", w.config.RetryInterval, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.config.RetryInterval):
+			}
+			next, err = w.Write(ctx)
+		}
+		creds = next
+	}
+}
+
+// renderCredentialsProfile returns the credentials file existing with
+// profile replaced by creds, or appended if it is missing
+func renderCredentialsProfile(existing []byte, profile string, creds aws.Credentials) []byte {
+	var section bytes.Buffer
+	fmt.Fprintf(&section, "[%s]\n", profile)
+	if creds.CanExpire {
+		fmt.Fprintf(&section, "# Managed by post2post, expires %s\n", creds.Expires.UTC().Format(time.RFC3339))
+	} else {
+		section.WriteString("# Managed by post2post\n")
+	}
+	fmt.Fprintf(&section, "aws_access_key_id = %s\n", creds.AccessKeyID)
+	fmt.Fprintf(&section, "aws_secret_access_key = %s\n", creds.SecretAccessKey)
+	if creds.SessionToken != "" {
+		fmt.Fprintf(&section, "aws_session_token = %s\n", creds.SessionToken)
+	}
+
+	var out bytes.Buffer
+	replaced, inProfile := false, false
+	// Comments and blank lines after the profile's last key belong to the
+	// next section
+	var trailing []string
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			wasInProfile := inProfile
+			inProfile = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == profile
+			if inProfile {
+				if !replaced {
+					out.Write(section.Bytes())
+					replaced = true
+				}
+				trailing = nil
+				continue
+			}
+			if wasInProfile {
+				if len(trailing) == 0 {
+					trailing = []string{""}
+				}
+				for _, kept := range trailing {
+					out.WriteString(kept)
+					out.WriteByte('\n')
+				}
+			}
+		}
+		if inProfile {
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+				trailing = append(trailing, line)
+			} else {
+				trailing = nil
+			}
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+
+	if !replaced {
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n\n")) {
+			out.WriteByte('\n')
+		}
+		out.Write(section.Bytes())
+	}
+	return out.Bytes()
+}
+
+// writeFileAtomic replaces path with data, mode 0600, so readers never see
+// a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".post2post-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package post2post
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestRenderCredentialsProfile(t *testing.T) {
+	creds := aws.Credentials{
+		AccessKeyID:     "AKIANEW",
+		SecretAccessKey: "newsecret",
+		SessionToken:    "newtoken",
+		CanExpire:       true,
+		Expires:         time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	section := "[post2post]\n# Managed by post2post, expires 2030-01-02T03:04:05Z\naws_access_key_id = AKIANEW\naws_secret_access_key = newsecret\naws_session_token = newtoken\n"
+
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+	}{
+		{
+			name: "new file",
+			want: section,
+		},
+		{
+			name:     "append profile",
+			existing: "[default]\naws_access_key_id = AKIADEFAULT\n",
+			want:     "[default]\naws_access_key_id = AKIADEFAULT\n\n" + section,
+		},
+		{
+			name:     "replace profile between others",
+			existing: "[default]\naws_access_key_id = AKIADEFAULT\n\n[post2post]\naws_access_key_id = AKIAOLD\naws_secret_access_key = old\n\n# Work account\n[work]\naws_access_key_id = AKIAWORK\n",
+			want:     "[default]\naws_access_key_id = AKIADEFAULT\n\n" + section + "\n# Work account\n[work]\naws_access_key_id = AKIAWORK\n",
+		},
+		{
+			name:     "replace last profile",
+			existing: "[ post2post ]\naws_access_key_id = AKIAOLD\n",
+			want:     section,
+		},
+		{
+			name:     "idempotent",
+			existing: section,
+			want:     section,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(renderCredentialsProfile([]byte(tt.existing), "post2post", creds))
+			if got != tt.want {
+				t.Errorf("renderCredentialsProfile() =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aws", "credentials")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("[default]\naws_access_key_id = AKIADEFAULT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	source := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return aws.Credentials{
+			AccessKeyID:     "AKIATEST",
+			SecretAccessKey: "secret",
+			SessionToken:    "token",
+			CanExpire:       true,
+			// Due for refresh almost immediately
+			Expires: time.Now().Add(time.Hour + time.Duration(n)*10*time.Millisecond),
+		}, nil
+	})
+
+	writer, err := NewCredentialsFileWriter(CredentialsFileWriterConfig{
+		Provider:      source,
+		Profile:       "remote",
+		Path:          path,
+		RefreshBefore: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	if err := writer.Start(context.Background()); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	writer.Stop()
+	if n := atomic.LoadInt32(&calls); n < 3 {
+		t.Errorf("expected the profile to be refreshed before expiry, got %d writes", n)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read credentials file: %v", err)
+	}
+	content := string(data)
+	if !strings.Contains(content, "[default]\naws_access_key_id = AKIADEFAULT") || strings.Count(content, "[remote]") != 1 {
+		t.Errorf("unexpected credentials file:\n%s", content)
+	}
+	if !strings.Contains(content, "aws_session_token = token") {
+		t.Errorf("expected the session token in the profile:\n%s", content)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	if _, err := NewCredentialsFileWriter(CredentialsFileWriterConfig{Provider: source, Profile: "bad]name", Path: path}); err == nil {
+		t.Error("expected error for an invalid profile name")
+	}
+	if _, err := NewCredentialsFileWriter(CredentialsFileWriterConfig{Path: path}); err == nil {
+		t.Error("expected error for a missing provider")
+	}
+}
@@ -0,0 +1,61 @@
+package post2post
+
+import (
+	"log"
+	"time"
+)
+
+// RefreshEvent describes a credentials refresh through the Lambda
+type RefreshEvent struct {
+	RoleARN   string
+	LambdaURL string
+	Started   time.Time
+	// Duration is the time spent refreshing, including retries; zero for
+	// OnRefreshStart
+	Duration time.Duration
+	// Expires is the expiry of the new credentials, set for OnRefreshSuccess
+	Expires time.Time
+	// Err is the refresh error, set for OnRefreshFailure
+	Err error
+}
+
+// CredentialsHooks are called around every refresh that goes to the Lambda,
+// e.g. to export metrics or alert on failures. Hooks run synchronously on the
+// refreshing goroutine and must not block. Cache hits do not call them.
+type CredentialsHooks struct {
+	OnRefreshStart   func(RefreshEvent)
+	OnRefreshSuccess func(RefreshEvent)
+	OnRefreshFailure func(RefreshEvent)
+}
+
+// callHook runs hook, if set, without letting a panic break the refresh
+func callHook(name string, hook func(RefreshEvent), event RefreshEvent) {
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Warning: credentials %s hook panicked: %v", name, r)
+		}
+	}()
+	hook(event)
+}
+
+// refreshStarted reports the start of a refresh and returns its event
+func (p *AWSCredentialsProvider) refreshStarted() RefreshEvent {
+	event := RefreshEvent{RoleARN: p.roleARN, LambdaURL: p.lambdaURL, Started: time.Now()}
+	callHook("OnRefreshStart", p.hooks.OnRefreshStart, event)
+	return event
+}
+
+// refreshFinished reports the outcome of the refresh started with event
+func (p *AWSCredentialsProvider) refreshFinished(event RefreshEvent, expires time.Time, err error) {
+	event.Duration = time.Since(event.Started)
+	if err != nil {
+		event.Err = err
+		callHook("OnRefreshFailure", p.hooks.OnRefreshFailure, event)
+		return
+	}
+	event.Expires = expires
+	callHook("OnRefreshSuccess", p.hooks.OnRefreshSuccess, event)
+}
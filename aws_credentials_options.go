@@ -0,0 +1,207 @@
+package post2post
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// AWSCredentialsOption sets a field of AWSCredentialsProviderConfig
+type AWSCredentialsOption func(*AWSCredentialsProviderConfig)
+
+// NewAWSCredentialsProviderWithOptions creates a provider from options
+// instead of a config struct. The resulting config is checked with Validate.
+//
+//	provider, err := post2post.NewAWSCredentialsProviderWithOptions(
+//		post2post.WithLambdaURL(lambdaURL),
+//		post2post.WithRoleARN(roleARN),
+//		post2post.WithTailnetKey(tailnetKey),
+//		post2post.WithDuration(2*time.Hour),
+//	)
+func NewAWSCredentialsProviderWithOptions(opts ...AWSCredentialsOption) (*AWSCredentialsProvider, error) {
+	var config AWSCredentialsProviderConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return NewAWSCredentialsProvider(config)
+}
+
+// WithLambdaURL sets the Lambda Function URL endpoint
+func WithLambdaURL(lambdaURL string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.LambdaURL = lambdaURL }
+}
+
+// WithLambdaURLs adds Lambda Function URLs tried in order when earlier ones
+// fail
+func WithLambdaURLs(lambdaURLs ...string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.LambdaURLs = append(c.LambdaURLs, lambdaURLs...)
+	}
+}
+
+// WithEndpointHealth sets how many consecutive failures mark a Lambda
+// endpoint unhealthy and for how long
+func WithEndpointHealth(threshold int, cooldown time.Duration) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.UnhealthyThreshold = threshold
+		c.UnhealthyCooldown = cooldown
+	}
+}
+
+// WithRoleARN sets the IAM role to assume
+func WithRoleARN(roleARN string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.RoleARN = roleARN }
+}
+
+// WithTailnetKey sets the Tailscale auth key
+func WithTailnetKey(tailnetKey string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.TailnetKey = tailnetKey }
+}
+
+// WithSessionName sets the session name of the assumed role
+func WithSessionName(sessionName string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.SessionName = sessionName }
+}
+
+// WithDuration sets the credential duration, 15 minutes to 12 hours
+func WithDuration(duration time.Duration) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.Duration = duration }
+}
+
+// WithTailscaleFallback sets the behavior when Tailscale is unavailable
+func WithTailscaleFallback(policy FallbackPolicy) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.Fallback = policy }
+}
+
+// WithExternalID sets the external ID required by the role's trust policy
+func WithExternalID(externalID string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.ExternalID = externalID }
+}
+
+// WithSessionPolicy scopes down the credentials with an inline JSON policy
+// and managed policy ARNs
+func WithSessionPolicy(policy string, policyARNs ...string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.Policy = policy
+		c.PolicyARNs = policyARNs
+	}
+}
+
+// WithSessionTags sets STS session tags and the keys that persist through
+// role chaining
+func WithSessionTags(tags map[string]string, transitiveTagKeys ...string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.Tags = tags
+		c.TransitiveTagKeys = transitiveTagKeys
+	}
+}
+
+// WithSourceIdentity sets the source identity of the session, e.g. the user
+// or workload requesting the credentials
+func WithSourceIdentity(sourceIdentity string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.SourceIdentity = sourceIdentity }
+}
+
+// WithCredentialEncryption has the Lambda encrypt the credentials to an
+// ephemeral key of each request
+func WithCredentialEncryption() AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.EncryptCredentials = true }
+}
+
+// WithWebIdentityTokenFile exchanges the OIDC token in path with
+// AssumeRoleWithWebIdentity instead of calling AssumeRole
+func WithWebIdentityTokenFile(path string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.WebIdentityTokenFile = path }
+}
+
+// WithWebIdentityTokenEnv exchanges the OIDC token in the environment
+// variable name with AssumeRoleWithWebIdentity
+func WithWebIdentityTokenEnv(name string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.WebIdentityTokenEnv = name }
+}
+
+// WithRegion sets the STS region the Lambda calls
+func WithRegion(region string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.Region = region }
+}
+
+// WithSTSEndpoint overrides the STS endpoint the Lambda calls
+func WithSTSEndpoint(endpoint string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.STSEndpoint = endpoint }
+}
+
+// WithSynchronous has the Lambda return credentials in its response instead
+// of a callback
+func WithSynchronous() AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.Synchronous = true }
+}
+
+// WithResponseQueue has the Lambda send credentials to the SQS queue at
+// queueURL, read with client or, when nil, the SDK's default config
+func WithResponseQueue(queueURL string, client ResponseQueueClient) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.ResponseQueueURL = queueURL
+		c.ResponseQueueClient = client
+	}
+}
+
+// WithResponseTopic has the Lambda publish credentials to the SNS topic
+// topicARN, which must feed the response queue
+func WithResponseTopic(topicARN string) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.ResponseTopicARN = topicARN }
+}
+
+// WithRequestSigning signs requests to the Lambda with key; keyID selects
+// a per-client key and may be empty
+func WithRequestSigning(keyID string, key []byte) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.SigningKeyID = keyID
+		c.SigningKey = key
+	}
+}
+
+// WithIAMAuth signs requests with SigV4 for a Function URL with AWS_IAM
+// auth, using credentials or, when nil, the SDK's default credential chain
+func WithIAMAuth(credentials aws.CredentialsProvider) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.IAMAuth = true
+		c.IAMAuthCredentials = credentials
+	}
+}
+
+// WithExpiryBuffer sets how long before expiry cached credentials are refreshed
+func WithExpiryBuffer(buffer time.Duration) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.ExpiryBuffer = buffer }
+}
+
+// WithStaleIfError serves cached credentials up to window past their expiry
+// when a refresh fails
+func WithStaleIfError(window time.Duration) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.StaleIfError = window }
+}
+
+// WithRetry sets the refresh attempts and the backoff between them
+func WithRetry(maxAttempts int, baseDelay, maxDelay time.Duration) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.MaxAttempts = maxAttempts
+		c.RetryBaseDelay = baseDelay
+		c.RetryMaxDelay = maxDelay
+	}
+}
+
+// WithFallbackProviders adds providers consulted when post2post fails
+func WithFallbackProviders(providers ...aws.CredentialsProvider) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) {
+		c.FallbackProviders = append(c.FallbackProviders, providers...)
+	}
+}
+
+// WithRolePathPolicy restricts which roles may be assumed
+func WithRolePathPolicy(policy RolePathPolicy) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.RolePathPolicy = &policy }
+}
+
+// WithHooks sets the refresh lifecycle hooks
+func WithHooks(hooks CredentialsHooks) AWSCredentialsOption {
+	return func(c *AWSCredentialsProviderConfig) { c.Hooks = hooks }
+}
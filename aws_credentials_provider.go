@@ -2,14 +2,19 @@ package post2post
 
 import (
 	"context"
+	"crypto/ecdh"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"golang.org/x/sync/singleflight"
 )
 
 // AWSCredentialsProvider implements aws.CredentialsProvider using post2post
@@ -20,29 +25,218 @@ type AWSCredentialsProvider struct {
 	tailnetKey  string
 	sessionName string
 	duration    time.Duration
+	externalID  string
+	policy      string
+	policyARNs  []string
+	tags        map[string]string
+	transitive  []string
+	
+	// Source identity set on the session, "" for none
+	sourceIdentity string
+	
+	// Whether the Lambda encrypts the credentials to a per-request key
+	encryptCredentials bool
+	
+	// Sources of an OIDC token for AssumeRoleWithWebIdentity
+	webIdentityTokenFile string
+	webIdentityTokenEnv  string
+	
+	// STS region and endpoint the Lambda calls, "" for the Lambda's default
+	region      string
+	stsEndpoint string
+	
+	// Read the result from the Lambda's response instead of a callback
+	synchronous bool
+	
+	// Have the Lambda deliver the result to a queue, or a topic feeding it
+	responseQueueURL string
+	responseTopicARN string
+	
+	// Signs requests to the Lambda
+	signing requestSigning
+	
+	// Cache tuning
+	expiryBuffer time.Duration
+	staleIfError time.Duration
+	
+	// Retry tuning
+	maxAttempts    int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	
+	// Consulted in order when the post2post path fails
+	fallbacks []aws.CredentialsProvider
+	
+	// Called around refreshes through the Lambda
+	hooks CredentialsHooks
+	
+	// Lambda endpoints in failover order, shared with the owner if any
+	endpoints *lambdaEndpoints
 	
 	// Cached credentials
 	mu          sync.RWMutex
 	credentials *aws.Credentials
 	expiry      time.Time
+	cache       *credentialsCache
+	// Largest expiry window of a wrapping aws.CredentialsCache, see AdjustExpiresBy
+	sdkExpiryWindow time.Duration
+	// Outcome of the last refresh through the Lambda, see Peek
+	lastRefresh    time.Time
+	lastRefreshErr error
+	
+	// Deduplicates concurrent refreshes
+	refresh     singleflight.Group
+	
+	// The server is started on first use
+	startMu     sync.Mutex
+	started     bool
+	
+	// Set when the server is shared by a MultiRoleCredentialsProvider
+	owner       *MultiRoleCredentialsProvider
 }
 
+// sessionNamePattern matches the role session names STS accepts
+var sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
 // AWSCredentialsProviderConfig holds configuration for the AWS credentials provider
 type AWSCredentialsProviderConfig struct {
-	LambdaURL   string        // Lambda Function URL endpoint
-	RoleARN     string        // IAM Role ARN to assume (must be in /remote/ path)
-	TailnetKey  string        // Tailscale auth key for secure communication
-	SessionName string        // Session name for the assumed role (optional)
-	Duration    time.Duration // Credential duration (optional, default 1 hour)
+	LambdaURL         string            // Lambda Function URL endpoint
+	RoleARN           string            // IAM Role ARN to assume (subject to RolePathPolicy)
+	TailnetKey        string            // Tailscale auth key for secure communication
+	SessionName       string            // Session name for the assumed role, shown in CloudTrail (optional)
+	Duration          time.Duration     // Credential duration (optional, default 1 hour)
+	Fallback          FallbackPolicy    // Behavior when Tailscale is unavailable (optional, default FallbackNever)
+	ExternalID        string            // External ID required by the role's trust policy (optional)
+	Policy            string            // Inline JSON session policy to scope down the credentials (optional)
+	PolicyARNs        []string          // Managed policy ARNs to scope down the credentials (optional, max 10)
+	Tags              map[string]string // STS session tags for ABAC (optional, max 50)
+	TransitiveTagKeys []string          // Session tag keys that persist through role chaining (optional)
+	// SourceIdentity is set on the session for sts:SourceIdentity conditions
+	// and CloudTrail; it persists through role chaining (optional)
+	SourceIdentity string
+	// EncryptCredentials has the Lambda encrypt the credentials to an
+	// ephemeral key of each request, so they are unreadable if the response
+	// is misrouted or logged (optional)
+	EncryptCredentials bool
+
+	// ExpiryBuffer is how long before expiry cached credentials are refreshed (optional, default 5 minutes)
+	ExpiryBuffer time.Duration
+	// StaleIfError serves cached credentials up to this long past their expiry
+	// when a refresh fails, e.g. while the Lambda is unreachable (optional, disabled when 0)
+	StaleIfError time.Duration
+
+	// MaxAttempts is how many times a refresh tries the Lambda before giving
+	// up; 1 disables retries (optional, default 3)
+	MaxAttempts int
+	// RetryBaseDelay is the backoff before the first retry, doubled for each
+	// further retry with random jitter (optional, default 500ms)
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the backoff between retries (optional, default 10s)
+	RetryMaxDelay time.Duration
+
+	// FallbackProviders are consulted in order when credentials cannot be
+	// retrieved through post2post, e.g. during a tailnet outage (optional)
+	FallbackProviders []aws.CredentialsProvider
+
+	// RolePathPolicy restricts which roles may be assumed, e.g.
+	// &RemoteRolePathPolicy (optional, no restriction when nil)
+	RolePathPolicy *RolePathPolicy
+
+	// Hooks are called around every refresh through the Lambda, e.g. to
+	// export metrics (optional)
+	Hooks CredentialsHooks
+
+	// LambdaURLs are further Lambda Function URLs, e.g. in other regions,
+	// tried in order when LambdaURL fails (optional)
+	LambdaURLs []string
+	// UnhealthyThreshold is how many consecutive timeouts or server errors
+	// mark an endpoint unhealthy (optional, default 3)
+	UnhealthyThreshold int
+	// UnhealthyCooldown is how long an unhealthy endpoint is tried only after
+	// the healthy ones (optional, default 30s)
+	UnhealthyCooldown time.Duration
+
+	// WebIdentityTokenFile holds an OIDC token, e.g. a Kubernetes projected
+	// service account token, that the Lambda exchanges with
+	// AssumeRoleWithWebIdentity instead of calling AssumeRole. It is read at
+	// every refresh (optional)
+	WebIdentityTokenFile string
+	// WebIdentityTokenEnv names an environment variable holding the OIDC
+	// token, read at every refresh (optional)
+	WebIdentityTokenEnv string
+
+	// Region is the STS region the Lambda calls, e.g. the workload's region,
+	// for lower latency and data residency (optional, default the Lambda's
+	// region)
+	Region string
+	// STSEndpoint overrides the STS endpoint the Lambda calls, e.g. the FIPS
+	// endpoint; it must be a public STS endpoint (optional)
+	STSEndpoint string
+
+	// Synchronous has the Lambda return the credentials in its Function URL
+	// response instead of posting them to a callback URL, for clients that
+	// are not reachable from the Lambda. No post2post server is started and
+	// TailnetKey is optional. The Lambda must allow it with RESPONSE_MODE
+	// (optional)
+	Synchronous bool
+
+	// ResponseQueueURL has the Lambda send the credentials to this SQS queue
+	// instead of posting them to a callback URL, and the provider consume
+	// them from it, so the client need not be reachable at all. The queue
+	// must be dedicated to this provider and in the Lambda's
+	// RESPONSE_QUEUE_ALLOWLIST; TailnetKey is optional (optional)
+	ResponseQueueURL string
+	// ResponseTopicARN has the Lambda publish the credentials to this SNS
+	// topic instead; ResponseQueueURL must be subscribed to it (optional)
+	ResponseTopicARN string
+	// ResponseQueueClient reads the response queue (optional, default an SQS
+	// client from the SDK's default config)
+	ResponseQueueClient ResponseQueueClient
+
+	// SigningKey signs every request to the Lambda with HMAC-SHA256 so it can
+	// reject requests from other callers of its Function URL; it must match
+	// the Lambda's REQUEST_SIGNING_KEY and be at least 32 bytes (optional)
+	SigningKey []byte
+	// SigningKeyID selects the key among the Lambda's REQUEST_SIGNING_KEYS
+	// when clients have separate keys (optional)
+	SigningKeyID string
+
+	// IAMAuth signs requests with SigV4 for a Function URL with AWS_IAM auth
+	// (optional)
+	IAMAuth bool
+	// IAMAuthCredentials are the bootstrap credentials requests are signed
+	// with, e.g. the instance role; they need lambda:InvokeFunctionUrl
+	// (optional, default the SDK's default credential chain)
+	IAMAuthCredentials aws.CredentialsProvider
+	// IAMAuthRegion is the signing region for Lambda URLs that are not
+	// Function URLs, e.g. behind a custom domain (optional)
+	IAMAuthRegion string
 }
 
 // LambdaAssumeRoleRequest represents the request sent to the Lambda function
 type LambdaAssumeRoleRequest struct {
-	URL        string `json:"url"`
-	Payload    string `json:"payload"`
-	RequestID  string `json:"request_id"`
-	TailnetKey string `json:"tailnet_key,omitempty"`
-	RoleARN    string `json:"role_arn"`
+	URL               string            `json:"url"`
+	Payload           string            `json:"payload"`
+	RequestID         string            `json:"request_id"`
+	TailnetKey        string            `json:"tailnet_key,omitempty"`
+	RoleARN           string            `json:"role_arn"`
+	ExternalID        string            `json:"external_id,omitempty"`
+	Policy            string            `json:"policy,omitempty"`
+	PolicyARNs        []string          `json:"policy_arns,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	TransitiveTagKeys []string          `json:"transitive_tag_keys,omitempty"`
+	SourceIdentity    string            `json:"source_identity,omitempty"`
+	DurationSeconds   int32             `json:"duration_seconds,omitempty"`
+	SessionName       string            `json:"session_name,omitempty"`
+	WebIdentityToken  string            `json:"web_identity_token,omitempty"`
+	Region            string            `json:"region,omitempty"`
+	STSEndpoint       string            `json:"sts_endpoint,omitempty"`
+	Synchronous       bool              `json:"synchronous,omitempty"`
+	ResponseQueueURL  string            `json:"response_queue_url,omitempty"`
+	ResponseTopicARN  string            `json:"response_topic_arn,omitempty"`
+	// CredentialsPublicKey is the base64 PKIX X25519 or RSA key the
+	// credentials are encrypted to
+	CredentialsPublicKey string `json:"credentials_public_key,omitempty"`
 }
 
 // LambdaAssumeRoleResponse represents the response from the Lambda function
@@ -60,6 +254,8 @@ type LambdaProcessedPayload struct {
 	ProcessedBy      string                   `json:"processed_by"`
 	LambdaRequestID  string                   `json:"lambda_request_id"`
 	Status           string                   `json:"status"`
+	Error            string                   `json:"error,omitempty"`
+	ErrorCode        string                   `json:"error_code,omitempty"`
 }
 
 // LambdaAssumeRoleResult represents the STS AssumeRole result from Lambda
@@ -68,61 +264,332 @@ type LambdaAssumeRoleResult struct {
 	AssumedRoleUser  *types.AssumedRoleUser  `json:"assumed_role_user"`
 	PackedPolicySize *int32                  `json:"packed_policy_size,omitempty"`
 	SourceIdentity   *string                 `json:"source_identity,omitempty"`
+	// Region is the STS region that issued the credentials, which may be a
+	// failover region of the Lambda
+	Region string `json:"region,omitempty"`
+	// EncryptedCredentials replaces Credentials when the request had a
+	// credentials public key
+	EncryptedCredentials *EncryptedCredentials `json:"encrypted_credentials,omitempty"`
 }
 
 // NewAWSCredentialsProvider creates a new AWS credentials provider using post2post
 func NewAWSCredentialsProvider(config AWSCredentialsProviderConfig) (*AWSCredentialsProvider, error) {
-	if config.LambdaURL == "" {
-		return nil, fmt.Errorf("lambda URL is required")
+	return newAWSCredentialsProvider(config, nil)
+}
+
+// newAWSCredentialsProvider creates a provider for config.RoleARN. When owner
+// is set the provider uses the owner's server instead of creating its own.
+func newAWSCredentialsProvider(config AWSCredentialsProviderConfig, owner *MultiRoleCredentialsProvider) (*AWSCredentialsProvider, error) {
+	if err := validateProviderRole(config); err != nil {
+		return nil, err
+	}
+	if err := normalizeProviderConfig(&config); err != nil {
+		return nil, err
+	}
+
+	var server *Server
+	var endpoints *lambdaEndpoints
+	if owner != nil {
+		server = owner.server
+		endpoints = owner.endpoints
+	} else {
+		endpoints = newLambdaEndpoints(append([]string{config.LambdaURL}, config.LambdaURLs...), config.UnhealthyThreshold, config.UnhealthyCooldown)
+		// Create a post2post server for handling responses; it is started by
+		// Start or the first Retrieve
+		server = NewServer().
+			WithPostURL(config.LambdaURL).
+			WithFallbackPolicy(config.Fallback).
+			WithRequestSigning(config.SigningKeyID, config.SigningKey)
+		if config.IAMAuth {
+			server.WithSigV4Signing(config.IAMAuthCredentials, "lambda", config.IAMAuthRegion)
+		}
+		server.WithResponseQueue(config.ResponseQueueURL, config.ResponseQueueClient)
 	}
+
+	provider := &AWSCredentialsProvider{
+		server:       server,
+		owner:        owner,
+		lambdaURL:    config.LambdaURL,
+		roleARN:      config.RoleARN,
+		tailnetKey:   config.TailnetKey,
+		sessionName:  config.SessionName,
+		duration:     config.Duration,
+		expiryBuffer: config.ExpiryBuffer,
+		staleIfError: config.StaleIfError,
+		externalID:   config.ExternalID,
+		policy:       config.Policy,
+		policyARNs:   append([]string(nil), config.PolicyARNs...),
+		tags:         config.Tags,
+		transitive:   append([]string(nil), config.TransitiveTagKeys...),
+
+		sourceIdentity:     config.SourceIdentity,
+		encryptCredentials: config.EncryptCredentials,
+
+		maxAttempts:    config.MaxAttempts,
+		retryBaseDelay: config.RetryBaseDelay,
+		retryMaxDelay:  config.RetryMaxDelay,
+
+		fallbacks: append([]aws.CredentialsProvider(nil), config.FallbackProviders...),
+		hooks:     config.Hooks,
+		endpoints: endpoints,
+
+		webIdentityTokenFile: config.WebIdentityTokenFile,
+		webIdentityTokenEnv:  config.WebIdentityTokenEnv,
+
+		region:      config.Region,
+		stsEndpoint: config.STSEndpoint,
+		synchronous: config.Synchronous,
+		signing:     server.signing,
+
+		responseQueueURL: config.ResponseQueueURL,
+		responseTopicARN: config.ResponseTopicARN,
+	}
+
+	log.Printf("AWS Credentials Provider initialized with Lambda URL: %s", config.LambdaURL)
+	log.Printf("Will assume role: %s", config.RoleARN)
+
+	return provider, nil
+}
+
+// Validate checks the config without creating a provider: the role ARN
+// format and role path policy, the Lambda URL scheme, the duration bounds and
+// the session settings
+func (c AWSCredentialsProviderConfig) Validate() error {
+	if err := validateProviderRole(c); err != nil {
+		return err
+	}
+	return normalizeProviderConfig(&c)
+}
+
+// validateProviderRole checks the role ARN format and role path policy
+func validateProviderRole(config AWSCredentialsProviderConfig) error {
 	if config.RoleARN == "" {
-		return nil, fmt.Errorf("role ARN is required")
+		return fmt.Errorf("role ARN is required")
 	}
-	if config.TailnetKey == "" {
-		return nil, fmt.Errorf("tailnet key is required for secure communication")
+	if _, _, err := parseRoleARN(config.RoleARN); err != nil {
+		return err
+	}
+	if config.RolePathPolicy != nil {
+		if err := config.RolePathPolicy.Check(config.RoleARN); err != nil {
+			return fmt.Errorf("role ARN not allowed: %w", err)
+		}
+	}
+	return nil
+}
+
+// normalizeProviderConfig validates the role-independent settings and fills
+// in defaults
+func normalizeProviderConfig(config *AWSCredentialsProviderConfig) error {
+	if config.LambdaURL == "" && len(config.LambdaURLs) > 0 {
+		config.LambdaURL, config.LambdaURLs = config.LambdaURLs[0], config.LambdaURLs[1:]
+	}
+	if config.LambdaURL == "" {
+		return fmt.Errorf("lambda URL is required")
+	}
+	for _, lambdaURL := range append([]string{config.LambdaURL}, config.LambdaURLs...) {
+		if err := validateLambdaURL(lambdaURL); err != nil {
+			return err
+		}
+	}
+	if config.UnhealthyThreshold < 0 || config.UnhealthyCooldown < 0 {
+		return fmt.Errorf("unhealthy threshold and cooldown must not be negative")
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if config.UnhealthyCooldown == 0 {
+		config.UnhealthyCooldown = defaultUnhealthyCooldown
+	}
+	if err := validateResponseQueueConfig(config); err != nil {
+		return err
+	}
+	if config.TailnetKey == "" && !config.Synchronous && config.ResponseQueueURL == "" {
+		return fmt.Errorf("tailnet key is required for secure communication")
 	}
 
 	// Set defaults
 	if config.SessionName == "" {
 		config.SessionName = "post2post-credentials-provider"
 	}
+	if !sessionNamePattern.MatchString(config.SessionName) {
+		return fmt.Errorf("session name must be 2 to 64 letters, digits or +=,.@_- characters, got %q", config.SessionName)
+	}
 	if config.Duration == 0 {
 		config.Duration = 1 * time.Hour
 	}
+	// STS issues role credentials for 15 minutes up to 12 hours
+	if config.Duration < 15*time.Minute || config.Duration > 12*time.Hour {
+		return fmt.Errorf("duration must be between 15 minutes and 12 hours, got %s", config.Duration)
+	}
+	if config.ExpiryBuffer < 0 || config.StaleIfError < 0 {
+		return fmt.Errorf("expiry buffer and stale-if-error window must not be negative")
+	}
+	if config.ExpiryBuffer == 0 {
+		config.ExpiryBuffer = 5 * time.Minute
+	}
+	if config.MaxAttempts < 0 || config.RetryBaseDelay < 0 || config.RetryMaxDelay < 0 {
+		return fmt.Errorf("retry attempts and delays must not be negative")
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.RetryBaseDelay == 0 {
+		config.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	if config.RetryMaxDelay == 0 {
+		config.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	// STS accepts external IDs of 2 to 1224 characters
+	if config.ExternalID != "" && (len(config.ExternalID) < 2 || len(config.ExternalID) > 1224) {
+		return fmt.Errorf("external ID must be between 2 and 1224 characters")
+	}
+	// Source identities follow the same rules as session names
+	if config.SourceIdentity != "" && !sessionNamePattern.MatchString(config.SourceIdentity) {
+		return fmt.Errorf("source identity must be 2 to 64 letters, digits or +=,.@_- characters, got %q", config.SourceIdentity)
+	}
+	if config.Policy != "" && !json.Valid([]byte(config.Policy)) {
+		return fmt.Errorf("session policy must be valid JSON")
+	}
+	if len(config.PolicyARNs) > 10 {
+		return fmt.Errorf("at most 10 managed session policy ARNs are allowed")
+	}
+	if err := validateWebIdentityConfig(config); err != nil {
+		return err
+	}
+	if err := validateSTSRegionConfig(config); err != nil {
+		return err
+	}
+	if err := validateSigningKey(config.SigningKeyID, config.SigningKey); err != nil {
+		return err
+	}
+	if err := validateIAMAuthConfig(config); err != nil {
+		return err
+	}
+	return validateSessionTags(config.Tags, config.TransitiveTagKeys)
+}
+
+// roundTripCallbackURL returns the URL the receiver posts its answer to: the
+// server's Tailscale URL when a tailnet key is set, its local URL otherwise
+func roundTripCallbackURL(server *Server, tailnetKey string) (string, error) {
+	if tailnetKey == "" {
+		return server.GetURL() + "/roundtrip", nil
+	}
+
+	// Use Tailscale hostname when Tailnet key is available
+	tailscaleURL, err := server.GetTailscaleURL()
+	if err != nil {
+		if !server.fallbackAllowed("Tailscale URL lookup", err) {
+			return "", fmt.Errorf("failed to get Tailscale URL: %w", err)
+		}
+		return server.GetURL() + "/roundtrip", nil
+	}
+	callbackURL := tailscaleURL + "/roundtrip"
+	log.Printf("Using Tailscale callback URL: %s", callbackURL)
+	return callbackURL, nil
+}
+
+// validateLambdaURL requires an https URL; plain http is only accepted for
+// loopback addresses, e.g. a local test Lambda
+func validateLambdaURL(lambdaURL string) error {
+	return validateReceiverURL("lambda", lambdaURL)
+}
+
+// validateReceiverURL checks the URL of a credentials receiver named kind
+// the same way
+func validateReceiverURL(kind, receiverURL string) error {
+	u, err := url.Parse(receiverURL)
+	if err != nil {
+		return fmt.Errorf("invalid %s URL: %w", kind, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s URL %q has no host", kind, receiverURL)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+		return fmt.Errorf("%s URL must use https, got %s", kind, receiverURL)
+	default:
+		return fmt.Errorf("%s URL must use https, got %s", kind, receiverURL)
+	}
+}
+
+// validateSessionTags checks session tags against the STS limits
+func validateSessionTags(tags map[string]string, transitiveTagKeys []string) error {
+	if len(tags) > 50 {
+		return fmt.Errorf("at most 50 session tags are allowed")
+	}
+	for key, value := range tags {
+		if len(key) < 1 || len(key) > 128 {
+			return fmt.Errorf("session tag key %q must be between 1 and 128 characters", key)
+		}
+		if len(value) > 256 {
+			return fmt.Errorf("session tag %q value must be at most 256 characters", key)
+		}
+	}
+	for _, key := range transitiveTagKeys {
+		if _, ok := tags[key]; !ok {
+			return fmt.Errorf("transitive tag key %q is not a session tag", key)
+		}
+	}
+	return nil
+}
+
+// Start starts the internal post2post server. It is called by the first
+// Retrieve; call it explicitly to surface startup errors early.
+func (p *AWSCredentialsProvider) Start(ctx context.Context) error {
+	// Synchronous requests need no callback server
+	if p.synchronous {
+		return nil
+	}
+	if p.owner != nil {
+		return p.owner.Start(ctx)
+	}
+
+	p.startMu.Lock()
+	defer p.startMu.Unlock()
+
+	if p.started {
+		return nil
+	}
+	if err := startCredentialsServer(ctx, p.server, p.tailnetKey); err != nil {
+		return err
+	}
+
+	p.started = true
+	return nil
+}
+
+// startCredentialsServer binds server to the Tailscale interface when a
+// tailnet key is set and starts it
+func startCredentialsServer(ctx context.Context, server *Server, tailnetKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Create a post2post server for handling responses
-	server := NewServer().WithPostURL(config.LambdaURL)
-	
 	// Configure server to listen on Tailscale interface if tailnet key is provided
-	if config.TailnetKey != "" {
+	if tailnetKey != "" {
 		// Try to get Tailscale IP and bind to it
 		tailscaleIP, err := server.GetTailscaleIP()
 		if err != nil {
-			log.Printf("Failed to get Tailscale IP, falling back to default interface: %v", err)
+			if !server.fallbackAllowed("Tailscale IP lookup", err) {
+				return fmt.Errorf("failed to get Tailscale IP: %w", err)
+			}
 		} else {
-			server = server.WithInterface(tailscaleIP)
+			server.WithInterface(tailscaleIP)
 			log.Printf("Server configured to listen on Tailscale interface: %s", tailscaleIP)
 		}
 	}
-	
+
 	// Start the server on an available port
 	if err := server.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start post2post server: %w", err)
+		return fmt.Errorf("failed to start post2post server: %w", err)
 	}
-
-	provider := &AWSCredentialsProvider{
-		server:      server,
-		lambdaURL:   config.LambdaURL,
-		roleARN:     config.RoleARN,
-		tailnetKey:  config.TailnetKey,
-		sessionName: config.SessionName,
-		duration:    config.Duration,
-	}
-
-	log.Printf("AWS Credentials Provider initialized with Lambda URL: %s", config.LambdaURL)
-	log.Printf("Will assume role: %s", config.RoleARN)
-
-	return provider, nil
+	return nil
 }
 
 // Retrieve implements aws.CredentialsProvider.Retrieve
@@ -137,42 +604,174 @@ func (p *AWSCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials,
 	}
 	p.mu.RUnlock()
 
-	// Need to fetch new credentials
-	log.Printf("Fetching new AWS credentials from Lambda: %s", p.lambdaURL)
+	// Another process may have refreshed the shared credentials cache
+	if creds, ok := p.loadPersistentCache(); ok {
+		return creds, nil
+	}
+
+	if err := p.Start(ctx); err != nil {
+		return p.retrieveFallback(ctx, err)
+	}
+
+	// Concurrent callers share a single upstream refresh. It runs detached
+	// from the caller that started it, bounded by the provider's own
+	// timeout, so that caller giving up does not fail the others.
+	result := p.refresh.DoChan("credentials", func() (interface{}, error) {
+		refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.refreshTimeout())
+		defer cancel()
+		return p.fetchCredentials(refreshCtx)
+	})
+	
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			if creds, ok := p.staleCredentials(); ok {
+				log.Printf("WARNING: Failed to refresh AWS credentials, serving cached credentials (expires: %s): %v", creds.Expires.Format(time.RFC3339), res.Err)
+				return creds, nil
+			}
+			return p.retrieveFallback(ctx, res.Err)
+		}
+		return res.Val.(aws.Credentials), nil
+	case <-ctx.Done():
+		return aws.Credentials{}, ctx.Err()
+	}
+}
+
+// refreshTimeout bounds a shared refresh: every attempt at every Lambda
+// endpoint timing out, with the longest backoff between attempts
+func (p *AWSCredentialsProvider) refreshTimeout() time.Duration {
+	attempt := time.Duration(len(p.endpoints.endpoints)) * credentialsRoundTripTimeout
+	return time.Duration(p.maxAttempts)*attempt + time.Duration(p.maxAttempts-1)*p.retryMaxDelay
+}
+
+// fetchCredentials retrieves new credentials from the Lambda and caches them
+func (p *AWSCredentialsProvider) fetchCredentials(ctx context.Context) (aws.Credentials, error) {
+	// Serialize refreshes with other processes sharing the credentials cache
+	p.mu.RLock()
+	cache := p.cache
+	p.mu.RUnlock()
+	if cache != nil {
+		unlock, err := cache.lock()
+		if err != nil {
+			log.Printf("Warning: refreshing without the credentials cache lock: %v", err)
+		} else {
+			defer unlock()
+		}
+		if creds, ok := p.loadPersistentCache(); ok {
+			return creds, nil
+		}
+	}
+
+	event := p.refreshStarted()
+	credentials, err := p.requestCredentialsWithRetry(ctx)
+	p.refreshFinished(event, credentials.Expires, err)
+	p.recordRefresh(err)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	p.cacheCredentials(credentials)
+	if cache != nil {
+		if err := cache.save(credentials); err != nil {
+			log.Printf("Warning: failed to save credentials to cache: %v", err)
+		}
+	}
+
+	log.Printf("Successfully retrieved AWS credentials (expires: %s)", credentials.Expires.Format(time.RFC3339))
+	return credentials, nil
+}
+
+// requestCredentials makes one assume role attempt, failing over to the next
+// Lambda endpoint when one times out or is unavailable
+func (p *AWSCredentialsProvider) requestCredentials(ctx context.Context) (aws.Credentials, error) {
+	var lastErr error
+	for _, lambdaURL := range p.endpoints.order() {
+		if lastErr != nil {
+			log.Printf("Failing over to Lambda endpoint %s: %v", lambdaURL, lastErr)
+		}
+		credentials, err := p.requestCredentialsFrom(ctx, lambdaURL)
+		p.endpoints.report(lambdaURL, err)
+		if err == nil || !isRetryable(err) {
+			return credentials, err
+		}
+		lastErr = err
+	}
+	return aws.Credentials{}, lastErr
+}
+
+// requestCredentialsFrom makes a single assume role round trip through the
+// Lambda at lambdaURL
+func (p *AWSCredentialsProvider) requestCredentialsFrom(ctx context.Context, lambdaURL string) (aws.Credentials, error) {
+	log.Printf("Fetching new AWS credentials from Lambda: %s", lambdaURL)
 	
 	// Generate a unique request ID
-	requestID := fmt.Sprintf("creds-%d", time.Now().UnixNano())
+	requestID := newRequestID()
 	
-	// Get the appropriate URL for the callback
+	// Get the appropriate URL for the callback; queued responses need none
 	var callbackURL string
-	if p.tailnetKey != "" {
-		// Use Tailscale hostname when Tailnet key is available
-		tailscaleURL, err := p.server.GetTailscaleURL()
+	if !p.synchronous && p.responseQueueURL == "" {
+		var err error
+		callbackURL, err = roundTripCallbackURL(p.server, p.tailnetKey)
 		if err != nil {
-			log.Printf("Failed to get Tailscale URL, falling back to localhost: %v", err)
-			callbackURL = p.server.GetURL() + "/roundtrip"
-		} else {
-			callbackURL = tailscaleURL + "/roundtrip"
-			log.Printf("Using Tailscale callback URL: %s", callbackURL)
+			return aws.Credentials{}, err
 		}
-	} else {
-		callbackURL = p.server.GetURL() + "/roundtrip"
+	}
+
+	webIdentityToken, err := p.webIdentityToken()
+	if err != nil {
+		return aws.Credentials{}, err
 	}
 
 	// Prepare the request payload
 	request := LambdaAssumeRoleRequest{
-		URL:        callbackURL,
-		Payload:    fmt.Sprintf("assume-role-request-%s", requestID),
-		RequestID:  requestID,
-		TailnetKey: p.tailnetKey,
-		RoleARN:    p.roleARN,
+		URL:               callbackURL,
+		Payload:           fmt.Sprintf("assume-role-request-%s", requestID),
+		RequestID:         requestID,
+		TailnetKey:        p.tailnetKey,
+		RoleARN:           p.roleARN,
+		ExternalID:        p.externalID,
+		Policy:            p.policy,
+		PolicyARNs:        p.policyARNs,
+		Tags:              p.tags,
+		TransitiveTagKeys: p.transitive,
+		SourceIdentity:    p.sourceIdentity,
+		DurationSeconds:   int32(p.duration / time.Second),
+		SessionName:       p.sessionName,
+		WebIdentityToken:  webIdentityToken,
+		Region:            p.region,
+		STSEndpoint:       p.stsEndpoint,
+		Synchronous:       p.synchronous,
+		ResponseQueueURL:  p.responseQueueURL,
+		ResponseTopicARN:  p.responseTopicARN,
 	}
 
-	// Use RoundTripPost to get the response synchronously
-	response, err := p.server.RoundTripPostWithTimeout(request, p.tailnetKey, 30*time.Second)
+	// A fresh key per request, so credentials of one request cannot be read
+	// with the key of another
+	var credentialsKey *ecdh.PrivateKey
+	if p.encryptCredentials {
+		credentialsKey, request.CredentialsPublicKey, err = generateCredentialsKey()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+	}
+
+	// Use RoundTripPost to get the response synchronously, or read it from
+	// the Lambda's response in synchronous mode
+	var response *RoundTripResponse
+	if p.synchronous {
+		request.TailnetKey = ""
+		attemptCtx, cancel := context.WithTimeout(ctx, credentialsRoundTripTimeout)
+		response, err = postSynchronous(attemptCtx, lambdaURL, request, p.signing)
+		cancel()
+	} else {
+		response, err = p.server.RoundTripPostToURL(lambdaURL, request, p.tailnetKey, credentialsRoundTripTimeout)
+	}
 	if err != nil {
 		return aws.Credentials{}, fmt.Errorf("failed to retrieve credentials from Lambda: %w", err)
 	}
+	if err := roundTripError(response, p.roleARN); err != nil {
+		return aws.Credentials{}, err
+	}
 
 	// Parse the response directly as LambdaProcessedPayload
 	log.Printf("Credentials Provider: Parsing response payload from RoundTrip")
@@ -184,10 +783,11 @@ func (p *AWSCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials,
 		return aws.Credentials{}, fmt.Errorf("failed to marshal response payload: %w", err)
 	}
 	
-	log.Printf("Credentials Provider: Marshaled payload: %s", string(responseBytes))
+	// The payload carries the credentials; log only its size
+	log.Printf("Credentials Provider: Response payload for request %s: %d bytes", requestID, len(responseBytes))
 
 	if err := json.Unmarshal(responseBytes, &lambdaProcessedPayload); err != nil {
-		return aws.Credentials{}, fmt.Errorf("failed to parse Lambda response: %w", err)
+		return aws.Credentials{}, terminal(fmt.Errorf("failed to parse Lambda response: %w", err))
 	}
 	
 	log.Printf("Credentials Provider: Parsed LambdaProcessedPayload - LambdaRequestID: %s", lambdaProcessedPayload.LambdaRequestID)
@@ -195,13 +795,35 @@ func (p *AWSCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials,
 
 	// Check if the request was successful
 	if lambdaProcessedPayload.Status != "success" {
-		return aws.Credentials{}, fmt.Errorf("Lambda returned error status: '%s'", lambdaProcessedPayload.Status)
+		message := lambdaProcessedPayload.Error
+		if message == "" {
+			message = fmt.Sprintf("Lambda returned error status: '%s'", lambdaProcessedPayload.Status)
+		}
+		return aws.Credentials{}, terminal(&CredentialsError{
+			Kind:            ErrAssumeRoleDenied,
+			RoleARN:         p.roleARN,
+			RequestID:       requestID,
+			LambdaRequestID: lambdaProcessedPayload.LambdaRequestID,
+			Code:            lambdaProcessedPayload.ErrorCode,
+			Message:         message,
+		})
 	}
 
 	// Extract credentials from the response
 	stsCredentials := lambdaProcessedPayload.AssumeRoleResult.Credentials
+	if encrypted := lambdaProcessedPayload.AssumeRoleResult.EncryptedCredentials; credentialsKey != nil {
+		// Plaintext credentials are refused, so a Lambda that ignores the
+		// key is noticed
+		if encrypted == nil {
+			return aws.Credentials{}, terminal(fmt.Errorf("lambda returned unencrypted credentials; it may not support credential encryption"))
+		}
+		stsCredentials, err = decryptCredentials(credentialsKey, requestID, encrypted)
+		if err != nil {
+			return aws.Credentials{}, terminal(err)
+		}
+	}
 	if stsCredentials == nil {
-		return aws.Credentials{}, fmt.Errorf("no credentials returned in Lambda response")
+		return aws.Credentials{}, terminal(fmt.Errorf("no credentials returned in Lambda response"))
 	}
 
 	// Convert to aws.Credentials
@@ -214,25 +836,82 @@ func (p *AWSCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials,
 		Expires:         *stsCredentials.Expiration,
 	}
 
-	// Cache the credentials with a buffer before expiry
-	expiryBuffer := 5 * time.Minute
+	if user := lambdaProcessedPayload.AssumeRoleResult.AssumedRoleUser; user != nil && user.Arn != nil {
+		log.Printf("Assumed role user: %s", *user.Arn)
+	}
+	if region := lambdaProcessedPayload.AssumeRoleResult.Region; region != "" {
+		log.Printf("Credentials issued by STS in %s", region)
+	}
+
+	return credentials, nil
+}
+
+// cacheCredentials caches the credentials in memory with a buffer before expiry
+func (p *AWSCredentialsProvider) cacheCredentials(credentials aws.Credentials) {
 	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.credentials = &credentials
-	p.expiry = credentials.Expires.Add(-expiryBuffer)
-	p.mu.Unlock()
+	p.expiry = credentials.Expires.Add(-p.refreshBuffer())
+}
 
-	log.Printf("Successfully retrieved AWS credentials (expires: %s)", credentials.Expires.Format(time.RFC3339))
-	log.Printf("Assumed role user: %s", *lambdaProcessedPayload.AssumeRoleResult.AssumedRoleUser.Arn)
+// loadPersistentCache loads credentials from the persistent cache into memory and
+// reports whether they are still fresh. Expired credentials are kept in
+// memory for the stale-if-error window.
+func (p *AWSCredentialsProvider) loadPersistentCache() (aws.Credentials, bool) {
+	p.mu.RLock()
+	cache := p.cache
+	p.mu.RUnlock()
+	if cache == nil {
+		return aws.Credentials{}, false
+	}
 
-	return credentials, nil
+	creds, ok := cache.load()
+	if !ok {
+		return aws.Credentials{}, false
+	}
+	p.cacheCredentials(creds)
+
+	p.mu.RLock()
+	buffer := p.refreshBuffer()
+	p.mu.RUnlock()
+	if !time.Now().Before(creds.Expires.Add(-buffer)) {
+		return aws.Credentials{}, false
+	}
+	log.Printf("Using AWS credentials from persistent cache %s (expires: %s)", cache.key, creds.Expires.Format(time.RFC3339))
+	return creds, true
+}
+
+// staleCredentials returns the cached credentials if they are within the
+// stale-if-error window
+func (p *AWSCredentialsProvider) staleCredentials() (aws.Credentials, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.staleIfError <= 0 || p.credentials == nil {
+		return aws.Credentials{}, false
+	}
+	if !time.Now().Before(p.credentials.Expires.Add(p.staleIfError)) {
+		return aws.Credentials{}, false
+	}
+	return *p.credentials, true
 }
 
-// Close stops the internal post2post server
+// Close stops the internal post2post server, if it was started. Providers
+// returned by a MultiRoleCredentialsProvider leave the shared server running.
 func (p *AWSCredentialsProvider) Close() error {
-	if p.server != nil {
-		return p.server.Stop()
+	if p.owner != nil {
+		return nil
 	}
-	return nil
+
+	p.startMu.Lock()
+	defer p.startMu.Unlock()
+
+	if !p.started {
+		return nil
+	}
+	p.started = false
+	return p.server.Stop()
 }
 
 // GetRoleARN returns the configured role ARN
@@ -256,5 +935,10 @@ func (p *AWSCredentialsProvider) InvalidateCache() {
 	defer p.mu.Unlock()
 	p.credentials = nil
 	p.expiry = time.Time{}
+	if p.cache != nil {
+		if err := p.cache.remove(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
 	log.Printf("AWS credentials cache invalidated")
 }
\ No newline at end of file
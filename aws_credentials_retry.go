@@ -0,0 +1,125 @@
+package post2post
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Retry defaults for credential retrieval
+const (
+	defaultMaxAttempts    = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+// credentialsRoundTripTimeout bounds one assume role round trip to a Lambda
+const credentialsRoundTripTimeout = 30 * time.Second
+
+// terminalError marks a failure that retrying cannot fix, e.g. the Lambda
+// rejecting the request or STS denying the role
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string { return e.err.Error() }
+func (e *terminalError) Unwrap() error { return e.err }
+
+// terminal marks err as not retryable
+func terminal(err error) error {
+	return &terminalError{err: err}
+}
+
+// isRetryable reports whether a failed attempt may succeed when retried
+func isRetryable(err error) bool {
+	var t *terminalError
+	return !errors.As(err, &t)
+}
+
+// roundTripError converts an unsuccessful round trip for roleARN into a
+// CredentialsError. Timeouts, network errors, throttling and 5xx responses
+// are retryable; other 4xx responses are terminal.
+func roundTripError(response *RoundTripResponse, roleARN string) error {
+	if response == nil {
+		return &CredentialsError{Kind: ErrLambdaUnavailable, RoleARN: roleARN, Message: "no response from Lambda"}
+	}
+	if response.Success {
+		return nil
+	}
+
+	err := &CredentialsError{
+		Kind:       ErrLambdaUnavailable,
+		RoleARN:    roleARN,
+		RequestID:  response.RequestID,
+		StatusCode: response.StatusCode,
+		Message:    response.Error,
+	}
+	if response.Timeout {
+		err.Kind = ErrTimeout
+		return err
+	}
+	if response.StatusCode >= 400 && response.StatusCode < 500 &&
+		response.StatusCode != http.StatusRequestTimeout && response.StatusCode != http.StatusTooManyRequests {
+		err.Kind = ErrLambdaRejected
+		return terminal(err)
+	}
+	return err
+}
+
+// requestCredentialsWithRetry retries retryable failures with jittered
+// exponential backoff, until ctx is done. Retrieve passes the shared
+// refresh's own context, so the backoff outlives any one caller.
+func (p *AWSCredentialsProvider) requestCredentialsWithRetry(ctx context.Context) (aws.Credentials, error) {
+	for attempt := 1; ; attempt++ {
+		credentials, err := p.requestCredentials(ctx)
+		if err == nil {
+			return credentials, nil
+		}
+		if !isRetryable(err) {
+			return aws.Credentials{}, err
+		}
+		if attempt >= p.maxAttempts {
+			if p.maxAttempts > 1 {
+				return aws.Credentials{}, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return aws.Credentials{}, err
+		}
+
+		delay := p.retryDelay(attempt)
+		log.Printf("Retrieving AWS credentials failed (attempt %d of %d), retrying in %s: %v", attempt, p.maxAttempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return aws.Credentials{}, fmt.Errorf("giving up after %d attempts: %w: %w", attempt, ctx.Err(), err)
+		}
+	}
+}
+
+// retryDelay returns the "full jitter" backoff before the next attempt: a
+// random delay up to the base delay doubled per attempt, capped at the maximum
+func (p *AWSCredentialsProvider) retryDelay(attempt int) time.Duration {
+	return backoffDelay(attempt, p.retryBaseDelay, p.retryMaxDelay)
+}
+
+// backoffDelay returns a random delay up to baseDelay doubled per attempt,
+// capped at maxDelay
+func backoffDelay(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	ceiling := maxDelay
+	if shift := attempt - 1; shift < 32 {
+		if d := baseDelay << shift; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
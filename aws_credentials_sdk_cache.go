@@ -0,0 +1,96 @@
+package post2post
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// The provider tunes aws.CredentialsCache when wrapped in it
+var (
+	_ aws.AdjustExpiresByCredentialsCacheStrategy   = (*AWSCredentialsProvider)(nil)
+	_ aws.HandleFailRefreshCredentialsCacheStrategy = (*AWSCredentialsProvider)(nil)
+)
+
+// AdjustExpiresBy implements aws.AdjustExpiresByCredentialsCacheStrategy.
+// aws.CredentialsCache calls it with its jittered expiry window. The window
+// is never allowed to take more than half of the remaining lifetime, so short
+// lived credentials are not refreshed on every call, and the provider's own
+// cache refreshes ahead of the largest window seen so the SDK cache is not
+// handed the same credentials again.
+func (p *AWSCredentialsProvider) AdjustExpiresBy(creds aws.Credentials, dur time.Duration) (aws.Credentials, error) {
+	if !creds.CanExpire {
+		return creds, nil
+	}
+
+	if dur < 0 {
+		p.mu.Lock()
+		if -dur > p.sdkExpiryWindow {
+			p.sdkExpiryWindow = -dur
+			if p.credentials != nil {
+				p.expiry = p.credentials.Expires.Add(-p.refreshBuffer())
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	now := time.Now()
+	remaining := creds.Expires.Sub(now)
+	if remaining <= 0 {
+		// Stale credentials served after a failed refresh; retry the refresh
+		// after the retry backoff rather than on every call
+		creds.Expires = now.Add(p.retryMaxDelay)
+		return creds, nil
+	}
+
+	adjusted := creds.Expires.Add(dur)
+	if earliest := now.Add(remaining / 2); adjusted.Before(earliest) {
+		adjusted = earliest
+	}
+	creds.Expires = adjusted
+	return creds, nil
+}
+
+// HandleFailToRefresh implements aws.HandleFailRefreshCredentialsCacheStrategy.
+// When a refresh fails, aws.CredentialsCache keeps serving the previous
+// credentials while they are still valid and retries after the retry backoff
+// instead of failing every caller.
+func (p *AWSCredentialsProvider) HandleFailToRefresh(ctx context.Context, prev aws.Credentials, err error) (aws.Credentials, error) {
+	if !prev.HasKeys() || !prev.CanExpire {
+		return aws.Credentials{}, err
+	}
+
+	// prev.Expires was moved forward by the cache; use the real expiry
+	p.mu.RLock()
+	cached := p.credentials
+	p.mu.RUnlock()
+	if cached == nil || cached.AccessKeyID != prev.AccessKeyID {
+		return aws.Credentials{}, err
+	}
+
+	now := time.Now()
+	if !now.Before(cached.Expires) {
+		return aws.Credentials{}, err
+	}
+	retryAt := now.Add(p.retryMaxDelay)
+	if retryAt.After(cached.Expires) {
+		retryAt = cached.Expires
+	}
+
+	log.Printf("WARNING: Failed to refresh AWS credentials, keeping the cached credentials until %s: %v", retryAt.Format(time.RFC3339), err)
+	creds := *cached
+	creds.Expires = retryAt
+	return creds, nil
+}
+
+// refreshBuffer is how long before expiry cached credentials are refreshed:
+// the expiry buffer, or the wrapping SDK cache's window if larger. The caller
+// holds p.mu.
+func (p *AWSCredentialsProvider) refreshBuffer() time.Duration {
+	if p.sdkExpiryWindow > p.expiryBuffer {
+		return p.sdkExpiryWindow
+	}
+	return p.expiryBuffer
+}
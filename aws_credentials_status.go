@@ -0,0 +1,72 @@
+package post2post
+
+import (
+	"sort"
+	"time"
+)
+
+// CredentialsStatus is a snapshot of a provider's cached credentials
+type CredentialsStatus struct {
+	RoleARN string
+	// Cached reports whether credentials are held in memory; the fields
+	// below describe them only when it is set
+	Cached      bool
+	AccessKeyID string
+	Expires     time.Time
+	// RefreshIn is the time until Retrieve fetches new credentials, zero or
+	// negative when a refresh is due
+	RefreshIn time.Duration
+
+	// LastRefresh is when the last refresh through the Lambda finished, zero
+	// if there was none
+	LastRefresh time.Time
+	// LastRefreshError is the error of the last refresh, nil if it succeeded
+	LastRefreshError error
+}
+
+// Peek returns the state of the cached credentials without fetching, e.g.
+// for health endpoints and debugging
+func (p *AWSCredentialsProvider) Peek() CredentialsStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status := CredentialsStatus{
+		RoleARN:          p.roleARN,
+		LastRefresh:      p.lastRefresh,
+		LastRefreshError: p.lastRefreshErr,
+	}
+	if p.credentials != nil {
+		status.Cached = true
+		status.AccessKeyID = p.credentials.AccessKeyID
+		status.Expires = p.credentials.Expires
+		status.RefreshIn = time.Until(p.expiry)
+	}
+	return status
+}
+
+// Peek returns the state of the cached credentials of every role requested
+// so far, ordered by role ARN
+func (m *MultiRoleCredentialsProvider) Peek() []CredentialsStatus {
+	m.mu.Lock()
+	providers := make([]*AWSCredentialsProvider, 0, len(m.providers))
+	for _, provider := range m.providers {
+		providers = append(providers, provider)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]CredentialsStatus, 0, len(providers))
+	for _, provider := range providers {
+		statuses = append(statuses, provider.Peek())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].RoleARN < statuses[j].RoleARN })
+	return statuses
+}
+
+// recordRefresh records the outcome of a refresh through the Lambda for Peek
+func (p *AWSCredentialsProvider) recordRefresh(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastRefresh = time.Now()
+	p.lastRefreshErr = err
+}
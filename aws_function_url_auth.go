@@ -0,0 +1,144 @@
+package post2post
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// functionURLHostPattern matches Lambda Function URL hosts and captures the
+// region
+var functionURLHostPattern = regexp.MustCompile(`^[a-z0-9]+\.lambda-url\.([a-z0-9-]+)\.on\.aws$`)
+
+// sigV4Signer signs posts with SigV4 for Function URLs with AWS_IAM auth
+type sigV4Signer struct {
+	service string
+	region  string // Used when the region cannot be read from the URL
+	signer  *v4.Signer
+
+	// Bootstrap credentials; the SDK's default chain is loaded on first use
+	// when none are given, and again after a failed load
+	credentialsMu sync.Mutex
+	credentials   aws.CredentialsProvider
+	// loadConfig loads the default chain, config.LoadDefaultConfig but in
+	// tests
+	loadConfig func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error)
+}
+
+// newSigV4Signer creates a signer for service; credentials may be nil
+func newSigV4Signer(credentials aws.CredentialsProvider, service, region string) *sigV4Signer {
+	if credentials != nil {
+		if _, ok := credentials.(*aws.CredentialsCache); !ok {
+			credentials = aws.NewCredentialsCache(credentials)
+		}
+	}
+	return &sigV4Signer{
+		service:     service,
+		region:      region,
+		signer:      v4.NewSigner(),
+		credentials: credentials,
+		loadConfig:  config.LoadDefaultConfig,
+	}
+}
+
+// WithSigV4Signing signs every post with SigV4 for service, e.g. "lambda"
+// for Function URLs with AWS_IAM auth. credentials are the caller's own,
+// e.g. an instance role; nil uses the SDK's default credential chain.
+// region is used when it cannot be read from a Function URL host.
+func (s *Server) WithSigV4Signing(credentials aws.CredentialsProvider, service, region string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signing.sigV4 = newSigV4Signer(credentials, service, region)
+	return s
+}
+
+// sign adds the SigV4 headers to req for body
+func (s *sigV4Signer) sign(req *http.Request, body []byte) error {
+	ctx := req.Context()
+	provider, err := s.credentialsProvider(ctx)
+	if err != nil {
+		return err
+	}
+	credentials, err := provider.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve signing credentials: %w", err)
+	}
+
+	region := functionURLRegion(req.URL)
+	if region == "" {
+		region = s.region
+	}
+	if region == "" {
+		return fmt.Errorf("cannot determine the signing region of %s", req.URL.Host)
+	}
+
+	// Function URLs require the payload hash header for POST requests
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	return s.signer.SignHTTP(ctx, credentials, req, payloadHash, s.service, region, time.Now())
+}
+
+// credentialsProvider returns the configured credentials or the default
+// chain. The chain is loaded detached from ctx, and only a successful load
+// is kept, so one cancelled post or transient failure does not break
+// signing for later ones.
+func (s *sigV4Signer) credentialsProvider(ctx context.Context) (aws.CredentialsProvider, error) {
+	s.credentialsMu.Lock()
+	defer s.credentialsMu.Unlock()
+
+	if s.credentials != nil {
+		return s.credentials, nil
+	}
+	cfg, err := s.loadConfig(context.WithoutCancel(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default AWS config for SigV4 signing: %w", err)
+	}
+	s.credentials = cfg.Credentials
+	return s.credentials, nil
+}
+
+// functionURLRegion returns the region of a Lambda Function URL, "" for
+// other URLs
+func functionURLRegion(u *url.URL) string {
+	match := functionURLHostPattern.FindStringSubmatch(u.Hostname())
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// validateIAMAuthConfig checks that the signing region of every Lambda URL
+// is known when IAM auth is enabled
+func validateIAMAuthConfig(config *AWSCredentialsProviderConfig) error {
+	if !config.IAMAuth {
+		if config.IAMAuthCredentials != nil || config.IAMAuthRegion != "" {
+			return fmt.Errorf("IAM auth credentials and region require IAMAuth")
+		}
+		return nil
+	}
+	if config.IAMAuthRegion != "" && !stsRegionPattern.MatchString(config.IAMAuthRegion) {
+		return fmt.Errorf("invalid IAM auth region %q", config.IAMAuthRegion)
+	}
+	for _, lambdaURL := range append([]string{config.LambdaURL}, config.LambdaURLs...) {
+		u, err := url.Parse(lambdaURL)
+		if err != nil {
+			return fmt.Errorf("invalid lambda URL: %w", err)
+		}
+		if functionURLRegion(u) == "" && config.IAMAuthRegion == "" {
+			return fmt.Errorf("cannot determine the region of %s for IAM auth; set IAMAuthRegion", lambdaURL)
+		}
+	}
+	return nil
+}
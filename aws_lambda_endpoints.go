@@ -0,0 +1,134 @@
+package post2post
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Endpoint health defaults
+const (
+	defaultUnhealthyThreshold = 3
+	defaultUnhealthyCooldown  = 30 * time.Second
+)
+
+// LambdaEndpointHealth is a snapshot of one Lambda endpoint's health
+type LambdaEndpointHealth struct {
+	URL                 string
+	Healthy             bool
+	ConsecutiveFailures int
+	// UnhealthyUntil is when an unhealthy endpoint is preferred again
+	UnhealthyUntil time.Time
+}
+
+// lambdaEndpoint tracks the health of one Lambda Function URL
+type lambdaEndpoint struct {
+	url            string
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// lambdaEndpoints orders Lambda endpoints for failover: healthy endpoints in
+// configured order, then endpoints that failed repeatedly, soonest to
+// recover first
+type lambdaEndpoints struct {
+	mu        sync.Mutex
+	endpoints []*lambdaEndpoint
+	threshold int
+	cooldown  time.Duration
+}
+
+// newLambdaEndpoints tracks urls, skipping duplicates
+func newLambdaEndpoints(urls []string, threshold int, cooldown time.Duration) *lambdaEndpoints {
+	e := &lambdaEndpoints{threshold: threshold, cooldown: cooldown}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		e.endpoints = append(e.endpoints, &lambdaEndpoint{url: url})
+	}
+	return e
+}
+
+// order returns the endpoint URLs in the order they should be tried
+func (e *lambdaEndpoints) order() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	var healthy, unhealthy []*lambdaEndpoint
+	for _, endpoint := range e.endpoints {
+		if now.Before(endpoint.unhealthyUntil) {
+			unhealthy = append(unhealthy, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].unhealthyUntil.Before(unhealthy[j].unhealthyUntil)
+	})
+
+	urls := make([]string, 0, len(e.endpoints))
+	for _, endpoint := range append(healthy, unhealthy...) {
+		urls = append(urls, endpoint.url)
+	}
+	return urls
+}
+
+// report records the outcome of a request to url. Only timeouts and
+// unavailability count against an endpoint; any answer from the Lambda, even
+// a rejection, shows it is healthy.
+func (e *lambdaEndpoints) report(url string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, endpoint := range e.endpoints {
+		if endpoint.url != url {
+			continue
+		}
+		if err == nil || !(errors.Is(err, ErrTimeout) || errors.Is(err, ErrLambdaUnavailable)) {
+			endpoint.failures = 0
+			endpoint.unhealthyUntil = time.Time{}
+			return
+		}
+		endpoint.failures++
+		if endpoint.failures >= e.threshold {
+			endpoint.unhealthyUntil = time.Now().Add(e.cooldown)
+			log.Printf("Lambda endpoint %s marked unhealthy after %d consecutive failures", url, endpoint.failures)
+		}
+		return
+	}
+}
+
+// health returns a snapshot of every endpoint in configured order
+func (e *lambdaEndpoints) health() []LambdaEndpointHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	health := make([]LambdaEndpointHealth, 0, len(e.endpoints))
+	for _, endpoint := range e.endpoints {
+		health = append(health, LambdaEndpointHealth{
+			URL:                 endpoint.url,
+			Healthy:             !now.Before(endpoint.unhealthyUntil),
+			ConsecutiveFailures: endpoint.failures,
+			UnhealthyUntil:      endpoint.unhealthyUntil,
+		})
+	}
+	return health
+}
+
+// GetLambdaEndpoints returns the health of each configured Lambda endpoint
+func (p *AWSCredentialsProvider) GetLambdaEndpoints() []LambdaEndpointHealth {
+	return p.endpoints.health()
+}
+
+// GetLambdaEndpoints returns the health of each configured Lambda endpoint,
+// shared by all roles
+func (m *MultiRoleCredentialsProvider) GetLambdaEndpoints() []LambdaEndpointHealth {
+	return m.endpoints.health()
+}
@@ -0,0 +1,75 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// synchronousClient posts synchronous requests, which the Lambda answers in
+// its response body. Requests are bounded by their context.
+var synchronousClient = &http.Client{}
+
+// maxSynchronousResponseSize bounds the Lambda response read in synchronous
+// mode
+const maxSynchronousResponseSize = 1 << 20
+
+// postSynchronous sends request to the Lambda at lambdaURL and returns the
+// result from the response body as a round trip response, so it is checked
+// like a callback. It needs no post2post server or reachable callback URL.
+// The request is signed with signing, and bounded by ctx.
+func postSynchronous(ctx context.Context, lambdaURL string, request LambdaAssumeRoleRequest, signing requestSigning) (*RoundTripResponse, error) {
+	body, err := json.Marshal(PostData{Payload: request, RequestID: request.RequestID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	log.Printf("Sending synchronous request to %s with RequestID: %s", lambdaURL, request.RequestID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lambdaURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signing.sign(req, body); err != nil {
+		return FailedResponse(request.RequestID, err), nil
+	}
+
+	resp, err := synchronousClient.Do(req)
+	if err != nil {
+		response := failedResponsef(request.RequestID, "failed to post JSON: %w", err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			response.Timeout = true
+			response.Err = fmt.Errorf("%w: %w", ErrRoundTripTimeout, response.Err)
+		}
+		return response, nil
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSynchronousResponseSize))
+	if err != nil {
+		return failedResponsef(request.RequestID, "failed to read response: %w", err), nil
+	}
+	if resp.StatusCode >= 400 {
+		var err error = &PostStatusError{StatusCode: resp.StatusCode}
+		var rejected struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &rejected) == nil && rejected.Error != "" {
+			err = fmt.Errorf("%w: %w", err, &ReceiverError{Message: rejected.Error})
+		}
+		return FailedResponse(request.RequestID, err), nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, terminal(fmt.Errorf("failed to parse synchronous Lambda response: %w", err))
+	}
+	return &RoundTripResponse{Payload: payload, Success: true, RequestID: request.RequestID}, nil
+}
@@ -0,0 +1,116 @@
+package post2post
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAWSCredentialsProvider_Synchronous(t *testing.T) {
+	lambda := newFakeCredentialsLambda(t)
+
+	provider, err := NewAWSCredentialsProviderWithOptions(
+		WithLambdaURL(lambda.URL),
+		WithRoleARN("arn:aws:iam::123456789012:role/remote/TestRole"),
+		WithSynchronous(),
+	)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	defer provider.Close()
+
+	creds, err := provider.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() failed: %v", err)
+	}
+	if creds.AccessKeyID != "AKIATEST123456789" || !creds.CanExpire {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	request := lambda.LastRequest()
+	if !request.Synchronous || request.URL != "" || request.TailnetKey != "" {
+		t.Errorf("expected a synchronous request without callback URL or tailnet key, got %+v", request)
+	}
+	if provider.server.IsRunning() {
+		t.Error("expected no callback server in synchronous mode")
+	}
+}
+
+func TestAWSCredentialsProvider_SynchronousDenied(t *testing.T) {
+	lambda := newFakeCredentialsLambda(t)
+	lambda.Deny("AccessDenied")
+
+	provider, err := NewAWSCredentialsProvider(AWSCredentialsProviderConfig{
+		LambdaURL:   lambda.URL,
+		RoleARN:     "arn:aws:iam::123456789012:role/remote/TestRole",
+		Synchronous: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	defer provider.Close()
+
+	_, err = provider.Retrieve(context.Background())
+	var credsErr *CredentialsError
+	if !errors.Is(err, ErrAssumeRoleDenied) || !errors.As(err, &credsErr) || credsErr.Code != "AccessDenied" {
+		t.Errorf("expected a denied CredentialsError, got %v", err)
+	}
+	if lambda.Calls() != 1 {
+		t.Errorf("expected denial not to be retried, got %d calls", lambda.Calls())
+	}
+}
+
+func TestAWSCredentialsProvider_SynchronousDisabled(t *testing.T) {
+	// A Lambda with the default RESPONSE_MODE rejects synchronous requests
+	lambda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "synchronous responses are disabled, see RESPONSE_MODE"}`))
+	}))
+	defer lambda.Close()
+
+	provider, err := NewAWSCredentialsProvider(AWSCredentialsProviderConfig{
+		LambdaURL:   lambda.URL,
+		RoleARN:     "arn:aws:iam::123456789012:role/remote/TestRole",
+		Synchronous: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	defer provider.Close()
+
+	_, err = provider.Retrieve(context.Background())
+	if !errors.Is(err, ErrLambdaRejected) || !strings.Contains(err.Error(), "RESPONSE_MODE") {
+		t.Errorf("expected a rejected CredentialsError naming RESPONSE_MODE, got %v", err)
+	}
+}
+
+func TestPostSynchronous_Context(t *testing.T) {
+	// A Lambda that never answers
+	release := make(chan struct{})
+	lambda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer lambda.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	response, err := postSynchronous(ctx, lambda.URL, LambdaAssumeRoleRequest{RequestID: "req-1"}, requestSigning{})
+	if err != nil {
+		t.Fatalf("postSynchronous() failed: %v", err)
+	}
+	if response.Success || !response.Timeout || !errors.Is(response.Err, ErrRoundTripTimeout) {
+		t.Errorf("postSynchronous() = %+v, want a timeout", response)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("postSynchronous() took %s, want it to stop at the context deadline", elapsed)
+	}
+}
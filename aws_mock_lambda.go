@@ -0,0 +1,238 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// Mock Lambda credential defaults
+const (
+	mockAccessKeyID     = "AKIAMOCKLAMBDA000000"
+	mockSecretAccessKey = "mock-secret-access-key"
+	mockSessionToken    = "mock-session-token"
+)
+
+// MockLambdaConfig holds configuration for MockLambda
+type MockLambdaConfig struct {
+	Lifetime        time.Duration // Lifetime of issued credentials (optional, default 1 hour)
+	Delay           time.Duration // Delay before the credentials are posted back (optional)
+	AccessKeyID     string        // Issued access key ID (optional, default a fixed test value)
+	SecretAccessKey string        // Issued secret access key (optional, default a fixed test value)
+	SessionToken    string        // Issued session token (optional, default a fixed test value)
+}
+
+// MockLambda is a stand-in for the credentials Lambda for tests of code that
+// uses an AWSCredentialsProvider, without AWS or Tailscale. It records each
+// assume role request and posts AssumeRole-shaped credentials back to the
+// callback URL. Point the provider's LambdaURL at its URL; with the default
+// Tailscale fallback the provider then works over plain HTTP on localhost.
+//
+//	lambda := post2post.NewMockLambda(post2post.MockLambdaConfig{})
+//	defer lambda.Close()
+//	provider, err := post2post.NewAWSCredentialsProvider(post2post.AWSCredentialsProviderConfig{
+//		LambdaURL:  lambda.URL,
+//		RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+//		TailnetKey: "tskey-auth-test",
+//	})
+type MockLambda struct {
+	*httptest.Server
+
+	calls int32
+
+	mu       sync.Mutex
+	config   MockLambdaConfig
+	requests []LambdaAssumeRoleRequest
+	// The next failures requests are rejected with failStatus
+	failures   int
+	failStatus int
+	// When set, role assumption fails with this STS error code
+	denyCode string
+}
+
+// NewMockLambda starts a mock Lambda on a local port; call Close when done
+func NewMockLambda(config MockLambdaConfig) *MockLambda {
+	if config.Lifetime == 0 {
+		config.Lifetime = time.Hour
+	}
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = mockAccessKeyID
+	}
+	if config.SecretAccessKey == "" {
+		config.SecretAccessKey = mockSecretAccessKey
+	}
+	if config.SessionToken == "" {
+		config.SessionToken = mockSessionToken
+	}
+
+	lambda := &MockLambda{config: config}
+	lambda.Server = httptest.NewServer(http.HandlerFunc(lambda.handle))
+	return lambda
+}
+
+// Calls returns the number of requests received, including rejected ones
+func (l *MockLambda) Calls() int {
+	return int(atomic.LoadInt32(&l.calls))
+}
+
+// Requests returns the assume role requests received, oldest first
+func (l *MockLambda) Requests() []LambdaAssumeRoleRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]LambdaAssumeRoleRequest(nil), l.requests...)
+}
+
+// LastRequest returns the most recent assume role request, or a zero request
+// if none was received
+func (l *MockLambda) LastRequest() LambdaAssumeRoleRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.requests) == 0 {
+		return LambdaAssumeRoleRequest{}
+	}
+	return l.requests[len(l.requests)-1]
+}
+
+// FailNext rejects the next n requests with the HTTP status code status,
+// e.g. http.StatusServiceUnavailable
+func (l *MockLambda) FailNext(n, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failures = n
+	l.failStatus = status
+}
+
+// Deny makes role assumption fail with the STS error code code, e.g.
+// "AccessDenied"; "" issues credentials again
+func (l *MockLambda) Deny(code string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.denyCode = code
+}
+
+// SetDelay sets the delay before credentials are posted back
+func (l *MockLambda) SetDelay(delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config.Delay = delay
+}
+
+// SetLifetime sets the lifetime of credentials issued from now on
+func (l *MockLambda) SetLifetime(lifetime time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config.Lifetime = lifetime
+}
+
+// handle acknowledges a request and posts the result to its callback URL,
+// or returns it in the response for synchronous requests, as the real Lambda
+// does
+func (l *MockLambda) handle(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&l.calls, 1)
+
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		status := l.failStatus
+		l.mu.Unlock()
+		w.WriteHeader(status)
+		return
+	}
+	l.mu.Unlock()
+
+	var data struct {
+		URL       string                  `json:"url"`
+		RequestID string                  `json:"request_id"`
+		Payload   LambdaAssumeRoleRequest `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	l.mu.Lock()
+	l.requests = append(l.requests, data.Payload)
+	config, denyCode := l.config, l.denyCode
+	l.mu.Unlock()
+
+	if data.Payload.Synchronous {
+		time.Sleep(config.Delay)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockPayload(config, denyCode, data.Payload))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	go func() {
+		time.Sleep(config.Delay)
+
+		body, err := json.Marshal(map[string]interface{}{
+			"request_id": data.RequestID,
+			"payload":    mockPayload(config, denyCode, data.Payload),
+		})
+		if err != nil {
+			log.Printf("Mock Lambda failed to encode response: %v", err)
+			return
+		}
+		resp, err := http.Post(data.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Mock Lambda failed to post response: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// mockPayload returns the processed payload for request: credentials,
+// encrypted if the request has a public key, or the denyCode error when set
+func mockPayload(config MockLambdaConfig, denyCode string, request LambdaAssumeRoleRequest) LambdaProcessedPayload {
+	payload := LambdaProcessedPayload{
+		Status:          "success",
+		LambdaRequestID: "mock-lambda-request",
+	}
+	if denyCode != "" {
+		payload.Status = "error"
+		payload.Error = "Failed to assume role: " + denyCode
+		payload.ErrorCode = denyCode
+		return payload
+	}
+
+	expiration := time.Now().Add(config.Lifetime)
+	payload.AssumeRoleResult = LambdaAssumeRoleResult{
+		Credentials: &types.Credentials{
+			AccessKeyId:     &config.AccessKeyID,
+			SecretAccessKey: &config.SecretAccessKey,
+			SessionToken:    &config.SessionToken,
+			Expiration:      &expiration,
+		},
+		AssumedRoleUser: &types.AssumedRoleUser{
+			Arn:           aws.String(request.RoleARN + "/mock-session"),
+			AssumedRoleId: aws.String("AROAMOCKLAMBDA:mock-session"),
+		},
+		Region: request.Region,
+	}
+	if request.CredentialsPublicKey != "" {
+		encrypted, err := encryptCredentials(request.CredentialsPublicKey, request.RequestID, payload.AssumeRoleResult.Credentials)
+		if err != nil {
+			return LambdaProcessedPayload{Status: "error", Error: err.Error(), LambdaRequestID: payload.LambdaRequestID}
+		}
+		payload.AssumeRoleResult.Credentials = nil
+		payload.AssumeRoleResult.EncryptedCredentials = encrypted
+	}
+	return payload
+}
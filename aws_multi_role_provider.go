@@ -0,0 +1,170 @@
+package post2post
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// MultiRoleCredentialsProvider serves credentials for several IAM roles over a
+// single post2post server and tailnet connection. Each role gets its own
+// AWSCredentialsProvider with a separate credential cache.
+type MultiRoleCredentialsProvider struct {
+	server    *Server
+	config    AWSCredentialsProviderConfig
+	endpoints *lambdaEndpoints
+
+	// Per-role providers, keyed by role ARN
+	mu        sync.Mutex
+	providers map[string]*AWSCredentialsProvider
+	store     CredentialsCacheStore
+
+	// The shared server is started on first use
+	startMu sync.Mutex
+	started bool
+}
+
+// NewMultiRoleCredentialsProvider creates a provider that assumes any role
+// passed to ForRole or Retrieve. config applies to every role; its RoleARN is
+// ignored.
+func NewMultiRoleCredentialsProvider(config AWSCredentialsProviderConfig) (*MultiRoleCredentialsProvider, error) {
+	config.RoleARN = ""
+	if err := normalizeProviderConfig(&config); err != nil {
+		return nil, err
+	}
+
+	// Create the shared post2post server; it is started by Start or the
+	// first Retrieve of any role
+	server := NewServer().
+		WithPostURL(config.LambdaURL).
+		WithFallbackPolicy(config.Fallback).
+		WithRequestSigning(config.SigningKeyID, config.SigningKey)
+	if config.IAMAuth {
+		server.WithSigV4Signing(config.IAMAuthCredentials, "lambda", config.IAMAuthRegion)
+	}
+	server.WithResponseQueue(config.ResponseQueueURL, config.ResponseQueueClient)
+
+	log.Printf("Multi-role AWS Credentials Provider initialized with Lambda URL: %s", config.LambdaURL)
+
+	return &MultiRoleCredentialsProvider{
+		server:    server,
+		config:    config,
+		endpoints: newLambdaEndpoints(append([]string{config.LambdaURL}, config.LambdaURLs...), config.UnhealthyThreshold, config.UnhealthyCooldown),
+		providers: make(map[string]*AWSCredentialsProvider),
+	}, nil
+}
+
+// ForRole returns the credentials provider for roleARN, creating it on first
+// use. The returned provider shares this provider's server; closing it is a
+// no-op.
+func (m *MultiRoleCredentialsProvider) ForRole(roleARN string) (*AWSCredentialsProvider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if provider, ok := m.providers[roleARN]; ok {
+		return provider, nil
+	}
+
+	config := m.config
+	config.RoleARN = roleARN
+	provider, err := newAWSCredentialsProvider(config, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.store != nil {
+		provider.WithCredentialsCache(m.store)
+	}
+
+	m.providers[roleARN] = provider
+	return provider, nil
+}
+
+// WithDiskCache persists every role's credentials in dir; see
+// AWSCredentialsProvider.WithDiskCache. It applies to roles requested after
+// the call.
+func (m *MultiRoleCredentialsProvider) WithDiskCache(dir string) *MultiRoleCredentialsProvider {
+	return m.WithCredentialsCache(&fileCacheStore{dir: dir})
+}
+
+// WithCredentialsCache persists every role's credentials in store. It
+// applies to roles requested after the call.
+func (m *MultiRoleCredentialsProvider) WithCredentialsCache(store CredentialsCacheStore) *MultiRoleCredentialsProvider {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store = store
+	return m
+}
+
+// Retrieve returns credentials for roleARN, using that role's cache
+func (m *MultiRoleCredentialsProvider) Retrieve(ctx context.Context, roleARN string) (aws.Credentials, error) {
+	provider, err := m.ForRole(roleARN)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	return provider.Retrieve(ctx)
+}
+
+// Start starts the shared post2post server. It is called by the first
+// Retrieve; call it explicitly to surface startup errors early.
+func (m *MultiRoleCredentialsProvider) Start(ctx context.Context) error {
+	if m.config.Synchronous {
+		return nil
+	}
+
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
+
+	if m.started {
+		return nil
+	}
+	if err := startCredentialsServer(ctx, m.server, m.config.TailnetKey); err != nil {
+		return err
+	}
+
+	m.started = true
+	return nil
+}
+
+// Close stops the shared post2post server, if it was started
+func (m *MultiRoleCredentialsProvider) Close() error {
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
+
+	if !m.started {
+		return nil
+	}
+	m.started = false
+	return m.server.Stop()
+}
+
+// GetRoleARNs returns the roles credentials have been requested for
+func (m *MultiRoleCredentialsProvider) GetRoleARNs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles := make([]string, 0, len(m.providers))
+	for roleARN := range m.providers {
+		roles = append(roles, roleARN)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// InvalidateCache clears the cached credentials of every role
+func (m *MultiRoleCredentialsProvider) InvalidateCache() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, provider := range m.providers {
+		provider.InvalidateCache()
+	}
+}
+
+// GetLambdaURL returns the configured Lambda URL
+func (m *MultiRoleCredentialsProvider) GetLambdaURL() string {
+	return m.config.LambdaURL
+}
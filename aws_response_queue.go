@@ -0,0 +1,221 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Response queue polling defaults
+const (
+	responseQueueWaitSeconds = 20
+	responseQueueRetryDelay  = 5 * time.Second
+)
+
+// ResponseQueueClient is the part of the SQS API the response queue consumer
+// uses; *sqs.Client implements it
+type ResponseQueueClient interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// responseQueue consumes round trip responses from an SQS queue
+type responseQueue struct {
+	url string
+
+	// Long poll wait and the pause after a failed receive
+	waitSeconds int32
+	retryDelay  time.Duration
+
+	// The SDK's default client is created on first use when none is given
+	clientOnce sync.Once
+	client     ResponseQueueClient
+	clientErr  error
+
+	// Stops the consumer of the running server
+	cancel context.CancelFunc
+}
+
+// WithResponseQueue completes round trips from responses delivered to the
+// SQS queue at queueURL, e.g. by a Lambda asked for queue delivery, as well
+// as from posts to /roundtrip. Neither the receiver nor the queue needs to
+// reach this server. A response with an "error" field fails its round trip.
+// Every message is deleted once read, so the queue should be dedicated to
+// this server, unless instances sharing it also share WithCallbackRelay:
+// responses no local round trip is waiting for are then forwarded through
+// the relay. client may be nil to use an SQS client from the SDK's default
+// config.
+func (s *Server) WithResponseQueue(queueURL string, client ResponseQueueClient) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if queueURL == "" {
+		s.responseQueue = nil
+		return s
+	}
+	s.responseQueue = &responseQueue{
+		url:         queueURL,
+		waitSeconds: responseQueueWaitSeconds,
+		retryDelay:  responseQueueRetryDelay,
+		client:      client,
+	}
+	return s
+}
+
+// GetResponseQueueURL returns the response queue URL, "" if none
+func (s *Server) GetResponseQueueURL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.responseQueue == nil {
+		return ""
+	}
+	return s.responseQueue.url
+}
+
+// startResponseQueue starts the response queue consumer if a queue is
+// configured. Must be called with s.mu held.
+func (s *Server) startResponseQueue() {
+	queue := s.responseQueue
+	if queue == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.cancel = cancel
+	log.Printf("Consuming round trip responses from queue: %s", queue.url)
+	go s.consumeResponseQueue(ctx, queue)
+}
+
+// stopResponseQueue stops the response queue consumer, if running. Must be
+// called with s.mu held.
+func (s *Server) stopResponseQueue() {
+	if s.responseQueue != nil && s.responseQueue.cancel != nil {
+		s.responseQueue.cancel()
+		s.responseQueue.cancel = nil
+	}
+}
+
+// consumeResponseQueue long-polls the queue until ctx is done
+func (s *Server) consumeResponseQueue(ctx context.Context, queue *responseQueue) {
+	for ctx.Err() == nil {
+		client, err := queue.sqsClient(ctx)
+		if err != nil {
+			log.Printf("Response queue %s unavailable: %v", queue.url, err)
+			return
+		}
+
+		output, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queue.url),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     queue.waitSeconds,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to receive from response queue %s: %v", queue.url, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(queue.retryDelay):
+			}
+			continue
+		}
+
+		for _, message := range output.Messages {
+			s.handleQueuedResponse(ctx, queue, client, message)
+		}
+	}
+}
+
+// handleQueuedResponse completes the round trip message answers and deletes
+// the message
+func (s *Server) handleQueuedResponse(ctx context.Context, queue *responseQueue, client ResponseQueueClient, message types.Message) {
+	var callback CallbackMessage
+	body := unwrapSNSNotification(aws.ToString(message.Body))
+	if err := json.Unmarshal([]byte(body), &callback); err != nil || callback.RequestID == "" {
+		log.Printf("Discarding message %s from response queue: not a round trip response", aws.ToString(message.MessageId))
+	} else if err := s.completeRoundTrip(callback.RoundTripResponse()); err != nil {
+		// Another instance sharing the queue may be waiting for it; late
+		// responses to timed out round trips end up here too
+		if err == errUnknownRoundTrip && s.forwardCallback(ctx, callback.RequestID, []byte(body)) {
+			log.Printf("Relayed queued response for RequestID %s", callback.RequestID)
+		} else {
+			log.Printf("Discarding queued response for RequestID %s: %v", callback.RequestID, err)
+		}
+	}
+
+	// Responses are only of use to the round trip waiting for them, and may
+	// hold credentials, so none are left in the queue
+	if _, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queue.url),
+		ReceiptHandle: message.ReceiptHandle,
+	}); err != nil {
+		log.Printf("Failed to delete message %s from response queue: %v", aws.ToString(message.MessageId), err)
+	}
+}
+
+// sqsClient returns the configured client or one from the SDK's default
+// config
+func (q *responseQueue) sqsClient(ctx context.Context) (ResponseQueueClient, error) {
+	q.clientOnce.Do(func() {
+		if q.client != nil {
+			return
+		}
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			q.clientErr = fmt.Errorf("failed to load default AWS config for the response queue: %w", err)
+			return
+		}
+		q.client = sqs.NewFromConfig(cfg)
+	})
+	return q.client, q.clientErr
+}
+
+// unwrapSNSNotification returns the message of an SNS notification, for
+// queues subscribed to a response topic without raw message delivery, or
+// body unchanged
+func unwrapSNSNotification(body string) string {
+	var notification struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" && notification.Message != "" {
+		return notification.Message
+	}
+	return body
+}
+
+// validateResponseQueueConfig checks the queued delivery settings of a
+// provider config
+func validateResponseQueueConfig(config *AWSCredentialsProviderConfig) error {
+	if config.ResponseQueueURL == "" {
+		if config.ResponseTopicARN != "" {
+			return fmt.Errorf("response topic requires a response queue subscribed to it")
+		}
+		return nil
+	}
+	if config.Synchronous {
+		return fmt.Errorf("synchronous and queued responses are mutually exclusive")
+	}
+	if err := validateReceiverURL("response queue", config.ResponseQueueURL); err != nil {
+		return err
+	}
+	if config.ResponseTopicARN != "" {
+		topic, err := arn.Parse(config.ResponseTopicARN)
+		if err != nil || topic.Service != "sns" {
+			return fmt.Errorf("invalid response topic ARN %q", config.ResponseTopicARN)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const testResponseQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/post2post-responses"
+
+// fakeResponseQueue is an in-memory SQS queue
+type fakeResponseQueue struct {
+	messages chan types.Message
+
+	mu      sync.Mutex
+	seq     int
+	deleted []string
+}
+
+func newFakeResponseQueue() *fakeResponseQueue {
+	return &fakeResponseQueue{messages: make(chan types.Message, 10)}
+}
+
+func (q *fakeResponseQueue) send(body string) {
+	q.mu.Lock()
+	q.seq++
+	id := fmt.Sprintf("message-%d", q.seq)
+	q.mu.Unlock()
+
+	q.messages <- types.Message{MessageId: aws.String(id), ReceiptHandle: aws.String(id), Body: aws.String(body)}
+}
+
+func (q *fakeResponseQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	select {
+	case message := <-q.messages:
+		return &sqs.ReceiveMessageOutput{Messages: []types.Message{message}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(100 * time.Millisecond):
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+}
+
+func (q *fakeResponseQueue) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.deleted = append(q.deleted, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (q *fakeResponseQueue) deletedCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.deleted)
+}
+
+func TestUnwrapSNSNotification(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"raw", `{"request_id":"req-1"}`, `{"request_id":"req-1"}`},
+		{"notification", `{"Type":"Notification","TopicArn":"arn:aws:sns:us-east-1:123456789012:responses","Message":"{\"request_id\":\"req-1\"}"}`, `{"request_id":"req-1"}`},
+		{"subscription confirmation", `{"Type":"SubscriptionConfirmation","Message":"confirm"}`, `{"Type":"SubscriptionConfirmation","Message":"confirm"}`},
+		{"not JSON", "hello", "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unwrapSNSNotification(tt.body); got != tt.want {
+				t.Errorf("unwrapSNSNotification() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ResponseQueueCompletesRoundTrip(t *testing.T) {
+	queue := newFakeResponseQueue()
+
+	// The receiver answers through the queue instead of the callback URL
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data PostData
+		json.NewDecoder(r.Body).Decode(&data)
+		body, _ := json.Marshal(map[string]interface{}{"request_id": data.RequestID, "payload": "queued answer"})
+		queue.send(string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	server := NewServer().WithPostURL(receiver.URL).WithResponseQueue(testResponseQueueURL, queue)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	// A late response to an earlier round trip is discarded
+	queue.send(`{"request_id":"req-stale","payload":"late"}`)
+
+	response, err := server.RoundTripPostWithTimeout("question", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "queued answer" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+	// The answer is deleted after its round trip completes
+	deadline := time.Now().Add(time.Second)
+	for queue.deletedCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if deleted := queue.deletedCount(); deleted != 2 {
+		t.Errorf("expected both messages to be deleted, got %d", deleted)
+	}
+}
+
+func TestServer_ResponseQueueSharedWithRelay(t *testing.T) {
+	relay := &fakeRelay{}
+	waitingQueue, otherQueue := newFakeResponseQueue(), newFakeResponseQueue()
+
+	// The instance not waiting reads the response, with an error, from the
+	// shared queue
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data PostData
+		json.NewDecoder(r.Body).Decode(&data)
+		body, _ := json.Marshal(map[string]interface{}{"request_id": data.RequestID, "error": "receiver failed"})
+		otherQueue.send(string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	waiting := NewServer().WithPostURL(receiver.URL).WithResponseQueue(testResponseQueueURL, waitingQueue).WithCallbackRelay(relay)
+	other := NewServer().WithResponseQueue(testResponseQueueURL, otherQueue).WithCallbackRelay(relay)
+	for _, server := range []*Server{waiting, other} {
+		if err := server.Start(); err != nil {
+			t.Fatalf("failed to start server: %v", err)
+		}
+		defer server.Stop()
+	}
+
+	response, err := waiting.RoundTripPostWithTimeout("question", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if response.Success || response.Error != "receiver failed" || response.Timeout {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+func TestAWSCredentialsProvider_ResponseQueue(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-east-1:123456789012:post2post-responses"
+
+	for _, topic := range []string{"", topicARN} {
+		t.Run("topic="+topic, func(t *testing.T) {
+			queue := newFakeResponseQueue()
+
+			// A Lambda delivering to the queue, or to the topic feeding it
+			lambdaWithQueue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var data struct {
+					Payload LambdaAssumeRoleRequest `json:"payload"`
+				}
+				json.NewDecoder(r.Body).Decode(&data)
+				request := data.Payload
+				if request.URL != "" || request.ResponseQueueURL != testResponseQueueURL || request.ResponseTopicARN != topic {
+					t.Errorf("unexpected delivery settings: url=%q queue=%q topic=%q", request.URL, request.ResponseQueueURL, request.ResponseTopicARN)
+				}
+
+				body, _ := json.Marshal(map[string]interface{}{
+					"request_id": request.RequestID,
+					"payload":    mockPayload(MockLambdaConfig{AccessKeyID: "AKIAQUEUED", SecretAccessKey: "secret", SessionToken: "token", Lifetime: time.Hour}, "", request),
+				})
+				if request.ResponseTopicARN != "" {
+					body, _ = json.Marshal(map[string]string{"Type": "Notification", "TopicArn": topic, "Message": string(body)})
+				}
+				queue.send(string(body))
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer lambdaWithQueue.Close()
+
+			provider, err := NewAWSCredentialsProvider(AWSCredentialsProviderConfig{
+				LambdaURL:           lambdaWithQueue.URL,
+				RoleARN:             "arn:aws:iam::123456789012:role/remote/TestRole",
+				ResponseQueueURL:    testResponseQueueURL,
+				ResponseTopicARN:    topic,
+				ResponseQueueClient: queue,
+			})
+			if err != nil {
+				t.Fatalf("failed to create provider: %v", err)
+			}
+			defer provider.Close()
+
+			credentials, err := provider.Retrieve(context.Background())
+			if err != nil {
+				t.Fatalf("Retrieve() failed: %v", err)
+			}
+			if credentials.AccessKeyID != "AKIAQUEUED" {
+				t.Errorf("expected queued credentials, got %+v", credentials)
+			}
+		})
+	}
+}
+
+func TestValidateResponseQueueConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AWSCredentialsProviderConfig
+		wantErr bool
+	}{
+		{"none", AWSCredentialsProviderConfig{}, false},
+		{"queue", AWSCredentialsProviderConfig{ResponseQueueURL: testResponseQueueURL}, false},
+		{"queue and topic", AWSCredentialsProviderConfig{ResponseQueueURL: testResponseQueueURL, ResponseTopicARN: "arn:aws:sns:us-east-1:123456789012:responses"}, false},
+		{"topic without queue", AWSCredentialsProviderConfig{ResponseTopicARN: "arn:aws:sns:us-east-1:123456789012:responses"}, true},
+		{"synchronous", AWSCredentialsProviderConfig{ResponseQueueURL: testResponseQueueURL, Synchronous: true}, true},
+		{"plain http queue", AWSCredentialsProviderConfig{ResponseQueueURL: "http://sqs.us-east-1.amazonaws.com/123456789012/responses"}, true},
+		{"not a topic", AWSCredentialsProviderConfig{ResponseQueueURL: testResponseQueueURL, ResponseTopicARN: "arn:aws:sqs:us-east-1:123456789012:responses"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateResponseQueueConfig(&tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateResponseQueueConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
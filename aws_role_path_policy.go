@@ -0,0 +1,82 @@
+package post2post
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RolePathPolicy restricts which IAM roles may be assumed. Every configured
+// check must pass; a zero policy allows any role.
+type RolePathPolicy struct {
+	// PathPrefix is the IAM path the role must be under, e.g. "/remote/"
+	PathPrefix string
+	// Pattern is a regular expression the full role ARN must match
+	Pattern string
+	// Allowlist lists the only role ARNs that may be assumed
+	Allowlist []string
+}
+
+// RemoteRolePathPolicy requires roles to be under the /remote/ IAM path, the
+// convention used by the examples
+var RemoteRolePathPolicy = RolePathPolicy{PathPrefix: "/remote/"}
+
+// Check returns an error if roleARN is not an IAM role ARN allowed by the policy
+func (p RolePathPolicy) Check(roleARN string) error {
+	path, _, err := parseRoleARN(roleARN)
+	if err != nil {
+		return err
+	}
+
+	if p.PathPrefix != "" {
+		prefix := normalizeRolePath(p.PathPrefix)
+		if !strings.HasPrefix(path, prefix) {
+			return fmt.Errorf("role %s is not under the required path %s", roleARN, prefix)
+		}
+	}
+	if p.Pattern != "" {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid role ARN pattern: %w", err)
+		}
+		if !re.MatchString(roleARN) {
+			return fmt.Errorf("role %s does not match the allowed pattern %s", roleARN, p.Pattern)
+		}
+	}
+	if len(p.Allowlist) > 0 {
+		for _, allowed := range p.Allowlist {
+			if allowed == roleARN {
+				return nil
+			}
+		}
+		return fmt.Errorf("role %s is not in the role allowlist", roleARN)
+	}
+	return nil
+}
+
+// parseRoleARN splits an IAM role ARN such as
+// arn:aws:iam::123456789012:role/remote/MyRole into its path and name
+func parseRoleARN(roleARN string) (path, name string, err error) {
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[1] == "" || parts[2] != "iam" || parts[4] == "" || !strings.HasPrefix(parts[5], "role/") {
+		return "", "", fmt.Errorf("invalid IAM role ARN %q", roleARN)
+	}
+
+	resource := strings.TrimPrefix(parts[5], "role")
+	i := strings.LastIndex(resource, "/")
+	path, name = resource[:i+1], resource[i+1:]
+	if name == "" {
+		return "", "", fmt.Errorf("invalid IAM role ARN %q", roleARN)
+	}
+	return path, name, nil
+}
+
+// normalizeRolePath returns prefix with a leading and trailing slash, so
+// "remote" and "/remote/" are equivalent
+func normalizeRolePath(prefix string) string {
+	trimmed := strings.Trim(prefix, "/")
+	if trimmed == "" {
+		return "/"
+	}
+	return "/" + trimmed + "/"
+}
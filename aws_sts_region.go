@@ -0,0 +1,37 @@
+package post2post
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// stsRegionPattern matches AWS region names such as us-east-1, eu-central-2
+// or us-gov-west-1
+var stsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// validateSTSRegionConfig checks the region and the STS endpoint override,
+// which must be an https URL on an AWS domain
+func validateSTSRegionConfig(config *AWSCredentialsProviderConfig) error {
+	if config.Region != "" && !stsRegionPattern.MatchString(config.Region) {
+		return fmt.Errorf("invalid region %q", config.Region)
+	}
+	if config.STSEndpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(config.STSEndpoint)
+	if err != nil {
+		return fmt.Errorf("invalid STS endpoint: %w", err)
+	}
+	if endpoint.Scheme != "https" || !isAWSHost(endpoint.Hostname()) {
+		return fmt.Errorf("STS endpoint must be an https URL on an AWS domain, got %s", config.STSEndpoint)
+	}
+	return nil
+}
+
+// isAWSHost reports whether host is in an AWS partition's domain
+func isAWSHost(host string) bool {
+	host = strings.ToLower(host)
+	return strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn")
+}
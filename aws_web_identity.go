@@ -0,0 +1,46 @@
+package post2post
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// validateWebIdentityConfig checks the web identity token settings.
+// AssumeRoleWithWebIdentity supports neither external IDs nor session tags.
+func validateWebIdentityConfig(config *AWSCredentialsProviderConfig) error {
+	if config.WebIdentityTokenFile == "" && config.WebIdentityTokenEnv == "" {
+		return nil
+	}
+	if config.WebIdentityTokenFile != "" && config.WebIdentityTokenEnv != "" {
+		return fmt.Errorf("set only one of web identity token file and environment variable")
+	}
+	if config.ExternalID != "" || len(config.Tags) > 0 || config.SourceIdentity != "" {
+		return fmt.Errorf("external ID, session tags and source identity are not supported with a web identity token")
+	}
+	return nil
+}
+
+// webIdentityToken reads the current OIDC token, or returns "" if the
+// provider uses AssumeRole. Tokens rotate, so it is read at every refresh.
+func (p *AWSCredentialsProvider) webIdentityToken() (string, error) {
+	var token string
+	switch {
+	case p.webIdentityTokenFile != "":
+		data, err := os.ReadFile(p.webIdentityTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read web identity token: %w", err)
+		}
+		token = string(data)
+	case p.webIdentityTokenEnv != "":
+		token = os.Getenv(p.webIdentityTokenEnv)
+	default:
+		return "", nil
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("web identity token is empty")
+	}
+	return token, nil
+}
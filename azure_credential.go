@@ -0,0 +1,229 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// azureClientIDPattern matches managed identity client IDs
+var azureClientIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// AzureCredentialConfig holds configuration for the Azure credential
+type AzureCredentialConfig struct {
+	ReceiverURL string // Azure Function receiver URL (required)
+	TailnetKey  string // Tailscale auth key for secure communication (required)
+	// ClientID selects a user-assigned managed identity of the receiver
+	// (optional, default the receiver's system-assigned identity)
+	ClientID     string
+	Fallback     FallbackPolicy // Behavior when Tailscale is unavailable (optional, default FallbackNever)
+	ExpiryBuffer time.Duration  // How long before expiry tokens are refreshed (optional, default 5 minutes)
+	MaxAttempts  int            // Attempts per refresh for retryable failures (optional, default 3)
+}
+
+// AzureTokenRequest represents the request sent to the Azure receiver
+type AzureTokenRequest struct {
+	URL        string   `json:"url"`
+	Payload    string   `json:"payload"`
+	RequestID  string   `json:"request_id"`
+	TailnetKey string   `json:"tailnet_key,omitempty"`
+	Scopes     []string `json:"scopes"`
+	ClientID   string   `json:"client_id,omitempty"`
+}
+
+// AzureProcessedPayload represents the processed payload from the Azure receiver
+type AzureProcessedPayload struct {
+	OriginalPayload   string           `json:"original_payload"`
+	TokenResult       AzureTokenResult `json:"token_result"`
+	ProcessedAt       string           `json:"processed_at"`
+	ProcessedBy       string           `json:"processed_by"`
+	ReceiverRequestID string           `json:"receiver_request_id"`
+	Status            string           `json:"status"`
+	Error             string           `json:"error,omitempty"`
+	ErrorCode         string           `json:"error_code,omitempty"`
+}
+
+// AzureTokenResult is the managed identity token
+type AzureTokenResult struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresOn   time.Time `json:"expires_on"`
+}
+
+// AzureCredential gets access tokens using post2post: a receiver on Azure
+// Functions gets a token from its managed identity and posts it back over
+// the tailnet. The azurecredential module adapts it to
+// azcore.TokenCredential for the Azure SDK for Go.
+type AzureCredential struct {
+	receiver     *tokenReceiver
+	clientID     string
+	expiryBuffer time.Duration
+
+	// Cached tokens by scope
+	mu     sync.RWMutex
+	tokens map[string]AzureTokenResult
+
+	// Deduplicates concurrent refreshes of a scope
+	refresh singleflight.Group
+}
+
+// NewAzureCredential creates a new Azure credential using post2post
+func NewAzureCredential(config AzureCredentialConfig) (*AzureCredential, error) {
+	if config.ReceiverURL == "" {
+		return nil, fmt.Errorf("receiver URL is required")
+	}
+	if err := validateReceiverURL("receiver", config.ReceiverURL); err != nil {
+		return nil, err
+	}
+	if config.TailnetKey == "" {
+		return nil, fmt.Errorf("tailnet key is required for secure communication")
+	}
+	if config.ClientID != "" && !azureClientIDPattern.MatchString(config.ClientID) {
+		return nil, fmt.Errorf("invalid managed identity client ID %q", config.ClientID)
+	}
+	if config.ExpiryBuffer < 0 || config.MaxAttempts < 0 {
+		return nil, fmt.Errorf("expiry buffer and attempts must not be negative")
+	}
+	if config.ExpiryBuffer == 0 {
+		config.ExpiryBuffer = 5 * time.Minute
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+
+	log.Printf("Azure Credential initialized with receiver URL: %s", config.ReceiverURL)
+
+	return &AzureCredential{
+		receiver:     newTokenReceiver(config.ReceiverURL, config.TailnetKey, config.Fallback, config.MaxAttempts),
+		clientID:     config.ClientID,
+		expiryBuffer: config.ExpiryBuffer,
+		tokens:       make(map[string]AzureTokenResult),
+	}, nil
+}
+
+// Start starts the internal post2post server. It is called by the first
+// Token; call it explicitly to surface startup errors early.
+func (c *AzureCredential) Start(ctx context.Context) error {
+	return c.receiver.start(ctx)
+}
+
+// Close stops the internal post2post server, if it was started
+func (c *AzureCredential) Close() error {
+	return c.receiver.close()
+}
+
+// Token returns an access token for scope, e.g.
+// "https://vault.azure.net/.default", from the cache or the receiver.
+// Managed identities issue tokens for a single resource, so a token has a
+// single scope.
+func (c *AzureCredential) Token(ctx context.Context, scope string) (AzureTokenResult, error) {
+	c.mu.RLock()
+	if token, ok := c.tokens[scope]; ok && time.Now().Before(token.ExpiresOn.Add(-c.expiryBuffer)) {
+		c.mu.RUnlock()
+		return token, nil
+	}
+	c.mu.RUnlock()
+
+	if err := c.Start(ctx); err != nil {
+		return AzureTokenResult{}, err
+	}
+
+	// Concurrent callers share a single upstream refresh per scope
+	result := c.refresh.DoChan(scope, func() (interface{}, error) {
+		return c.fetchToken(scope)
+	})
+
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return AzureTokenResult{}, res.Err
+		}
+		return res.Val.(AzureTokenResult), nil
+	case <-ctx.Done():
+		return AzureTokenResult{}, ctx.Err()
+	}
+}
+
+// InvalidateCache forces the credential to fetch new tokens on the next call
+func (c *AzureCredential) InvalidateCache() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokens = make(map[string]AzureTokenResult)
+}
+
+// GetClientID returns the configured managed identity client ID, "" for the
+// receiver's system-assigned identity
+func (c *AzureCredential) GetClientID() string {
+	return c.clientID
+}
+
+// GetReceiverURL returns the configured receiver URL
+func (c *AzureCredential) GetReceiverURL() string {
+	return c.receiver.url
+}
+
+// identity names the managed identity in errors
+func (c *AzureCredential) identity() string {
+	if c.clientID != "" {
+		return "managed identity " + c.clientID
+	}
+	return "system-assigned managed identity"
+}
+
+// fetchToken requests a token for scope, retrying retryable failures, and
+// caches it
+func (c *AzureCredential) fetchToken(scope string) (AzureTokenResult, error) {
+	var token AzureTokenResult
+	err := c.receiver.withRetry("Azure access token", func() error {
+		var err error
+		token, err = c.requestToken(scope)
+		return err
+	})
+	if err != nil {
+		return AzureTokenResult{}, err
+	}
+
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+	log.Printf("Successfully retrieved Azure access token for %s (expires: %s)", scope, token.ExpiresOn.Format(time.RFC3339))
+	return token, nil
+}
+
+// requestToken makes a single round trip through the receiver
+func (c *AzureCredential) requestToken(scope string) (AzureTokenResult, error) {
+	log.Printf("Fetching new Azure access token from receiver: %s", c.receiver.url)
+
+	data, requestID, err := c.receiver.roundTrip("azure-token", c.identity(), func(callbackURL, requestID string) interface{} {
+		return AzureTokenRequest{
+			URL:        callbackURL,
+			Payload:    fmt.Sprintf("token-request-%s", requestID),
+			RequestID:  requestID,
+			TailnetKey: c.receiver.tailnetKey,
+			Scopes:     []string{scope},
+			ClientID:   c.clientID,
+		}
+	})
+	if err != nil {
+		return AzureTokenResult{}, err
+	}
+
+	var payload AzureProcessedPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return AzureTokenResult{}, terminal(fmt.Errorf("failed to parse receiver response: %w", err))
+	}
+	if payload.Status != "success" {
+		return AzureTokenResult{}, receiverDenied(c.identity(), requestID, payload.ReceiverRequestID, payload.Status, payload.Error, payload.ErrorCode)
+	}
+	if payload.TokenResult.AccessToken == "" {
+		return AzureTokenResult{}, terminal(fmt.Errorf("no access token returned in receiver response"))
+	}
+
+	return payload.TokenResult, nil
+}
@@ -0,0 +1,45 @@
+// Package azurecredential adapts post2post's AzureCredential to
+// azcore.TokenCredential, so its managed identity tokens work with any Azure
+// SDK for Go client
+package azurecredential
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/pgdad/post2post"
+)
+
+// Credential implements azcore.TokenCredential with a
+// post2post.AzureCredential
+type Credential struct {
+	*post2post.AzureCredential
+}
+
+var _ azcore.TokenCredential = (*Credential)(nil)
+
+// New creates a credential getting tokens from the receiver of config
+func New(config post2post.AzureCredentialConfig) (*Credential, error) {
+	credential, err := post2post.NewAzureCredential(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{AzureCredential: credential}, nil
+}
+
+// GetToken implements azcore.TokenCredential.GetToken. Managed identities
+// issue tokens for a single resource, so exactly one scope is required;
+// options.TenantID is ignored.
+func (c *Credential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if len(options.Scopes) != 1 {
+		return azcore.AccessToken{}, fmt.Errorf("exactly one scope is required, got %d", len(options.Scopes))
+	}
+
+	token, err := c.Token(ctx, options.Scopes[0])
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	return azcore.AccessToken{Token: token.AccessToken, ExpiresOn: token.ExpiresOn}, nil
+}
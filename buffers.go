@@ -0,0 +1,106 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are dropped instead
+// of pooled, so that a few large bodies do not pin memory
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool holds the buffers bodies are marshaled and read into, cutting
+// allocations under high request rates
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool. Nothing may refer to its bytes anymore.
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readBody reads r into a pooled buffer, to be returned with putBuffer once
+// the bytes are decoded
+func readBody(r io.Reader) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// pooledBody is a request body held in a pooled buffer. The buffer returns to
+// the pool once the sender releases the body and the transport has closed
+// every reader on it, as the transport may still read the body after
+// Client.Do returns.
+type pooledBody struct {
+	buf  *bytes.Buffer
+	data []byte
+	refs atomic.Int32
+}
+
+// newPooledBody returns a body of data, which is buf's bytes or was derived
+// from them, e.g. compressed. buf may be nil for bodies not in a pooled
+// buffer. The sender must call release once done with it.
+func newPooledBody(buf *bytes.Buffer, data []byte) *pooledBody {
+	body := &pooledBody{buf: buf, data: data}
+	body.refs.Store(1)
+	return body
+}
+
+// release releases a reference to the body, returning its buffer to the pool
+// with the last one
+func (b *pooledBody) release() {
+	if b.refs.Add(-1) == 0 {
+		putBuffer(b.buf)
+	}
+}
+
+// reader returns a reader of the body, which releases its reference when
+// closed
+func (b *pooledBody) reader() io.ReadCloser {
+	b.refs.Add(1)
+	return &pooledBodyReader{Reader: bytes.NewReader(b.data), body: b}
+}
+
+// newRequest returns a POST request of the body to url. The body can be
+// read again for redirects and retries while the sender holds it.
+func (b *pooledBody) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	reader := b.reader()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	req.ContentLength = int64(len(b.data))
+	req.GetBody = func() (io.ReadCloser, error) { return b.reader(), nil }
+	return req, nil
+}
+
+// pooledBodyReader reads a pooledBody
+type pooledBodyReader struct {
+	*bytes.Reader
+	body *pooledBody
+	once sync.Once
+}
+
+func (r *pooledBodyReader) Close() error {
+	r.once.Do(r.body.release)
+	return nil
+}
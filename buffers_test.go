@@ -0,0 +1,173 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncoding_MarshalBuffer(t *testing.T) {
+	values := []interface{}{
+		PostData{URL: "http://example.com/roundtrip?a=1&b=2", RequestID: "req-1", Payload: map[string]interface{}{"html": "<b>&</b>", "n": 1.5}},
+		map[string]interface{}{"nested": []interface{}{"a", nil, true}},
+		"plain",
+	}
+	for _, encoding := range []Encoding{EncodingJSON, testEncoding} {
+		for _, v := range values {
+			want, err := encoding.marshal(v)
+			if err != nil {
+				t.Fatalf("%s marshal(%v) failed: %v", encoding, v, err)
+			}
+			buf, err := encoding.marshalBuffer(v)
+			if err != nil {
+				t.Fatalf("%s marshalBuffer(%v) failed: %v", encoding, v, err)
+			}
+			// Only JSON orders map keys: compare the others decoded
+			var got, wantValue interface{}
+			if err := encoding.unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("%s marshalBuffer(%v) = %q: %v", encoding, v, buf.Bytes(), err)
+			}
+			encoding.unmarshal(want, &wantValue)
+			if encoding == EncodingJSON && !bytes.Equal(buf.Bytes(), want) || !reflect.DeepEqual(got, wantValue) {
+				t.Errorf("%s marshalBuffer(%v) = %q, want %q", encoding, v, buf.Bytes(), want)
+			}
+			putBuffer(buf)
+		}
+	}
+
+	if _, err := EncodingJSON.marshalBuffer(make(chan int)); err == nil {
+		t.Error("expected an error for a value JSON cannot encode")
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	buf, err := readBody(strings.NewReader("hello"))
+	if err != nil || buf.String() != "hello" {
+		t.Fatalf("readBody() = %q, %v", buf, err)
+	}
+	putBuffer(buf)
+
+	buf, err = readBody(strings.NewReader(""))
+	if err != nil || buf.Len() != 0 {
+		t.Errorf("readBody() of an empty body = %q, %v", buf, err)
+	}
+}
+
+func TestPooledBody(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString(`{"hello":"world"}`)
+	body := newPooledBody(buf, buf.Bytes())
+
+	req, err := body.newRequest(context.Background(), "http://example.com")
+	if err != nil {
+		t.Fatalf("newRequest() failed: %v", err)
+	}
+	if req.ContentLength != int64(buf.Len()) {
+		t.Errorf("ContentLength = %d, want %d", req.ContentLength, buf.Len())
+	}
+
+	// The transport may still read the body after the sender is done
+	body.release()
+	if refs := body.refs.Load(); refs != 1 {
+		t.Fatalf("references = %d with an open reader, want 1", refs)
+	}
+	data, _ := io.ReadAll(req.Body)
+	if string(data) != `{"hello":"world"}` {
+		t.Errorf("body = %q", data)
+	}
+	req.Body.Close()
+	req.Body.Close()
+	if refs := body.refs.Load(); refs != 0 {
+		t.Errorf("references = %d once closed, want 0", refs)
+	}
+}
+
+func TestPooledBody_Redirect(t *testing.T) {
+	var bodies []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusPermanentRedirect)
+		}
+	}))
+	defer receiver.Close()
+
+	server := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.URL + "/old")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	if err := server.PostJSON(map[string]string{"hello": "world"}); err != nil {
+		t.Fatalf("PostJSON() failed: %v", err)
+	}
+	if len(bodies) != 2 || bodies[0] != bodies[1] || !strings.Contains(bodies[1], `"hello":"world"`) {
+		t.Errorf("bodies = %q, want the post twice", bodies)
+	}
+}
+
+// benchmarkPostData is a post of a typical size
+var benchmarkPostData = PostData{
+	URL:       "http://127.0.0.1:8080/roundtrip",
+	RequestID: "req_1234567890",
+	Payload: map[string]interface{}{
+		"role_arn": "arn:aws:iam::123456789012:role/example",
+		"items":    []interface{}{"alpha", "beta", "gamma", "delta"},
+		"count":    42,
+		"note":     strings.Repeat("x", 512),
+	},
+}
+
+func BenchmarkMarshalPostData(b *testing.B) {
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(benchmarkPostData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := EncodingJSON.marshalBuffer(benchmarkPostData)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	body, _ := json.Marshal(benchmarkPostData)
+	body = bytes.Repeat(body, 8)
+
+	b.Run("io.ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			buf, err := readBody(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+}
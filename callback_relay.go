@@ -0,0 +1,113 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// CallbackRelay relays round trip responses between the instances of a
+// horizontally scaled sender, so that a callback reaching an instance that is
+// not waiting for it completes the round trip on the instance that is. The
+// redistransport module relays them through Redis pub/sub.
+type CallbackRelay interface {
+	// Forward relays callback, a CallbackMessage encoded as JSON, for the
+	// round trip waiting for requestID
+	Forward(ctx context.Context, requestID string, callback []byte) error
+	// ReceiveResponses starts receiving the responses relayed by any
+	// instance, or delivered to the relay by receivers directly, until ctx is
+	// done and returns the channel they are delivered on
+	ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error)
+}
+
+// WithCallbackRelay also completes round trips from the responses relay
+// receives, and forwards the callbacks posted to /roundtrip or read from the
+// response queue for round trips this instance is not waiting for through
+// relay, to the instance that is. A nil relay turns this off.
+func (s *Server) WithCallbackRelay(relay CallbackRelay) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.relay = relay
+	return s
+}
+
+// startCallbackRelay starts receiving relayed responses if a relay is
+// configured. Must be called with s.mu held.
+func (s *Server) startCallbackRelay() error {
+	if s.relay == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	responses, err := s.relay.ReceiveResponses(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to receive relayed responses: %w", err)
+	}
+	s.relayStop = cancel
+	go s.consumeRelayedResponses(ctx, responses)
+	return nil
+}
+
+// stopCallbackRelay stops receiving relayed responses. Must be called with
+// s.mu held.
+func (s *Server) stopCallbackRelay() {
+	if s.relayStop != nil {
+		s.relayStop()
+		s.relayStop = nil
+	}
+}
+
+// consumeRelayedResponses completes the round trips this server waits for
+// until ctx is done. Responses for other instances are ignored.
+func (s *Server) consumeRelayedResponses(ctx context.Context, responses <-chan *RoundTripResponse) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case response, ok := <-responses:
+			if !ok {
+				return
+			}
+			err := s.completeRoundTrip(response)
+			if err != nil && err != errUnknownRoundTrip {
+				log.Printf("Relayed response for RequestID %s: %v", response.RequestID, err)
+			}
+		}
+	}
+}
+
+// forwardedCallback returns the body of a callback posted to /roundtrip as
+// forwarded through the relay, where callbacks are plain JSON
+func forwardedCallback(r *http.Request, body []byte) []byte {
+	var callback CallbackMessage
+	if err := decodeCallback(r, body, &callback); err != nil {
+		return body
+	}
+	data, err := json.Marshal(callback)
+	if err != nil {
+		return body
+	}
+	return data
+}
+
+// forwardCallback relays a callback body that reached this server for a
+// round trip it is not waiting for, so that the instance waiting for it
+// completes it. It reports whether the callback was forwarded.
+func (s *Server) forwardCallback(ctx context.Context, requestID string, body []byte) bool {
+	s.mu.RLock()
+	relay := s.relay
+	s.mu.RUnlock()
+	if relay == nil || requestID == "" {
+		return false
+	}
+
+	if err := relay.Forward(ctx, requestID, body); err != nil {
+		log.Printf("Failed to forward response for RequestID %s: %v", requestID, err)
+		return false
+	}
+	return true
+}
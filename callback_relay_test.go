@@ -0,0 +1,101 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay relays callbacks to every server receiving its responses, as
+// Redis pub/sub does
+type fakeRelay struct {
+	mu    sync.Mutex
+	feeds []*ResponseFeed
+}
+
+func (r *fakeRelay) Forward(ctx context.Context, requestID string, callback []byte) error {
+	var message CallbackMessage
+	if err := json.Unmarshal(callback, &message); err != nil {
+		return err
+	}
+	message.RequestID = requestID
+
+	r.mu.Lock()
+	feeds := append([]*ResponseFeed(nil), r.feeds...)
+	r.mu.Unlock()
+	for _, feed := range feeds {
+		feed.Deliver(message.RoundTripResponse())
+	}
+	return nil
+}
+
+func (r *fakeRelay) ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error) {
+	feed := &ResponseFeed{}
+	r.mu.Lock()
+	r.feeds = append(r.feeds, feed)
+	r.mu.Unlock()
+	return feed.Start(ctx), nil
+}
+
+func TestServer_WithCallbackRelay(t *testing.T) {
+	relay := &fakeRelay{}
+
+	// Two instances of a horizontally scaled sender
+	waiting := NewServer().WithInterface("127.0.0.1").WithCallbackRelay(relay)
+	other := NewServer().WithInterface("127.0.0.1").WithCallbackRelay(relay)
+	for _, server := range []*Server{waiting, other} {
+		if err := server.Start(); err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+		defer server.Stop()
+	}
+
+	// A receiver posts the callback to the instance that is not waiting
+	forwarding := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var post PostData
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		go func() {
+			body := []byte(`{"request_id":"` + post.RequestID + `","payload":"from other instance"}`)
+			resp, err := http.Post(other.GetURL()+"/roundtrip", "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusAccepted {
+					t.Errorf("callback to other instance status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+				}
+			}
+		}()
+	}))
+	defer forwarding.Close()
+
+	response, err := waiting.RoundTripPostToURL(forwarding.URL, map[string]string{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "from other instance" {
+		t.Errorf("RoundTripPostToURL() = %+v, want the forwarded callback", response)
+	}
+
+	// Without a relay the callback is unknown to the other instance
+	alone := NewServer().WithInterface("127.0.0.1")
+	if err := alone.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer alone.Stop()
+	resp, err := http.Post(alone.GetURL()+"/roundtrip", "application/json", bytes.NewReader([]byte(`{"request_id":"req-unknown"}`)))
+	if err != nil {
+		t.Fatalf("callback failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("callback status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,134 @@
+package post2post
+
+import (
+	"errors"
+	"sync"
+)
+
+// Default size of the pool posting callbacks
+const (
+	defaultCallbackWorkers   = 16
+	defaultCallbackQueueSize = 1024
+)
+
+// errCallbackQueueFull rejects posts to /webhook whose callback cannot be
+// queued
+var errCallbackQueueFull = errors.New("callback queue is full")
+
+// callbackPool posts callbacks with a bounded number of workers, queueing
+// those waiting for one. Workers are started as callbacks are queued and exit
+// once the queue is empty, so the pool needs no lifecycle.
+type callbackPool struct {
+	mu         sync.Mutex
+	queue      []func()
+	maxWorkers int
+	maxQueued  int
+	workers    int
+	// reserved counts places in the queue claimed by posts still being
+	// processed
+	reserved int
+}
+
+// newCallbackPool returns a pool of up to workers workers queueing up to
+// queueSize callbacks
+func newCallbackPool(workers, queueSize int) *callbackPool {
+	return &callbackPool{maxWorkers: workers, maxQueued: queueSize}
+}
+
+// WithCallbackWorkers posts the responses to /webhook back to their senders
+// with up to workers goroutines, 16 by default, queueing up to queueSize
+// responses waiting for one, 1024 by default. Posts are given a place in the
+// queue before they are processed; those that cannot get one are answered
+// with 503 Service Unavailable unprocessed, so senders can retry them.
+// Values below 1 are ignored.
+func (s *Server) WithCallbackWorkers(workers, queueSize int) *Server {
+	s.callbacks.mu.Lock()
+	defer s.callbacks.mu.Unlock()
+
+	if workers > 0 {
+		s.callbacks.maxWorkers = workers
+	}
+	if queueSize > 0 {
+		s.callbacks.maxQueued = queueSize
+	}
+	return s
+}
+
+// submit queues callback, starting a worker if fewer than the maximum are
+// running. It reports whether the callback was queued.
+func (p *callbackPool) submit(callback func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue)+p.reserved >= p.maxQueued {
+		return false
+	}
+	p.enqueue(callback)
+	return true
+}
+
+// reserve claims a place in the queue for a callback that is yet to be
+// submitted with submitReserved, or given back with release. It reports
+// false if the queue is full.
+func (p *callbackPool) reserve() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue)+p.reserved >= p.maxQueued {
+		return false
+	}
+	p.reserved++
+	return true
+}
+
+// release gives back a place claimed with reserve
+func (p *callbackPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reserved--
+}
+
+// submitReserved queues callback in a place claimed with reserve
+func (p *callbackPool) submitReserved(callback func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reserved--
+	p.enqueue(callback)
+}
+
+// enqueue queues callback, starting a worker if fewer than the maximum are
+// running. Must be called with p.mu held.
+func (p *callbackPool) enqueue(callback func()) {
+	p.queue = append(p.queue, callback)
+	if p.workers < p.maxWorkers {
+		p.workers++
+		go p.work()
+	}
+}
+
+// work runs the queued callbacks until the queue is empty
+func (p *callbackPool) work() {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.workers--
+			p.mu.Unlock()
+			return
+		}
+		callback := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		callback()
+	}
+}
+
+// depth returns the numbers of queued callbacks and of running workers
+func (p *callbackPool) depth() (queued, workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), p.workers
+}
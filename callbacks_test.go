@@ -0,0 +1,137 @@
+package post2post
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbackPool(t *testing.T) {
+	pool := newCallbackPool(2, 3)
+	release := make(chan struct{})
+	var running, peak, done atomic.Int32
+	callback := func() {
+		n := running.Add(1)
+		for {
+			if p := peak.Load(); n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+		done.Add(1)
+	}
+
+	// Two callbacks run, three wait in the queue
+	for i := 0; i < 5; i++ {
+		if !pool.submit(callback) {
+			t.Fatalf("callback %d was not queued", i)
+		}
+		if i < 2 {
+			// Let the worker take the callback off the queue
+			for queued, _ := pool.depth(); queued != 0; queued, _ = pool.depth() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if pool.submit(callback) {
+		t.Error("submit() queued a callback beyond the queue size")
+	}
+	if queued, workers := pool.depth(); queued != 3 || workers != 2 {
+		t.Errorf("depth() = %d queued, %d workers, want 3 and 2", queued, workers)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for done.Load() != 5 || func() bool { _, workers := pool.depth(); return workers != 0 }() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callbacks done, want 5 with no workers left", done.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if peak.Load() != 2 {
+		t.Errorf("%d callbacks ran at once, want 2", peak.Load())
+	}
+}
+
+func TestServer_WithCallbackWorkers(t *testing.T) {
+	failed := make(chan CallbackEvent, 1)
+	var processed atomic.Int32
+	receiver := NewServer().WithInterface("127.0.0.1").WithCallbackWorkers(1, 1).WithHooks(Hooks{
+		OnCallbackFailed: func(event CallbackEvent) { failed <- event },
+	}).WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		processed.Add(1)
+		return payload, nil
+	}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil || !response.Success || response.Payload != "hello" {
+		t.Fatalf("RoundTripPost() = %+v, %v, want the echoed payload", response, err)
+	}
+
+	// Occupy the worker and the queue
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 2; i++ {
+		if !receiver.callbacks.submit(func() { <-release }) {
+			t.Fatalf("callback %d was not queued", i)
+		}
+		for queued, _ := receiver.callbacks.depth(); i == 0 && queued != 0; queued, _ = receiver.callbacks.depth() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if stats := receiver.Stats(); stats.CallbackQueueDepth != 1 || stats.CallbackWorkers != 1 {
+		t.Errorf("Stats() = %+v, want 1 queued callback and 1 worker", stats)
+	}
+
+	response, err = sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil || response.Success || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("RoundTripPost() = %+v, %v, want status 503", response, err)
+	}
+	select {
+	case event := <-failed:
+		if !errors.Is(event.Err, errCallbackQueueFull) {
+			t.Errorf("OnCallbackFailed event = %+v, want a full queue", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnCallbackFailed was not called")
+	}
+	// The refused post was not processed, so retrying it is safe
+	if n := processed.Load(); n != 1 {
+		t.Errorf("processor called %d times, want 1 as the refused post must not be processed", n)
+	}
+}
+
+func TestCallbackPool_Reserve(t *testing.T) {
+	pool := newCallbackPool(1, 2)
+	if !pool.reserve() || !pool.reserve() {
+		t.Fatal("reserve() failed below the queue size")
+	}
+	// Reserved places count against the queue
+	if pool.reserve() || pool.submit(func() {}) {
+		t.Error("reserve() or submit() succeeded with every place reserved")
+	}
+	pool.release()
+	done := make(chan struct{})
+	pool.submitReserved(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserved callback did not run")
+	}
+	if !pool.reserve() || !pool.reserve() {
+		t.Error("reserve() failed after the places were given back")
+	}
+}
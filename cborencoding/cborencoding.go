@@ -0,0 +1,52 @@
+// Package cborencoding registers the CBOR encoding (RFC 8949) of post2post,
+// post2post.EncodingCBOR, when imported:
+//
+//	import _ "github.com/pgdad/post2post/cborencoding"
+//
+// It is a module of its own so that only servers using CBOR depend on the
+// CBOR library.
+package cborencoding
+
+import (
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/pgdad/post2post"
+)
+
+func init() {
+	post2post.RegisterEncoding(post2post.EncodingCBOR, Codec{})
+}
+
+// Codec encodes and decodes CBOR bodies. Structs are encoded by the JSON
+// names of their fields, and []byte values as byte strings.
+type Codec struct{}
+
+var _ post2post.Codec = Codec{}
+
+// decMode decodes CBOR maps of interface{} values as JSON objects are, so
+// processors see the same payload types
+var decMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// Name returns "CBOR"
+func (Codec) Name() string {
+	return "CBOR"
+}
+
+// MediaTypes returns application/cbor
+func (Codec) MediaTypes() []string {
+	return []string{"application/cbor"}
+}
+
+// Marshal encodes v as CBOR
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// Unmarshal decodes CBOR into v
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return decMode.Unmarshal(data, v)
+}
@@ -0,0 +1,68 @@
+package cborencoding
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pgdad/post2post"
+)
+
+func TestCBOREncoding(t *testing.T) {
+	// Without a processor the receiver echoes payloads back
+	receiver := post2post.NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the content type of the post on its way to the receiver
+	target, _ := url.Parse(receiver.GetURL())
+	forward := httputil.NewSingleHostReverseProxy(target)
+	contentTypes := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes <- r.Header.Get("Content-Type")
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		name string
+		mode post2post.CloudEventsMode
+	}{
+		{"plain", post2post.CloudEventsOff},
+		{"CloudEvents binary", post2post.CloudEventsBinary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := post2post.NewServer().WithInterface("127.0.0.1").
+				WithEncoding(post2post.EncodingCBOR).
+				WithCloudEvents(tt.mode, "urn:test:sender")
+			if err := sender.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer sender.Stop()
+
+			binary := []byte{0x00, 0xff, 0x10}
+			response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"data": binary}, "", 5*time.Second)
+			if err != nil {
+				t.Fatalf("RoundTripPostToURL() failed: %v", err)
+			}
+			if !response.Success {
+				t.Fatalf("RoundTripPostToURL() = %+v, want success", response)
+			}
+			if contentType := <-contentTypes; contentType != "application/cbor" {
+				t.Errorf("post Content-Type = %s, want application/cbor", contentType)
+			}
+			// Byte strings come back as bytes, and maps as JSON objects do
+			echoed, ok := response.Payload.(map[string]interface{})
+			if data, _ := echoed["data"].([]byte); !ok || !bytes.Equal(data, binary) {
+				t.Errorf("response payload = %#v, want the original bytes", response.Payload)
+			}
+		})
+	}
+}
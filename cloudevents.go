@@ -0,0 +1,207 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CloudEventsMode selects how posts and callbacks are wrapped as CloudEvents
+// 1.0 over HTTP
+type CloudEventsMode int
+
+const (
+	// CloudEventsOff posts plain bodies, the default
+	CloudEventsOff CloudEventsMode = iota
+	// CloudEventsStructured posts events with Content-Type
+	// application/cloudevents+json, attributes and data in the body
+	CloudEventsStructured
+	// CloudEventsBinary posts the plain body with the attributes in ce-*
+	// headers
+	CloudEventsBinary
+)
+
+// CloudEvent types of posts and callbacks
+const (
+	CloudEventTypePost     = "io.post2post.post"
+	CloudEventTypeResponse = "io.post2post.response"
+)
+
+// cloudEventsMediaType is the Content-Type of structured events in the JSON
+// event format
+const cloudEventsMediaType = "application/cloudevents+json"
+
+// cloudEventsConfig configures wrapping posts as CloudEvents
+type cloudEventsConfig struct {
+	mode   CloudEventsMode
+	source string
+}
+
+// cloudEvent is a CloudEvent in the JSON event format
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// WithCloudEvents wraps posts, and the callbacks of this server as a
+// receiver, as CloudEvents 1.0 in the given mode, with type
+// CloudEventTypePost or CloudEventTypeResponse, the request ID as event ID
+// and source as event source, or the server URL if empty. Incoming
+// CloudEvents are unwrapped in any mode.
+func (s *Server) WithCloudEvents(mode CloudEventsMode, source string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cloudEvents = cloudEventsConfig{mode: mode, source: source}
+	return s
+}
+
+// wrapCloudEvent returns the body and headers posting body, encoded with
+// encoding, as a CloudEvent of eventType if configured, or as is otherwise
+func (s *Server) wrapCloudEvent(eventType, id string, encoding Encoding, body []byte) ([]byte, http.Header, error) {
+	s.mu.RLock()
+	config := s.cloudEvents
+	s.mu.RUnlock()
+
+	header := make(http.Header)
+	header.Set("Content-Type", encoding.ContentType())
+	if config.mode == CloudEventsOff {
+		return body, header, nil
+	}
+
+	if id == "" {
+		id = fmt.Sprintf("evt_%d", time.Now().UnixNano())
+	}
+	source := config.source
+	if source == "" {
+		source = s.GetURL()
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	if config.mode == CloudEventsBinary {
+		header.Set("Ce-Specversion", "1.0")
+		header.Set("Ce-Id", id)
+		header.Set("Ce-Source", source)
+		header.Set("Ce-Type", eventType)
+		header.Set("Ce-Time", now)
+		return body, header, nil
+	}
+
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          source,
+		Type:            eventType,
+		Time:            now,
+		DataContentType: encoding.ContentType(),
+	}
+	if encoding == EncodingJSON || encoding == "" {
+		event.Data = body
+	} else {
+		event.DataBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	wrapped, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal CloudEvent: %w", err)
+	}
+	header.Set("Content-Type", cloudEventsMediaType)
+	return wrapped, header, nil
+}
+
+// unwrapCloudEvent returns the data of a CloudEvent in structured or binary
+// mode, with its content type and the event, or body and its content type
+// with a nil event if it is not one
+func unwrapCloudEvent(header http.Header, body []byte) ([]byte, string, *cloudEvent, error) {
+	contentType := header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == cloudEventsMediaType {
+		var event cloudEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, "", nil, fmt.Errorf("failed to unmarshal CloudEvent: %w", err)
+		}
+		data := []byte(event.Data)
+		if event.DataBase64 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(event.DataBase64)
+			if err != nil {
+				return nil, "", nil, fmt.Errorf("invalid CloudEvent data_base64: %w", err)
+			}
+			data = decoded
+		}
+		dataContentType := event.DataContentType
+		if dataContentType == "" {
+			dataContentType = "application/json"
+		}
+		return data, dataContentType, &event, nil
+	}
+
+	if specVersion := header.Get("Ce-Specversion"); specVersion != "" {
+		return body, contentType, &cloudEvent{
+			SpecVersion:     specVersion,
+			ID:              header.Get("Ce-Id"),
+			Source:          header.Get("Ce-Source"),
+			Type:            header.Get("Ce-Type"),
+			Time:            header.Get("Ce-Time"),
+			DataContentType: contentType,
+		}, nil
+	}
+	return body, contentType, nil, nil
+}
+
+// decodePost decodes the body of a post to /webhook, unwrapping CloudEvents.
+// The data of other events than post2post posts is the payload, with the
+// event ID as request ID and no callback.
+func decodePost(r *http.Request, body []byte) (PostData, error) {
+	data, contentType, event, err := unwrapCloudEvent(r.Header, body)
+	if err != nil {
+		return PostData{}, err
+	}
+
+	var post PostData
+	if event == nil || event.Type == CloudEventTypePost {
+		err := encodingOf(contentType).unmarshal(data, &post)
+		return post, err
+	}
+
+	post.RequestID = event.ID
+	if isJSONMediaType(contentType) {
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &post.Payload); err != nil {
+				return PostData{}, fmt.Errorf("failed to unmarshal CloudEvent data: %w", err)
+			}
+		}
+	} else {
+		// data may be in a pooled buffer
+		post.Payload = bytes.Clone(data)
+	}
+	return post, nil
+}
+
+// decodeCallback decodes the body of a callback to /roundtrip into v,
+// unwrapping CloudEvents
+func decodeCallback(r *http.Request, body []byte, v interface{}) error {
+	data, contentType, _, err := unwrapCloudEvent(r.Header, body)
+	if err != nil {
+		return err
+	}
+	return encodingOf(contentType).unmarshal(data, v)
+}
+
+// isJSONMediaType reports whether contentType is JSON, including +json
+// types and a missing type
+func isJSONMediaType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
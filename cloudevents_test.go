@@ -0,0 +1,108 @@
+package post2post
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_WithCloudEvents(t *testing.T) {
+	processed := make(chan PostData, 1)
+	receiver := NewServer().WithInterface("127.0.0.1").
+		WithCloudEvents(CloudEventsBinary, "urn:test:receiver").
+		WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			processed <- PostData{Payload: payload, RequestID: requestID}
+			return map[string]interface{}{"original": payload}, nil
+		}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the headers of the post on its way to the receiver
+	headers := make(chan http.Header, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		receiver.server.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		name     string
+		mode     CloudEventsMode
+		encoding Encoding
+		check    func(http.Header) bool
+	}{
+		{"structured", CloudEventsStructured, EncodingJSON, func(h http.Header) bool {
+			return h.Get("Content-Type") == "application/cloudevents+json"
+		}},
+		{"structured test encoding", CloudEventsStructured, testEncoding, func(h http.Header) bool {
+			return h.Get("Content-Type") == "application/cloudevents+json"
+		}},
+		{"binary", CloudEventsBinary, testEncoding, func(h http.Header) bool {
+			return h.Get("Ce-Specversion") == "1.0" && h.Get("Ce-Type") == CloudEventTypePost &&
+				h.Get("Ce-Source") == "urn:test:sender" && h.Get("Content-Type") == testEncoding.ContentType()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := NewServer().WithInterface("127.0.0.1").
+				WithEncoding(tt.encoding).
+				WithCloudEvents(tt.mode, "urn:test:sender")
+			if err := sender.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer sender.Stop()
+
+			response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+			if err != nil {
+				t.Fatalf("RoundTripPostToURL() failed: %v", err)
+			}
+			if !response.Success {
+				t.Fatalf("RoundTripPostToURL() = %+v, want success", response)
+			}
+			if h := <-headers; !tt.check(h) {
+				t.Errorf("post headers = %v", h)
+			}
+			if post := <-processed; post.RequestID != response.RequestID {
+				t.Errorf("processed RequestID = %s, want %s", post.RequestID, response.RequestID)
+			}
+		})
+	}
+
+	// Events from other sources are processed with their data as payload
+	event := `{"specversion":"1.0","id":"order-1","source":"urn:shop","type":"com.example.order.created","data":{"order":42}}`
+	resp, err := http.Post(receiver.GetURL()+"/webhook", "application/cloudevents+json", bytes.NewBufferString(event))
+	if err != nil {
+		t.Fatalf("posting a CloudEvent failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("posting a CloudEvent status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	post := <-processed
+	if payload, ok := post.Payload.(map[string]interface{}); post.RequestID != "order-1" || !ok || payload["order"] != float64(42) {
+		t.Errorf("processed %+v, want the event data with its ID", post)
+	}
+}
+
+func TestUnwrapCloudEvent(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	body := []byte(`{"specversion":"1.0","id":"e1","source":"s","type":"t","datacontenttype":"application/octet-stream","data_base64":"AP8Q"}`)
+	data, contentType, event, err := unwrapCloudEvent(header, body)
+	if err != nil {
+		t.Fatalf("unwrapCloudEvent() failed: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x00, 0xff, 0x10}) || contentType != "application/octet-stream" || event == nil || event.ID != "e1" {
+		t.Errorf("unwrapCloudEvent() = %v, %s, %+v", data, contentType, event)
+	}
+
+	// Plain bodies are not events
+	header.Set("Content-Type", "application/json")
+	if _, _, event, err := unwrapCloudEvent(header, []byte(`{}`)); event != nil || err != nil {
+		t.Errorf("unwrapCloudEvent() = %+v, %v for a plain body", event, err)
+	}
+}
@@ -0,0 +1,229 @@
+package post2post
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression is a Content-Encoding of post and callback bodies
+type Compression string
+
+const (
+	// CompressionNone sends bodies uncompressed, the default
+	CompressionNone Compression = ""
+	// CompressionGzip compresses bodies with gzip
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd compresses bodies with Zstandard, faster and smaller
+	// than gzip. It is registered by
+	// github.com/pgdad/post2post/zstdcompression, so that the root module
+	// does not depend on a Zstandard library.
+	CompressionZstd Compression = "zstd"
+)
+
+// compressionMinSize is the size below which bodies are sent uncompressed,
+// as compressing them saves little
+const compressionMinSize = 1024
+
+// defaultMaxDecompressedSize is the default size above which decompressed
+// request bodies are rejected
+const defaultMaxDecompressedSize = 64 << 20
+
+// Compressor compresses and decompresses bodies in a Content-Encoding
+// registered with RegisterCompression
+type Compressor interface {
+	// Compress returns body compressed
+	Compress(body []byte) ([]byte, error)
+	// NewReader returns a reader decompressing r. At most maxSize bytes are
+	// read from it, so its decoder should not take more memory than that,
+	// and may fail early with an *http.MaxBytesError for bodies it knows
+	// to be larger.
+	NewReader(r io.Reader, maxSize int64) (io.ReadCloser, error)
+}
+
+// gzipCompressor compresses with gzip, the built-in compression
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Compression]Compressor{
+		CompressionGzip: gzipCompressor{},
+	}
+)
+
+// RegisterCompression makes compression available to WithCompression, and
+// decompresses bodies with it as Content-Encoding with c. It is called by
+// the init function of the package providing the compressor, e.g. on
+// importing github.com/pgdad/post2post/zstdcompression. Registering gzip or
+// no compression panics.
+func RegisterCompression(compression Compression, c Compressor) {
+	if compression == CompressionNone || compression == CompressionGzip {
+		panic(fmt.Sprintf("post2post: cannot register compression %q", compression))
+	}
+
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[compression] = c
+}
+
+// lookupCompressor returns the compressor of a registered compression
+func lookupCompressor(compression Compression) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[compression]
+	return c, ok
+}
+
+// WithCompression compresses posts of at least 1 KB, and the callbacks of
+// this server as a receiver to senders accepting it, with compression. Posts
+// name the compressions accepted for their callbacks in Accept-Encoding.
+// Compressed incoming bodies are decompressed whatever the compression
+// configured. Compressions that are not registered, e.g. zstd without
+// importing its module, are ignored.
+func (s *Server) WithCompression(compression Compression) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := lookupCompressor(compression); ok || compression == CompressionNone {
+		s.compression = compression
+	}
+	return s
+}
+
+// WithMaxDecompressedSize rejects compressed request bodies decompressing to
+// more than size bytes with 413 Request Entity Too Large, so that a small
+// highly compressed body cannot exhaust memory or disk. Bodies verified with
+// WithWebhookVerification are held in memory up to size too, unless payload
+// spill is enabled. It defaults to 64 MB; a zero or negative size restores
+// the default.
+func (s *Server) WithMaxDecompressedSize(size int64) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxDecompressed = size
+	return s
+}
+
+// acceptEncoding returns the Accept-Encoding of posts of a server
+// configured with compression, "" without compression. Gzip is accepted
+// besides any other compression, as every server has it.
+func acceptEncoding(compression Compression) string {
+	switch compression {
+	case CompressionNone:
+		return ""
+	case CompressionGzip:
+		return "gzip"
+	}
+	return string(compression) + ", gzip"
+}
+
+// acceptedCompression returns compression if the Accept-Encoding header of
+// a post lists it, and CompressionNone otherwise
+func acceptedCompression(accept string, compression Compression) Compression {
+	if compression == CompressionNone {
+		return CompressionNone
+	}
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), string(compression)) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return CompressionNone
+			}
+		}
+		return compression
+	}
+	return CompressionNone
+}
+
+// compressBody compresses body with compression if it is large enough,
+// setting the Content-Encoding of header accordingly
+func compressBody(compression Compression, body []byte, header http.Header) ([]byte, error) {
+	if compression == CompressionNone || len(body) < compressionMinSize {
+		return body, nil
+	}
+
+	compressor, ok := lookupCompressor(compression)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	compressed, err := compressor.Compress(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress body: %w", err)
+	}
+	header.Set("Content-Encoding", string(compression))
+	return compressed, nil
+}
+
+// decompressRequests decompresses request bodies with a registered
+// Content-Encoding for next, up to the configured maximum size, and rejects
+// other encodings
+func (s *Server) decompressRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		maxSize := s.maxDecompressed
+		s.mu.RUnlock()
+		if maxSize <= 0 {
+			maxSize = defaultMaxDecompressedSize
+		}
+
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		compressor, ok := lookupCompressor(Compression(encoding))
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q", encoding), http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := compressor.NewReader(r.Body, maxSize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s body", encoding), bodyErrorStatus(err))
+			return
+		}
+		defer body.Close()
+
+		r = r.Clone(r.Context())
+		r.Body = http.MaxBytesReader(w, body, maxSize)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyErrorStatus returns the status of a request whose body failed to read
+// with err: 413 Request Entity Too Large for bodies over a size limit, 400
+// Bad Request otherwise
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
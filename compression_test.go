@@ -0,0 +1,170 @@
+package post2post
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCompression is a compression registered by the tests, standing in for
+// the compressions of other modules
+const testCompression Compression = "deflate"
+
+type testCompressor struct{}
+
+func (testCompressor) Compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	writer.Write(body)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (testCompressor) NewReader(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func init() {
+	RegisterCompression(testCompression, testCompressor{})
+}
+
+func TestServer_WithCompression(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithCompression(testCompression)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the headers of the post on its way to the receiver
+	headers := make(chan http.Header, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		receiver.server.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	large := strings.Repeat("post2post ", 500)
+	tests := []struct {
+		name         string
+		compression  Compression
+		message      string
+		wantEncoding string
+	}{
+		{"gzip", CompressionGzip, large, "gzip"},
+		{"deflate", testCompression, large, "deflate"},
+		{"small", testCompression, "hello", ""},
+		{"none", CompressionNone, large, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := NewServer().WithInterface("127.0.0.1").WithCompression(tt.compression)
+			if err := sender.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer sender.Stop()
+
+			response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"message": tt.message}, "", 5*time.Second)
+			if err != nil {
+				t.Fatalf("RoundTripPostToURL() failed: %v", err)
+			}
+			if !response.Success || response.Payload.(map[string]interface{})["message"] != tt.message {
+				t.Fatalf("RoundTripPostToURL() = %+v, want the echoed message", response)
+			}
+			h := <-headers
+			if got := h.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("post Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got, want := h.Get("Accept-Encoding"), acceptEncoding(tt.compression); want != "" && got != want {
+				t.Errorf("post Accept-Encoding = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Unknown encodings are rejected
+	req, _ := http.NewRequest("POST", receiver.GetURL()+"/webhook", bytes.NewBufferString("{}"))
+	req.Header.Set("Content-Encoding", "br")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("br post status = %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+
+	// Zstandard is not registered without its module
+	if server := NewServer().WithCompression(CompressionZstd); server.compression != CompressionNone {
+		t.Errorf("WithCompression() accepted an unregistered compression: %s", server.compression)
+	}
+}
+
+func TestAcceptedCompression(t *testing.T) {
+	tests := []struct {
+		accept      string
+		compression Compression
+		want        Compression
+	}{
+		{"zstd, gzip", CompressionZstd, CompressionZstd},
+		{"gzip", CompressionZstd, CompressionNone},
+		{"GZIP;q=0.5", CompressionGzip, CompressionGzip},
+		{"gzip;q=0", CompressionGzip, CompressionNone},
+		{"zstd, gzip", CompressionNone, CompressionNone},
+		{"", CompressionGzip, CompressionNone},
+	}
+	for _, tt := range tests {
+		if got := acceptedCompression(tt.accept, tt.compression); got != tt.want {
+			t.Errorf("acceptedCompression(%q, %q) = %q, want %q", tt.accept, tt.compression, got, tt.want)
+		}
+	}
+}
+
+func TestServer_WithMaxDecompressedSize(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithMaxDecompressedSize(1 << 20)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// 16 MB of payload compress to a few KB
+	bomb := []byte(`{"payload":"` + strings.Repeat("a", 16<<20) + `"}`)
+	small := []byte(`{"payload":"` + strings.Repeat("a", 4096) + `"}`)
+	for _, compression := range []Compression{CompressionGzip, testCompression} {
+		for _, tt := range []struct {
+			name string
+			body []byte
+			want int
+		}{
+			{"bomb", bomb, http.StatusRequestEntityTooLarge},
+			{"small", small, http.StatusOK},
+		} {
+			t.Run(string(compression)+"/"+tt.name, func(t *testing.T) {
+				header := make(http.Header)
+				body, err := compressBody(compression, tt.body, header)
+				if err != nil {
+					t.Fatalf("compressBody() failed: %v", err)
+				}
+				if len(body) > 64<<10 {
+					t.Fatalf("compressed body is %d bytes, want a highly compressed body", len(body))
+				}
+				req, _ := http.NewRequest("POST", receiver.GetURL()+"/webhook", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Content-Encoding", header.Get("Content-Encoding"))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("POST /webhook failed: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.want {
+					t.Errorf("POST /webhook status = %d, want %d", resp.StatusCode, tt.want)
+				}
+			})
+		}
+	}
+}
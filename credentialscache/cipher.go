@@ -0,0 +1,235 @@
+package credentialscache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Cipher encrypts credentials cache entries at rest
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// KMSDataKeyClient is the subset of AWS KMS used for envelope encryption.
+// Adapt a kms.Client by calling GenerateDataKey with KeySpec AES_256 and
+// Decrypt with the CiphertextBlob.
+type KMSDataKeyClient interface {
+	// GenerateDataKey returns a new 256-bit data key in plaintext and
+	// encrypted under keyID
+	GenerateDataKey(ctx context.Context, keyID string) (plaintext, encrypted []byte, err error)
+	// Decrypt returns the plaintext of an encrypted data key
+	Decrypt(ctx context.Context, encrypted []byte) ([]byte, error)
+}
+
+// Header bytes identifying the cipher that wrote an entry
+const (
+	passphraseCipherVersion byte = 1
+	kmsCipherVersion        byte = 2
+)
+
+const (
+	scryptSaltSize = 16
+	kmsTimeout     = 30 * time.Second
+)
+
+// passphraseCipher derives an AES-256-GCM key from a passphrase with scrypt
+type passphraseCipher struct {
+	passphrase []byte
+}
+
+// kmsCipher encrypts each entry with a fresh KMS data key
+type kmsCipher struct {
+	client KMSDataKeyClient
+	keyID  string
+}
+
+// rotatingCipher encrypts with the current cipher and decrypts with it or
+// any previous one
+type rotatingCipher struct {
+	current  Cipher
+	previous []Cipher
+}
+
+// NewPassphraseCipher returns a Cipher that encrypts with AES-256-GCM
+// under a key derived from passphrase with scrypt and a random salt
+func NewPassphraseCipher(passphrase string) (Cipher, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("cache passphrase is required")
+	}
+	return &passphraseCipher{passphrase: []byte(passphrase)}, nil
+}
+
+// NewKMSCipher returns a Cipher that uses envelope encryption: each
+// entry is encrypted with a new data key, stored wrapped by the KMS key
+func NewKMSCipher(client KMSDataKeyClient, keyID string) (Cipher, error) {
+	if client == nil {
+		return nil, fmt.Errorf("KMS client is required")
+	}
+	if keyID == "" {
+		return nil, fmt.Errorf("KMS key ID is required")
+	}
+	return &kmsCipher{client: client, keyID: keyID}, nil
+}
+
+// NewRotatingCipher returns a Cipher for rotating the cache key: it
+// encrypts with current and decrypts entries written with current or any of
+// previous. Entries still under a previous key are re-encrypted with current
+// when they are loaded, after which the previous keys can be dropped.
+func NewRotatingCipher(current Cipher, previous ...Cipher) (Cipher, error) {
+	if current == nil {
+		return nil, fmt.Errorf("current cache cipher is required")
+	}
+	return &rotatingCipher{current: current, previous: previous}, nil
+}
+
+// Encrypt implements Cipher
+func (c *passphraseCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := c.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{passphraseCipherVersion}, salt...)
+	return sealGCM(key, header, plaintext)
+}
+
+// Decrypt implements Cipher
+func (c *passphraseCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 1+scryptSaltSize || ciphertext[0] != passphraseCipherVersion {
+		return nil, fmt.Errorf("cache entry was not encrypted with a passphrase")
+	}
+	salt := ciphertext[1 : 1+scryptSaltSize]
+	key, err := c.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(key, ciphertext[:1+scryptSaltSize], ciphertext[1+scryptSaltSize:])
+}
+
+// deriveKey derives the AES key for salt
+func (c *passphraseCipher) deriveKey(salt []byte) ([]byte, error) {
+	key, err := scrypt.Key(c.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive cache key: %w", err)
+	}
+	return key, nil
+}
+
+// Encrypt implements Cipher
+func (c *kmsCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+
+	key, wrapped, err := c.client.GenerateDataKey(ctx, c.keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate KMS data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("KMS data key is too large")
+	}
+
+	header := make([]byte, 3, 3+len(wrapped))
+	header[0] = kmsCipherVersion
+	binary.BigEndian.PutUint16(header[1:], uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	return sealGCM(key, header, plaintext)
+}
+
+// Decrypt implements Cipher
+func (c *kmsCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 3 || ciphertext[0] != kmsCipherVersion {
+		return nil, fmt.Errorf("cache entry was not encrypted with KMS")
+	}
+	end := 3 + int(binary.BigEndian.Uint16(ciphertext[1:3]))
+	if len(ciphertext) < end {
+		return nil, fmt.Errorf("cache entry is truncated")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+
+	key, err := c.client.Decrypt(ctx, ciphertext[3:end])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt KMS data key: %w", err)
+	}
+	return openGCM(key, ciphertext[:end], ciphertext[end:])
+}
+
+// Encrypt implements Cipher
+func (c *rotatingCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.current.Encrypt(plaintext)
+}
+
+// Decrypt implements Cipher
+func (c *rotatingCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext, _, err := c.decrypt(ciphertext)
+	return plaintext, err
+}
+
+// decrypt decrypts ciphertext and reports whether a previous key was needed
+func (c *rotatingCipher) decrypt(ciphertext []byte) ([]byte, bool, error) {
+	plaintext, err := c.current.Decrypt(ciphertext)
+	if err == nil {
+		return plaintext, false, nil
+	}
+	for _, previous := range c.previous {
+		if plaintext, prevErr := previous.Decrypt(ciphertext); prevErr == nil {
+			return plaintext, true, nil
+		}
+	}
+	return nil, false, err
+}
+
+// sealGCM encrypts plaintext and returns header, nonce and ciphertext. The
+// header is authenticated but not encrypted.
+func sealGCM(key, header, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(out, nonce, plaintext, header), nil
+}
+
+// openGCM decrypts the nonce and ciphertext written by sealGCM
+func openGCM(key, header, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cache entry is truncated")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt cache entry: wrong key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+// newGCM returns an AES-GCM AEAD for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
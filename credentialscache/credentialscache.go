@@ -0,0 +1,94 @@
+// Package credentialscache provides credentials cache backends for
+// post2post.AWSCredentialsProvider that need libraries of their own: the OS
+// keyring, and stores encrypting their entries at rest, e.g. in files. Use
+// them with WithCredentialsCache:
+//
+//	provider.WithCredentialsCache(credentialscache.NewKeyringStore("post2post"))
+//
+// It is a module of its own so that only programs caching credentials this
+// way depend on the keyring and key derivation libraries.
+package credentialscache
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pgdad/post2post"
+)
+
+// encryptedSuffix is appended to the keys of encrypted entries, so that
+// they are kept apart from plaintext ones in the same store
+const encryptedSuffix = ".enc"
+
+// encryptedStore encrypts the entries of another store with a cipher
+type encryptedStore struct {
+	store  post2post.CredentialsCacheStore
+	cipher Cipher
+}
+
+// NewEncryptedStore returns a CredentialsCacheStore keeping entries in store
+// encrypted with c. Refreshes are serialized across processes, and entries
+// reported in files, if store does so.
+func NewEncryptedStore(store post2post.CredentialsCacheStore, c Cipher) post2post.CredentialsCacheStore {
+	return &encryptedStore{store: store, cipher: c}
+}
+
+// NewEncryptedFileStore returns a CredentialsCacheStore that keeps each
+// entry in a file in dir encrypted with c, as post2post.NewFileCacheStore
+// does in plaintext
+func NewEncryptedFileStore(dir string, c Cipher) post2post.CredentialsCacheStore {
+	return NewEncryptedStore(post2post.NewFileCacheStore(dir), c)
+}
+
+// Load implements CredentialsCacheStore. Entries under a previous key of a
+// rotating cipher are re-encrypted with its current key.
+func (s *encryptedStore) Load(key string) ([]byte, error) {
+	data, err := s.store.Load(key + encryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if rotating, ok := s.cipher.(*rotatingCipher); ok {
+		plaintext, stale, err := rotating.decrypt(data)
+		if err == nil && stale {
+			if err := s.Save(key, plaintext); err != nil {
+				log.Printf("Warning: failed to re-encrypt cache entry %s with the current key: %v", key, err)
+			}
+		}
+		return plaintext, err
+	}
+	return s.cipher.Decrypt(data)
+}
+
+// Save implements CredentialsCacheStore
+func (s *encryptedStore) Save(key string, data []byte) error {
+	encrypted, err := s.cipher.Encrypt(data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt cached credentials: %w", err)
+	}
+	return s.store.Save(key+encryptedSuffix, encrypted)
+}
+
+// Delete implements CredentialsCacheStore
+func (s *encryptedStore) Delete(key string) error {
+	return s.store.Delete(key + encryptedSuffix)
+}
+
+// Lock implements CredentialsCacheLocker, doing nothing if the store does
+// not serialize refreshes
+func (s *encryptedStore) Lock(key string) (func(), error) {
+	locker, ok := s.store.(post2post.CredentialsCacheLocker)
+	if !ok {
+		return func() {}, nil
+	}
+	return locker.Lock(key + encryptedSuffix)
+}
+
+// Path implements CredentialsCacheFiler, returning "" if the store does not
+// keep entries in files
+func (s *encryptedStore) Path(key string) string {
+	filer, ok := s.store.(post2post.CredentialsCacheFiler)
+	if !ok {
+		return ""
+	}
+	return filer.Path(key + encryptedSuffix)
+}
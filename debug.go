@@ -0,0 +1,141 @@
+package post2post
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugConfig configures the pprof and expvar endpoints
+type debugConfig struct {
+	enabled bool
+	// addr is the address of a separate listener, "" to serve the endpoints
+	// on the server
+	addr   string
+	server *http.Server
+	url    string
+}
+
+// WithDebugEndpoints serves /debug/pprof and /debug/vars, e.g. to diagnose
+// goroutine leaks from stuck round trips on a live server. /debug/vars holds
+// the published expvars and the server's Stats under "post2post". The
+// endpoints are served on the server, or on a separate listener at
+// listenAddr, which must be a loopback address such as "localhost:6060";
+// Start fails otherwise. On the server, Start likewise fails unless it
+// listens on a loopback address or WithAllowedTags restricts its callers.
+// They are never served through Tailscale Funnel.
+func (s *Server) WithDebugEndpoints(listenAddr ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.debug.enabled = true
+	s.debug.addr = ""
+	if len(listenAddr) > 0 {
+		s.debug.addr = listenAddr[0]
+	}
+	return s
+}
+
+// GetDebugURL returns the base URL of the debug endpoints, "" if they are
+// not enabled or their listener is not running
+func (s *Server) GetDebugURL() string {
+	s.mu.RLock()
+	enabled, addr, url := s.debug.enabled, s.debug.addr, s.debug.url
+	s.mu.RUnlock()
+
+	if !enabled {
+		return ""
+	}
+	if addr != "" {
+		return url
+	}
+	return s.GetURL()
+}
+
+// handleDebugEndpoints adds the debug endpoints to mux, each wrapped with
+// wrap
+func (s *Server) handleDebugEndpoints(mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("/debug/pprof/", wrap(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", wrap(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", wrap(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", wrap(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", wrap(pprof.Trace))
+	mux.HandleFunc("/debug/vars", wrap(s.debugVarsHandler))
+}
+
+// debugVarsHandler serves the published expvars as expvar.Handler does,
+// with the server's Stats
+func (s *Server) debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(s.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", "post2post", stats)
+}
+
+// checkDebugOnServer fails if the debug endpoints are to be served on the
+// server listening on listener, but it is reachable by anyone: it neither
+// listens on a loopback address nor requires allowed tags. Must be called
+// with s.mu held.
+func (s *Server) checkDebugOnServer(listener net.Listener) error {
+	if !s.debug.enabled || s.debug.addr != "" || len(s.allowedTags) > 0 {
+		return nil
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("debug endpoints on the server require it to listen on a loopback address or allowed tags; give WithDebugEndpoints a loopback listen address instead")
+}
+
+// startDebugListener serves the debug endpoints on their separate listener,
+// if configured. Must be called with s.mu held.
+func (s *Server) startDebugListener() error {
+	if !s.debug.enabled || s.debug.addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(s.debug.addr)
+	if err != nil {
+		return fmt.Errorf("invalid debug listen address %q: %w", s.debug.addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug endpoints must listen on a loopback address, not %q", s.debug.addr)
+	}
+	ln, err := net.Listen("tcp", s.debug.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for debug endpoints: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	s.handleDebugEndpoints(mux, func(handler http.HandlerFunc) http.HandlerFunc { return handler })
+	s.debug.server = &http.Server{Handler: mux}
+	s.debug.url = "http://" + ln.Addr().String()
+	log.Printf("Debug endpoints listening on %s", s.debug.url)
+
+	debugServer := s.debug.server
+	go func() {
+		if err := debugServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Debug server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopDebugListener stops the separate listener of the debug endpoints, if
+// any. Must be called with s.mu held.
+func (s *Server) stopDebugListener() {
+	if s.debug.server != nil {
+		s.debug.server.Close()
+		s.debug.server = nil
+	}
+	s.debug.url = ""
+}
@@ -0,0 +1,124 @@
+package post2post
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// getDebug fetches path from baseURL, returning the status and body
+func getDebug(t *testing.T, baseURL, path string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(baseURL + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestServer_DebugEndpoints(t *testing.T) {
+	server := NewServer().WithInterface("127.0.0.1").WithDebugEndpoints()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetDebugURL() != server.GetURL() {
+		t.Errorf("GetDebugURL() = %q, want the server URL %q", server.GetDebugURL(), server.GetURL())
+	}
+	status, body := getDebug(t, server.GetDebugURL(), "/debug/pprof/")
+	if status != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("GET /debug/pprof/ = %d, want the profile index", status)
+	}
+	status, body = getDebug(t, server.GetDebugURL(), "/debug/vars")
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &vars); status != http.StatusOK || err != nil {
+		t.Fatalf("GET /debug/vars = %d %v, want JSON", status, err)
+	}
+	var stats ServerStats
+	if err := json.Unmarshal(vars["post2post"], &stats); err != nil {
+		t.Errorf("post2post var = %s, want the server stats: %v", vars["post2post"], err)
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Error("GET /debug/vars has no memstats")
+	}
+}
+
+func TestServer_DebugEndpointsDisabled(t *testing.T) {
+	server := NewServer().WithInterface("127.0.0.1")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetDebugURL() != "" {
+		t.Errorf("GetDebugURL() = %q, want empty", server.GetDebugURL())
+	}
+	if _, body := getDebug(t, server.GetURL(), "/debug/vars"); strings.Contains(body, "memstats") {
+		t.Error("GET /debug/vars served without debug endpoints")
+	}
+}
+
+func TestServer_DebugEndpointsSeparateListener(t *testing.T) {
+	server := NewServer().WithInterface("127.0.0.1").WithDebugEndpoints("127.0.0.1:0")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	debugURL := server.GetDebugURL()
+	if debugURL == "" || debugURL == server.GetURL() {
+		t.Fatalf("GetDebugURL() = %q, want a separate listener", debugURL)
+	}
+	if status, _ := getDebug(t, debugURL, "/debug/pprof/goroutine?debug=1"); status != http.StatusOK {
+		t.Errorf("GET /debug/pprof/goroutine = %d, want 200", status)
+	}
+	if _, body := getDebug(t, server.GetURL(), "/debug/vars"); strings.Contains(body, "memstats") {
+		t.Error("GET /debug/vars served on the server with a separate listener")
+	}
+
+	server.Stop()
+	if server.GetDebugURL() != "" {
+		t.Errorf("GetDebugURL() = %q after Stop, want empty", server.GetDebugURL())
+	}
+	if _, err := http.Get(debugURL + "/debug/vars"); err == nil {
+		t.Error("debug listener still serving after Stop")
+	}
+}
+
+func TestServer_DebugEndpointsRequireLoopback(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", ":0", "example.com:6060", "localhost"} {
+		server := NewServer().WithInterface("127.0.0.1").WithDebugEndpoints(addr)
+		if err := server.Start(); err == nil {
+			server.Stop()
+			t.Errorf("Start() with debug address %q succeeded, want an error", addr)
+		}
+		if server.IsRunning() {
+			t.Errorf("server running after a failed Start with debug address %q", addr)
+		}
+	}
+}
+
+func TestServer_DebugEndpointsOnServerRequireLoopbackOrTags(t *testing.T) {
+	server := NewServer().WithDebugEndpoints()
+	if err := server.Start(); err == nil {
+		server.Stop()
+		t.Error("Start() with debug endpoints on all interfaces succeeded, want an error")
+	}
+	if server.IsRunning() {
+		t.Error("server running after a failed Start")
+	}
+
+	server = NewServer().WithDebugEndpoints().WithAllowedTags("tag:ops")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() with allowed tags failed: %v", err)
+	}
+	defer server.Stop()
+	// Without a tailnet no caller bears the tag
+	if status, _ := getDebug(t, server.GetURL(), "/debug/vars"); status != http.StatusForbidden {
+		t.Errorf("GET /debug/vars = %d, want 403", status)
+	}
+}
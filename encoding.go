@@ -0,0 +1,239 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// Encoding is the wire encoding of posts and callbacks over HTTP, named by
+// their Content-Type header
+type Encoding string
+
+// Supported encodings. CBOR and MessagePack are available once the module
+// providing their codec is imported, so that the root module does not depend
+// on their libraries.
+const (
+	// EncodingJSON encodes as JSON, the default
+	EncodingJSON Encoding = "json"
+	// EncodingCBOR encodes as CBOR (RFC 8949), which is more compact and
+	// carries []byte payloads as byte strings instead of base64. It is
+	// registered by github.com/pgdad/post2post/cborencoding.
+	EncodingCBOR Encoding = "cbor"
+	// EncodingMsgpack encodes as MessagePack, which is faster to encode and
+	// decode than JSON for large payloads and also carries []byte payloads
+	// as binary. It is registered by
+	// github.com/pgdad/post2post/msgpackencoding.
+	EncodingMsgpack Encoding = "msgpack"
+	// EncodingProtobuf encodes as a post2postpb.Envelope (see
+	// proto/post2post/v1/envelope.proto), a strict contract for receivers
+	// in other languages. []byte payloads are carried as is, others as
+	// JSON. It is registered by github.com/pgdad/post2post/grpctransport.
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Codec encodes and decodes bodies in an encoding registered with
+// RegisterEncoding. Codecs encode structs by the JSON names of their
+// fields, and decode payloads to the same types as JSON where the encoding
+// allows.
+type Codec interface {
+	// Name names the encoding in errors, e.g. "CBOR"
+	Name() string
+	// MediaTypes returns the media types of the encoding: the Content-Type
+	// of the bodies it encodes first, then others it is also known by
+	MediaTypes() []string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// BufferEncoder is implemented by codecs that encode into a buffer as
+// Marshal does, so that bodies are encoded into pooled buffers without
+// allocating the result
+type BufferEncoder interface {
+	Encode(buf *bytes.Buffer, v interface{}) error
+}
+
+// codec encodes and decodes bodies in an encoding
+type codec struct {
+	name        string
+	contentType string
+	// aliases are other media types of the encoding in use
+	aliases   []string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+	// encode, if set, encodes v into buf as marshal does, without
+	// allocating the result
+	encode func(buf *bytes.Buffer, v interface{}) error
+}
+
+// hasMediaType reports whether mediaType names the encoding
+func (c codec) hasMediaType(mediaType string) bool {
+	if mediaType == c.contentType {
+		return true
+	}
+	for _, alias := range c.aliases {
+		if mediaType == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeJSON encodes v into buf as json.Marshal does
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// Unlike Marshal, Encode ends the value with a newline
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[Encoding]codec{
+		EncodingJSON: {name: "JSON", contentType: "application/json", marshal: json.Marshal, unmarshal: json.Unmarshal, encode: encodeJSON},
+	}
+)
+
+// RegisterEncoding makes encoding available to WithEncoding, and decodes
+// bodies of its media types with c. It is called by the init function of
+// the package providing the codec, e.g. on importing
+// github.com/pgdad/post2post/cborencoding. Registering JSON, or a codec
+// without media types, panics.
+func RegisterEncoding(encoding Encoding, c Codec) {
+	mediaTypes := c.MediaTypes()
+	if encoding == EncodingJSON || len(mediaTypes) == 0 {
+		panic(fmt.Sprintf("post2post: cannot register encoding %q", encoding))
+	}
+	registered := codec{
+		name:        c.Name(),
+		contentType: mediaTypes[0],
+		aliases:     mediaTypes[1:],
+		marshal:     c.Marshal,
+		unmarshal:   c.Unmarshal,
+	}
+	if encoder, ok := c.(BufferEncoder); ok {
+		registered.encode = encoder.Encode
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[encoding] = registered
+}
+
+// lookupCodec returns the codec of a registered encoding
+func lookupCodec(encoding Encoding) (codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[encoding]
+	return c, ok
+}
+
+// ContentType returns the media type of the encoding
+func (e Encoding) ContentType() string {
+	return e.codec().contentType
+}
+
+// codec returns the codec of the encoding, JSON's for unknown encodings
+func (e Encoding) codec() codec {
+	if c, ok := lookupCodec(e); ok {
+		return c
+	}
+	c, _ := lookupCodec(EncodingJSON)
+	return c
+}
+
+// marshal encodes v
+func (e Encoding) marshal(v interface{}) ([]byte, error) {
+	c := e.codec()
+	data, err := c.marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", c.name, err)
+	}
+	return data, nil
+}
+
+// marshalBuffer encodes v into a pooled buffer, to be returned with
+// putBuffer once nothing refers to its bytes
+func (e Encoding) marshalBuffer(v interface{}) (*bytes.Buffer, error) {
+	c := e.codec()
+	if c.encode == nil {
+		data, err := e.marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(data), nil
+	}
+	buf := getBuffer()
+	if err := c.encode(buf, v); err != nil {
+		putBuffer(buf)
+		return nil, fmt.Errorf("failed to marshal %s: %w", c.name, err)
+	}
+	return buf, nil
+}
+
+// unmarshal decodes data into v
+func (e Encoding) unmarshal(data []byte, v interface{}) error {
+	c := e.codec()
+	if err := c.unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", c.name, err)
+	}
+	return nil
+}
+
+// encodingOf returns the encoding of a body with the given Content-Type.
+// Bodies of other or missing types are taken as JSON, as they were before
+// encodings could be negotiated.
+func encodingOf(contentType string) Encoding {
+	if encoding, ok := encodingForMediaType(contentType); ok {
+		return encoding
+	}
+	return EncodingJSON
+}
+
+// acceptedEncoding returns the first supported encoding of an Accept header,
+// which senders set to the encoding of their callbacks, or JSON
+func acceptedEncoding(accept string) Encoding {
+	for _, part := range strings.Split(accept, ",") {
+		if encoding, ok := encodingForMediaType(strings.TrimSpace(part)); ok {
+			return encoding
+		}
+	}
+	return EncodingJSON
+}
+
+// encodingForMediaType returns the encoding a media type, possibly with
+// parameters, names
+func encodingForMediaType(value string) (Encoding, bool) {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", false
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for encoding, c := range codecs {
+		if c.hasMediaType(mediaType) {
+			return encoding, true
+		}
+	}
+	return "", false
+}
+
+// WithEncoding encodes posts over HTTP with encoding and asks receivers for
+// callbacks in it with the Accept header. Servers decode posts and
+// callbacks by their Content-Type whatever their own encoding. Encodings
+// that are not registered, e.g. CBOR without importing its module, are
+// ignored.
+func (s *Server) WithEncoding(encoding Encoding) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := lookupCodec(encoding); ok {
+		s.encoding = encoding
+	}
+	return s
+}
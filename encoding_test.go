@@ -0,0 +1,114 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+)
+
+// testEncoding is an encoding registered by the tests, JSON under another
+// media type, standing in for the encodings of other modules
+const testEncoding Encoding = "test"
+
+type testCodec struct{}
+
+func (testCodec) Name() string { return "test" }
+
+func (testCodec) MediaTypes() []string {
+	return []string{"application/x-post2post-test", "application/x-post2post-alias"}
+}
+
+func (testCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (testCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (testCodec) Encode(buf *bytes.Buffer, v interface{}) error { return encodeJSON(buf, v) }
+
+func init() {
+	RegisterEncoding(testEncoding, testCodec{})
+}
+
+func TestServer_WithEncoding(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		return map[string]interface{}{"original": payload}, nil
+	}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the content type of the post on its way to the receiver
+	contentTypes := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes <- r.Header.Get("Content-Type")
+		receiver.server.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithEncoding(testEncoding)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPostToURL() = %+v, want success", response)
+	}
+	if contentType := <-contentTypes; contentType != testEncoding.ContentType() {
+		t.Errorf("post Content-Type = %s, want %s", contentType, testEncoding.ContentType())
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %#v, want the original message", original)
+	}
+}
+
+func TestEncodingNegotiation(t *testing.T) {
+	tests := []struct {
+		header     string
+		ofType     Encoding
+		acceptable Encoding
+	}{
+		{"", EncodingJSON, EncodingJSON},
+		{"application/json; charset=utf-8", EncodingJSON, EncodingJSON},
+		{"application/x-post2post-test", testEncoding, testEncoding},
+		{"text/plain, application/x-post2post-alias;q=0.9", EncodingJSON, testEncoding},
+		{"application/cbor", EncodingJSON, EncodingJSON},
+		{"application/x-protobuf", EncodingJSON, EncodingJSON},
+	}
+	for _, tt := range tests {
+		if got := encodingOf(tt.header); got != tt.ofType {
+			t.Errorf("encodingOf(%q) = %s, want %s", tt.header, got, tt.ofType)
+		}
+		if got := acceptedEncoding(tt.header); got != tt.acceptable {
+			t.Errorf("acceptedEncoding(%q) = %s, want %s", tt.header, got, tt.acceptable)
+		}
+	}
+
+	if server := NewServer().WithEncoding("yaml"); server.encoding != "" {
+		t.Errorf("WithEncoding() accepted an unsupported encoding: %s", server.encoding)
+	}
+	// CBOR, MessagePack and protobuf are not registered without their modules
+	for _, encoding := range []Encoding{EncodingCBOR, EncodingMsgpack, EncodingProtobuf} {
+		if server := NewServer().WithEncoding(encoding); server.encoding != "" {
+			t.Errorf("WithEncoding() accepted an unregistered encoding: %s", server.encoding)
+		}
+	}
+}
+
+func TestRegisterEncoding_JSON(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterEncoding() of JSON did not panic")
+		}
+	}()
+	RegisterEncoding(EncodingJSON, testCodec{})
+}
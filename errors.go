@@ -0,0 +1,69 @@
+package post2post
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of the server and its round trips. Match them with errors.Is on the
+// returned errors or on the Err of a RoundTripResponse.
+var (
+	// ErrPostURLNotConfigured means a post was sent without a post URL or
+	// transport configured
+	ErrPostURLNotConfigured = errors.New("post URL not configured")
+	// ErrServerNotRunning means the operation needs the server to be running
+	ErrServerNotRunning = errors.New("server is not running")
+	// ErrServerRunning means Start was called on a running server
+	ErrServerRunning = errors.New("server is already running")
+	// ErrRoundTripTimeout means the response of a round trip did not arrive
+	// before its timeout
+	ErrRoundTripTimeout = errors.New("timeout waiting for response")
+)
+
+// ReceiverError is the error a receiver reported in the response of a round
+// trip, e.g. a processing error
+type ReceiverError struct {
+	Message string
+}
+
+func (e *ReceiverError) Error() string {
+	return e.Message
+}
+
+// FailedResponse returns the response of a round trip that failed with err,
+// which sets its Error, StatusCode and Timeout. Transports report their
+// failures with it, e.g. ErrRoundTripTimeout once the round trip's context
+// is done.
+func FailedResponse(requestID string, err error) *RoundTripResponse {
+	response := &RoundTripResponse{
+		Error:     err.Error(),
+		Err:       err,
+		Timeout:   errors.Is(err, ErrRoundTripTimeout),
+		RequestID: requestID,
+	}
+	var statusErr *PostStatusError
+	if errors.As(err, &statusErr) {
+		response.StatusCode = statusErr.StatusCode
+	}
+	return response
+}
+
+// failedResponsef is FailedResponse with an error formatted as by
+// fmt.Errorf
+func failedResponsef(requestID string, format string, args ...interface{}) *RoundTripResponse {
+	return FailedResponse(requestID, fmt.Errorf(format, args...))
+}
+
+// SetErr sets the Err of a response decoded from a receiver or transport
+// from its Error, as ErrRoundTripTimeout or a *ReceiverError, and returns
+// the response
+func (r *RoundTripResponse) SetErr() *RoundTripResponse {
+	switch {
+	case r.Err != nil || r.Success:
+	case r.Timeout:
+		r.Err = ErrRoundTripTimeout
+	case r.Error != "":
+		r.Err = &ReceiverError{Message: r.Error}
+	}
+	return r
+}
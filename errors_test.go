@@ -0,0 +1,91 @@
+package post2post
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFailedResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantTimeout bool
+		wantStatus  int
+	}{
+		{"timeout", ErrRoundTripTimeout, true, 0},
+		{"status", &PostStatusError{StatusCode: 502}, false, 502},
+		{"wrapped status", fmt.Errorf("failed to post: %w", &PostStatusError{StatusCode: 429}), false, 429},
+		{"other", errors.New("connection refused"), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := FailedResponse("req-1", tt.err)
+			if response.Success || response.Err != tt.err || response.Error != tt.err.Error() {
+				t.Errorf("FailedResponse() = %+v, want error %v", response, tt.err)
+			}
+			if response.Timeout != tt.wantTimeout || response.StatusCode != tt.wantStatus || response.RequestID != "req-1" {
+				t.Errorf("FailedResponse() = %+v, want timeout %v and status %d", response, tt.wantTimeout, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRoundTripResponse_SetErr(t *testing.T) {
+	if response := (&RoundTripResponse{Success: true}).SetErr(); response.Err != nil {
+		t.Errorf("successful response Err = %v, want nil", response.Err)
+	}
+	if response := (&RoundTripResponse{Error: "timeout waiting for response", Timeout: true}).SetErr(); !errors.Is(response.Err, ErrRoundTripTimeout) {
+		t.Errorf("timed out response Err = %v, want ErrRoundTripTimeout", response.Err)
+	}
+
+	response := (&RoundTripResponse{Error: "Processing error: bad payload"}).SetErr()
+	var receiverErr *ReceiverError
+	if !errors.As(response.Err, &receiverErr) || receiverErr.Message != "Processing error: bad payload" {
+		t.Errorf("failed response Err = %v, want a ReceiverError", response.Err)
+	}
+}
+
+func TestRoundTripPost_TypedErrors(t *testing.T) {
+	server := NewServer().WithInterface("127.0.0.1")
+	if _, err := server.GetTailscaleURL(); !errors.Is(err, ErrServerNotRunning) {
+		t.Errorf("GetTailscaleURL() error = %v, want ErrServerNotRunning", err)
+	}
+	if _, err := server.RoundTripPostViaEvents("hello", "", time.Second); !errors.Is(err, ErrPostURLNotConfigured) {
+		t.Errorf("RoundTripPostViaEvents() error = %v, want ErrPostURLNotConfigured", err)
+	}
+	if _, err := server.RoundTripPostStream("hello", "", time.Second, nil); !errors.Is(err, ErrPostURLNotConfigured) {
+		t.Errorf("RoundTripPostStream() error = %v, want ErrPostURLNotConfigured", err)
+	}
+
+	feed := make(chan *RoundTripResponse)
+	server.WithTransport(&stubTransport{responses: feed})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+	if err := server.Start(); !errors.Is(err, ErrServerRunning) {
+		t.Errorf("second Start() error = %v, want ErrServerRunning", err)
+	}
+
+	response, err := server.RoundTripPostWithTimeout("hello", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Timeout || !errors.Is(response.Err, ErrRoundTripTimeout) {
+		t.Errorf("RoundTripPost() = %+v, want ErrRoundTripTimeout", response)
+	}
+}
+
+// stubTransport accepts every post and delivers the responses of feed
+type stubTransport struct {
+	responses chan *RoundTripResponse
+}
+
+func (s *stubTransport) Send(ctx context.Context, post *Post) error { return nil }
+
+func (s *stubTransport) ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error) {
+	return s.responses, nil
+}
@@ -0,0 +1,398 @@
+package post2post
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseModeEvents asks a receiver to keep the response to a post for
+// GET /events instead of posting it to a callback URL
+const ResponseModeEvents = "events"
+
+// EventsTokenHeader carries the secret a sender chooses for a post made with
+// ResponseModeEvents. It must be sent with the post and with GET /events,
+// so that only the sender can collect the response, and only its post can
+// answer the request ID.
+const EventsTokenHeader = "X-Post2Post-Events-Token"
+
+// Event stream timings
+const (
+	// eventRetention bounds how long a response waits for its subscriber,
+	// and a subscriber for its response, before the entry is dropped
+	eventRetention = 5 * time.Minute
+	// eventKeepAlive is the interval of comments keeping idle streams open
+	// through proxies
+	eventKeepAlive = 15 * time.Second
+	// maxPendingEvents caps the entries held for responses and subscribers,
+	// as anyone able to reach /events can create one
+	maxPendingEvents = 1024
+)
+
+// Event hub errors
+var (
+	errEventsTokenMismatch = errors.New("request_id is held with another events token")
+	errEventsFull          = errors.New("too many pending events")
+)
+
+// eventEntry is the response to one request ID, ready once closed
+type eventEntry struct {
+	requestID string
+	// token is the events token of the post or subscriber that came first
+	token    string
+	response *RoundTripResponse
+	ready    chan struct{}
+	created  time.Time
+}
+
+// eventHub holds responses to posts made with ResponseModeEvents until
+// their sender collects them from /events. Either may come first.
+type eventHub struct {
+	mu      sync.Mutex
+	entries map[string]*eventEntry
+	// order holds the entries by creation, so the oldest expire first
+	order []*eventEntry
+}
+
+// newEventHub returns an empty event hub
+func newEventHub() *eventHub {
+	return &eventHub{entries: make(map[string]*eventEntry)}
+}
+
+// entry returns the entry of requestID, creating it with token if needed.
+// It fails if the entry exists with another token, or if a new one would
+// exceed maxPendingEvents. It drops expired entries. Must be called with
+// h.mu held.
+func (h *eventHub) entry(requestID, token string) (*eventEntry, error) {
+	now := time.Now()
+	for len(h.order) > 0 && now.Sub(h.order[0].created) > eventRetention {
+		expired := h.order[0]
+		h.order[0] = nil
+		h.order = h.order[1:]
+		delete(h.entries, expired.requestID)
+	}
+
+	e, ok := h.entries[requestID]
+	if !ok {
+		if len(h.entries) >= maxPendingEvents {
+			return nil, errEventsFull
+		}
+		e = &eventEntry{requestID: requestID, token: token, ready: make(chan struct{}), created: now}
+		h.entries[requestID] = e
+		h.order = append(h.order, e)
+		return e, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(e.token), []byte(token)) != 1 {
+		return nil, errEventsTokenMismatch
+	}
+	return e, nil
+}
+
+// publish stores the response to requestID and wakes its subscribers. It
+// fails if the request ID is held with another token or the hub is full.
+func (h *eventHub) publish(requestID, token string, response *RoundTripResponse) error {
+	e, err := h.subscribe(requestID, token)
+	if err != nil {
+		return err
+	}
+	h.complete(e, response)
+	return nil
+}
+
+// complete stores response in e and wakes its subscribers. Posts claim
+// their entry with subscribe before they are processed, so that one refused
+// has had no effect. A response already stored is kept.
+func (h *eventHub) complete(e *eventEntry, response *RoundTripResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	select {
+	case <-e.ready:
+		// A response was already published for this request ID
+	default:
+		e.response = response
+		close(e.ready)
+	}
+}
+
+// subscribe returns the entry to wait on for the response to requestID, or
+// to complete with it. It fails if the request ID is held with another
+// token or the hub is full.
+func (h *eventHub) subscribe(requestID, token string) (*eventEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.entry(requestID, token)
+}
+
+// remove drops the entry of requestID once its response was delivered
+func (h *eventHub) remove(requestID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.entries[requestID]
+	if !ok {
+		return
+	}
+	delete(h.entries, requestID)
+	// Keep the order within maxPendingEvents too
+	for i, o := range h.order {
+		if o == e {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// eventsHandler streams the response to the request_id query parameter as
+// a Server-Sent Event named "response" and then ends the stream. The
+// subscriber must present the events token of the post.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := r.URL.Query().Get("request_id")
+	if requestID == "" {
+		http.Error(w, "request_id is required", http.StatusBadRequest)
+		return
+	}
+	token := r.Header.Get(EventsTokenHeader)
+	if token == "" {
+		http.Error(w, EventsTokenHeader+" is required", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := s.events.subscribe(requestID, token)
+	if err != nil {
+		http.Error(w, err.Error(), eventsErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-entry.ready:
+			data, err := json.Marshal(entry.response)
+			if err != nil {
+				log.Printf("eventsHandler: Failed to marshal response for RequestID %s: %v", requestID, err)
+				return
+			}
+			fmt.Fprintf(w, "event: response\ndata: %s\n\n", data)
+			flusher.Flush()
+			s.events.remove(requestID)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// eventsErrorStatus returns the status answering an event hub error: 503
+// while the hub is full, 403 for a request ID held with another token
+func eventsErrorStatus(err error) int {
+	if errors.Is(err, errEventsFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusForbidden
+}
+
+// WithEventsURL sets the URL of the receiver's /events stream used by
+// RoundTripPostViaEvents. By default it is the post URL with its path
+// replaced by /events.
+func (s *Server) WithEventsURL(eventsURL string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.eventsURL = eventsURL
+	return s
+}
+
+// GetEventsURL returns the URL of the receiver's /events stream, "" if
+// neither it nor the post URL is configured
+func (s *Server) GetEventsURL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.eventsURL != "" || s.postURL == "" {
+		return s.eventsURL
+	}
+	u, err := url.Parse(s.postURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = "/events"
+	u.RawQuery = ""
+	return u.String()
+}
+
+// RoundTripPostViaEvents performs a round trip without a callback to this
+// server: it subscribes to the receiver's /events stream for the request ID,
+// posts the payload with ResponseModeEvents and waits for the response on
+// the stream. It suits senders that cannot accept inbound connections, and
+// the server need not be running. Like RoundTripPost, failures are reported
+// in the response.
+func (s *Server) RoundTripPostViaEvents(payload interface{}, tailnetKey string, timeout time.Duration) (*RoundTripResponse, error) {
+	started := s.roundTripStarted()
+	response, err := s.roundTripPostViaEvents(payload, tailnetKey, timeout)
+	postURL := s.GetPostURL()
+	s.roundTripFinished(postURL, started, timeout, response)
+	s.auditRoundTrip(postURL, "", payload, started, response)
+	return response, err
+}
+
+// roundTripPostViaEvents performs a round trip over /events
+func (s *Server) roundTripPostViaEvents(payload interface{}, tailnetKey string, timeout time.Duration) (*RoundTripResponse, error) {
+	s.mu.RLock()
+	postURL := s.postURL
+	client := s.client
+	s.mu.RUnlock()
+	eventsURL := s.GetEventsURL()
+
+	if postURL == "" || eventsURL == "" {
+		return nil, ErrPostURLNotConfigured
+	}
+	node, err := s.tailnetNodeFor(postURL, "")
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		client = node.client
+	}
+	// The stream outlives the client's timeout; the context bounds it
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	requestID := PayloadRequestID(payload)
+	token := newEventsToken()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Subscribe before posting so that no response is missed, and the
+	// request ID is bound to the token
+	req, err := http.NewRequestWithContext(ctx, "GET", eventsURL+"?request_id="+url.QueryEscape(requestID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(EventsTokenHeader, token)
+	stream, err := streamClient.Do(req)
+	if err != nil {
+		return eventsErrorResponse(ctx, requestID, fmt.Errorf("failed to subscribe to events: %w", err)), nil
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		response := failedResponsef(requestID, "events subscription failed with status: %d", stream.StatusCode)
+		response.StatusCode = stream.StatusCode
+		return response, nil
+	}
+
+	data := PostData{
+		Payload:      payload,
+		RequestID:    requestID,
+		TailnetKey:   tailnetKey,
+		ResponseMode: ResponseModeEvents,
+	}
+	// Posted in the server's encoding and compression, as a CloudEvent if
+	// configured, like any other post
+	post, body, err := s.newPostRequest(ctx, postURL, data, nil)
+	if err != nil {
+		return FailedResponse(requestID, err), nil
+	}
+	defer body.release()
+	post.Header.Set(EventsTokenHeader, token)
+	if err := s.signRequest(post, body.data); err != nil {
+		post.Body.Close()
+		return FailedResponse(requestID, err), nil
+	}
+	sent := time.Now()
+	resp, err := streamClient.Do(post)
+	s.postSent(postURL, data, true, sent, responseError(resp, err))
+	if err != nil {
+		return eventsErrorResponse(ctx, requestID, fmt.Errorf("failed to post JSON: %w", err)), nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return FailedResponse(requestID, &PostStatusError{StatusCode: resp.StatusCode}), nil
+	}
+
+	response, err := readResponseEvent(stream)
+	if err != nil {
+		return eventsErrorResponse(ctx, requestID, fmt.Errorf("failed to read events: %w", err)), nil
+	}
+	return response, nil
+}
+
+// newEventsToken returns a random events token
+func newEventsToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// eventsErrorResponse describes a failed events round trip, as a timeout if
+// its context expired
+func eventsErrorResponse(ctx context.Context, requestID string, err error) *RoundTripResponse {
+	if ctx.Err() != nil {
+		return FailedResponse(requestID, ErrRoundTripTimeout)
+	}
+	return FailedResponse(requestID, err)
+}
+
+// readResponseEvent reads Server-Sent Events from resp until the "response"
+// event and returns its data
+func readResponseEvent(resp *http.Response) (*RoundTripResponse, error) {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "response" {
+				var response RoundTripResponse
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &response); err != nil {
+					return nil, fmt.Errorf("invalid response event: %w", err)
+				}
+				return response.SetErr(), nil
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comment, e.g. a keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("event stream ended without a response")
+}
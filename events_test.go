@@ -0,0 +1,303 @@
+package post2post
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoundTripPostViaEvents(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		if payload.(map[string]interface{})["fail"] == true {
+			return nil, errors.New("bad payload")
+		}
+		return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+	}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// The sender is never started: responses come back on its own request
+	sender := NewServer().WithPostURL(receiver.GetURL() + "/webhook")
+	if want := receiver.GetURL() + "/events"; sender.GetEventsURL() != want {
+		t.Errorf("GetEventsURL() = %s, want %s", sender.GetEventsURL(), want)
+	}
+
+	payload := struct {
+		RequestID string `json:"request_id"`
+		Message   string `json:"message"`
+	}{RequestID: "req-events", Message: "hello"}
+	response, err := sender.RoundTripPostViaEvents(payload, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostViaEvents() failed: %v", err)
+	}
+	if !response.Success || response.RequestID != "req-events" {
+		t.Fatalf("RoundTripPostViaEvents() = %+v, want success for req-events", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	// A processing error fails the post
+	response, err = sender.RoundTripPostViaEvents(map[string]interface{}{"fail": true}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostViaEvents() failed: %v", err)
+	}
+	if response.Success || response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("RoundTripPostViaEvents() = %+v, want status 500", response)
+	}
+
+	resp, err := http.Get(receiver.GetURL() + "/events")
+	if err != nil {
+		t.Fatalf("GET /events failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /events without request_id status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestRoundTripPostViaEvents_Encoding(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		return payload, nil
+	}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the post on its way to the receiver
+	target, _ := url.Parse(receiver.GetURL())
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	posted := make(chan http.Header, 1)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posted <- r.Header.Clone()
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	// Posts go out like any other post of the sender
+	sender := NewServer().WithPostURL(front.URL + "/webhook").
+		WithEncoding(testEncoding).
+		WithCompression(CompressionGzip).
+		WithCloudEvents(CloudEventsBinary, "test")
+	message := strings.Repeat("hello ", 500)
+	response, err := sender.RoundTripPostViaEvents(map[string]interface{}{"message": message}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostViaEvents() failed: %v", err)
+	}
+	if !response.Success || response.Payload.(map[string]interface{})["message"] != message {
+		t.Fatalf("RoundTripPostViaEvents() = %+v, want the echoed message", response)
+	}
+
+	header := <-posted
+	if header.Get("Content-Type") != testEncoding.ContentType() {
+		t.Errorf("Content-Type = %q, want %q", header.Get("Content-Type"), testEncoding.ContentType())
+	}
+	if header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", header.Get("Content-Encoding"))
+	}
+	if header.Get("Ce-Type") != CloudEventTypePost {
+		t.Errorf("ce-type = %q, want %q", header.Get("Ce-Type"), CloudEventTypePost)
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+
+	// A response published before its subscriber arrives is kept
+	hub.publish("early", "token", &RoundTripResponse{RequestID: "early", Success: true})
+	entry, _ := hub.subscribe("early", "token")
+	select {
+	case <-entry.ready:
+		if entry.response.RequestID != "early" {
+			t.Errorf("response = %+v, want early", entry.response)
+		}
+	default:
+		t.Fatal("published response not ready")
+	}
+
+	// A subscriber waits for the response; a second publish is ignored
+	entry, _ = hub.subscribe("late", "token")
+	go hub.publish("late", "token", &RoundTripResponse{RequestID: "late", Payload: "first"})
+	select {
+	case <-entry.ready:
+	case <-time.After(time.Second):
+		t.Fatal("response not delivered")
+	}
+	hub.publish("late", "token", &RoundTripResponse{RequestID: "late", Payload: "second"})
+	if entry.response.Payload != "first" {
+		t.Errorf("response payload = %v, want first", entry.response.Payload)
+	}
+
+	// Expired entries are dropped, oldest first
+	hub.mu.Lock()
+	for _, e := range hub.entries {
+		e.created = time.Now().Add(-2 * eventRetention)
+	}
+	hub.mu.Unlock()
+	hub.subscribe("other", "token")
+	if len(hub.entries) != 1 || len(hub.order) != 1 {
+		t.Errorf("entries = %v, order = %v, want only other", hub.entries, hub.order)
+	}
+
+	// A removed entry leaves the order too, and its request ID can be reused
+	hub.remove("other")
+	if len(hub.entries) != 0 || len(hub.order) != 0 {
+		t.Errorf("entries = %v, order = %v, want none after remove", hub.entries, hub.order)
+	}
+	hub.subscribe("other", "token")
+	if _, ok := hub.entries["other"]; !ok || len(hub.order) != 1 {
+		t.Error("removed request ID could not be reused")
+	}
+}
+
+func TestEventHub_Token(t *testing.T) {
+	hub := newEventHub()
+
+	// The first subscriber binds the request ID to its token
+	entry, _ := hub.subscribe("req-1", "sender")
+	if _, err := hub.subscribe("req-1", "attacker"); !errors.Is(err, errEventsTokenMismatch) {
+		t.Errorf("subscribe() with another token error = %v, want %v", err, errEventsTokenMismatch)
+	}
+	if err := hub.publish("req-1", "attacker", &RoundTripResponse{Payload: "forged"}); !errors.Is(err, errEventsTokenMismatch) {
+		t.Errorf("publish() with another token error = %v, want %v", err, errEventsTokenMismatch)
+	}
+	if err := hub.publish("req-1", "sender", &RoundTripResponse{Payload: "real"}); err != nil {
+		t.Fatalf("publish() with the sender's token failed: %v", err)
+	}
+	<-entry.ready
+	if entry.response.Payload != "real" {
+		t.Errorf("response payload = %v, want real", entry.response.Payload)
+	}
+
+	// A published response only goes to a subscriber with its token
+	hub.publish("req-2", "sender", &RoundTripResponse{Payload: "secret"})
+	if _, err := hub.subscribe("req-2", "attacker"); err == nil {
+		t.Error("subscribe() with another token got the response")
+	}
+}
+
+func TestEventHub_Full(t *testing.T) {
+	hub := newEventHub()
+	for i := 0; i < maxPendingEvents; i++ {
+		if _, err := hub.subscribe(fmt.Sprintf("req-%d", i), "token"); err != nil {
+			t.Fatalf("subscribe() failed below the cap: %v", err)
+		}
+	}
+
+	// New request IDs are refused at the cap; pending ones still work
+	if _, err := hub.subscribe("one-more", "token"); !errors.Is(err, errEventsFull) {
+		t.Errorf("subscribe() at the cap error = %v, want %v", err, errEventsFull)
+	}
+	if err := hub.publish("one-more", "token", &RoundTripResponse{}); !errors.Is(err, errEventsFull) {
+		t.Errorf("publish() at the cap error = %v, want %v", err, errEventsFull)
+	}
+	if err := hub.publish("req-0", "token", &RoundTripResponse{}); err != nil {
+		t.Errorf("publish() to a pending request ID failed: %v", err)
+	}
+
+	// Delivered and expired entries make room again
+	hub.remove("req-0")
+	if _, err := hub.subscribe("one-more", "token"); err != nil {
+		t.Errorf("subscribe() after a removal failed: %v", err)
+	}
+	hub.mu.Lock()
+	for _, e := range hub.order {
+		e.created = time.Now().Add(-2 * eventRetention)
+	}
+	hub.mu.Unlock()
+	if _, err := hub.subscribe("after-expiry", "token"); err != nil {
+		t.Errorf("subscribe() after expiry failed: %v", err)
+	}
+}
+
+func TestEventsHandler_RequiresToken(t *testing.T) {
+	var processed atomic.Int32
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		processed.Add(1)
+		return payload, nil
+	}))
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	resp, err := http.Get(receiver.GetURL() + "/events?request_id=req-1")
+	if err != nil {
+		t.Fatalf("GET /events failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /events without a token status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Post(receiver.GetURL()+"/webhook", "application/json", strings.NewReader(`{"payload":"hi","request_id":"req-1","response_mode":"events"}`))
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /webhook with response_mode events without a token status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// The response to a request ID held by another token is refused
+	receiver.events.subscribe("req-2", "sender")
+	req, _ := http.NewRequest("POST", receiver.GetURL()+"/webhook", strings.NewReader(`{"payload":"hi","request_id":"req-2","response_mode":"events"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventsTokenHeader, "attacker")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /webhook with another token status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// Neither is the post to a full hub
+	for i := 0; i < maxPendingEvents; i++ {
+		receiver.events.subscribe(fmt.Sprintf("pending-%d", i), "sender")
+	}
+	req, _ = http.NewRequest("POST", receiver.GetURL()+"/webhook", strings.NewReader(`{"payload":"hi","request_id":"req-3","response_mode":"events"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventsTokenHeader, "sender")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST /webhook to a full hub status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n := processed.Load(); n != 0 {
+		t.Errorf("processor called %d times, want refused posts left unprocessed", n)
+	}
+}
+
+func TestReadResponseEvent(t *testing.T) {
+	stream := ": keep-alive\n\nevent: other\ndata: {}\n\nevent: response\ndata: {\"success\":true,\ndata: \"request_id\":\"r1\"}\n\n"
+	response, err := readResponseEvent(&http.Response{Body: io.NopCloser(strings.NewReader(stream))})
+	if err != nil {
+		t.Fatalf("readResponseEvent() failed: %v", err)
+	}
+	if !response.Success || response.RequestID != "r1" {
+		t.Errorf("readResponseEvent() = %+v", response)
+	}
+
+	if _, err := readResponseEvent(&http.Response{Body: io.NopCloser(strings.NewReader(": keep-alive\n\n"))}); err == nil {
+		t.Error("readResponseEvent() succeeded on a stream without a response")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// auditRecord is the audit table entry for one Function URL request
+type auditRecord struct {
+	LambdaRequestID string
+	ReceivedAt      time.Time
+	SourceIP        string
+	UserAgent       string
+	CallerARN       string // IAM caller with AWS_IAM auth
+	EventSource     string // function-url, api-gateway or alb
+	Principal       string // Caller authenticated by an API Gateway authorizer
+	SigningKeyID    string
+	RequestID       string
+	RoleARN         string
+	SourceIdentity  string
+	CallbackURL     string
+	ResponseQueue   string // Queue URL or topic ARN of queued delivery
+	STSRegion       string // STS region that issued the credentials
+	Synchronous     bool
+	Result          string // success, error or rejected
+	Error           string
+	ErrorCode       string
+	AccessKeyID     string
+	Expiration      time.Time
+	CallbackError   string
+	DeadLetter      string // Where the undelivered response was kept
+}
+
+// auditRecordKey is the context key of the request's audit record
+type auditRecordKey struct{}
+
+// newAuditRecord starts the audit record of a request with its caller
+func newAuditRecord(ctx context.Context, request events.LambdaFunctionURLRequest) *auditRecord {
+	record := &auditRecord{
+		LambdaRequestID: request.RequestContext.RequestID,
+		ReceivedAt:      time.Now(),
+		SourceIP:        request.RequestContext.HTTP.SourceIP,
+		UserAgent:       request.RequestContext.HTTP.UserAgent,
+		SigningKeyID:    request.Headers["x-post2post-key-id"],
+	}
+	if authorizer := request.RequestContext.Authorizer; authorizer != nil && authorizer.IAM != nil {
+		record.CallerARN = authorizer.IAM.UserARN
+	}
+	if source, ok := ctx.Value(eventSourceKey{}).(eventSource); ok {
+		record.EventSource = source.Kind
+		record.Principal = source.Principal
+	}
+	return record
+}
+
+// auditRecordFrom returns the audit record of the request handled with ctx
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+// write stores the record in the audit table, if one is configured. Failures
+// are logged and do not fail the request.
+func (r *auditRecord) write(ctx context.Context, statusCode int) {
+	if auditTable == "" {
+		return
+	}
+	if r.Result == "" {
+		// Requests rejected before the role was assumed
+		r.Result = "rejected"
+	}
+
+	completedAt := time.Now()
+	item := map[string]dynamotypes.AttributeValue{
+		"lambda_request_id": &dynamotypes.AttributeValueMemberS{Value: r.LambdaRequestID},
+		"received_at":       &dynamotypes.AttributeValueMemberS{Value: r.ReceivedAt.UTC().Format(time.RFC3339Nano)},
+		"completed_at":      &dynamotypes.AttributeValueMemberS{Value: completedAt.UTC().Format(time.RFC3339Nano)},
+		"result":            &dynamotypes.AttributeValueMemberS{Value: r.Result},
+		"status_code":       &dynamotypes.AttributeValueMemberN{Value: strconv.Itoa(statusCode)},
+		"synchronous":       &dynamotypes.AttributeValueMemberBOOL{Value: r.Synchronous},
+		"ttl":               &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(r.ReceivedAt.Add(auditTTL).Unix(), 10)},
+	}
+	// Unset attributes are left out
+	for name, value := range map[string]string{
+		"request_id":      r.RequestID,
+		"role_arn":        r.RoleARN,
+		"source_identity": r.SourceIdentity,
+		"callback_url":    r.CallbackURL,
+		"response_queue":  r.ResponseQueue,
+		"source_ip":       r.SourceIP,
+		"user_agent":      r.UserAgent,
+		"caller_arn":      r.CallerARN,
+		"event_source":    r.EventSource,
+		"principal":       r.Principal,
+		"signing_key_id":  r.SigningKeyID,
+		"error":           r.Error,
+		"error_code":      r.ErrorCode,
+		"access_key_id":   r.AccessKeyID,
+		"sts_region":      r.STSRegion,
+		"callback_error":  r.CallbackError,
+		"dead_letter":     r.DeadLetter,
+	} {
+		if value != "" {
+			item[name] = &dynamotypes.AttributeValueMemberS{Value: value}
+		}
+	}
+	if !r.Expiration.IsZero() {
+		item["expiration"] = &dynamotypes.AttributeValueMemberS{Value: r.Expiration.UTC().Format(time.RFC3339)}
+	}
+
+	// The invocation may already be cancelled, but the record is still written
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := dynamoClient.PutItem(writeCtx, &dynamodb.PutItemInput{
+		TableName: aws.String(auditTable),
+		Item:      item,
+	}); err != nil {
+		log.Printf("Failed to write audit record for %s to %s: %v", r.LambdaRequestID, auditTable, err)
+	}
+}
@@ -9,7 +9,7 @@ echo "Building AWS Lambda post2post receiver..."
 rm -f bootstrap bootstrap.zip
 
 # Build for Linux x86_64 (Lambda runtime)
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -ldflags="-s -w" -o bootstrap main.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -ldflags="-s -w" -o bootstrap .
 
 # Create deployment package
 zip bootstrap.zip bootstrap
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-xray-sdk-go/instrumentation/awsv2"
+)
+
+// defaultRolePathPrefix is the IAM path roles must be under by default
+const defaultRolePathPrefix = "/remote/"
+
+// STS limits for role credential duration, in seconds
+const (
+	minDurationSeconds     = 900
+	maxDurationSeconds     = 43200
+	defaultDurationSeconds = 3600
+)
+
+// Longest duration requests may ask for, at most maxDurationSeconds
+var durationLimitSeconds int32 = maxDurationSeconds
+
+// sessionNamePattern matches the role session names STS accepts
+var sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// Naming policy requested session names must also match, if configured
+var sessionNamePolicy *regexp.Regexp
+
+// Whether requests must have a credentials public key
+var requireCredentialEncryption bool
+
+// Queues and topics responses may be delivered to instead of a callback;
+// queued delivery is disabled while both are empty
+var responseQueueAllowlist []string
+var responseTopicAllowlist []string
+var sqsClient *sqs.Client
+var snsClient *sns.Client
+
+// Callback delivery attempts, and the delay before the first retry, which
+// doubles up to maxCallbackRetryDelay
+var callbackMaxAttempts = 3
+var callbackRetryDelay = time.Second
+
+// Where responses whose callback failed are kept for redelivery: an SQS
+// queue URL or an S3 bucket, neither to drop them
+var callbackDLQURL string
+var callbackDLQBucket string
+var s3Client *s3.Client
+
+// Global AWS configuration
+var awsConfig aws.Config
+var stsClient *sts.Client
+
+// STS regions tried in order for requests without a region or endpoint,
+// failing over when one does not answer, and how long each may take
+var stsRegions []string
+var stsRegionTimeout = 5 * time.Second
+
+var allowedTailnetDomain string
+
+// callbackAllowedTags, when set, only lets callbacks go to tailnet nodes
+// bearing one of these ACL tags
+var callbackAllowedTags []string
+var tailscaleFallback string
+
+// How results are returned: callback (default), allow or synchronous
+var responseMode string
+
+var signatureMaxAge = 5 * time.Minute
+
+// Role path policy; roles must be under /remote/ unless ROLE_PATH_PREFIX
+// is / ("" here), which allows any path
+var rolePathPrefix = defaultRolePathPrefix
+var roleARNPattern *regexp.Regexp
+
+// receiverConfig is the configuration that can be kept in Secrets Manager or
+// SSM Parameter Store and rotated without redeploying
+type receiverConfig struct {
+	// Auth key of the Lambda's tsnet node; requests' tailnet_key is used
+	// when unset
+	tailnetAuthKey string
+	// Request signing keys by key ID, "" for the shared key; requests must
+	// be signed when any is configured
+	signingKeys map[string][]byte
+	// Roles that may be assumed, any when empty
+	roleARNAllowlist []string
+}
+
+// envConfig is the configuration from environment variables, which values
+// from CONFIG_SECRET_ARN or CONFIG_SSM_PATH override
+var envConfig receiverConfig
+
+// Secrets Manager secret or SSM parameter path the configuration is loaded
+// from, and how long it is cached
+var configSecretARN string
+var configSSMPath string
+var configCacheTTL = 5 * time.Minute
+var secretsClient *secretsmanager.Client
+var ssmClient *ssm.Client
+
+// loadedConfig caches the configuration loaded from CONFIG_SECRET_ARN or
+// CONFIG_SSM_PATH
+var loadedConfig struct {
+	mu       sync.Mutex
+	config   receiverConfig
+	loadedAt time.Time
+}
+
+// Audit trail; requests are recorded in DynamoDB when AUDIT_TABLE is set
+var dynamoClient *dynamodb.Client
+var auditTable string
+var auditTTL = 90 * 24 * time.Hour
+
+// loadConfig reads the configuration from the environment and creates the
+// AWS clients
+func loadConfig() {
+	// Initialize AWS configuration
+	var err error
+	awsConfig, err = config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	// Every AWS call gets an X-Ray subsegment; they are only sent when the
+	// function has active tracing or the caller's trace is sampled
+	awsv2.AWSV2Instrumentor(&awsConfig.APIOptions)
+
+	stsClient = sts.NewFromConfig(awsConfig)
+
+	// Get required Tailscale domain configuration
+	allowedTailnetDomain = os.Getenv("TAILNET_DOMAIN")
+	if allowedTailnetDomain == "" {
+		log.Fatalf("TAILNET_DOMAIN environment variable is required but not set")
+	}
+	allowedTailnetDomain = strings.ToLower(strings.Trim(allowedTailnetDomain, "."))
+	callbackAllowedTags = parseList(os.Getenv("CALLBACK_ALLOWED_TAGS"))
+	for _, tag := range callbackAllowedTags {
+		if !strings.HasPrefix(tag, "tag:") {
+			log.Fatalf("CALLBACK_ALLOWED_TAGS must be ACL tags starting with tag:, got: %s", tag)
+		}
+	}
+
+	// Behavior when tsnet fails: never (default), warn or silent
+	tailscaleFallback = os.Getenv("TAILSCALE_FALLBACK")
+	if tailscaleFallback == "" {
+		tailscaleFallback = "never"
+	}
+	if tailscaleFallback != "never" && tailscaleFallback != "warn" && tailscaleFallback != "silent" {
+		log.Fatalf("TAILSCALE_FALLBACK must be never, warn or silent, got: %s", tailscaleFallback)
+	}
+
+	// Synchronous responses return credentials in the Function URL response
+	// instead of over the tailnet, so they must be enabled explicitly
+	responseMode = os.Getenv("RESPONSE_MODE")
+	if responseMode == "" {
+		responseMode = "callback"
+	}
+	if responseMode != "callback" && responseMode != "allow" && responseMode != "synchronous" {
+		log.Fatalf("RESPONSE_MODE must be callback, allow or synchronous, got: %s", responseMode)
+	}
+
+	// Queued delivery sends credentials to AWS resources the client names, so
+	// only allowlisted queues and topics are accepted
+	responseQueueAllowlist = parseList(os.Getenv("RESPONSE_QUEUE_ALLOWLIST"))
+	responseTopicAllowlist = parseList(os.Getenv("RESPONSE_TOPIC_ALLOWLIST"))
+	if len(responseQueueAllowlist) > 0 {
+		sqsClient = sqs.NewFromConfig(awsConfig)
+	}
+	if len(responseTopicAllowlist) > 0 {
+		snsClient = sns.NewFromConfig(awsConfig)
+	}
+
+	// Prioritized STS regions for failover
+	stsRegions = parseList(os.Getenv("STS_REGIONS"))
+	for _, region := range stsRegions {
+		if !stsRegionPattern.MatchString(region) {
+			log.Fatalf("STS_REGIONS has an invalid region: %s", region)
+		}
+	}
+	if timeout := os.Getenv("STS_REGION_TIMEOUT"); timeout != "" {
+		stsRegionTimeout, err = time.ParseDuration(timeout)
+		if err != nil || stsRegionTimeout <= 0 {
+			log.Fatalf("STS_REGION_TIMEOUT must be a positive duration, got: %s", timeout)
+		}
+	}
+
+	// Failed callbacks are retried with backoff, then the response is kept
+	if attempts := os.Getenv("CALLBACK_MAX_ATTEMPTS"); attempts != "" {
+		callbackMaxAttempts, err = strconv.Atoi(attempts)
+		if err != nil || callbackMaxAttempts < 1 || callbackMaxAttempts > 10 {
+			log.Fatalf("CALLBACK_MAX_ATTEMPTS must be between 1 and 10, got: %s", attempts)
+		}
+	}
+	if delay := os.Getenv("CALLBACK_RETRY_DELAY"); delay != "" {
+		callbackRetryDelay, err = time.ParseDuration(delay)
+		if err != nil || callbackRetryDelay <= 0 {
+			log.Fatalf("CALLBACK_RETRY_DELAY must be a positive duration, got: %s", delay)
+		}
+	}
+	callbackDLQURL = os.Getenv("CALLBACK_DLQ_URL")
+	callbackDLQBucket = os.Getenv("CALLBACK_DLQ_BUCKET")
+	if callbackDLQURL != "" && callbackDLQBucket != "" {
+		log.Fatalf("Only one of CALLBACK_DLQ_URL and CALLBACK_DLQ_BUCKET may be set")
+	}
+	if callbackDLQURL != "" && sqsClient == nil {
+		sqsClient = sqs.NewFromConfig(awsConfig)
+	}
+	if callbackDLQBucket != "" {
+		s3Client = s3.NewFromConfig(awsConfig)
+	}
+
+	// Authenticate callers of the Function URL with HMAC request signatures
+	envConfig.signingKeys, err = parseSigningKeys(os.Getenv("REQUEST_SIGNING_KEY"), os.Getenv("REQUEST_SIGNING_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid request signing keys: %v", err)
+	}
+	if maxAge := os.Getenv("REQUEST_SIGNATURE_MAX_AGE"); maxAge != "" {
+		signatureMaxAge, err = time.ParseDuration(maxAge)
+		if err != nil || signatureMaxAge <= 0 {
+			log.Fatalf("REQUEST_SIGNATURE_MAX_AGE must be a positive duration, got: %s", maxAge)
+		}
+	}
+
+	// Restrict which roles may be assumed. The path is enforced here rather
+	// than trusted to clients; only an explicit / lifts it.
+	rolePathPrefix = parseRolePathPrefix(os.Getenv("ROLE_PATH_PREFIX"))
+	if rolePathPrefix == "" {
+		log.Printf("WARNING: ROLE_PATH_PREFIX is /, roles on any path may be assumed")
+	}
+	if pattern := os.Getenv("ROLE_ARN_PATTERN"); pattern != "" {
+		roleARNPattern, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("ROLE_ARN_PATTERN is not a valid regular expression: %v", err)
+		}
+	}
+	envConfig.roleARNAllowlist = parseList(os.Getenv("ROLE_ARN_ALLOWLIST"))
+	envConfig.tailnetAuthKey = os.Getenv("TAILSCALE_AUTH_KEY")
+
+	// Secrets can be kept out of the environment and rotated in place
+	configSecretARN = os.Getenv("CONFIG_SECRET_ARN")
+	configSSMPath = os.Getenv("CONFIG_SSM_PATH")
+	if configSecretARN != "" && configSSMPath != "" {
+		log.Fatalf("Set only one of CONFIG_SECRET_ARN and CONFIG_SSM_PATH")
+	}
+	if configSecretARN != "" {
+		secretsClient = secretsmanager.NewFromConfig(awsConfig)
+	}
+	if configSSMPath != "" {
+		ssmClient = ssm.NewFromConfig(awsConfig)
+	}
+	if ttl := os.Getenv("CONFIG_CACHE_TTL"); ttl != "" {
+		configCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil || configCacheTTL <= 0 {
+			log.Fatalf("CONFIG_CACHE_TTL must be a positive duration, got: %s", ttl)
+		}
+	}
+
+	// Bound the requested credential duration and session names
+	if limit := os.Getenv("MAX_DURATION_SECONDS"); limit != "" {
+		seconds, err := strconv.Atoi(limit)
+		if err != nil || seconds < minDurationSeconds || seconds > maxDurationSeconds {
+			log.Fatalf("MAX_DURATION_SECONDS must be between %d and %d, got: %s", minDurationSeconds, maxDurationSeconds, limit)
+		}
+		durationLimitSeconds = int32(seconds)
+	}
+	if pattern := os.Getenv("SESSION_NAME_PATTERN"); pattern != "" {
+		sessionNamePolicy, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("SESSION_NAME_PATTERN is not a valid regular expression: %v", err)
+		}
+	}
+
+	// Refuse to return plaintext credentials
+	requireCredentialEncryption = os.Getenv("REQUIRE_CREDENTIAL_ENCRYPTION") == "true"
+
+	// Record every request in a DynamoDB table, expired through its TTL
+	auditTable = os.Getenv("AUDIT_TABLE")
+	if auditTable != "" {
+		dynamoClient = dynamodb.NewFromConfig(awsConfig)
+	}
+	if ttl := os.Getenv("AUDIT_TTL"); ttl != "" {
+		auditTTL, err = time.ParseDuration(ttl)
+		if err != nil || auditTTL <= 0 {
+			log.Fatalf("AUDIT_TTL must be a positive duration, got: %s", ttl)
+		}
+	}
+
+	// Duplicate deliveries of a request are detected across sandboxes with a
+	// DynamoDB table
+	idempotencyTable = os.Getenv("IDEMPOTENCY_TABLE")
+	if idempotencyTable != "" && dynamoClient == nil {
+		dynamoClient = dynamodb.NewFromConfig(awsConfig)
+	}
+	if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+		idempotencyTTL, err = time.ParseDuration(ttl)
+		if err != nil || idempotencyTTL <= 0 {
+			log.Fatalf("IDEMPOTENCY_TTL must be a positive duration, got: %s", ttl)
+		}
+	}
+
+	// Metrics are written to the logs in embedded metric format
+	if namespace := os.Getenv("METRICS_NAMESPACE"); namespace != "" {
+		metricsNamespace = namespace
+	}
+	if disabled := os.Getenv("METRICS_DISABLED"); disabled == "true" || disabled == "1" {
+		metricsNamespace = ""
+	}
+
+	log.Printf("AWS Lambda post2post receiver initialized with Tailnet domain: %s", allowedTailnetDomain)
+}
+
+// callbackTailnetKey returns the auth key the callback for req is posted
+// with: the configured one, or the request's
+func (c receiverConfig) callbackTailnetKey(req LambdaRequest) string {
+	if c.tailnetAuthKey != "" {
+		return c.tailnetAuthKey
+	}
+	return req.TailnetKey
+}
+
+// currentConfig returns the configuration, loading it from
+// CONFIG_SECRET_ARN or CONFIG_SSM_PATH when the cached copy is older than
+// CONFIG_CACHE_TTL. If a reload fails, the cached copy is used until a
+// reload succeeds.
+func currentConfig(ctx context.Context) (receiverConfig, error) {
+	if secretsClient == nil && ssmClient == nil {
+		return envConfig, nil
+	}
+
+	loadedConfig.mu.Lock()
+	defer loadedConfig.mu.Unlock()
+
+	if !loadedConfig.loadedAt.IsZero() && time.Since(loadedConfig.loadedAt) < configCacheTTL {
+		return loadedConfig.config, nil
+	}
+
+	var values map[string]string
+	var err error
+	source := configSecretARN
+	if secretsClient != nil {
+		values, err = loadSecretValues(ctx)
+	} else {
+		source = configSSMPath
+		values, err = loadSSMValues(ctx)
+	}
+	if err == nil {
+		var config receiverConfig
+		config, err = mergeConfig(envConfig, values)
+		if err == nil {
+			loadedConfig.config = config
+			loadedConfig.loadedAt = time.Now()
+			log.Printf("Loaded configuration from %s", source)
+			return config, nil
+		}
+	}
+
+	if loadedConfig.loadedAt.IsZero() {
+		return receiverConfig{}, err
+	}
+	log.Printf("WARNING: Failed to reload configuration, using the cached copy: %v", err)
+	return loadedConfig.config, nil
+}
+
+// loadSecretValues reads the JSON object in the CONFIG_SECRET_ARN secret
+func loadSecretValues(ctx context.Context) (map[string]string, error) {
+	output, err := secretsClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(configSecretARN),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", configSecretARN, err)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal([]byte(aws.ToString(output.SecretString)), &values); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object of strings: %w", configSecretARN, err)
+	}
+	return values, nil
+}
+
+// loadSSMValues reads the parameters under CONFIG_SSM_PATH, decrypting
+// SecureString parameters, keyed by their name below the path
+func loadSSMValues(ctx context.Context) (map[string]string, error) {
+	path := "/" + strings.Trim(configSSMPath, "/")
+	values := map[string]string{}
+	paginator := ssm.NewGetParametersByPathPaginator(ssmClient, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		WithDecryption: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parameters under %s: %w", path, err)
+		}
+		for _, parameter := range page.Parameters {
+			values[strings.TrimPrefix(aws.ToString(parameter.Name), path+"/")] = aws.ToString(parameter.Value)
+		}
+	}
+	return values, nil
+}
+
+// mergeConfig overrides base with the values that are set: tailnet_auth_key,
+// request_signing_key, request_signing_keys and role_arn_allowlist
+func mergeConfig(base receiverConfig, values map[string]string) (receiverConfig, error) {
+	config := base
+	if key := values["tailnet_auth_key"]; key != "" {
+		config.tailnetAuthKey = key
+	}
+	if shared, keys := values["request_signing_key"], values["request_signing_keys"]; shared != "" || keys != "" {
+		signingKeys, err := parseSigningKeys(shared, keys)
+		if err != nil {
+			return receiverConfig{}, err
+		}
+		config.signingKeys = signingKeys
+	}
+	if allowlist := values["role_arn_allowlist"]; allowlist != "" {
+		config.roleARNAllowlist = parseList(allowlist)
+	}
+	return config, nil
+}
+
+// parseRolePathPrefix returns the role path prefix for ROLE_PATH_PREFIX:
+// /remote/ when unset, "" for /, which allows any path, or the path with a
+// slash on both ends
+func parseRolePathPrefix(value string) string {
+	switch prefix := strings.TrimSpace(value); prefix {
+	case "":
+		return defaultRolePathPrefix
+	case "/":
+		return ""
+	default:
+		return "/" + strings.Trim(prefix, "/") + "/"
+	}
+}
+
+// parseSigningKeys returns the signing keys from a shared key and
+// comma-separated key-id=secret pairs
+func parseSigningKeys(shared, keys string) (map[string][]byte, error) {
+	signingKeys := map[string][]byte{}
+	if shared != "" {
+		signingKeys[""] = []byte(shared)
+	}
+	for _, entry := range parseList(keys) {
+		keyID, key, ok := strings.Cut(entry, "=")
+		if !ok || keyID == "" || key == "" {
+			return nil, fmt.Errorf("signing key entries must be key-id=secret")
+		}
+		signingKeys[keyID] = []byte(key)
+	}
+	for keyID, key := range signingKeys {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("request signing key %q must be at least 32 bytes", keyID)
+		}
+	}
+	return signingKeys, nil
+}
+
+// parseList splits a comma-separated list, dropping empty entries
+func parseList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
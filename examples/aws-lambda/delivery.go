@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+const maxCallbackRetryDelay = 8 * time.Second
+
+// callbackAttemptTimeout bounds one callback attempt, so a hung sender
+// leaves time to retry
+const callbackAttemptTimeout = 10 * time.Second
+
+// callbackDeadlineReserve is the time kept after the callback attempts for
+// keeping an undelivered response and answering the client
+const callbackDeadlineReserve = 2 * time.Second
+
+// postResponse posts the response back to the callback URL, optionally using Tailscale
+func postResponse(ctx context.Context, callbackURL string, response LambdaResponse, tailnetKey string) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	// The response carries the issued credentials; log only its size
+	log.Printf("Posting response for request %s to receiver: %d bytes", response.RequestID, len(responseJSON))
+
+	var client *http.Client
+	var reused bool
+
+	if tailnetKey != "" {
+		// Use Tailscale client for secure networking
+		log.Printf("Attempting to create Tailscale client for callback to: %s", callbackURL)
+		var tailscaleClient *http.Client
+		tailscaleClient, reused, err = tailscaleHTTPClient(ctx, tailnetKey)
+		if err != nil {
+			if tailscaleFallback == "never" {
+				// Credentials must not leave the tailnet
+				return fmt.Errorf("failed to create Tailscale client and TAILSCALE_FALLBACK is never: %w", err)
+			}
+			if tailscaleFallback == "warn" {
+				log.Printf("WARNING: Failed to create Tailscale client, falling back to regular HTTP: %v", err)
+			}
+			client = &http.Client{Timeout: 30 * time.Second}
+		} else {
+			client = tailscaleClient
+			log.Printf("Successfully created Tailscale client for callback (reused node: %t)", reused)
+		}
+	} else {
+		// Use regular HTTP client
+		log.Printf("Using regular HTTP client for callback to: %s", callbackURL)
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	// Credentials only go to callback nodes bearing an allowed tag
+	if len(callbackAllowedTags) > 0 {
+		if err := checkCallbackTags(ctx, callbackURL); err != nil {
+			return err
+		}
+	}
+
+	delay := callbackRetryDelay
+	for attempt := 1; ; {
+		err = attemptCallback(ctx, client, callbackURL, responseJSON)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		var statusErr *callbackStatusError
+		if reused && !errors.As(err, &statusErr) {
+			// The warm node may have lost its session while the sandbox was
+			// frozen, so it is replaced with a freshly authenticated one and
+			// tried at once, without using up an attempt
+			log.Printf("Callback over the reused Tailscale node failed, restarting the node: %v", err)
+			resetTailscaleNode()
+			client, _, err = tailscaleHTTPClient(ctx, tailnetKey)
+			if err != nil {
+				return fmt.Errorf("failed to restart Tailscale node: %w", err)
+			}
+			reused = false
+			continue
+		}
+
+		if attempt >= callbackMaxAttempts || !retryableCallbackError(err) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return fmt.Errorf("%w (no time left to retry)", err)
+		}
+		log.Printf("Callback attempt %d of %d failed, retrying in %s: %v", attempt, callbackMaxAttempts, delay, err)
+		emitMetrics([]metric{{"CallbackRetry", "Count", 1}}, nil, nil)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		attempt++
+		if delay *= 2; delay > maxCallbackRetryDelay {
+			delay = maxCallbackRetryDelay
+		}
+	}
+}
+
+// callbackStatusError is a callback the sender answered with an error status
+type callbackStatusError struct {
+	statusCode int
+}
+
+func (e *callbackStatusError) Error() string {
+	return fmt.Sprintf("callback returned error status: %d", e.statusCode)
+}
+
+// retryableCallbackError reports whether a failed callback may succeed when
+// retried: the sender could not be reached or was briefly unavailable. Other
+// error statuses, e.g. 410 for a round trip the client gave up on, are final.
+func retryableCallbackError(err error) bool {
+	var statusErr *callbackStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusRequestTimeout || statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	return true
+}
+
+// attemptCallback posts the response JSON once, within
+// callbackAttemptTimeout
+func attemptCallback(ctx context.Context, client *http.Client, callbackURL string, responseJSON []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, callbackAttemptTimeout)
+	defer cancel()
+
+	resp, err := sendCallback(ctx, client, callbackURL, responseJSON)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read and log the response body
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Failed to read response body: %v", err)
+	} else {
+		log.Printf("Receiver response status: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	if resp.StatusCode >= 400 {
+		return &callbackStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// undeliveredResponse is a response whose callback failed, as kept in the
+// callback dead-letter queue or bucket for redelivery
+type undeliveredResponse struct {
+	RequestID       string         `json:"request_id"`
+	LambdaRequestID string         `json:"lambda_request_id"`
+	CallbackURL     string         `json:"callback_url"`
+	Error           string         `json:"error"`
+	FailedAt        string         `json:"failed_at"`
+	Response        LambdaResponse `json:"response"`
+}
+
+// deadLetterResponse keeps a response whose callback failed with
+// deliveryErr in CALLBACK_DLQ_URL or CALLBACK_DLQ_BUCKET, and returns where
+func deadLetterResponse(ctx context.Context, req LambdaRequest, lambdaRequestID string, response LambdaResponse, deliveryErr error) (string, error) {
+	// The tailnet key is not needed to redeliver the response
+	response.TailnetKey = ""
+	body, err := json.Marshal(undeliveredResponse{
+		RequestID:       req.RequestID,
+		LambdaRequestID: lambdaRequestID,
+		CallbackURL:     req.URL,
+		Error:           deliveryErr.Error(),
+		FailedAt:        time.Now().UTC().Format(time.RFC3339),
+		Response:        response,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal undelivered response: %w", err)
+	}
+
+	if callbackDLQURL != "" {
+		_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(callbackDLQURL),
+			MessageBody: aws.String(string(body)),
+			MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+				"request_id": {DataType: aws.String("String"), StringValue: aws.String(req.RequestID)},
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to send undelivered response to queue: %w", err)
+		}
+		return callbackDLQURL, nil
+	}
+
+	// Keyed by the Lambda request ID, which unlike the client's is unique
+	key := "undelivered/" + lambdaRequestID + ".json"
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(callbackDLQBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write undelivered response to bucket: %w", err)
+	}
+	return "s3://" + callbackDLQBucket + "/" + key, nil
+}
+
+// sendCallback posts the response JSON to the callback URL, in an X-Ray
+// subsegment whose trace header is sent with the callback
+func sendCallback(ctx context.Context, client *http.Client, callbackURL string, responseJSON []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", callbackURL, bytes.NewReader(responseJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "aws-lambda-post2post/1.0")
+
+	resp, err := xray.Client(client).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to post response: %w", err)
+	}
+	return resp, nil
+}
+
+// responseDestination returns the queue URL or topic ARN the response is
+// delivered to, "" for a callback or synchronous response
+func (r LambdaRequest) responseDestination() string {
+	if r.ResponseQueueURL != "" {
+		return r.ResponseQueueURL
+	}
+	return r.ResponseTopicARN
+}
+
+// queueResponse sends the response to the request's queue, or publishes it
+// to its topic. The request ID is also a message attribute, for filtering.
+func queueResponse(ctx context.Context, req LambdaRequest, response LambdaResponse) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	if req.ResponseQueueURL != "" {
+		_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(req.ResponseQueueURL),
+			MessageBody: aws.String(string(responseJSON)),
+			MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+				"request_id": {DataType: aws.String("String"), StringValue: aws.String(req.RequestID)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send response to queue: %w", err)
+		}
+		return nil
+	}
+
+	_, err = snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(req.ResponseTopicARN),
+		Message:  aws.String(string(responseJSON)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"request_id": {DataType: aws.String("String"), StringValue: aws.String(req.RequestID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish response to topic: %w", err)
+	}
+	return nil
+}
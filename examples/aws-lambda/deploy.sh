@@ -40,6 +40,12 @@ case $DEPLOYMENT_METHOD in
     
   "cli")
     echo "Deploying with AWS CLI..."
+    : "${TAILNET_DOMAIN:?TAILNET_DOMAIN must be set for the cli method}"
+    
+    # Requests for roles outside the path or allowlist are rejected before
+    # STS is called
+    ENVIRONMENT=$(printf '{"Variables":{"TAILNET_DOMAIN":"%s","ROLE_PATH_PREFIX":"%s","ROLE_ARN_ALLOWLIST":"%s"}}' \
+      "$TAILNET_DOMAIN" "${ROLE_PATH_PREFIX:-/remote/}" "${ROLE_ARN_ALLOWLIST:-}")
     
     # Check if role exists
     ROLE_NAME="${FUNCTION_NAME}-role"
@@ -68,7 +74,7 @@ case $DEPLOYMENT_METHOD in
           "Statement": [{
             "Effect": "Allow",
             "Action": ["sts:AssumeRole"],
-            "Resource": "*"
+            "Resource": "arn:aws:iam::*:role/remote/*"
           }]
         }' \
         --query 'Policy.Arn' --output text)
@@ -89,6 +95,10 @@ case $DEPLOYMENT_METHOD in
       aws lambda update-function-code \
         --function-name "$FUNCTION_NAME" \
         --zip-file fileb://bootstrap.zip
+      aws lambda wait function-updated --function-name "$FUNCTION_NAME"
+      aws lambda update-function-configuration \
+        --function-name "$FUNCTION_NAME" \
+        --environment "$ENVIRONMENT"
     else
       echo "Creating new function..."
       aws lambda create-function \
@@ -97,6 +107,7 @@ case $DEPLOYMENT_METHOD in
         --role "$ROLE_ARN" \
         --handler bootstrap \
         --zip-file fileb://bootstrap.zip \
+        --environment "$ENVIRONMENT" \
         --timeout 30
     fi
     
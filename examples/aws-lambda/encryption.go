@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// parseCredentialsPublicKey decodes a base64 PKIX X25519 or RSA public key
+// of at least 2048 bits
+func parseCredentialsPublicKey(encoded string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("credentials_public_key is not base64")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("credentials_public_key is not a PKIX public key")
+	}
+	switch key := publicKey.(type) {
+	case *ecdh.PublicKey:
+		if key.Curve() == ecdh.X25519() {
+			return key, nil
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() >= 2048 {
+			return key, nil
+		}
+		return nil, fmt.Errorf("RSA credentials_public_key must be at least 2048 bits")
+	}
+	return nil, fmt.Errorf("credentials_public_key must be X25519 or RSA")
+}
+
+// encryptCredentials encrypts the credentials to the requester's public key
+// with X25519-HKDF-SHA256-AES256GCM or RSA-OAEP-SHA256-AES256GCM, binding
+// them to the request ID
+func encryptCredentials(encodedPublicKey, requestID string, credentials *types.Credentials) (*EncryptedCredentials, error) {
+	publicKey, err := parseCredentialsPublicKey(encodedPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+
+	encrypted := &EncryptedCredentials{}
+	key := make([]byte, 32)
+	switch publicKey := publicKey.(type) {
+	case *ecdh.PublicKey:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+		}
+		shared, err := ephemeral.ECDH(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key agreement failed: %w", err)
+		}
+		encrypted.Scheme = "X25519-HKDF-SHA256-AES256GCM"
+		encrypted.EphemeralPublicKey = ephemeral.PublicKey().Bytes()
+
+		// HKDF-SHA256 (RFC 5869) salted with both public keys; a single
+		// expand block yields the 32-byte key
+		extract := hmac.New(sha256.New, append(append([]byte(nil), encrypted.EphemeralPublicKey...), publicKey.Bytes()...))
+		extract.Write(shared)
+		expand := hmac.New(sha256.New, extract.Sum(nil))
+		expand.Write([]byte("post2post credentials v1\x01"))
+		key = expand.Sum(nil)
+	case *rsa.PublicKey:
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		encrypted.Scheme = "RSA-OAEP-SHA256-AES256GCM"
+		encrypted.EncryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt key: %w", err)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, plaintext, []byte(requestID))
+	return encrypted, nil
+}
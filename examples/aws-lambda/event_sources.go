@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// eventSource describes the front end that invoked the function, for
+// events converted to Function URL requests
+type eventSource struct {
+	Kind      string // function-url, api-gateway or alb
+	Principal string // Caller authenticated by an API Gateway JWT or Lambda authorizer
+}
+
+// eventSourceKey is the context key of the request's eventSource
+type eventSourceKey struct{}
+
+// clientTraceKey is the context key of the trace ID in the client's
+// X-Amzn-Trace-Id header
+type clientTraceKey struct{}
+
+// functionURLRequestFromAPIGateway converts an HTTP API request, which has
+// the Function URL request's layout. An IAM authorizer's caller is kept.
+func functionURLRequestFromAPIGateway(request events.APIGatewayV2HTTPRequest) events.LambdaFunctionURLRequest {
+	converted := events.LambdaFunctionURLRequest{
+		Version:               request.Version,
+		RawPath:               request.RawPath,
+		RawQueryString:        request.RawQueryString,
+		Cookies:               request.Cookies,
+		Headers:               lowerCaseHeaders(request.Headers),
+		QueryStringParameters: request.QueryStringParameters,
+		Body:                  request.Body,
+		IsBase64Encoded:       request.IsBase64Encoded,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			AccountID:    request.RequestContext.AccountID,
+			RequestID:    request.RequestContext.RequestID,
+			APIID:        request.RequestContext.APIID,
+			DomainName:   request.RequestContext.DomainName,
+			DomainPrefix: request.RequestContext.DomainPrefix,
+			Time:         request.RequestContext.Time,
+			TimeEpoch:    request.RequestContext.TimeEpoch,
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:    request.RequestContext.HTTP.Method,
+				Path:      request.RequestContext.HTTP.Path,
+				Protocol:  request.RequestContext.HTTP.Protocol,
+				SourceIP:  request.RequestContext.HTTP.SourceIP,
+				UserAgent: request.RequestContext.HTTP.UserAgent,
+			},
+		},
+	}
+	if authorizer := request.RequestContext.Authorizer; authorizer != nil && authorizer.IAM != nil {
+		converted.RequestContext.Authorizer = &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+			IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{
+				AccessKey: authorizer.IAM.AccessKey,
+				AccountID: authorizer.IAM.AccountID,
+				CallerID:  authorizer.IAM.CallerID,
+				UserARN:   authorizer.IAM.UserARN,
+				UserID:    authorizer.IAM.UserID,
+			},
+		}
+	}
+	return converted
+}
+
+// authorizerPrincipal returns the caller a JWT authorizer (its sub claim) or
+// Lambda authorizer (its principalId context value) authenticated, if any
+func authorizerPrincipal(authorizer *events.APIGatewayV2HTTPRequestContextAuthorizerDescription) string {
+	if authorizer == nil {
+		return ""
+	}
+	if authorizer.JWT != nil {
+		return authorizer.JWT.Claims["sub"]
+	}
+	if principal, ok := authorizer.Lambda["principalId"].(string); ok {
+		return principal
+	}
+	return ""
+}
+
+// functionURLRequestFromALB converts an ALB request. ALB events carry no
+// request ID or caller address, so the invocation's request ID and the
+// X-Forwarded-For client are used.
+func functionURLRequestFromALB(ctx context.Context, request events.ALBTargetGroupRequest) events.LambdaFunctionURLRequest {
+	headers := lowerCaseHeaders(request.Headers)
+	if len(request.MultiValueHeaders) > 0 {
+		headers = make(map[string]string, len(request.MultiValueHeaders))
+		for name, values := range request.MultiValueHeaders {
+			headers[strings.ToLower(name)] = strings.Join(values, ",")
+		}
+	}
+
+	var requestID string
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		requestID = lc.AwsRequestID
+	}
+	sourceIP, _, _ := strings.Cut(headers["x-forwarded-for"], ",")
+
+	return events.LambdaFunctionURLRequest{
+		Version:               "2.0",
+		RawPath:               request.Path,
+		Headers:               headers,
+		QueryStringParameters: request.QueryStringParameters,
+		Body:                  request.Body,
+		IsBase64Encoded:       request.IsBase64Encoded,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			RequestID: requestID,
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:    request.HTTPMethod,
+				Path:      request.Path,
+				SourceIP:  strings.TrimSpace(sourceIP),
+				UserAgent: headers["user-agent"],
+			},
+		},
+	}
+}
+
+// albResponse converts a response for the ALB, which needs a status
+// description and, when the target group has multi-value headers enabled,
+// multi-value response headers
+func albResponse(response events.LambdaFunctionURLResponse, multiValue bool) events.ALBTargetGroupResponse {
+	converted := events.ALBTargetGroupResponse{
+		StatusCode:        response.StatusCode,
+		StatusDescription: fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		Body:              response.Body,
+		IsBase64Encoded:   response.IsBase64Encoded,
+	}
+	if !multiValue {
+		converted.Headers = response.Headers
+		return converted
+	}
+	converted.MultiValueHeaders = make(map[string][]string, len(response.Headers))
+	for name, value := range response.Headers {
+		converted.MultiValueHeaders[name] = []string{value}
+	}
+	return converted
+}
+
+// lowerCaseHeaders returns headers with lower case names, as Function URL
+// requests have them
+func lowerCaseHeaders(headers map[string]string) map[string]string {
+	lowered := make(map[string]string, len(headers))
+	for name, value := range headers {
+		lowered[strings.ToLower(name)] = value
+	}
+	return lowered
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Request IDs of callback and queued requests are claimed in this DynamoDB
+// table, or in memory for the sandbox when it is "", and kept for
+// idempotencyTTL once processed
+var idempotencyTable string
+var idempotencyTTL = time.Hour
+
+// idempotencyEntry is the claim of a delivery on a request ID
+type idempotencyEntry struct {
+	BodyHash  string
+	Status    string // in_progress or completed
+	ExpiresAt time.Time
+}
+
+// processedRequests holds the sandbox's claims when there is no idempotency
+// table, so only duplicates reaching the same warm sandbox are detected
+var processedRequests = struct {
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+}{entries: make(map[string]idempotencyEntry)}
+
+// checkDuplicate claims the request's request_id before the role is
+// assumed. It returns whether the claim was taken, to be finished with
+// finishRequest, or the response to a duplicate delivery.
+//
+// A claim that cannot be made, e.g. while the table is unreachable, lets
+// the request through unclaimed: idempotency only guards against resent
+// requests, and failing closed would make issuing credentials depend on the
+// table's availability.
+func checkDuplicate(ctx context.Context, req LambdaRequest, body []byte, synchronous bool) (bool, *events.LambdaFunctionURLResponse) {
+	if req.RequestID == "" {
+		return false, nil
+	}
+
+	sum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(sum[:])
+	existing, err := claimRequest(ctx, req.RequestID, bodyHash)
+	switch {
+	case err != nil:
+		log.Printf("Failed to claim request %s, processing it unclaimed: %v", req.RequestID, err)
+		emitMetrics([]metric{{"IdempotencyClaimFailure", "Count", 1}}, nil, map[string]string{
+			"RequestId": req.RequestID,
+			"Error":     err.Error(),
+		})
+		return false, nil
+	case existing == nil:
+		return true, nil
+	case existing.BodyHash != bodyHash:
+		log.Printf("Rejected request %s: its request_id was used for another request", req.RequestID)
+		return false, &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusConflict,
+			Body:       `{"error": "request_id was already used for a different request"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}
+	}
+
+	log.Printf("Request %s is a duplicate, the first delivery is %s", req.RequestID, existing.Status)
+	if record := auditRecordFrom(ctx); record != nil {
+		record.Result = "duplicate"
+	}
+	switch {
+	case synchronous:
+		// The credentials went to the first delivery's connection and are
+		// not issued twice
+		return false, &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusConflict,
+			Body:       `{"error": "request_id was already used, credentials are only returned to the first request"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}
+	case existing.Status == "completed":
+		// The client keeps waiting for the response of the first delivery
+		return false, &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusOK,
+			Body:       `{"status": "completed", "message": "Request was already processed"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}
+	default:
+		return false, &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusAccepted,
+			Body:       `{"status": "in_progress", "message": "Request is already being processed"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}
+	}
+}
+
+// claimRequest claims requestID for the request whose body hashes to
+// bodyHash until the invocation's deadline. It returns nil once the claim
+// is taken, or the claim of the delivery that holds it.
+func claimRequest(ctx context.Context, requestID, bodyHash string) (*idempotencyEntry, error) {
+	now := time.Now()
+	expiresAt := now.Add(15 * time.Minute)
+	if deadline, ok := ctx.Deadline(); ok {
+		expiresAt = deadline
+	}
+
+	if idempotencyTable == "" {
+		processedRequests.mu.Lock()
+		defer processedRequests.mu.Unlock()
+
+		for id, entry := range processedRequests.entries {
+			if now.After(entry.ExpiresAt) {
+				delete(processedRequests.entries, id)
+			}
+		}
+		if existing, ok := processedRequests.entries[requestID]; ok {
+			return &existing, nil
+		}
+		processedRequests.entries[requestID] = idempotencyEntry{BodyHash: bodyHash, Status: "in_progress", ExpiresAt: expiresAt}
+		return nil, nil
+	}
+
+	// The TTL deletes expired items late, so they are overwritten
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(idempotencyTable),
+		Item: map[string]dynamotypes.AttributeValue{
+			"request_id": &dynamotypes.AttributeValueMemberS{Value: requestID},
+			"body_hash":  &dynamotypes.AttributeValueMemberS{Value: bodyHash},
+			"status":     &dynamotypes.AttributeValueMemberS{Value: "in_progress"},
+			"ttl":        &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(request_id) OR #ttl < :now"),
+		ExpressionAttributeNames: map[string]string{"#ttl": "ttl"},
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":now": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: dynamotypes.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		existing := &idempotencyEntry{}
+		if v, ok := conditionErr.Item["body_hash"].(*dynamotypes.AttributeValueMemberS); ok {
+			existing.BodyHash = v.Value
+		}
+		if v, ok := conditionErr.Item["status"].(*dynamotypes.AttributeValueMemberS); ok {
+			existing.Status = v.Value
+		}
+		if v, ok := conditionErr.Item["ttl"].(*dynamotypes.AttributeValueMemberN); ok {
+			if seconds, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+				existing.ExpiresAt = time.Unix(seconds, 0)
+			}
+		}
+		return existing, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim request ID: %w", err)
+	}
+	return nil, nil
+}
+
+// finishRequest marks a claimed request completed for idempotencyTTL, or
+// releases the claim of a failed one so the client can retry it
+func finishRequest(ctx context.Context, requestID string, completed bool) {
+	if idempotencyTable == "" {
+		processedRequests.mu.Lock()
+		defer processedRequests.mu.Unlock()
+
+		if completed {
+			processedRequests.entries[requestID] = idempotencyEntry{
+				BodyHash:  processedRequests.entries[requestID].BodyHash,
+				Status:    "completed",
+				ExpiresAt: time.Now().Add(idempotencyTTL),
+			}
+		} else {
+			delete(processedRequests.entries, requestID)
+		}
+		return
+	}
+
+	key := map[string]dynamotypes.AttributeValue{
+		"request_id": &dynamotypes.AttributeValueMemberS{Value: requestID},
+	}
+	var err error
+	if completed {
+		_, err = dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(idempotencyTable),
+			Key:                      key,
+			UpdateExpression:         aws.String("SET #status = :completed, #ttl = :ttl"),
+			ExpressionAttributeNames: map[string]string{"#status": "status", "#ttl": "ttl"},
+			ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+				":completed": &dynamotypes.AttributeValueMemberS{Value: "completed"},
+				":ttl":       &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(idempotencyTTL).Unix(), 10)},
+			},
+		})
+	} else {
+		_, err = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(idempotencyTable),
+			Key:       key,
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to record the outcome of request %s: %v", requestID, err)
+	}
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -16,19 +15,35 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/aws-sdk-go-v2/service/sts/types"
-	"tailscale.com/tsnet"
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/aws/smithy-go"
 )
 
 // LambdaRequest represents the incoming request payload
 type LambdaRequest struct {
-	URL        string      `json:"url"`
-	Payload    interface{} `json:"payload"`
-	RequestID  string      `json:"request_id"`
-	TailnetKey string      `json:"tailnet_key,omitempty"`
-	RoleARN    string      `json:"role_arn"`
+	URL               string            `json:"url"`
+	Payload           interface{}       `json:"payload"`
+	RequestID         string            `json:"request_id"`
+	TailnetKey        string            `json:"tailnet_key,omitempty"`
+	RoleARN           string            `json:"role_arn"`
+	ExternalID        string            `json:"external_id,omitempty"`
+	Policy            string            `json:"policy,omitempty"`
+	PolicyARNs        []string          `json:"policy_arns,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	TransitiveTagKeys []string          `json:"transitive_tag_keys,omitempty"`
+	SourceIdentity    string            `json:"source_identity,omitempty"`
+	DurationSeconds   int32             `json:"duration_seconds,omitempty"`
+	SessionName       string            `json:"session_name,omitempty"`
+	WebIdentityToken  string            `json:"web_identity_token,omitempty"`
+	Region            string            `json:"region,omitempty"`
+	STSEndpoint       string            `json:"sts_endpoint,omitempty"`
+	Synchronous       bool              `json:"synchronous,omitempty"`
+	ResponseQueueURL  string            `json:"response_queue_url,omitempty"`
+	ResponseTopicARN  string            `json:"response_topic_arn,omitempty"`
+	// Base64 PKIX X25519 or RSA key the credentials are encrypted to
+	CredentialsPublicKey string `json:"credentials_public_key,omitempty"`
 }
 
 // AssumeRoleResponse represents the response from AWS STS AssumeRole
@@ -37,6 +52,21 @@ type AssumeRoleResponse struct {
 	AssumedRoleUser *types.AssumedRoleUser `json:"assumed_role_user"`
 	PackedPolicySize *int32 `json:"packed_policy_size,omitempty"`
 	SourceIdentity   *string `json:"source_identity,omitempty"`
+	// STS region that issued the credentials
+	Region           string  `json:"region,omitempty"`
+	// Replaces Credentials when the request has a credentials public key
+	EncryptedCredentials *EncryptedCredentials `json:"encrypted_credentials,omitempty"`
+}
+
+// EncryptedCredentials is the Credentials block encrypted to the requester's
+// public key. The plaintext is the JSON of the credentials and the request ID
+// is authenticated with it.
+type EncryptedCredentials struct {
+	Scheme             string `json:"scheme"`
+	EphemeralPublicKey []byte `json:"ephemeral_public_key,omitempty"`
+	EncryptedKey       []byte `json:"encrypted_key,omitempty"`
+	Nonce              []byte `json:"nonce"`
+	Ciphertext         []byte `json:"ciphertext"`
 }
 
 // ProcessedResponse represents the final response payload
@@ -56,34 +86,76 @@ type LambdaResponse struct {
 	TailnetKey string     `json:"tailnet_key,omitempty"`
 }
 
-// Global AWS configuration
-var awsConfig aws.Config
-var stsClient *sts.Client
-var allowedTailnetDomain string
-
-func init() {
-	// Initialize AWS configuration
-	var err error
-	awsConfig, err = config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-	
-	stsClient = sts.NewFromConfig(awsConfig)
-	
-	// Get required Tailscale domain configuration
-	allowedTailnetDomain = os.Getenv("TAILNET_DOMAIN")
-	if allowedTailnetDomain == "" {
-		log.Fatalf("TAILNET_DOMAIN environment variable is required but not set")
+// invoke handles a Function URL, API Gateway HTTP API (payload format 2.0)
+// or ALB event by converting it to a Function URL request for handleRequest
+// and converting the response back
+func invoke(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Version        string `json:"version"`
+		RequestContext struct {
+			ELB        json.RawMessage `json:"elb"`
+			DomainName string          `json:"domainName"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(event, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	
+	switch {
+	case len(probe.RequestContext.ELB) > 0:
+		var request events.ALBTargetGroupRequest
+		if err := json.Unmarshal(event, &request); err != nil {
+			return nil, fmt.Errorf("failed to parse ALB event: %w", err)
+		}
+		ctx = context.WithValue(ctx, eventSourceKey{}, eventSource{Kind: "alb"})
+		response, err := handleRequest(ctx, functionURLRequestFromALB(ctx, request))
+		return albResponse(response, len(request.MultiValueHeaders) > 0), err
+	case probe.Version == "2.0" && probe.RequestContext.DomainName != "" && !strings.Contains(probe.RequestContext.DomainName, ".lambda-url."):
+		var request events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(event, &request); err != nil {
+			return nil, fmt.Errorf("failed to parse API Gateway event: %w", err)
+		}
+		ctx = context.WithValue(ctx, eventSourceKey{}, eventSource{Kind: "api-gateway", Principal: authorizerPrincipal(request.RequestContext.Authorizer)})
+		response, err := handleRequest(ctx, functionURLRequestFromAPIGateway(request))
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode:      response.StatusCode,
+			Headers:         response.Headers,
+			Body:            response.Body,
+			IsBase64Encoded: response.IsBase64Encoded,
+			Cookies:         response.Cookies,
+		}, err
+	case probe.Version == "2.0":
+		var request events.LambdaFunctionURLRequest
+		if err := json.Unmarshal(event, &request); err != nil {
+			return nil, fmt.Errorf("failed to parse Function URL event: %w", err)
+		}
+		ctx = context.WithValue(ctx, eventSourceKey{}, eventSource{Kind: "function-url"})
+		return handleRequest(ctx, request)
+	default:
+		// API Gateway REST APIs and HTTP API payload format 1.0
+		return nil, fmt.Errorf("unsupported event: use a Function URL, an HTTP API with payload format 2.0 or an ALB")
 	}
-	
-	log.Printf("AWS Lambda post2post receiver initialized with Tailnet domain: %s", allowedTailnetDomain)
 }
 
-// handleRequest processes the Lambda URL request
-func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+// handleRequest processes the Lambda URL request, or an API Gateway or ALB
+// request converted by invoke
+func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest) (response events.LambdaFunctionURLResponse, err error) {
+	// Every request is audited, including rejected ones, once it completes
+	record := newAuditRecord(ctx, request)
+	ctx = context.WithValue(ctx, auditRecordKey{}, record)
+	defer func() { record.write(ctx, response.StatusCode) }()
+	
+	// The client's trace is recorded on the subsegments, so the Lambda's
+	// trace can be found from it when Lambda does not continue it
+	if traceHeader := request.Headers["x-amzn-trace-id"]; traceHeader != "" {
+		if clientTraceID := header.FromString(traceHeader).TraceID; clientTraceID != "" {
+			ctx = context.WithValue(ctx, clientTraceKey{}, clientTraceID)
+		}
+	}
+	
 	log.Printf("Received request: %s %s", request.RequestContext.HTTP.Method, request.RawPath)
-	log.Printf("Complete request body: %s", request.Body)
+	// The body holds web identity tokens and external IDs; log only its size
+	log.Printf("Request body: %d bytes", len(request.Body))
 	
 	// Only handle POST requests
 	if request.RequestContext.HTTP.Method != "POST" {
@@ -96,6 +168,41 @@ func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest)
 		return errorResponse, nil
 	}
 	
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       `{"error": "Invalid request body encoding"}`,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+			}, nil
+		}
+		body = decoded
+	}
+	
+	// Configuration from Secrets Manager or SSM; without it requests cannot
+	// be authenticated, so they are refused
+	cfg, err := currentConfig(ctx)
+	if err != nil {
+		log.Printf("Failed to load configuration: %v", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       `{"error": "Configuration unavailable"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
+	}
+	
+	// Reject unsigned or forged requests before anything else is done
+	if err := verifySignature(cfg.signingKeys, request.Headers, body); err != nil {
+		log.Printf("Rejected request signature: %v", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusUnauthorized,
+			Body:       fmt.Sprintf(`{"error": "Invalid request signature: %s"}`, err.Error()),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
+	}
+	
 	// Parse the incoming post2post wrapper request
 	var postData struct {
 		URL        string      `json:"url"`
@@ -103,7 +210,7 @@ func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest)
 		RequestID  string      `json:"request_id,omitempty"`
 		TailnetKey string      `json:"tailnet_key,omitempty"`
 	}
-	if err := json.Unmarshal([]byte(request.Body), &postData); err != nil {
+	if err := json.Unmarshal(body, &postData); err != nil {
 		log.Printf("Failed to parse post2post wrapper: %v", err)
 		return events.LambdaFunctionURLResponse{
 			StatusCode: http.StatusBadRequest,
@@ -113,7 +220,6 @@ func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest)
 	}
 	
 	log.Printf("Parsed post2post wrapper - URL: %s, RequestID: %s", postData.URL, postData.RequestID)
-	log.Printf("Payload content: %+v", postData.Payload)
 
 	// Extract the actual Lambda request from the payload
 	payloadBytes, err := json.Marshal(postData.Payload)
@@ -137,6 +243,15 @@ func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest)
 	}
 	
 	log.Printf("Processing request ID: %s", lambdaReq.RequestID)
+	record.RequestID = lambdaReq.RequestID
+	record.RoleARN = lambdaReq.RoleARN
+	record.CallbackURL = lambdaReq.URL
+	record.ResponseQueue = lambdaReq.responseDestination()
+	record.SourceIdentity = lambdaReq.SourceIdentity
+	// With AWS_IAM auth the Function URL has already verified the SigV4 signature
+	if authorizer := request.RequestContext.Authorizer; authorizer != nil && authorizer.IAM != nil {
+		log.Printf("Caller authenticated by IAM: %s", authorizer.IAM.UserARN)
+	}
 	log.Printf("Role ARN to assume: %s", lambdaReq.RoleARN)
 	log.Printf("Callback URL from payload: %s", lambdaReq.URL)
 	if lambdaReq.TailnetKey != "" {
@@ -152,275 +267,397 @@ func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest)
 		}, nil
 	}
 	
-	if lambdaReq.URL == "" {
+	synchronous, err := respondSynchronously(lambdaReq)
+	record.Synchronous = synchronous
+	if err != nil {
 		return events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       `{"error": "callback url is required"}`,
+			StatusCode: http.StatusForbidden,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
 			Headers:    map[string]string{"Content-Type": "application/json"},
 		}, nil
 	}
 	
-	// Validate callback URL domain against configured Tailnet domain
-	if err := validateCallbackURL(lambdaReq.URL); err != nil {
-		log.Printf("Invalid callback URL %s: %v", lambdaReq.URL, err)
+	// Responses go to one place: the Function URL response, a queue, a
+	// topic or the callback URL
+	queued := lambdaReq.responseDestination() != ""
+	if queued && (synchronous || (lambdaReq.ResponseQueueURL != "" && lambdaReq.ResponseTopicARN != "")) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       `{"error": "only one of synchronous, response_queue_url and response_topic_arn may be set"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
+	}
+	if err := validateResponseDestination(lambdaReq); err != nil {
+		log.Printf("Rejected response destination %s: %v", lambdaReq.responseDestination(), err)
 		return events.LambdaFunctionURLResponse{
 			StatusCode: http.StatusForbidden,
-			Body:       fmt.Sprintf(`{"error": "Invalid callback URL: %s"}`, err.Error()),
+			Body:       fmt.Sprintf(`{"error": "Response destination not allowed: %s"}`, err.Error()),
 			Headers:    map[string]string{"Content-Type": "application/json"},
 		}, nil
 	}
 	
-	// Process the request synchronously 
-	processRequest(ctx, lambdaReq, request.RequestContext.RequestID)
-	
-	// Return success acknowledgment after processing completes
-	lambdaResponse := events.LambdaFunctionURLResponse{
-		StatusCode: http.StatusOK,
-		Body:       `{"status": "completed", "message": "Request processed successfully"}`,
-		Headers:    map[string]string{"Content-Type": "application/json"},
+	if lambdaReq.URL == "" && !synchronous && !queued {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       `{"error": "callback url is required"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	log.Printf("Lambda returning response: StatusCode=%d, Body=%s", lambdaResponse.StatusCode, lambdaResponse.Body)
-	return lambdaResponse, nil
-}
-
-// processRequest handles the actual processing and response posting
-func processRequest(ctx context.Context, req LambdaRequest, lambdaRequestID string) {
-	// Add processing delay to simulate work
-	time.Sleep(100 * time.Millisecond)
-	
-	log.Printf("Starting role assumption for request: %s", req.RequestID)
-	
-	// Assume the specified IAM role
-	assumeRoleResult, err := assumeRole(ctx, req.RoleARN, req.RequestID)
-	if err != nil {
-		log.Printf("Failed to assume role %s: %v", req.RoleARN, err)
-		postErrorResponse(req, fmt.Sprintf("Failed to assume role: %v", err), lambdaRequestID)
-		return
+	// STS accepts durations from 15 minutes to 12 hours
+	if lambdaReq.DurationSeconds != 0 && (lambdaReq.DurationSeconds < minDurationSeconds || lambdaReq.DurationSeconds > durationLimitSeconds) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf(`{"error": "duration_seconds must be between %d and %d"}`, minDurationSeconds, durationLimitSeconds),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	log.Printf("Successfully assumed role: %s", req.RoleARN)
-	
-	// Create the processed response
-	processedResponse := ProcessedResponse{
-		OriginalPayload:  req.Payload,
-		AssumeRoleResult: *assumeRoleResult,
-		ProcessedAt:      time.Now().Format("2006-01-02 15:04:05 MST"),
-		ProcessedBy:      "aws-lambda-post2post-receiver",
-		LambdaRequestID:  lambdaRequestID,
-		Status:           "success",
+	// Session names show up in CloudTrail, so they must follow the naming policy
+	if err := validateSessionName(lambdaReq.SessionName); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	// Create the response to send back
-	response := LambdaResponse{
-		RequestID:  req.RequestID,
-		Payload:    processedResponse,
-		TailnetKey: req.TailnetKey,
+	// The key is checked before the role is assumed, so credentials are
+	// never issued that cannot be encrypted
+	if lambdaReq.CredentialsPublicKey != "" {
+		if _, err := parseCredentialsPublicKey(lambdaReq.CredentialsPublicKey); err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
+				Headers:    map[string]string{"Content-Type": "application/json"},
+			}, nil
+		}
+	} else if requireCredentialEncryption {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       `{"error": "credentials_public_key is required, see REQUIRE_CREDENTIAL_ENCRYPTION"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	// Post the response back using Tailscale if specified
-	log.Printf("Posting response back to callback URL: %s", req.URL)
-	if err := postResponse(req.URL, response, req.TailnetKey); err != nil {
-		log.Printf("Failed to post response back to %s: %v", req.URL, err)
-	} else {
-		log.Printf("Successfully posted response back to %s", req.URL)
+	// Reject malformed condition keys here rather than as STS validation errors
+	if err := validateConditionKeys(lambdaReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
-}
-
-// assumeRole performs AWS STS AssumeRole operation
-func assumeRole(ctx context.Context, roleARN, sessionName string) (*AssumeRoleResponse, error) {
-	// Create a unique session name
-	fullSessionName := fmt.Sprintf("post2post-%s-%d", sessionName, time.Now().Unix())
 	
-	// Prepare the AssumeRole request
-	input := &sts.AssumeRoleInput{
-		RoleArn:         aws.String(roleARN),
-		RoleSessionName: aws.String(fullSessionName),
-		DurationSeconds: aws.Int32(3600), // 1 hour
+	// AssumeRoleWithWebIdentity has no external ID, session tags or source
+	// identity; the token's claims supply them
+	if lambdaReq.WebIdentityToken != "" && (lambdaReq.ExternalID != "" || len(lambdaReq.Tags) > 0 || len(lambdaReq.TransitiveTagKeys) > 0 || lambdaReq.SourceIdentity != "") {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       `{"error": "external_id, tags and source_identity are not supported with web_identity_token"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	// Execute the AssumeRole call
-	result, err := stsClient.AssumeRole(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("STS AssumeRole failed: %w", err)
+	// Validate the requested STS region and endpoint
+	if err := validateSTSTarget(lambdaReq.Region, lambdaReq.STSEndpoint); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	// Return the structured response
-	return &AssumeRoleResponse{
-		Credentials:      result.Credentials,
-		AssumedRoleUser:  result.AssumedRoleUser,
-		PackedPolicySize: result.PackedPolicySize,
-		SourceIdentity:   result.SourceIdentity,
-	}, nil
-}
-
-// postResponse posts the response back to the callback URL, optionally using Tailscale
-func postResponse(callbackURL string, response LambdaResponse, tailnetKey string) error {
-	responseJSON, err := json.Marshal(response)
-	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+	// Validate the role against the configured role path policy
+	if err := validateRoleARN(lambdaReq.RoleARN, cfg.roleARNAllowlist); err != nil {
+		log.Printf("Rejected role %s: %v", lambdaReq.RoleARN, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusForbidden,
+			Body:       fmt.Sprintf(`{"error": "Role not allowed: %s"}`, err.Error()),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	log.Printf("Response body to post to receiver: %s", string(responseJSON))
-	
-	var client *http.Client
-	
-	if tailnetKey != "" {
-		// Use Tailscale client for secure networking
-		log.Printf("Attempting to create Tailscale client for callback to: %s", callbackURL)
-		tailscaleClient, err := createTailscaleClient(tailnetKey)
-		if err != nil {
-			log.Printf("Failed to create Tailscale client, falling back to regular HTTP: %v", err)
-			client = &http.Client{Timeout: 30 * time.Second}
-		} else {
-			client = tailscaleClient
-			log.Printf("Successfully created Tailscale client for callback")
+	// Validate callback URL domain against configured Tailnet domain; queued
+	// and synchronous responses have none
+	if !queued && !synchronous {
+		if err := validateCallbackURL(lambdaReq.URL); err != nil {
+			log.Printf("Invalid callback URL %s: %v", lambdaReq.URL, err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: http.StatusForbidden,
+				Body:       fmt.Sprintf(`{"error": "Invalid callback URL: %s"}`, err.Error()),
+				Headers:    map[string]string{"Content-Type": "application/json"},
+			}, nil
 		}
-	} else {
-		// Use regular HTTP client
-		log.Printf("Using regular HTTP client for callback to: %s", callbackURL)
-		client = &http.Client{Timeout: 30 * time.Second}
 	}
 	
-	// Create and send the POST request
-	req, err := http.NewRequest("POST", callbackURL, bytes.NewBuffer(responseJSON))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	// Duplicate deliveries of a request are answered without assuming the
+	// role or delivering the response again
+	claimed, duplicate := checkDuplicate(ctx, lambdaReq, body, synchronous)
+	if duplicate != nil {
+		return *duplicate, nil
 	}
 	
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "aws-lambda-post2post/1.0")
-	
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to post response: %w", err)
+	// Synchronous requests are answered in the response body
+	if synchronous {
+		response, err := synchronousResponse(ctx, lambdaReq, request.RequestContext.RequestID)
+		if claimed {
+			finishRequest(ctx, lambdaReq.RequestID, err == nil && response.StatusCode == http.StatusOK)
+		}
+		return response, err
 	}
-	defer resp.Body.Close()
 	
-	// Read and log the response body
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed to read response body: %v", err)
-	} else {
-		log.Printf("Receiver response status: %d, body: %s", resp.StatusCode, string(respBody))
+	// Finish the work before returning: Lambda freezes the execution
+	// environment once the handler returns, so nothing may run after it
+	processErr := processRequest(ctx, lambdaReq, request.RequestContext.RequestID, cfg.callbackTailnetKey(lambdaReq))
+	if claimed {
+		finishRequest(ctx, lambdaReq.RequestID, processErr == nil)
+	}
+	if processErr != nil {
+		// The client is told at once instead of waiting for a callback that
+		// will not arrive; 502 lets it retry
+		errorResponse := events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusBadGateway,
+			Body:       `{"error": "Failed to deliver the response"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}
+		log.Printf("Lambda returning error response: StatusCode=%d, Body=%s", errorResponse.StatusCode, errorResponse.Body)
+		return errorResponse, nil
 	}
 	
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("callback returned error status: %d", resp.StatusCode)
+	// Return success acknowledgment after processing completes
+	lambdaResponse := events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Body:       `{"status": "completed", "message": "Request processed successfully"}`,
+		Headers:    map[string]string{"Content-Type": "application/json"},
 	}
 	
-	return nil
+	log.Printf("Lambda returning response: StatusCode=%d, Body=%s", lambdaResponse.StatusCode, lambdaResponse.Body)
+	return lambdaResponse, nil
 }
 
-// createTailscaleClient creates an HTTP client that routes through Tailscale
-func createTailscaleClient(tailnetKey string) (*http.Client, error) {
-	// Set environment variables required by tsnet if not already set
-	if os.Getenv("HOME") == "" {
-		os.Setenv("HOME", "/tmp")
-	}
-	if os.Getenv("XDG_CONFIG_HOME") == "" {
-		os.Setenv("XDG_CONFIG_HOME", "/tmp/.config")
-	}
-	
-	// Force fresh login in Lambda environment to avoid state conflicts
-	os.Setenv("TSNET_FORCE_LOGIN", "1")
-	
-	// Ensure auth key is used instead of interactive login
-	if tailnetKey == "" {
-		return nil, fmt.Errorf("tailnet key is required for Tailscale authentication")
-	}
-	
-	// Clean up any existing state directory to ensure fresh start
-	stateDir := "/tmp/tailscale"
-	os.RemoveAll(stateDir)
-	
-	// Create tsnet server for Tailscale integration
-	srv := &tsnet.Server{
-		Hostname:    "lambda-post2post-receiver",
-		AuthKey:     tailnetKey,
-		Ephemeral:   true, // Lambda instances are ephemeral
-		Dir:         stateDir, // Use writable tmp directory for state
-		Logf:        log.Printf, // Enable logging for debugging
-		ControlURL:  "", // Use default Tailscale control server
+// processRequest assumes the role and posts the result to the callback URL,
+// over Tailscale with tailnetKey if set, or sends it to the response queue
+// or topic, returning once the response is delivered or has failed
+func processRequest(ctx context.Context, req LambdaRequest, lambdaRequestID, tailnetKey string) error {
+	// Create the response to send back
+	response := LambdaResponse{
+		RequestID:  req.RequestID,
+		Payload:    assumeRolePayload(ctx, req, lambdaRequestID),
+		TailnetKey: req.TailnetKey,
 	}
 	
-	// Start the tsnet server
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	
-	log.Printf("Starting Tailscale tsnet server with auth key: %s...", tailnetKey[:min(len(tailnetKey), 10)])
-	if err := srv.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start tsnet server: %w", err)
+	if destination := req.responseDestination(); destination != "" {
+		// The tailnet key is not needed to read the response, so it is not
+		// written to the queue
+		response.TailnetKey = ""
+		log.Printf("Sending response to %s", destination)
+		err := traceSubsegment(ctx, "QueueResponse", req, func(ctx context.Context) error {
+			return queueResponse(ctx, req, response)
+		})
+		if err != nil {
+			log.Printf("Failed to send response to %s: %v", destination, err)
+			emitMetrics([]metric{{"CallbackFailure", "Count", 1}}, nil, map[string]string{
+				"RequestId":       req.RequestID,
+				"LambdaRequestId": lambdaRequestID,
+				"Error":           err.Error(),
+			})
+			if record := auditRecordFrom(ctx); record != nil {
+				record.CallbackError = err.Error()
+			}
+		}
+		return err
 	}
 	
-	log.Printf("Tailscale tsnet server started, waiting for connection...")
-	
-	// Wait for the server to be ready
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, fmt.Errorf("timeout waiting for Tailscale to start")
-		default:
-			status, err := srv.Up(ctx)
-			if err != nil {
-				log.Printf("Error checking Tailscale status: %v", err)
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			if status != nil {
-				log.Println("Tailscale tsnet server is ready")
-				goto ready
+	// Post the response back using Tailscale if specified, leaving time to
+	// keep the response if it cannot be delivered
+	log.Printf("Posting response back to callback URL: %s", req.URL)
+	callbackCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		callbackCtx, cancel = context.WithDeadline(ctx, deadline.Add(-callbackDeadlineReserve))
+		defer cancel()
+	}
+	err := traceSubsegment(callbackCtx, "Callback", req, func(ctx context.Context) error {
+		return postResponse(ctx, req.URL, response, tailnetKey)
+	})
+	if err != nil {
+		log.Printf("Failed to post response back to %s: %v", req.URL, err)
+		emitMetrics([]metric{{"CallbackFailure", "Count", 1}}, nil, map[string]string{
+			"RequestId":       req.RequestID,
+			"LambdaRequestId": lambdaRequestID,
+			"Error":           err.Error(),
+		})
+		record := auditRecordFrom(ctx)
+		if record != nil {
+			record.CallbackError = err.Error()
+		}
+		
+		// The client is still told the callback failed; the kept response
+		// can be redelivered once the sender is reachable
+		if callbackDLQURL != "" || callbackDLQBucket != "" {
+			var location string
+			dlqErr := traceSubsegment(ctx, "DeadLetter", req, func(ctx context.Context) error {
+				var dlqErr error
+				location, dlqErr = deadLetterResponse(ctx, req, lambdaRequestID, response, err)
+				return dlqErr
+			})
+			if dlqErr != nil {
+				log.Printf("Failed to keep undelivered response for request %s: %v", req.RequestID, dlqErr)
+				emitMetrics([]metric{{"DeadLetterFailure", "Count", 1}}, nil, map[string]string{
+					"RequestId":       req.RequestID,
+					"LambdaRequestId": lambdaRequestID,
+					"Error":           dlqErr.Error(),
+				})
+			} else {
+				log.Printf("Kept undelivered response for request %s in %s", req.RequestID, location)
+				if record != nil {
+					record.DeadLetter = location
+				}
 			}
-			time.Sleep(100 * time.Millisecond)
 		}
+		return err
 	}
-	
-ready:
-	// Create HTTP client that routes through Tailscale
-	client := srv.HTTPClient()
-	return client, nil
+	log.Printf("Successfully posted response back to %s", req.URL)
+	return nil
 }
 
-// validateCallbackURL validates that the callback URL domain matches the configured Tailnet domain
-func validateCallbackURL(callbackURL string) error {
-	parsedURL, err := url.Parse(callbackURL)
+// synchronousResponse assumes the role and returns the result in the
+// Function URL response body, for clients without a reachable callback
+func synchronousResponse(ctx context.Context, req LambdaRequest, lambdaRequestID string) (events.LambdaFunctionURLResponse, error) {
+	body, err := json.Marshal(assumeRolePayload(ctx, req, lambdaRequestID))
 	if err != nil {
-		return fmt.Errorf("invalid URL format: %w", err)
+		log.Printf("Failed to marshal synchronous response: %v", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       `{"error": "Failed to encode response"}`,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, nil
 	}
 	
-	// Extract the hostname from the URL
-	hostname := parsedURL.Hostname()
-	if hostname == "" {
-		return fmt.Errorf("no hostname found in URL")
+	log.Printf("Lambda returning synchronous response for request: %s", req.RequestID)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+	}, nil
+}
+
+// assumeRolePayload assumes the role and returns the processed response, or
+// the error payload if the role cannot be assumed
+func assumeRolePayload(ctx context.Context, req LambdaRequest, lambdaRequestID string) interface{} {
+	log.Printf("Starting role assumption for request: %s", req.RequestID)
+	
+	// Assume the specified IAM role
+	started := time.Now()
+	var assumeRoleResult *AssumeRoleResponse
+	err := traceSubsegment(ctx, "AssumeRole", req, func(ctx context.Context) error {
+		xray.AddAnnotation(ctx, "role_arn", req.RoleARN)
+		var err error
+		assumeRoleResult, err = assumeRole(ctx, req)
+		return err
+	})
+	latency := metric{"AssumeRoleLatency", "Milliseconds", float64(time.Since(started).Milliseconds())}
+	roleDimension := map[string]string{"RoleArn": req.RoleARN}
+	if err != nil {
+		log.Printf("Failed to assume role %s: %v", req.RoleARN, err)
+		// Pass the STS error code, e.g. AccessDenied, so clients can branch on it
+		var errorCode string
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			errorCode = apiErr.ErrorCode()
+		}
+		emitMetrics([]metric{latency, {"AssumeRoleSuccess", "Count", 0}, {"AssumeRoleFailure", "Count", 1}}, roleDimension, map[string]string{
+			"RequestId":       req.RequestID,
+			"LambdaRequestId": lambdaRequestID,
+			"ErrorCode":       errorCode,
+		})
+		if record := auditRecordFrom(ctx); record != nil {
+			record.Result = "error"
+			record.Error = err.Error()
+			record.ErrorCode = errorCode
+		}
+		return errorPayload(fmt.Sprintf("Failed to assume role: %v", err), errorCode, lambdaRequestID)
 	}
 	
-	// Check if hostname ends with the allowed Tailnet domain
-	if !strings.HasSuffix(hostname, allowedTailnetDomain) {
-		return fmt.Errorf("hostname %s does not match allowed Tailnet domain %s", hostname, allowedTailnetDomain)
+	log.Printf("Successfully assumed role: %s", req.RoleARN)
+	emitMetrics([]metric{latency, {"AssumeRoleSuccess", "Count", 1}, {"AssumeRoleFailure", "Count", 0}}, roleDimension, map[string]string{
+		"RequestId":       req.RequestID,
+		"LambdaRequestId": lambdaRequestID,
+	})
+	if record := auditRecordFrom(ctx); record != nil && assumeRoleResult.Credentials != nil {
+		record.Result = "success"
+		record.AccessKeyID = aws.ToString(assumeRoleResult.Credentials.AccessKeyId)
+		record.Expiration = aws.ToTime(assumeRoleResult.Credentials.Expiration)
+		record.STSRegion = assumeRoleResult.Region
+	}
+	
+	// Only the requester can read the credentials, even if the callback is
+	// misrouted or logged
+	if req.CredentialsPublicKey != "" {
+		encrypted, err := encryptCredentials(req.CredentialsPublicKey, req.RequestID, assumeRoleResult.Credentials)
+		if err != nil {
+			log.Printf("Failed to encrypt credentials for request %s: %v", req.RequestID, err)
+			return errorPayload(fmt.Sprintf("Failed to encrypt credentials: %v", err), "", lambdaRequestID)
+		}
+		assumeRoleResult.Credentials = nil
+		assumeRoleResult.EncryptedCredentials = encrypted
 	}
 	
-	return nil
+	return ProcessedResponse{
+		OriginalPayload:  req.Payload,
+		AssumeRoleResult: *assumeRoleResult,
+		ProcessedAt:      time.Now().Format("2006-01-02 15:04:05 MST"),
+		ProcessedBy:      "aws-lambda-post2post-receiver",
+		LambdaRequestID:  lambdaRequestID,
+		Status:           "success",
+	}
 }
 
-// postErrorResponse posts an error response back to the callback URL
-func postErrorResponse(req LambdaRequest, errorMsg, lambdaRequestID string) {
-	errorResponse := LambdaResponse{
-		RequestID: req.RequestID,
-		Payload: map[string]interface{}{
-			"error":             errorMsg,
-			"processed_at":      time.Now().Format("2006-01-02 15:04:05 MST"),
-			"processed_by":      "aws-lambda-post2post-receiver",
-			"lambda_request_id": lambdaRequestID,
-			"status":            "error",
-		},
-		TailnetKey: req.TailnetKey,
-	}
-	
-	if err := postResponse(req.URL, errorResponse, req.TailnetKey); err != nil {
-		log.Printf("Failed to post error response: %v", err)
+// respondSynchronously reports whether the request is answered in the
+// Function URL response, rejecting synchronous requests RESPONSE_MODE does
+// not allow
+func respondSynchronously(req LambdaRequest) (bool, error) {
+	switch responseMode {
+	case "synchronous":
+		return true, nil
+	case "allow":
+		return req.Synchronous, nil
+	default:
+		if req.Synchronous {
+			return false, fmt.Errorf("synchronous responses are disabled, see RESPONSE_MODE")
+		}
+		return false, nil
 	}
 }
 
+// traceSubsegment runs fn in an X-Ray subsegment annotated with the
+// request ID and the client's trace ID
+func traceSubsegment(ctx context.Context, name string, req LambdaRequest, fn func(context.Context) error) error {
+	return xray.Capture(ctx, name, func(ctx context.Context) error {
+		xray.AddAnnotation(ctx, "request_id", req.RequestID)
+		if clientTraceID, ok := ctx.Value(clientTraceKey{}).(string); ok {
+			xray.AddAnnotation(ctx, "client_trace_id", clientTraceID)
+		}
+		return fn(ctx)
+	})
+}
+
+// errorPayload returns the payload reporting a failed role assumption
+func errorPayload(errorMsg, errorCode, lambdaRequestID string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"error":             errorMsg,
+		"processed_at":      time.Now().Format("2006-01-02 15:04:05 MST"),
+		"processed_by":      "aws-lambda-post2post-receiver",
+		"lambda_request_id": lambdaRequestID,
+		"status":            "error",
+	}
+	if errorCode != "" {
+		payload["error_code"] = errorCode
+	}
+	return payload
+}
+
 // min returns the minimum of two integers
 func min(a, b int) int {
 	if a < b {
@@ -430,12 +667,14 @@ func min(a, b int) int {
 }
 
 func main() {
+	loadConfig()
+
 	// Check if we're running in Lambda environment
 	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
 		log.Println("Starting AWS Lambda handler")
-		lambda.Start(handleRequest)
+		lambda.Start(invoke)
 	} else {
-		log.Println("Not running in Lambda environment. Use 'go run main.go' for local testing.")
-		log.Println("For Lambda deployment, build with: GOOS=linux GOARCH=amd64 go build -o bootstrap main.go")
+		log.Println("Not running in Lambda environment. Use 'go run .' for local testing.")
+		log.Println("For Lambda deployment, build with: GOOS=linux GOARCH=amd64 go build -o bootstrap .")
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+// sign returns the v1 signature of body at timestamp with key
+func sign(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"role_arn":"arn:aws:iam::123456789012:role/remote/Example"}`)
+	keys := map[string][]byte{
+		"":      []byte("shared-key"),
+		"2026a": []byte("old-key"),
+		"2026b": []byte("new-key"),
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-signatureMaxAge-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(signatureMaxAge+time.Minute).Unix(), 10)
+	edge := strconv.FormatInt(time.Now().Add(-signatureMaxAge+time.Minute).Unix(), 10)
+
+	valid := sign(keys[""], now, body)
+	// Same length as a valid signature, differing only in the last digit
+	tampered := valid[:len(valid)-1] + "0"
+	if valid[len(valid)-1] == '0' {
+		tampered = valid[:len(valid)-1] + "1"
+	}
+
+	tests := []struct {
+		name    string
+		keys    map[string][]byte
+		headers map[string]string
+		wantErr bool
+	}{
+		{"no keys configured", nil, map[string]string{}, false},
+		{"shared key", keys, map[string]string{"x-post2post-signature": valid, "x-post2post-timestamp": now}, false},
+		{"old rotated key", keys, map[string]string{"x-post2post-signature": sign(keys["2026a"], now, body), "x-post2post-timestamp": now, "x-post2post-key-id": "2026a"}, false},
+		{"new rotated key", keys, map[string]string{"x-post2post-signature": sign(keys["2026b"], now, body), "x-post2post-timestamp": now, "x-post2post-key-id": "2026b"}, false},
+		{"signed with another key's ID", keys, map[string]string{"x-post2post-signature": sign(keys["2026a"], now, body), "x-post2post-timestamp": now, "x-post2post-key-id": "2026b"}, true},
+		{"unknown key ID", keys, map[string]string{"x-post2post-signature": valid, "x-post2post-timestamp": now, "x-post2post-key-id": "retired"}, true},
+		{"unsigned", keys, map[string]string{}, true},
+		{"no timestamp", keys, map[string]string{"x-post2post-signature": valid}, true},
+		{"invalid timestamp", keys, map[string]string{"x-post2post-signature": valid, "x-post2post-timestamp": "yesterday"}, true},
+		{"inside the window", keys, map[string]string{"x-post2post-signature": sign(keys[""], edge, body), "x-post2post-timestamp": edge}, false},
+		{"stale timestamp", keys, map[string]string{"x-post2post-signature": sign(keys[""], stale, body), "x-post2post-timestamp": stale}, true},
+		{"future timestamp", keys, map[string]string{"x-post2post-signature": sign(keys[""], future, body), "x-post2post-timestamp": future}, true},
+		{"timestamp not the signed one", keys, map[string]string{"x-post2post-signature": valid, "x-post2post-timestamp": edge}, true},
+		{"no version prefix", keys, map[string]string{"x-post2post-signature": valid[len("v1="):], "x-post2post-timestamp": now}, true},
+		{"unknown version", keys, map[string]string{"x-post2post-signature": "v2=" + valid[len("v1="):], "x-post2post-timestamp": now}, true},
+		{"tampered signature", keys, map[string]string{"x-post2post-signature": tampered, "x-post2post-timestamp": now}, true},
+		{"truncated signature", keys, map[string]string{"x-post2post-signature": valid[:len(valid)-2], "x-post2post-timestamp": now}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignature(tt.keys, tt.headers, body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := verifySignature(keys, map[string]string{"x-post2post-signature": valid, "x-post2post-timestamp": now}, []byte(`{}`)); err == nil {
+		t.Error("verifySignature() accepted a signature of another body")
+	}
+}
+
+func TestValidateRoleARN(t *testing.T) {
+	defer func(prefix string) { rolePathPrefix = prefix }(rolePathPrefix)
+
+	tests := []struct {
+		name      string
+		prefix    string
+		roleARN   string
+		allowlist []string
+		wantErr   bool
+	}{
+		{"under /remote/", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remote/Example", nil, false},
+		{"nested under /remote/", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remote/x/Example", nil, false},
+		{"on the root path", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/Example", nil, true},
+		{"path sharing the prefix", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remoteX/Example", nil, true},
+		{"outside /remote/", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/admin/Example", nil, true},
+		{"named remote on the root path", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remote", nil, true},
+		{"not a role", defaultRolePathPrefix, "arn:aws:iam::123456789012:user/remote/Example", nil, true},
+		{"not an ARN", defaultRolePathPrefix, "remote/Example", nil, true},
+		{"in the allowlist", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remote/Example", []string{"arn:aws:iam::123456789012:role/remote/Example"}, false},
+		{"not in the allowlist", defaultRolePathPrefix, "arn:aws:iam::123456789012:role/remote/Other", []string{"arn:aws:iam::123456789012:role/remote/Example"}, true},
+		{"any path allowed, root path", "", "arn:aws:iam::123456789012:role/Example", nil, false},
+		{"any path allowed, other path", "", "arn:aws:iam::123456789012:role/admin/Example", nil, false},
+		{"any path allowed, not a role", "", "arn:aws:iam::123456789012:user/Example", nil, true},
+		{"custom prefix", "/team/", "arn:aws:iam::123456789012:role/team/Example", nil, false},
+		{"outside a custom prefix", "/team/", "arn:aws:iam::123456789012:role/remote/Example", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rolePathPrefix = tt.prefix
+			err := validateRoleARN(tt.roleARN, tt.allowlist)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRoleARN(%q) with prefix %q error = %v, wantErr %v", tt.roleARN, tt.prefix, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRolePathPrefix(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", defaultRolePathPrefix},
+		{"  ", defaultRolePathPrefix},
+		{"/", ""},
+		{" / ", ""},
+		{"team", "/team/"},
+		{"/team", "/team/"},
+		{"/team/", "/team/"},
+		{"team/ops/", "/team/ops/"},
+	}
+	for _, tt := range tests {
+		if got := parseRolePathPrefix(tt.value); got != tt.want {
+			t.Errorf("parseRolePathPrefix(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	defer func(domain string) { allowedTailnetDomain = domain }(allowedTailnetDomain)
+	allowedTailnetDomain = "example.ts.net"
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://sender.example.ts.net:8080/roundtrip", false},
+		{"https://Sender.Example.TS.net./roundtrip", false},
+		{"http://example.ts.net/roundtrip", true},
+		{"http://sender.evil-example.ts.net/roundtrip", true},
+		{"http://sender.example.ts.net.evil.com/roundtrip", true},
+		{"http:///roundtrip", true},
+	}
+	for _, tt := range tests {
+		if err := validateCallbackURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("validateCallbackURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckPeerTags(t *testing.T) {
+	tagged := views.SliceOf([]string{"tag:post2post"})
+	other := views.SliceOf([]string{"tag:other"})
+	status := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {DNSName: "sender.example.ts.net.", Tags: &tagged},
+		key.NewNode().Public(): {DNSName: "other.example.ts.net.", Tags: &other},
+		key.NewNode().Public(): {DNSName: "laptop.example.ts.net."},
+	}}
+	allowed := []string{"tag:post2post"}
+
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"sender.example.ts.net", false},
+		{"Sender.Example.ts.net.", false},
+		{"other.example.ts.net", true},
+		{"laptop.example.ts.net", true},
+		{"unknown.example.ts.net", true},
+	}
+	for _, tt := range tests {
+		if err := checkPeerTags(status, tt.host, allowed); (err != nil) != tt.wantErr {
+			t.Errorf("checkPeerTags(%q) error = %v, wantErr %v", tt.host, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClaimRequest(t *testing.T) {
+	defer func(table string) { idempotencyTable = table }(idempotencyTable)
+	idempotencyTable = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if existing, err := claimRequest(ctx, "req-claim", "hash-a"); existing != nil || err != nil {
+		t.Fatalf("claimRequest() = %+v, %v, want the claim", existing, err)
+	}
+	existing, err := claimRequest(ctx, "req-claim", "hash-b")
+	if err != nil || existing == nil || existing.Status != "in_progress" || existing.BodyHash != "hash-a" {
+		t.Fatalf("claimRequest() of a claimed ID = %+v, %v, want the in-progress claim", existing, err)
+	}
+
+	// A completed request stays claimed for idempotencyTTL
+	finishRequest(ctx, "req-claim", true)
+	existing, err = claimRequest(ctx, "req-claim", "hash-a")
+	if err != nil || existing == nil || existing.Status != "completed" || existing.BodyHash != "hash-a" {
+		t.Fatalf("claimRequest() of a completed ID = %+v, %v, want the completed claim", existing, err)
+	}
+	if time.Until(existing.ExpiresAt) <= time.Minute {
+		t.Errorf("completed claim expires at %v, want about idempotencyTTL from now", existing.ExpiresAt)
+	}
+
+	// A failed request releases its claim for the client to retry
+	if existing, err := claimRequest(ctx, "req-failed", "hash-c"); existing != nil || err != nil {
+		t.Fatalf("claimRequest() = %+v, %v, want the claim", existing, err)
+	}
+	finishRequest(ctx, "req-failed", false)
+	if existing, err := claimRequest(ctx, "req-failed", "hash-c"); existing != nil || err != nil {
+		t.Errorf("claimRequest() after a failure = %+v, %v, want the claim again", existing, err)
+	}
+
+	// An expired claim is taken over
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if existing, err := claimRequest(expired, "req-expired", "hash-d"); existing != nil || err != nil {
+		t.Fatalf("claimRequest() = %+v, %v, want the claim", existing, err)
+	}
+	if existing, err := claimRequest(ctx, "req-expired", "hash-d"); existing != nil || err != nil {
+		t.Errorf("claimRequest() of an expired claim = %+v, %v, want the claim", existing, err)
+	}
+}
+
+func TestCheckDuplicate(t *testing.T) {
+	defer func(table string) { idempotencyTable = table }(idempotencyTable)
+	idempotencyTable = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	body := []byte(`{"request_id":"req-sync"}`)
+
+	// Synchronous requests are claimed before the role is assumed
+	req := LambdaRequest{RequestID: "req-sync"}
+	if claimed, duplicate := checkDuplicate(ctx, req, body, true); !claimed || duplicate != nil {
+		t.Fatalf("checkDuplicate() = %v, %+v, want the claim", claimed, duplicate)
+	}
+	if claimed, duplicate := checkDuplicate(ctx, req, body, true); claimed || duplicate == nil || duplicate.StatusCode != http.StatusConflict {
+		t.Errorf("checkDuplicate() of an in-progress synchronous request = %v, %+v, want 409", claimed, duplicate)
+	}
+	finishRequest(ctx, req.RequestID, true)
+	if claimed, duplicate := checkDuplicate(ctx, req, body, true); claimed || duplicate == nil || duplicate.StatusCode != http.StatusConflict {
+		t.Errorf("checkDuplicate() of a completed synchronous request = %v, %+v, want 409", claimed, duplicate)
+	}
+
+	req = LambdaRequest{RequestID: "req-callback"}
+	if claimed, duplicate := checkDuplicate(ctx, req, body, false); !claimed || duplicate != nil {
+		t.Fatalf("checkDuplicate() = %v, %+v, want the claim", claimed, duplicate)
+	}
+	if _, duplicate := checkDuplicate(ctx, req, body, false); duplicate == nil || duplicate.StatusCode != http.StatusAccepted {
+		t.Errorf("checkDuplicate() of an in-progress request = %+v, want 202", duplicate)
+	}
+	if _, duplicate := checkDuplicate(ctx, req, []byte(`{}`), false); duplicate == nil || duplicate.StatusCode != http.StatusConflict {
+		t.Errorf("checkDuplicate() of another body = %+v, want 409", duplicate)
+	}
+	finishRequest(ctx, req.RequestID, true)
+	if _, duplicate := checkDuplicate(ctx, req, body, false); duplicate == nil || duplicate.StatusCode != http.StatusOK {
+		t.Errorf("checkDuplicate() of a completed request = %+v, want 200", duplicate)
+	}
+
+	// Requests without a request ID are not deduplicated
+	if claimed, duplicate := checkDuplicate(ctx, LambdaRequest{}, body, false); claimed || duplicate != nil {
+		t.Errorf("checkDuplicate() without a request ID = %v, %+v, want neither", claimed, duplicate)
+	}
+}
+
+func TestCheckDuplicate_FailsOpen(t *testing.T) {
+	defer func(table string, client *dynamodb.Client) {
+		idempotencyTable, dynamoClient = table, client
+	}(idempotencyTable, dynamoClient)
+
+	// Nothing listens on port 1, so every claim fails
+	idempotencyTable = "post2post-idempotency"
+	dynamoClient = dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://127.0.0.1:1"),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := claimRequest(ctx, "req-unreachable", "hash"); err == nil {
+		t.Fatal("claimRequest() succeeded without a table")
+	}
+	claimed, duplicate := checkDuplicate(ctx, LambdaRequest{RequestID: "req-unreachable"}, []byte(`{}`), false)
+	if claimed || duplicate != nil {
+		t.Errorf("checkDuplicate() = %v, %+v, want the request processed unclaimed", claimed, duplicate)
+	}
+}
+
+func TestValidateSTSTarget(t *testing.T) {
+	tests := []struct {
+		region   string
+		endpoint string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"us-east-1", "", false},
+		{"us-gov-west-1", "", false},
+		{"US-EAST-1", "", true},
+		{"us-east-1.evil.com", "", true},
+		{"", "https://sts.amazonaws.com", false},
+		{"", "https://sts.amazonaws.com/", false},
+		{"eu-west-1", "https://sts.eu-west-1.amazonaws.com", false},
+		{"us-east-1", "https://sts-fips.us-east-1.amazonaws.com", false},
+		{"us-gov-west-1", "https://sts.us-gov-west-1.amazonaws.com", false},
+		{"cn-north-1", "https://sts.cn-north-1.amazonaws.com.cn", false},
+		{"", "https://STS.EU-WEST-1.AMAZONAWS.COM", false},
+		{"", "http://sts.amazonaws.com", true},
+		{"", "https://sts.amazonaws.com:8443", true},
+		{"", "https://user@sts.amazonaws.com", true},
+		{"", "https://sts.amazonaws.com/path", true},
+		{"", "https://sts.amazonaws.com/?a=b", true},
+		{"", "https://evil.amazonaws.com", true},
+		{"", "https://attacker-bucket.s3.amazonaws.com", true},
+		{"", "https://execute-api.us-east-1.amazonaws.com", true},
+		{"", "https://sts.us-east-1.amazonaws.com.evil.com", true},
+		{"", "https://xsts.us-east-1.amazonaws.com", true},
+		{"", "https://sts.evil.us-east-1.amazonaws.com", true},
+		{"", "https://sts-fips.cn-north-1.amazonaws.com.cn", true},
+		{"", "https://sts.amazonaws.com.cn", true},
+		{"", "https://vpce-0123.sts.us-east-1.vpce.amazonaws.com", true},
+	}
+	for _, tt := range tests {
+		if err := validateSTSTarget(tt.region, tt.endpoint); (err != nil) != tt.wantErr {
+			t.Errorf("validateSTSTarget(%q, %q) error = %v, wantErr %v", tt.region, tt.endpoint, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// CloudWatch namespace of the embedded metric format records, "" when
+// metrics are disabled
+var metricsNamespace = "Post2Post"
+
+// metric is one value of an embedded metric format record
+type metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// emitMetrics writes an embedded metric format record to stdout, which
+// CloudWatch Logs turns into metrics. The metrics are published by function
+// name and, if dimensions are given, by function name and dimensions too;
+// properties are only searchable in the logs.
+func emitMetrics(metrics []metric, dimensions map[string]string, properties map[string]string) {
+	if metricsNamespace == "" {
+		return
+	}
+
+	record := map[string]interface{}{}
+	for name, value := range properties {
+		if value != "" {
+			record[name] = value
+		}
+	}
+	record["FunctionName"] = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	dimensionSets := [][]string{{"FunctionName"}}
+	if len(dimensions) > 0 {
+		set := []string{"FunctionName"}
+		for name, value := range dimensions {
+			set = append(set, name)
+			record[name] = value
+		}
+		sort.Strings(set[1:])
+		dimensionSets = append(dimensionSets, set)
+	}
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		record[m.Name] = m.Value
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": dimensionSets,
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal metrics: %v", err)
+		return
+	}
+	// The record must be a line of its own, without the log package's prefix
+	fmt.Fprintln(os.Stdout, string(line))
+}
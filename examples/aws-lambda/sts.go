@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// STS clients for requested regions and endpoints, keyed by region and endpoint
+var regionalSTSClients sync.Map
+
+// stsRegionCooldown is how long a region that failed is tried after the
+// others
+const stsRegionCooldown = time.Minute
+
+// degradedSTSRegions maps the regions that failed to when they are tried
+// in priority order again
+var degradedSTSRegions sync.Map
+
+// stsRegionPattern matches AWS region names such as us-east-1
+var stsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// stsEndpointPattern matches the hosts of the global, regional, FIPS and
+// China STS endpoints
+var stsEndpointPattern = regexp.MustCompile(`^(sts\.amazonaws\.com|sts(-fips)?\.[a-z]{2}(-[a-z]+)+-[0-9]+\.amazonaws\.com|sts\.cn-[a-z]+-[0-9]+\.amazonaws\.com\.cn)$`)
+
+// defaultSessionName returns the session name of requests without one:
+// post2post, the request ID and the time, cut to the 64 characters STS allows
+func defaultSessionName(requestID string) string {
+	suffix := fmt.Sprintf("-%d", time.Now().Unix())
+	id := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || strings.ContainsRune("+=,.@_-", r) {
+			return r
+		}
+		return '-'
+	}, requestID)
+	name := "post2post-" + id
+	if len(name)+len(suffix) > 64 {
+		name = name[:64-len(suffix)]
+	}
+	return name + suffix
+}
+
+// assumeRole performs AWS STS AssumeRole operation for the request
+func assumeRole(ctx context.Context, req LambdaRequest) (*AssumeRoleResponse, error) {
+	// Use the requested session name, or a unique one for the request
+	fullSessionName := req.SessionName
+	if fullSessionName == "" {
+		fullSessionName = defaultSessionName(req.RequestID)
+	}
+
+	// Use the requested credential duration, defaulting to 1 hour
+	durationSeconds := req.DurationSeconds
+	if durationSeconds == 0 {
+		durationSeconds = defaultDurationSeconds
+	}
+
+	// A web identity token is exchanged with AssumeRoleWithWebIdentity, which
+	// needs no permissions on the Lambda's execution role
+	if req.WebIdentityToken != "" {
+		return assumeRoleWithWebIdentity(ctx, req, fullSessionName, durationSeconds)
+	}
+
+	// Prepare the AssumeRole request
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(req.RoleARN),
+		RoleSessionName: aws.String(fullSessionName),
+		DurationSeconds: aws.Int32(durationSeconds),
+	}
+
+	// Cross-account roles may require an external ID in their trust policy
+	if req.ExternalID != "" {
+		input.ExternalId = aws.String(req.ExternalID)
+	}
+
+	// Session policies scope the credentials below the role's permissions
+	if req.Policy != "" {
+		input.Policy = aws.String(req.Policy)
+	}
+	for _, arn := range req.PolicyARNs {
+		input.PolicyArns = append(input.PolicyArns, types.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+
+	// Session tags for ABAC; the role's trust policy must allow sts:TagSession
+	for key, value := range req.Tags {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	input.TransitiveTagKeys = req.TransitiveTagKeys
+
+	// The source identity persists through role chaining, for
+	// sts:SourceIdentity conditions; the trust policy must allow
+	// sts:SetSourceIdentity
+	if req.SourceIdentity != "" {
+		input.SourceIdentity = aws.String(req.SourceIdentity)
+	}
+
+	// Execute the AssumeRole call
+	var result *sts.AssumeRoleOutput
+	region, err := callSTS(ctx, req, func(ctx context.Context, client *sts.Client) error {
+		var err error
+		result, err = client.AssumeRole(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("STS AssumeRole failed: %w", err)
+	}
+
+	// Return the structured response
+	return &AssumeRoleResponse{
+		Credentials:      result.Credentials,
+		AssumedRoleUser:  result.AssumedRoleUser,
+		PackedPolicySize: result.PackedPolicySize,
+		SourceIdentity:   result.SourceIdentity,
+		Region:           region,
+	}, nil
+}
+
+// assumeRoleWithWebIdentity exchanges the caller's OIDC token for credentials
+func assumeRoleWithWebIdentity(ctx context.Context, req LambdaRequest, sessionName string, durationSeconds int32) (*AssumeRoleResponse, error) {
+	input := &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(req.RoleARN),
+		RoleSessionName:  aws.String(sessionName),
+		WebIdentityToken: aws.String(req.WebIdentityToken),
+		DurationSeconds:  aws.Int32(durationSeconds),
+	}
+	if req.Policy != "" {
+		input.Policy = aws.String(req.Policy)
+	}
+	for _, arn := range req.PolicyARNs {
+		input.PolicyArns = append(input.PolicyArns, types.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+
+	var result *sts.AssumeRoleWithWebIdentityOutput
+	region, err := callSTS(ctx, req, func(ctx context.Context, client *sts.Client) error {
+		var err error
+		result, err = client.AssumeRoleWithWebIdentity(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("STS AssumeRoleWithWebIdentity failed: %w", err)
+	}
+
+	return &AssumeRoleResponse{
+		Credentials:      result.Credentials,
+		AssumedRoleUser:  result.AssumedRoleUser,
+		PackedPolicySize: result.PackedPolicySize,
+		SourceIdentity:   result.SourceIdentity,
+		Region:           region,
+	}, nil
+}
+
+// validateSTSTarget checks the requested region and STS endpoint. The
+// endpoint must be one of the public STS endpoints, matched exactly, so the
+// Lambda never sends signed requests elsewhere.
+func validateSTSTarget(region, endpoint string) error {
+	if region != "" && !stsRegionPattern.MatchString(region) {
+		return fmt.Errorf("invalid region")
+	}
+	if endpoint == "" {
+		return nil
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid sts_endpoint")
+	}
+	if parsed.Scheme != "https" || parsed.User != nil || parsed.Port() != "" || (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" {
+		return fmt.Errorf("sts_endpoint must be an https URL of an STS endpoint")
+	}
+	if !stsEndpointPattern.MatchString(strings.ToLower(parsed.Hostname())) {
+		return fmt.Errorf("sts_endpoint must be sts.amazonaws.com, sts.<region>.amazonaws.com, sts-fips.<region>.amazonaws.com or sts.<region>.amazonaws.com.cn")
+	}
+	return nil
+}
+
+// callSTS calls fn with the STS client of the request's region and
+// endpoint. Requests without either go to STS_REGIONS in priority order,
+// failing over while regions do not answer. It returns the region that
+// answered.
+func callSTS(ctx context.Context, req LambdaRequest, fn func(context.Context, *sts.Client) error) (string, error) {
+	if req.Region != "" || req.STSEndpoint != "" || len(stsRegions) == 0 {
+		client := stsClientFor(req.Region, req.STSEndpoint)
+		return client.Options().Region, fn(ctx, client)
+	}
+
+	var err error
+	for i, region := range orderedSTSRegions() {
+		if i > 0 {
+			log.Printf("Failing over to STS in %s: %v", region, err)
+			emitMetrics([]metric{{"STSFailover", "Count", 1}}, map[string]string{"Region": region}, map[string]string{
+				"RequestId": req.RequestID,
+				"Error":     err.Error(),
+			})
+		}
+		regionCtx, cancel := context.WithTimeout(ctx, stsRegionTimeout)
+		err = fn(regionCtx, stsClientFor(region, ""))
+		cancel()
+		if err == nil {
+			degradedSTSRegions.Delete(region)
+			return region, nil
+		}
+		if ctx.Err() != nil || !stsRegionFailure(err) {
+			return region, err
+		}
+		degradedSTSRegions.Store(region, time.Now().Add(stsRegionCooldown))
+	}
+	return "", err
+}
+
+// orderedSTSRegions returns STS_REGIONS in priority order, with the regions
+// that failed within stsRegionCooldown last
+func orderedSTSRegions() []string {
+	var healthy, degraded []string
+	for _, region := range stsRegions {
+		if until, ok := degradedSTSRegions.Load(region); ok && time.Now().Before(until.(time.Time)) {
+			degraded = append(degraded, region)
+		} else {
+			healthy = append(healthy, region)
+		}
+	}
+	return append(healthy, degraded...)
+}
+
+// stsRegionFailure reports whether err means the STS region is unavailable,
+// rather than that it refused the request
+func stsRegionFailure(err error) bool {
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "RegionDisabledException", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+		return false
+	}
+	// STS did not answer: the connection failed or the region timed out
+	return true
+}
+
+// stsClientFor returns the STS client for the region and endpoint, or the
+// default client if neither is set
+func stsClientFor(region, endpoint string) *sts.Client {
+	if region == "" && endpoint == "" {
+		return stsClient
+	}
+
+	key := region + "|" + endpoint
+	if client, ok := regionalSTSClients.Load(key); ok {
+		return client.(*sts.Client)
+	}
+
+	client := sts.NewFromConfig(awsConfig, func(o *sts.Options) {
+		if region != "" {
+			o.Region = region
+		}
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	log.Printf("Using STS in region %s, endpoint %s", client.Options().Region, endpoint)
+	actual, _ := regionalSTSClients.LoadOrStore(key, client)
+	return actual.(*sts.Client)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// tailscaleNode is the tsnet node of the sandbox. It is started by the first
+// callback and reused while the sandbox is warm, so invocations neither wait
+// for a new node nor register a new ephemeral device.
+var tailscaleNode struct {
+	mu  sync.Mutex
+	srv *tsnet.Server
+}
+
+// tailscaleHTTPClient returns an HTTP client that routes through the
+// sandbox's tsnet node, starting the node if there is none or it is no
+// longer up, and whether a running node was reused
+func tailscaleHTTPClient(ctx context.Context, tailnetKey string) (*http.Client, bool, error) {
+	tailscaleNode.mu.Lock()
+	defer tailscaleNode.mu.Unlock()
+
+	if srv := tailscaleNode.srv; srv != nil {
+		// The node reconnects on its own after the sandbox is thawed; give it a
+		// moment before starting over
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := srv.Up(ctx)
+		cancel()
+		if err == nil {
+			return srv.HTTPClient(), true, nil
+		}
+		log.Printf("Warm Tailscale node is not up, starting a new one: %v", err)
+		srv.Close()
+		tailscaleNode.srv = nil
+	}
+
+	started := time.Now()
+	var srv *tsnet.Server
+	err := xray.Capture(ctx, "TailscaleStartup", func(context.Context) error {
+		var err error
+		srv, err = startTailscaleNode(tailnetKey)
+		return err
+	})
+	if err != nil {
+		emitMetrics([]metric{{"TailscaleStartupFailure", "Count", 1}}, nil, map[string]string{"Error": err.Error()})
+		return nil, false, err
+	}
+	emitMetrics([]metric{
+		{"TailscaleStartupTime", "Milliseconds", float64(time.Since(started).Milliseconds())},
+		{"TailscaleStartupFailure", "Count", 0},
+	}, nil, nil)
+
+	tailscaleNode.srv = srv
+	return srv.HTTPClient(), false, nil
+}
+
+// resetTailscaleNode closes the sandbox's tsnet node, so the next callback
+// starts and authenticates a new one
+func resetTailscaleNode() {
+	tailscaleNode.mu.Lock()
+	defer tailscaleNode.mu.Unlock()
+
+	if tailscaleNode.srv != nil {
+		tailscaleNode.srv.Close()
+		tailscaleNode.srv = nil
+	}
+}
+
+// startTailscaleNode starts a tsnet node and waits until it is up
+func startTailscaleNode(tailnetKey string) (*tsnet.Server, error) {
+	// Set environment variables required by tsnet if not already set
+	if os.Getenv("HOME") == "" {
+		os.Setenv("HOME", "/tmp")
+	}
+	if os.Getenv("XDG_CONFIG_HOME") == "" {
+		os.Setenv("XDG_CONFIG_HOME", "/tmp/.config")
+	}
+
+	// Force fresh login when a node is started, to avoid state conflicts
+	// with a node that was closed
+	os.Setenv("TSNET_FORCE_LOGIN", "1")
+
+	// Ensure auth key is used instead of interactive login
+	if tailnetKey == "" {
+		return nil, fmt.Errorf("tailnet key is required for Tailscale authentication")
+	}
+
+	// Clean up any existing state directory to ensure fresh start
+	stateDir := "/tmp/tailscale"
+	os.RemoveAll(stateDir)
+
+	// Allow the node hostname to be overridden so multiple receivers are distinguishable
+	hostname := os.Getenv("TAILSCALE_HOSTNAME")
+	if hostname == "" {
+		hostname = "lambda-post2post-receiver"
+	}
+
+	// Create tsnet server for Tailscale integration
+	srv := &tsnet.Server{
+		Hostname:   hostname,
+		AuthKey:    tailnetKey,
+		Ephemeral:  true,       // Removed from the tailnet once the sandbox is gone
+		Dir:        stateDir,   // Use writable tmp directory for state
+		Logf:       log.Printf, // Enable logging for debugging
+		ControlURL: "",         // Use default Tailscale control server
+	}
+
+	// Start the tsnet server
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	log.Printf("Starting Tailscale tsnet server with auth key: %s...", tailnetKey[:min(len(tailnetKey), 10)])
+	if err := srv.Start(); err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("failed to start tsnet server: %w", err)
+	}
+
+	log.Printf("Tailscale tsnet server started, waiting for connection...")
+
+	// Wait for the server to be ready
+	for {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+			return nil, fmt.Errorf("timeout waiting for Tailscale to start")
+		default:
+			status, err := srv.Up(ctx)
+			if err != nil {
+				log.Printf("Error checking Tailscale status: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if status != nil {
+				log.Println("Tailscale tsnet server is ready")
+				goto ready
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+ready:
+	return srv, nil
+}
+
+// checkCallbackTags checks that the callback URL's host is a node of the
+// tailnet bearing one of CALLBACK_ALLOWED_TAGS, as seen by the sandbox's
+// tsnet node. Tags can only be checked over Tailscale.
+func checkCallbackTags(ctx context.Context, callbackURL string) error {
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL format: %w", err)
+	}
+
+	tailscaleNode.mu.Lock()
+	srv := tailscaleNode.srv
+	tailscaleNode.mu.Unlock()
+	if srv == nil {
+		return fmt.Errorf("callback node tags can only be checked over Tailscale")
+	}
+	lc, err := srv.LocalClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Tailscale local client: %w", err)
+	}
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Tailscale status: %w", err)
+	}
+
+	return checkPeerTags(status, parsedURL.Hostname(), callbackAllowedTags)
+}
+
+// checkPeerTags checks that the peer named host in status bears one of tags
+func checkPeerTags(status *ipnstate.Status, host string, tags []string) error {
+	host = strings.TrimSuffix(host, ".")
+	for _, peer := range status.Peer {
+		if !strings.EqualFold(strings.TrimSuffix(peer.DNSName, "."), host) {
+			continue
+		}
+		if peer.Tags != nil {
+			for _, tag := range peer.Tags.AsSlice() {
+				if slices.Contains(tags, tag) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("callback node %s bears none of the allowed tags %v", host, tags)
+	}
+	return fmt.Errorf("callback host %s is not a node of the tailnet", host)
+}
@@ -32,6 +32,243 @@ variable "tailnet_domain" {
   type        = string
 }
 
+variable "function_url_auth_type" {
+  description = "Function URL auth: NONE, or AWS_IAM to require SigV4-signed requests"
+  type        = string
+  default     = "NONE"
+}
+
+variable "role_path_prefix" {
+  description = "IAM path requested roles must be under; matches the STS policy below"
+  type        = string
+  default     = "/remote/"
+}
+
+variable "role_arn_allowlist" {
+  description = "Role ARNs the Lambda may assume (default: any under role_path_prefix)"
+  type        = list(string)
+  default     = []
+}
+
+variable "config_secret_arn" {
+  description = "Secrets Manager secret to load the tailnet auth key, signing keys and allowlist from"
+  type        = string
+  default     = ""
+}
+
+variable "config_ssm_path" {
+  description = "SSM parameter path to load the tailnet auth key, signing keys and allowlist from, e.g. /post2post/receiver"
+  type        = string
+  default     = ""
+}
+
+variable "sts_regions" {
+  description = "STS regions tried in priority order, failing over when one does not answer; empty for the Lambda's region"
+  type        = list(string)
+  default     = []
+}
+
+variable "response_queue_arns" {
+  description = "SQS queues clients may have responses delivered to instead of a callback"
+  type        = list(string)
+  default     = []
+}
+
+variable "response_topic_arns" {
+  description = "SNS topics clients may have responses published to instead of a callback"
+  type        = list(string)
+  default     = []
+}
+
+variable "callback_max_attempts" {
+  description = "Attempts to deliver a callback before it is given up, with backoff between them"
+  type        = number
+  default     = 3
+}
+
+variable "callback_dead_letter_queue_arn" {
+  description = "SQS queue responses are kept in for redelivery when their callback fails"
+  type        = string
+  default     = ""
+}
+
+variable "callback_dead_letter_bucket" {
+  description = "S3 bucket responses are kept in for redelivery when their callback fails, instead of a queue"
+  type        = string
+  default     = ""
+}
+
+variable "audit_table_enabled" {
+  description = "Record every request in a DynamoDB audit table"
+  type        = bool
+  default     = false
+}
+
+variable "audit_ttl" {
+  description = "How long audit records are kept, as a Go duration"
+  type        = string
+  default     = "2160h"
+}
+
+variable "xray_tracing_enabled" {
+  description = "Trace every request with AWS X-Ray, not only those whose caller's trace is sampled"
+  type        = bool
+  default     = false
+}
+
+variable "idempotency_table_enabled" {
+  description = "Detect duplicate deliveries of a request across sandboxes with a DynamoDB table, instead of per sandbox"
+  type        = bool
+  default     = false
+}
+
+variable "idempotency_ttl" {
+  description = "How long processed request IDs are remembered, as a Go duration"
+  type        = string
+  default     = "1h"
+}
+
+# DynamoDB audit trail of requests, expired through the ttl attribute
+resource "aws_dynamodb_table" "audit" {
+  count        = var.audit_table_enabled ? 1 : 0
+  name         = "${var.function_name}-audit"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "lambda_request_id"
+
+  attribute {
+    name = "lambda_request_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+}
+
+resource "aws_iam_role_policy" "audit" {
+  count = var.audit_table_enabled ? 1 : 0
+  name  = "${var.function_name}-audit-policy"
+  role  = aws_iam_role.lambda_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["dynamodb:PutItem"]
+        Resource = aws_dynamodb_table.audit[0].arn
+      }
+    ]
+  })
+}
+
+# Claims on request IDs, expired through the ttl attribute
+resource "aws_dynamodb_table" "idempotency" {
+  count        = var.idempotency_table_enabled ? 1 : 0
+  name         = "${var.function_name}-idempotency"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "request_id"
+
+  attribute {
+    name = "request_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+}
+
+resource "aws_iam_role_policy" "idempotency" {
+  count = var.idempotency_table_enabled ? 1 : 0
+  name  = "${var.function_name}-idempotency-policy"
+  role  = aws_iam_role.lambda_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["dynamodb:PutItem", "dynamodb:UpdateItem", "dynamodb:DeleteItem"]
+        Resource = aws_dynamodb_table.idempotency[0].arn
+      }
+    ]
+  })
+}
+
+# Read access to the configuration secret or parameters
+resource "aws_iam_role_policy" "config" {
+  count = var.config_secret_arn != "" || var.config_ssm_path != "" ? 1 : 0
+  name  = "${var.function_name}-config-policy"
+  role  = aws_iam_role.lambda_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      var.config_secret_arn != "" ? {
+        Effect   = "Allow"
+        Action   = ["secretsmanager:GetSecretValue"]
+        Resource = var.config_secret_arn
+      } : {
+        Effect   = "Allow"
+        Action   = ["ssm:GetParametersByPath"]
+        Resource = "arn:aws:ssm:${var.aws_region}:${data.aws_caller_identity.current.account_id}:parameter/${trimprefix(var.config_ssm_path, "/")}"
+      }
+    ]
+  })
+}
+
+# Delivery of responses to the allowed queues and topics
+resource "aws_iam_role_policy" "response_queue" {
+  count = length(var.response_queue_arns) + length(var.response_topic_arns) > 0 ? 1 : 0
+  name  = "${var.function_name}-response-queue-policy"
+  role  = aws_iam_role.lambda_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = concat(
+      length(var.response_queue_arns) > 0 ? [{
+        Effect   = "Allow"
+        Action   = ["sqs:SendMessage"]
+        Resource = var.response_queue_arns
+      }] : [],
+      length(var.response_topic_arns) > 0 ? [{
+        Effect   = "Allow"
+        Action   = ["sns:Publish"]
+        Resource = var.response_topic_arns
+      }] : []
+    )
+  })
+}
+
+# Keeping undelivered responses in the dead-letter queue or bucket
+resource "aws_iam_role_policy" "callback_dead_letter" {
+  count = var.callback_dead_letter_queue_arn != "" || var.callback_dead_letter_bucket != "" ? 1 : 0
+  name  = "${var.function_name}-callback-dead-letter-policy"
+  role  = aws_iam_role.lambda_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      var.callback_dead_letter_queue_arn != "" ? {
+        Effect   = "Allow"
+        Action   = ["sqs:SendMessage"]
+        Resource = var.callback_dead_letter_queue_arn
+        } : {
+        Effect   = "Allow"
+        Action   = ["s3:PutObject"]
+        Resource = "arn:aws:s3:::${var.callback_dead_letter_bucket}/undelivered/*"
+      }
+    ]
+  })
+}
+
 # IAM role for the Lambda function
 resource "aws_iam_role" "lambda_role" {
   name = "${var.function_name}-role"
@@ -80,6 +317,12 @@ resource "aws_iam_role_policy_attachment" "lambda_sts" {
   policy_arn = aws_iam_policy.sts_assume_role.arn
 }
 
+# IAM policy for sending trace segments to X-Ray
+resource "aws_iam_role_policy_attachment" "lambda_xray" {
+  role       = aws_iam_role.lambda_role.name
+  policy_arn = "arn:aws:iam::aws:policy/AWSXRayDaemonWriteAccess"
+}
+
 # Lambda function
 resource "aws_lambda_function" "post2post_receiver" {
   filename         = "../bootstrap.zip"
@@ -89,28 +332,48 @@ resource "aws_lambda_function" "post2post_receiver" {
   runtime         = "provided.al2023"
   timeout         = 30
 
+  tracing_config {
+    mode = var.xray_tracing_enabled ? "Active" : "PassThrough"
+  }
+
   environment {
     variables = {
-      TAILNET_DOMAIN = var.tailnet_domain
+      TAILNET_DOMAIN     = var.tailnet_domain
+      ROLE_PATH_PREFIX   = var.role_path_prefix
+      ROLE_ARN_ALLOWLIST = join(",", var.role_arn_allowlist)
+      CONFIG_SECRET_ARN  = var.config_secret_arn
+      CONFIG_SSM_PATH    = var.config_ssm_path
+      STS_REGIONS        = join(",", var.sts_regions)
+      # Queue URLs, which requests name, derived from the queue ARNs
+      RESPONSE_QUEUE_ALLOWLIST = join(",", [for arn in var.response_queue_arns : format("https://sqs.%s.amazonaws.com/%s/%s", split(":", arn)[3], split(":", arn)[4], split(":", arn)[5])])
+      RESPONSE_TOPIC_ALLOWLIST = join(",", var.response_topic_arns)
+      CALLBACK_MAX_ATTEMPTS    = tostring(var.callback_max_attempts)
+      CALLBACK_DLQ_URL         = var.callback_dead_letter_queue_arn == "" ? "" : format("https://sqs.%s.amazonaws.com/%s/%s", split(":", var.callback_dead_letter_queue_arn)[3], split(":", var.callback_dead_letter_queue_arn)[4], split(":", var.callback_dead_letter_queue_arn)[5])
+      CALLBACK_DLQ_BUCKET      = var.callback_dead_letter_queue_arn == "" ? var.callback_dead_letter_bucket : ""
+      AUDIT_TABLE        = var.audit_table_enabled ? aws_dynamodb_table.audit[0].name : ""
+      AUDIT_TTL          = var.audit_ttl
+      IDEMPOTENCY_TABLE  = var.idempotency_table_enabled ? aws_dynamodb_table.idempotency[0].name : ""
+      IDEMPOTENCY_TTL    = var.idempotency_ttl
     }
   }
 
   depends_on = [
     aws_iam_role_policy_attachment.lambda_basic,
     aws_iam_role_policy_attachment.lambda_sts,
+    aws_iam_role_policy_attachment.lambda_xray,
   ]
 }
 
 # Lambda Function URL for HTTP access
 resource "aws_lambda_function_url" "post2post_url" {
   function_name      = aws_lambda_function.post2post_receiver.function_name
-  authorization_type = "NONE"  # Public access - adjust as needed
+  authorization_type = var.function_url_auth_type
 
   cors {
     allow_credentials = false
     allow_origins     = ["*"]
     allow_methods     = ["POST"]
-    allow_headers     = ["date", "keep-alive", "content-type"]
+    allow_headers     = ["date", "keep-alive", "content-type", "x-amzn-trace-id"]
     expose_headers    = ["date", "keep-alive"]
     max_age          = 86400
   }
@@ -130,4 +393,14 @@ output "lambda_function_name" {
 output "lambda_function_arn" {
   description = "ARN of the Lambda function"
   value       = aws_lambda_function.post2post_receiver.arn
-}
\ No newline at end of file
+}
+
+output "audit_table_name" {
+  description = "Name of the DynamoDB audit table, if enabled"
+  value       = var.audit_table_enabled ? aws_dynamodb_table.audit[0].name : null
+}
+
+output "idempotency_table_name" {
+  description = "Name of the DynamoDB idempotency table, if enabled"
+  value       = var.idempotency_table_enabled ? aws_dynamodb_table.idempotency[0].name : null
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateSessionName checks a requested session name against the STS
+// format and SESSION_NAME_PATTERN; an empty name is allowed
+func validateSessionName(sessionName string) error {
+	if sessionName == "" {
+		return nil
+	}
+	if !sessionNamePattern.MatchString(sessionName) {
+		return fmt.Errorf("session_name must be 2 to 64 letters, digits or +=,.@_- characters")
+	}
+	if sessionNamePolicy != nil && !sessionNamePolicy.MatchString(sessionName) {
+		return fmt.Errorf("session_name does not match SESSION_NAME_PATTERN")
+	}
+	return nil
+}
+
+// validateConditionKeys checks the external ID, session tags and source
+// identity against the limits STS enforces
+func validateConditionKeys(req LambdaRequest) error {
+	if req.ExternalID != "" && (len(req.ExternalID) < 2 || len(req.ExternalID) > 1224) {
+		return fmt.Errorf("external_id must be between 2 and 1224 characters")
+	}
+	if len(req.Tags) > 50 {
+		return fmt.Errorf("at most 50 session tags are allowed")
+	}
+	for key, value := range req.Tags {
+		if len(key) == 0 || len(key) > 128 || len(value) > 256 {
+			return fmt.Errorf("session tag keys must be 1 to 128 and values at most 256 characters")
+		}
+	}
+	for _, key := range req.TransitiveTagKeys {
+		if _, ok := req.Tags[key]; !ok {
+			return fmt.Errorf("transitive tag key %s is not a session tag", key)
+		}
+	}
+	if req.SourceIdentity != "" && !sessionNamePattern.MatchString(req.SourceIdentity) {
+		return fmt.Errorf("source_identity must be 2 to 64 letters, digits or +=,.@_- characters")
+	}
+	return nil
+}
+
+// validateResponseDestination checks the response queue or topic against
+// RESPONSE_QUEUE_ALLOWLIST or RESPONSE_TOPIC_ALLOWLIST. Entries ending in *
+// match by prefix.
+func validateResponseDestination(req LambdaRequest) error {
+	switch {
+	case req.ResponseQueueURL != "":
+		if len(responseQueueAllowlist) == 0 {
+			return fmt.Errorf("queued responses are disabled, see RESPONSE_QUEUE_ALLOWLIST")
+		}
+		if !matchesAllowlist(req.ResponseQueueURL, responseQueueAllowlist) {
+			return fmt.Errorf("queue is not in the allowlist")
+		}
+	case req.ResponseTopicARN != "":
+		if len(responseTopicAllowlist) == 0 {
+			return fmt.Errorf("topic responses are disabled, see RESPONSE_TOPIC_ALLOWLIST")
+		}
+		if !matchesAllowlist(req.ResponseTopicARN, responseTopicAllowlist) {
+			return fmt.Errorf("topic is not in the allowlist")
+		}
+	}
+	return nil
+}
+
+// matchesAllowlist reports whether value is an entry of allowlist or starts
+// with the prefix of an entry ending in *
+func matchesAllowlist(value string, allowlist []string) bool {
+	for _, allowed := range allowlist {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCallbackURL validates that the callback URL's host is a node of
+// the configured Tailnet domain
+func validateCallbackURL(callbackURL string) error {
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL format: %w", err)
+	}
+
+	// Extract the hostname from the URL
+	hostname := strings.ToLower(strings.TrimSuffix(parsedURL.Hostname(), "."))
+	if hostname == "" {
+		return fmt.Errorf("no hostname found in URL")
+	}
+
+	// The domain must match whole labels: evil-example.ts.net is not in
+	// example.ts.net
+	if !strings.HasSuffix(hostname, "."+allowedTailnetDomain) {
+		return fmt.Errorf("hostname %s does not match allowed Tailnet domain %s", hostname, allowedTailnetDomain)
+	}
+
+	return nil
+}
+
+// validateRoleARN checks the role against ROLE_PATH_PREFIX, ROLE_ARN_PATTERN
+// and ROLE_ARN_ALLOWLIST; every configured check must pass
+func validateRoleARN(roleARN string, roleARNAllowlist []string) error {
+	// Expected format: arn:aws:iam::123456789012:role/path/RoleName
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || !strings.HasPrefix(parts[5], "role/") {
+		return fmt.Errorf("not an IAM role ARN")
+	}
+
+	if rolePathPrefix != "" {
+		resource := strings.TrimPrefix(parts[5], "role")
+		path := resource[:strings.LastIndex(resource, "/")+1]
+		if !strings.HasPrefix(path, rolePathPrefix) {
+			return fmt.Errorf("role is not under the required path %s", rolePathPrefix)
+		}
+	}
+	if roleARNPattern != nil && !roleARNPattern.MatchString(roleARN) {
+		return fmt.Errorf("role does not match the allowed pattern")
+	}
+	if len(roleARNAllowlist) > 0 {
+		for _, allowed := range roleARNAllowlist {
+			if allowed == roleARN {
+				return nil
+			}
+		}
+		return fmt.Errorf("role is not in the allowlist")
+	}
+
+	return nil
+}
+
+// verifySignature checks the request's HMAC-SHA256 signature over the
+// timestamp and body when signing keys are configured. Function URL header
+// names are lower case.
+func verifySignature(signingKeys map[string][]byte, headers map[string]string, body []byte) error {
+	if len(signingKeys) == 0 {
+		return nil
+	}
+
+	signature := headers["x-post2post-signature"]
+	timestamp := headers["x-post2post-timestamp"]
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("request is not signed")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return fmt.Errorf("timestamp is outside the allowed window")
+	}
+
+	key, ok := signingKeys[headers["x-post2post-key-id"]]
+	if !ok {
+		return fmt.Errorf("unknown key ID")
+	}
+	got, ok := strings.CutPrefix(signature, "v1=")
+	if !ok {
+		return fmt.Errorf("unsupported signature version")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal([]byte(got), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
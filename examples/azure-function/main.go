@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// managedIdentityAPIVersion is the App Service managed identity API version
+const managedIdentityAPIVersion = "2019-08-01"
+
+// clientIDPattern matches managed identity client IDs
+var clientIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// TokenRequest represents the incoming token request payload
+type TokenRequest struct {
+	URL        string   `json:"url"`
+	Payload    string   `json:"payload"`
+	RequestID  string   `json:"request_id"`
+	TailnetKey string   `json:"tailnet_key,omitempty"`
+	Scopes     []string `json:"scopes"`
+	ClientID   string   `json:"client_id,omitempty"`
+}
+
+// TokenResult is the managed identity token
+type TokenResult struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresOn   time.Time `json:"expires_on"`
+}
+
+// ProcessedResponse is posted back to the client
+type ProcessedResponse struct {
+	OriginalPayload   string       `json:"original_payload"`
+	TokenResult       *TokenResult `json:"token_result,omitempty"`
+	ProcessedAt       string       `json:"processed_at"`
+	ProcessedBy       string       `json:"processed_by"`
+	ReceiverRequestID string       `json:"receiver_request_id"`
+	Status            string       `json:"status"`
+	Error             string       `json:"error,omitempty"`
+	ErrorCode         string       `json:"error_code,omitempty"`
+}
+
+// CallbackResponse wraps the processed response for the post2post callback
+type CallbackResponse struct {
+	RequestID  string            `json:"request_id"`
+	Payload    ProcessedResponse `json:"payload"`
+	TailnetKey string            `json:"tailnet_key,omitempty"`
+}
+
+var allowedTailnetDomain string
+var tailscaleFallback string
+
+// Managed identity client IDs and resources that may be requested; any when
+// empty
+var clientIDAllowlist []string
+var resourceAllowlist []string
+
+// Tailscale clients by auth key; function instances serve many requests
+var tailscaleClientsMu sync.Mutex
+var tailscaleClients = map[string]*http.Client{}
+
+func main() {
+	allowedTailnetDomain = os.Getenv("TAILNET_DOMAIN")
+	if allowedTailnetDomain == "" {
+		log.Fatalf("TAILNET_DOMAIN environment variable is required but not set")
+	}
+	if os.Getenv("IDENTITY_ENDPOINT") == "" || os.Getenv("IDENTITY_HEADER") == "" {
+		log.Fatalf("IDENTITY_ENDPOINT and IDENTITY_HEADER are not set; enable a managed identity on the function app")
+	}
+
+	// Behavior when tsnet fails: never (default), warn or silent
+	tailscaleFallback = os.Getenv("TAILSCALE_FALLBACK")
+	if tailscaleFallback == "" {
+		tailscaleFallback = "never"
+	}
+	if tailscaleFallback != "never" && tailscaleFallback != "warn" && tailscaleFallback != "silent" {
+		log.Fatalf("TAILSCALE_FALLBACK must be never, warn or silent, got: %s", tailscaleFallback)
+	}
+
+	clientIDAllowlist = splitList(os.Getenv("CLIENT_ID_ALLOWLIST"))
+	resourceAllowlist = splitList(os.Getenv("RESOURCE_ALLOWLIST"))
+
+	// The Functions host tells custom handlers which port to listen on
+	port := os.Getenv("FUNCTIONS_CUSTOMHANDLER_PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	http.HandleFunc("/api/token", handleRequest)
+	log.Printf("Azure post2post receiver listening on port %s with Tailnet domain: %s", port, allowedTailnetDomain)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+// handleRequest validates a token request, acknowledges it and posts the
+// token back to the callback URL
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse the incoming post2post wrapper request
+	var postData struct {
+		URL        string       `json:"url"`
+		Payload    TokenRequest `json:"payload"`
+		RequestID  string       `json:"request_id,omitempty"`
+		TailnetKey string       `json:"tailnet_key,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		log.Printf("Failed to parse post2post wrapper: %v", err)
+		writeError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	req := postData.Payload
+
+	log.Printf("Processing request ID: %s", req.RequestID)
+
+	if len(req.Scopes) != 1 {
+		writeError(w, http.StatusBadRequest, "exactly one scope is required")
+		return
+	}
+	if req.URL == "" {
+		writeError(w, http.StatusBadRequest, "callback url is required")
+		return
+	}
+	if req.ClientID != "" && !clientIDPattern.MatchString(req.ClientID) {
+		writeError(w, http.StatusBadRequest, "client_id must be a managed identity client ID")
+		return
+	}
+	resource := scopeResource(req.Scopes[0])
+	if err := validateIdentity(req.ClientID, resource); err != nil {
+		log.Printf("Rejected token request for %s: %v", resource, err)
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Token request not allowed: %s", err.Error()))
+		return
+	}
+	if err := validateCallbackURL(req.URL); err != nil {
+		log.Printf("Invalid callback URL %s: %v", req.URL, err)
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Invalid callback URL: %s", err.Error()))
+		return
+	}
+
+	// Process the request synchronously; the instance may be frozen after
+	// the response is sent
+	processRequest(r.Context(), req, resource, r.Header.Get("X-Arr-Log-Id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "completed", "message": "Request processed successfully"}`))
+}
+
+// processRequest gets the managed identity token and posts the result back
+func processRequest(ctx context.Context, req TokenRequest, resource, receiverRequestID string) {
+	response := ProcessedResponse{
+		OriginalPayload:   req.Payload,
+		ProcessedAt:       time.Now().Format("2006-01-02 15:04:05 MST"),
+		ProcessedBy:       "azure-function-post2post-receiver",
+		ReceiverRequestID: receiverRequestID,
+		Status:            "success",
+	}
+
+	token, errorCode, err := managedIdentityToken(ctx, resource, req.ClientID)
+	if err != nil {
+		log.Printf("Failed to get token for %s: %v", resource, err)
+		response.Status = "error"
+		response.Error = fmt.Sprintf("Failed to get managed identity token: %v", err)
+		response.ErrorCode = errorCode
+	} else {
+		log.Printf("Got managed identity token for %s", resource)
+		response.TokenResult = token
+	}
+
+	callback := CallbackResponse{
+		RequestID:  req.RequestID,
+		Payload:    response,
+		TailnetKey: req.TailnetKey,
+	}
+	if err := postResponse(req.URL, callback, req.TailnetKey); err != nil {
+		log.Printf("Failed to post response back to %s: %v", req.URL, err)
+	} else {
+		log.Printf("Successfully posted response back to %s", req.URL)
+	}
+}
+
+// managedIdentityToken gets a token for resource from the function app's
+// managed identity endpoint; clientID selects a user-assigned identity. On
+// failure it also returns the HTTP status text, e.g. Forbidden.
+func managedIdentityToken(ctx context.Context, resource, clientID string) (*TokenResult, string, error) {
+	query := url.Values{}
+	query.Set("resource", resource)
+	query.Set("api-version", managedIdentityAPIVersion)
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("IDENTITY_ENDPOINT")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, "", fmt.Errorf("managed identity request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read managed identity response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return nil, http.StatusText(resp.StatusCode), fmt.Errorf("managed identity endpoint: %s", apiErr.Message)
+		}
+		return nil, http.StatusText(resp.StatusCode), fmt.Errorf("managed identity endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"` // Unix seconds
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, "", fmt.Errorf("failed to parse managed identity response: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(result.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid expires_on %q: %w", result.ExpiresOn, err)
+	}
+	return &TokenResult{AccessToken: result.AccessToken, ExpiresOn: time.Unix(expiresOn, 0)}, "", nil
+}
+
+// scopeResource converts an Azure AD scope to the resource the managed
+// identity endpoint expects
+func scopeResource(scope string) string {
+	return strings.TrimSuffix(scope, "/.default")
+}
+
+// validateIdentity checks the client ID and resource against
+// CLIENT_ID_ALLOWLIST and RESOURCE_ALLOWLIST
+func validateIdentity(clientID, resource string) error {
+	if len(clientIDAllowlist) > 0 && !contains(clientIDAllowlist, clientID) {
+		if clientID == "" {
+			return fmt.Errorf("the system-assigned identity is not in the allowlist")
+		}
+		return fmt.Errorf("client ID %s is not in the allowlist", clientID)
+	}
+	if len(resourceAllowlist) > 0 && !contains(resourceAllowlist, resource) {
+		return fmt.Errorf("resource %s is not in the allowlist", resource)
+	}
+	return nil
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated environment variable
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// postResponse posts the response back to the callback URL, optionally using Tailscale
+func postResponse(callbackURL string, response CallbackResponse, tailnetKey string) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if tailnetKey != "" {
+		tailscaleClient, err := tailscaleClientFor(tailnetKey)
+		if err != nil {
+			if tailscaleFallback == "never" {
+				// Tokens must not leave the tailnet
+				return fmt.Errorf("failed to create Tailscale client and TAILSCALE_FALLBACK is never: %w", err)
+			}
+			if tailscaleFallback == "warn" {
+				log.Printf("WARNING: Failed to create Tailscale client, falling back to regular HTTP: %v", err)
+			}
+		} else {
+			client = tailscaleClient
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(responseJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "azure-function-post2post/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("callback returned error status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tailscaleClientFor returns an HTTP client that routes through Tailscale,
+// joining the tailnet on first use
+func tailscaleClientFor(tailnetKey string) (*http.Client, error) {
+	tailscaleClientsMu.Lock()
+	defer tailscaleClientsMu.Unlock()
+
+	if client, ok := tailscaleClients[tailnetKey]; ok {
+		return client, nil
+	}
+
+	hostname := os.Getenv("TAILSCALE_HOSTNAME")
+	if hostname == "" {
+		hostname = "azure-post2post-receiver"
+	}
+
+	srv := &tsnet.Server{
+		Hostname:  hostname,
+		AuthKey:   tailnetKey,
+		Ephemeral: true, // Function instances are ephemeral
+		Dir:       "/tmp/tailscale",
+		Logf:      log.Printf,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := srv.Up(ctx); err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("failed to start tsnet server: %w", err)
+	}
+
+	client := srv.HTTPClient()
+	tailscaleClients[tailnetKey] = client
+	return client, nil
+}
+
+// validateCallbackURL validates that the callback URL domain matches the configured Tailnet domain
+func validateCallbackURL(callbackURL string) error {
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL format: %w", err)
+	}
+
+	hostname := parsedURL.Hostname()
+	if hostname == "" {
+		return fmt.Errorf("no hostname found in URL")
+	}
+	if !strings.HasSuffix(hostname, allowedTailnetDomain) {
+		return fmt.Errorf("hostname %s does not match allowed Tailnet domain %s", hostname, allowedTailnetDomain)
+	}
+	return nil
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// GCP endpoints used by the receiver
+const (
+	metadataTokenURL       = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	generateAccessTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+	cloudPlatformScope     = "https://www.googleapis.com/auth/cloud-platform"
+	defaultLifetime        = 3600
+	maxLifetime            = 43200
+)
+
+// TokenRequest represents the incoming token request payload
+type TokenRequest struct {
+	URL             string   `json:"url"`
+	Payload         string   `json:"payload"`
+	RequestID       string   `json:"request_id"`
+	TailnetKey      string   `json:"tailnet_key,omitempty"`
+	ServiceAccount  string   `json:"service_account"`
+	Scopes          []string `json:"scopes,omitempty"`
+	Delegates       []string `json:"delegates,omitempty"`
+	LifetimeSeconds int32    `json:"lifetime_seconds,omitempty"`
+}
+
+// TokenResult is the generated access token
+type TokenResult struct {
+	AccessToken string    `json:"access_token"`
+	ExpireTime  time.Time `json:"expire_time"`
+}
+
+// ProcessedResponse is posted back to the client
+type ProcessedResponse struct {
+	OriginalPayload   string       `json:"original_payload"`
+	TokenResult       *TokenResult `json:"token_result,omitempty"`
+	ProcessedAt       string       `json:"processed_at"`
+	ProcessedBy       string       `json:"processed_by"`
+	ReceiverRequestID string       `json:"receiver_request_id"`
+	Status            string       `json:"status"`
+	Error             string       `json:"error,omitempty"`
+	ErrorCode         string       `json:"error_code,omitempty"`
+}
+
+// CallbackResponse wraps the processed response for the post2post callback
+type CallbackResponse struct {
+	RequestID  string            `json:"request_id"`
+	Payload    ProcessedResponse `json:"payload"`
+	TailnetKey string            `json:"tailnet_key,omitempty"`
+}
+
+// iamError is the error body of the IAM Credentials API
+type iamError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+var allowedTailnetDomain string
+var tailscaleFallback string
+
+// Service accounts that may be impersonated; any when empty
+var serviceAccountAllowlist []string
+
+// Tailscale clients by auth key; Cloud Run instances serve many requests
+var tailscaleClientsMu sync.Mutex
+var tailscaleClients = map[string]*http.Client{}
+
+func main() {
+	allowedTailnetDomain = os.Getenv("TAILNET_DOMAIN")
+	if allowedTailnetDomain == "" {
+		log.Fatalf("TAILNET_DOMAIN environment variable is required but not set")
+	}
+
+	// Behavior when tsnet fails: never (default), warn or silent
+	tailscaleFallback = os.Getenv("TAILSCALE_FALLBACK")
+	if tailscaleFallback == "" {
+		tailscaleFallback = "never"
+	}
+	if tailscaleFallback != "never" && tailscaleFallback != "warn" && tailscaleFallback != "silent" {
+		log.Fatalf("TAILSCALE_FALLBACK must be never, warn or silent, got: %s", tailscaleFallback)
+	}
+
+	for _, account := range strings.Split(os.Getenv("SERVICE_ACCOUNT_ALLOWLIST"), ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			serviceAccountAllowlist = append(serviceAccountAllowlist, account)
+		}
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	http.HandleFunc("/", handleRequest)
+	log.Printf("GCP post2post receiver listening on port %s with Tailnet domain: %s", port, allowedTailnetDomain)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+// handleRequest validates a token request, acknowledges it and posts the
+// token back to the callback URL
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse the incoming post2post wrapper request
+	var postData struct {
+		URL        string       `json:"url"`
+		Payload    TokenRequest `json:"payload"`
+		RequestID  string       `json:"request_id,omitempty"`
+		TailnetKey string       `json:"tailnet_key,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		log.Printf("Failed to parse post2post wrapper: %v", err)
+		writeError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	req := postData.Payload
+
+	log.Printf("Processing request ID: %s", req.RequestID)
+	log.Printf("Service account to impersonate: %s", req.ServiceAccount)
+
+	if req.ServiceAccount == "" {
+		writeError(w, http.StatusBadRequest, "service_account is required")
+		return
+	}
+	if req.URL == "" {
+		writeError(w, http.StatusBadRequest, "callback url is required")
+		return
+	}
+	if req.LifetimeSeconds < 0 || req.LifetimeSeconds > maxLifetime {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("lifetime_seconds must be at most %d", maxLifetime))
+		return
+	}
+	if err := validateServiceAccount(req.ServiceAccount); err != nil {
+		log.Printf("Rejected service account %s: %v", req.ServiceAccount, err)
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Service account not allowed: %s", err.Error()))
+		return
+	}
+	for _, delegate := range req.Delegates {
+		if !strings.Contains(delegate, "@") || !strings.HasSuffix(delegate, ".gserviceaccount.com") {
+			writeError(w, http.StatusBadRequest, "delegates must be service account emails")
+			return
+		}
+	}
+	if err := validateCallbackURL(req.URL); err != nil {
+		log.Printf("Invalid callback URL %s: %v", req.URL, err)
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Invalid callback URL: %s", err.Error()))
+		return
+	}
+
+	// Process the request synchronously; Cloud Run may throttle the CPU
+	// after the response is sent
+	processRequest(r.Context(), req, r.Header.Get("X-Cloud-Trace-Context"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "completed", "message": "Request processed successfully"}`))
+}
+
+// processRequest generates the access token and posts the result back
+func processRequest(ctx context.Context, req TokenRequest, receiverRequestID string) {
+	response := ProcessedResponse{
+		OriginalPayload:   req.Payload,
+		ProcessedAt:       time.Now().Format("2006-01-02 15:04:05 MST"),
+		ProcessedBy:       "gcp-cloud-run-post2post-receiver",
+		ReceiverRequestID: receiverRequestID,
+		Status:            "success",
+	}
+
+	token, errorCode, err := generateAccessToken(ctx, req)
+	if err != nil {
+		log.Printf("Failed to impersonate %s: %v", req.ServiceAccount, err)
+		response.Status = "error"
+		response.Error = fmt.Sprintf("Failed to generate access token: %v", err)
+		response.ErrorCode = errorCode
+	} else {
+		log.Printf("Generated access token for %s", req.ServiceAccount)
+		response.TokenResult = token
+	}
+
+	callback := CallbackResponse{
+		RequestID:  req.RequestID,
+		Payload:    response,
+		TailnetKey: req.TailnetKey,
+	}
+	if err := postResponse(req.URL, callback, req.TailnetKey); err != nil {
+		log.Printf("Failed to post response back to %s: %v", req.URL, err)
+	} else {
+		log.Printf("Successfully posted response back to %s", req.URL)
+	}
+}
+
+// generateAccessToken impersonates the requested service account with the
+// IAM Credentials API, authenticated as the receiver's own service account.
+// On failure it also returns the API's error status, e.g. PERMISSION_DENIED.
+func generateAccessToken(ctx context.Context, req TokenRequest) (*TokenResult, string, error) {
+	callerToken, err := metadataToken(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+	lifetime := req.LifetimeSeconds
+	if lifetime == 0 {
+		lifetime = defaultLifetime
+	}
+	delegates := make([]string, 0, len(req.Delegates))
+	for _, delegate := range req.Delegates {
+		delegates = append(delegates, "projects/-/serviceAccounts/"+delegate)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"scope":     scopes,
+		"delegates": delegates,
+		"lifetime":  fmt.Sprintf("%ds", lifetime),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	endpoint := fmt.Sprintf(generateAccessTokenURL, url.PathEscape(req.ServiceAccount))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+callerToken)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, "", fmt.Errorf("generateAccessToken failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read generateAccessToken response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr iamError
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error.Message != "" {
+			return nil, apiErr.Error.Status, fmt.Errorf("generateAccessToken failed: %s", apiErr.Error.Message)
+		}
+		return nil, "", fmt.Errorf("generateAccessToken returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, "", fmt.Errorf("failed to parse generateAccessToken response: %w", err)
+	}
+	return &TokenResult{AccessToken: result.AccessToken, ExpireTime: result.ExpireTime}, "", nil
+}
+
+// metadataToken returns an access token for the receiver's own service
+// account from the metadata server
+func metadataToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to parse metadata token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// postResponse posts the response back to the callback URL, optionally using Tailscale
+func postResponse(callbackURL string, response CallbackResponse, tailnetKey string) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if tailnetKey != "" {
+		tailscaleClient, err := tailscaleClientFor(tailnetKey)
+		if err != nil {
+			if tailscaleFallback == "never" {
+				// Tokens must not leave the tailnet
+				return fmt.Errorf("failed to create Tailscale client and TAILSCALE_FALLBACK is never: %w", err)
+			}
+			if tailscaleFallback == "warn" {
+				log.Printf("WARNING: Failed to create Tailscale client, falling back to regular HTTP: %v", err)
+			}
+		} else {
+			client = tailscaleClient
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(responseJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gcp-cloud-run-post2post/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("callback returned error status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tailscaleClientFor returns an HTTP client that routes through Tailscale,
+// joining the tailnet on first use
+func tailscaleClientFor(tailnetKey string) (*http.Client, error) {
+	tailscaleClientsMu.Lock()
+	defer tailscaleClientsMu.Unlock()
+
+	if client, ok := tailscaleClients[tailnetKey]; ok {
+		return client, nil
+	}
+
+	hostname := os.Getenv("TAILSCALE_HOSTNAME")
+	if hostname == "" {
+		hostname = "gcp-post2post-receiver"
+	}
+
+	srv := &tsnet.Server{
+		Hostname:  hostname,
+		AuthKey:   tailnetKey,
+		Ephemeral: true, // Cloud Run instances are ephemeral
+		Dir:       "/tmp/tailscale",
+		Logf:      log.Printf,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := srv.Up(ctx); err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("failed to start tsnet server: %w", err)
+	}
+
+	client := srv.HTTPClient()
+	tailscaleClients[tailnetKey] = client
+	return client, nil
+}
+
+// validateCallbackURL validates that the callback URL domain matches the configured Tailnet domain
+func validateCallbackURL(callbackURL string) error {
+	parsedURL, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL format: %w", err)
+	}
+
+	hostname := parsedURL.Hostname()
+	if hostname == "" {
+		return fmt.Errorf("no hostname found in URL")
+	}
+	if !strings.HasSuffix(hostname, allowedTailnetDomain) {
+		return fmt.Errorf("hostname %s does not match allowed Tailnet domain %s", hostname, allowedTailnetDomain)
+	}
+	return nil
+}
+
+// validateServiceAccount checks the service account against
+// SERVICE_ACCOUNT_ALLOWLIST
+func validateServiceAccount(serviceAccount string) error {
+	if !strings.Contains(serviceAccount, "@") || !strings.HasSuffix(serviceAccount, ".gserviceaccount.com") {
+		return fmt.Errorf("not a service account email")
+	}
+	if len(serviceAccountAllowlist) == 0 {
+		return nil
+	}
+	for _, allowed := range serviceAccountAllowlist {
+		if allowed == serviceAccount {
+			return nil
+		}
+	}
+	return fmt.Errorf("service account is not in the allowlist")
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
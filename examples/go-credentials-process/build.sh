@@ -44,7 +44,7 @@ go mod tidy
 
 # Build for current platform
 echo "🔨 Building for current platform..."
-go build -ldflags="${LDFLAGS}" -o post2post-credentials main.go
+go build -ldflags="${LDFLAGS}" -o post2post-credentials .
 
 # Make executable
 chmod +x post2post-credentials
@@ -54,23 +54,23 @@ echo "🔨 Building for multiple platforms..."
 
 # Linux AMD64
 echo "  - Building for Linux AMD64..."
-GOOS=linux GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-linux-amd64 main.go
+GOOS=linux GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-linux-amd64 .
 
 # Linux ARM64
 echo "  - Building for Linux ARM64..."
-GOOS=linux GOARCH=arm64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-linux-arm64 main.go
+GOOS=linux GOARCH=arm64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-linux-arm64 .
 
 # macOS AMD64
 echo "  - Building for macOS AMD64..."
-GOOS=darwin GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-darwin-amd64 main.go
+GOOS=darwin GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-darwin-amd64 .
 
 # macOS ARM64 (Apple Silicon)
 echo "  - Building for macOS ARM64..."
-GOOS=darwin GOARCH=arm64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-darwin-arm64 main.go
+GOOS=darwin GOARCH=arm64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-darwin-arm64 .
 
 # Windows AMD64
 echo "  - Building for Windows AMD64..."
-GOOS=windows GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-windows-amd64.exe main.go
+GOOS=windows GOARCH=amd64 go build -ldflags="${LDFLAGS}" -o post2post-credentials-windows-amd64.exe .
 
 # Display build results
 echo ""
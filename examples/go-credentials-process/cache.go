@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	post2post "github.com/pgdad/post2post"
+	"github.com/pgdad/post2post/credentialscache"
+	"github.com/zalando/go-keyring"
+)
+
+// Cache subcommands
+const (
+	commandPrefetch = "prefetch"
+	commandStatus   = "status"
+	commandPurge    = "purge"
+)
+
+// Cache stores selectable with --cache-store
+const (
+	cacheStoreAuto    = "auto"
+	cacheStoreKeyring = "keyring"
+	cacheStoreFile    = "file"
+)
+
+// Sources of the file cache passphrase selectable with --cache-encryption
+const (
+	cacheEncryptionNone    = "none"
+	cacheEncryptionKeyring = "keyring"
+	cacheEncryptionKeyFile = "key-file"
+)
+
+// keyringService is the OS keyring service credentials are stored under
+const keyringService = "post2post-credentials"
+
+// cacheKeyringUser is the keyring entry holding the generated file cache
+// passphrase
+const cacheKeyringUser = "cache-encryption-key"
+
+// newCacheStore returns the store for cached credentials: the OS keyring or,
+// for the file store or when auto finds no usable keyring, the disk cache,
+// and a description of where it keeps entries. It fails if no cache can be
+// used.
+func newCacheStore(config *Config) (post2post.CredentialsCacheStore, string, error) {
+	store := config.CacheStore
+	if store != cacheStoreFile {
+		err := credentialscache.KeyringAvailable(keyringService)
+		if err == nil {
+			return credentialscache.NewKeyringStore(keyringService), fmt.Sprintf("OS keyring (service %s)", keyringService), nil
+		}
+		if store == cacheStoreKeyring {
+			return nil, "", err
+		}
+		log.Printf("OS keyring not usable, falling back to the disk cache: %v", err)
+	}
+
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, "", err
+	}
+	if config.CacheEncryption == "" || config.CacheEncryption == cacheEncryptionNone {
+		return post2post.NewFileCacheStore(cacheDir), cacheDir, nil
+	}
+
+	// Never fall back to a plaintext cache when encryption was asked for
+	cipher, err := cacheCipher(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return credentialscache.NewEncryptedFileStore(cacheDir, cipher), cacheDir + " (encrypted)", nil
+}
+
+// cacheCipher returns the cipher for the file cache, accepting the previous
+// passphrases for decryption so the key can be rotated
+func cacheCipher(config *Config) (credentialscache.Cipher, error) {
+	var passphrase string
+	var err error
+	if config.CacheEncryption == cacheEncryptionKeyring {
+		passphrase, err = keyringCachePassphrase()
+	} else {
+		passphrase, err = readSecretFile(config.CacheKeyFile, "cache key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	current, err := credentialscache.NewPassphraseCipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.CachePreviousKeyFiles) == 0 {
+		return current, nil
+	}
+
+	previous := make([]credentialscache.Cipher, 0, len(config.CachePreviousKeyFiles))
+	for _, path := range config.CachePreviousKeyFiles {
+		oldPassphrase, err := readSecretFile(path, "previous cache key")
+		if err != nil {
+			return nil, err
+		}
+		oldCipher, err := credentialscache.NewPassphraseCipher(oldPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, oldCipher)
+	}
+	return credentialscache.NewRotatingCipher(current, previous...)
+}
+
+// keyringCachePassphrase returns the file cache passphrase kept in the OS
+// keyring, generating a random one on first use
+func keyringCachePassphrase() (string, error) {
+	passphrase, err := keyring.Get(keyringService, cacheKeyringUser)
+	if err == nil {
+		return passphrase, nil
+	}
+	if !errors.Is(err, keyring.ErrNotFound) {
+		return "", fmt.Errorf("failed to read cache passphrase from keyring: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate cache passphrase: %w", err)
+	}
+	passphrase = base64.StdEncoding.EncodeToString(key)
+	if err := keyring.Set(keyringService, cacheKeyringUser, passphrase); err != nil {
+		return "", fmt.Errorf("failed to store cache passphrase in keyring: %w", err)
+	}
+	log.Printf("Generated cache passphrase in the OS keyring (service %s)", keyringService)
+	return passphrase, nil
+}
+
+// getCacheDir returns the directory for the credentials cache: post2post in
+// the user cache directory, $XDG_CACHE_HOME or ~/.cache on Linux,
+// ~/Library/Caches on macOS and %LocalAppData% on Windows. Each entry is
+// named after a hash of the Lambda URL, role ARN and session name, so
+// profiles sharing a session name do not collide.
+func getCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user cache directory: %w", err)
+	}
+	return filepath.Join(cacheDir, "post2post"), nil
+}
+
+// cacheTarget is a profile a cache subcommand applies to
+type cacheTarget struct {
+	profile string
+	config  *Config
+}
+
+// cacheTargets returns the profiles the cache subcommand of config applies
+// to: the selected one, or every profile of the config file with
+// AllProfiles. Only prefetch needs tailnet keys, so the others do not read
+// them.
+func cacheTargets(config *Config) ([]cacheTarget, error) {
+	if !config.AllProfiles {
+		name := config.profileName
+		if name == "" {
+			name = "-"
+		}
+		if err := validateCacheTarget(config); err != nil {
+			return nil, err
+		}
+		return []cacheTarget{{profile: name, config: config}}, nil
+	}
+
+	path := config.configPath
+	if path == "" {
+		var exists bool
+		path, exists = defaultConfigPath()
+		if !exists {
+			return nil, fmt.Errorf("--all needs a config file, but there is no %s", path)
+		}
+	}
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(file.Profiles))
+	for name := range file.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var targets []cacheTarget
+	for _, name := range names {
+		profile := file.Profiles[name]
+		if config.Command != commandPrefetch {
+			profile.TailnetKeyEnv, profile.TailnetKeyFile = "", ""
+		}
+		profileConfig := *config.flagConfig
+		if err := applyProfile(&profileConfig, &profile, config.setFlags); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		if err := applyEnvironment(&profileConfig); err != nil {
+			return nil, err
+		}
+		// Profiles without a single role, such as daemon profiles, have no
+		// cache entry of their own
+		if profileConfig.LambdaURL == "" || profileConfig.RoleARN == "" {
+			log.Printf("Skipping profile %s: no Lambda URL or role ARN", name)
+			continue
+		}
+		if err := validateCacheTarget(&profileConfig); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		targets = append(targets, cacheTarget{profile: name, config: &profileConfig})
+	}
+	return targets, nil
+}
+
+// validateCacheTarget checks config for its cache subcommand. Prefetch
+// retrieves credentials and needs a full configuration; status and purge
+// only locate the cache entry.
+func validateCacheTarget(config *Config) error {
+	if config.Command == commandPrefetch {
+		return validateConfig(config)
+	}
+	if config.LambdaURL == "" || config.RoleARN == "" {
+		return fmt.Errorf("lambda URL and role ARN are required to locate cached credentials")
+	}
+	return nil
+}
+
+// runCacheCommand runs a cache subcommand for each target, writing its
+// report to w. It carries on past failing profiles and returns the first
+// error.
+func runCacheCommand(w io.Writer, command string, targets []cacheTarget) error {
+	if command == commandStatus {
+		return printCacheStatus(w, targets)
+	}
+
+	var firstErr error
+	for _, target := range targets {
+		var err error
+		if command == commandPrefetch {
+			err = prefetchCredentials(w, target)
+		} else {
+			err = purgeCredentials(w, target)
+		}
+		if err != nil {
+			log.Printf("Profile %s: %v", target.profile, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("profile %s: %w", target.profile, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// prefetchCredentials refreshes the cached credentials of target if they
+// expire within its RefreshBefore window
+func prefetchCredentials(w io.Writer, target cacheTarget) error {
+	config := *target.config
+	if config.NoCache {
+		return fmt.Errorf("prefetch needs the credentials cache, but it is disabled")
+	}
+	if config.GeneratedAuthKey {
+		authKey, err := generateTailscaleAuthKey(&config)
+		if err != nil {
+			return fmt.Errorf("failed to generate Tailscale auth key: %w", err)
+		}
+		config.TailnetKey = authKey
+	}
+	credentials, err := retrieveCredentials(&config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: valid until %s\n", target.profile, credentials.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// purgeCredentials deletes the cached credentials of target
+func purgeCredentials(w io.Writer, target cacheTarget) error {
+	store, _, err := newCacheStore(target.config)
+	if err != nil {
+		return err
+	}
+	key := post2post.CredentialsCacheKey(target.config.LambdaURL, target.config.RoleARN, target.config.SessionName)
+	if err := store.Delete(key); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: purged\n", target.profile)
+	return nil
+}
+
+// printCacheStatus writes a table of the cached credentials of each target
+// and when they expire
+func printCacheStatus(w io.Writer, targets []cacheTarget) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tROLE\tEXPIRES\tREMAINING")
+	for _, target := range targets {
+		expires, remaining := "-", "not cached"
+		entry, err := loadCacheEntry(target.config)
+		switch {
+		case errors.Is(err, post2post.ErrCacheMiss):
+		case err != nil:
+			remaining = fmt.Sprintf("error: %v", err)
+		default:
+			expires = entry.Expires.Format(time.RFC3339)
+			if left := time.Until(entry.Expires); left > 0 {
+				remaining = left.Round(time.Second).String()
+			} else {
+				remaining = "expired"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", target.profile, target.config.RoleARN, expires, remaining)
+	}
+	return tw.Flush()
+}
+
+// loadCacheEntry reads the cached credentials of config
+func loadCacheEntry(config *Config) (*post2post.DiskCacheEntry, error) {
+	store, _, err := newCacheStore(config)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Load(post2post.CredentialsCacheKey(config.LambdaURL, config.RoleARN, config.SessionName))
+	if err != nil {
+		return nil, err
+	}
+	var entry post2post.DiskCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cache entry: %w", err)
+	}
+	return &entry, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	post2post "github.com/pgdad/post2post"
+	"github.com/zalando/go-keyring"
+)
+
+func TestCacheCipher(t *testing.T) {
+	keyring.MockInit()
+	dir := t.TempDir()
+	oldKeyFile := filepath.Join(dir, "old.key")
+	newKeyFile := filepath.Join(dir, "new.key")
+	if err := os.WriteFile(oldKeyFile, []byte("old passphrase\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newKeyFile, []byte("new passphrase\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte(`{"secret_access_key":"secretkey123456789"}`)
+
+	oldCipher, err := cacheCipher(&Config{CacheEncryption: "key-file", CacheKeyFile: oldKeyFile})
+	if err != nil {
+		t.Fatalf("cacheCipher() failed: %v", err)
+	}
+	sealed, err := oldCipher.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt() failed: %v", err)
+	}
+
+	// The previous key file still decrypts entries while rotating
+	rotating, err := cacheCipher(&Config{CacheEncryption: "key-file", CacheKeyFile: newKeyFile, CachePreviousKeyFiles: []string{oldKeyFile}})
+	if err != nil {
+		t.Fatalf("cacheCipher() with a previous key failed: %v", err)
+	}
+	if opened, err := rotating.Decrypt(sealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Decrypt() = %q, %v; want the plaintext", opened, err)
+	}
+
+	// The keyring passphrase is generated once and then reused
+	first, err := cacheCipher(&Config{CacheEncryption: "keyring"})
+	if err != nil {
+		t.Fatalf("cacheCipher() with the keyring failed: %v", err)
+	}
+	second, err := cacheCipher(&Config{CacheEncryption: "keyring"})
+	if err != nil {
+		t.Fatalf("cacheCipher() with the keyring failed: %v", err)
+	}
+	sealed, _ = first.Encrypt(plaintext)
+	if opened, err := second.Decrypt(sealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("expected the keyring passphrase to be reused, got %q, %v", opened, err)
+	}
+}
+
+func TestGetCacheDir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG_CACHE_HOME is only used on Linux")
+	}
+	xdgCache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdgCache)
+
+	dir, err := getCacheDir()
+	if err != nil {
+		t.Fatalf("getCacheDir() failed: %v", err)
+	}
+	if want := filepath.Join(xdgCache, "post2post"); dir != want {
+		t.Errorf("getCacheDir() = %s, want %s", dir, want)
+	}
+}
+
+func TestCacheCommands(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG_CACHE_HOME is only used on Linux")
+	}
+	xdgCache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdgCache)
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(configPath, []byte(`
+[profiles.dev]
+lambda_url = "https://dev.lambda-url.us-east-1.on.aws/"
+role_arn = "arn:aws:iam::123456789012:role/remote/Dev"
+tailnet_key_env = "UNSET_TAILNET_KEY"
+
+[profiles.prod]
+lambda_url = "https://prod.lambda-url.us-east-1.on.aws/"
+role_arn = "arn:aws:iam::123456789012:role/remote/Prod"
+
+[profiles.daemon]
+lambda_url = "https://prod.lambda-url.us-east-1.on.aws/"
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig := func(command string, all bool) *Config {
+		flagConfig := Config{
+			SessionName: "post2post-credentials-process",
+			Duration:    time.Hour,
+			CacheStore:  cacheStoreFile,
+			Command:     command,
+			AllProfiles: all,
+		}
+		config := flagConfig
+		config.configPath = configPath
+		config.flagConfig = &flagConfig
+		config.setFlags = map[string]bool{}
+		return &config
+	}
+
+	// Cache credentials for dev only
+	devRole := "arn:aws:iam::123456789012:role/remote/Dev"
+	devURL := "https://dev.lambda-url.us-east-1.on.aws/"
+	entry, err := json.Marshal(post2post.DiskCacheEntry{
+		Version:     1,
+		AccessKeyID: "AKIATEST",
+		Expires:     time.Now().Add(time.Hour),
+		RoleARN:     devRole,
+		LambdaURL:   devURL,
+		SessionName: "post2post-credentials-process",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := post2post.NewFileCacheStore(filepath.Join(xdgCache, "post2post"))
+	devKey := post2post.CredentialsCacheKey(devURL, devRole, "post2post-credentials-process")
+	if err := store.Save(devKey, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Status of every profile skips the one without a role and does not
+	// need tailnet keys
+	targets, err := cacheTargets(newConfig(commandStatus, true))
+	if err != nil {
+		t.Fatalf("cacheTargets() failed: %v", err)
+	}
+	if len(targets) != 2 || targets[0].profile != "dev" || targets[1].profile != "prod" {
+		t.Fatalf("cacheTargets() = %+v, want dev and prod", targets)
+	}
+	var out bytes.Buffer
+	if err := runCacheCommand(&out, commandStatus, targets); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("status printed %q, want a header and two profiles", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "dev ") || strings.Contains(lines[1], "not cached") {
+		t.Errorf("dev status = %q, want cached credentials", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "prod ") || !strings.Contains(lines[2], "not cached") {
+		t.Errorf("prod status = %q, want not cached", lines[2])
+	}
+
+	// Prefetch of every profile reads the tailnet keys
+	if _, err := cacheTargets(newConfig(commandPrefetch, true)); err == nil {
+		t.Error("cacheTargets() for prefetch succeeded without the tailnet key of dev")
+	}
+
+	// Purge the selected profile
+	dev := newConfig(commandPurge, false)
+	dev.profileName = "dev"
+	dev.LambdaURL, dev.RoleARN = devURL, devRole
+	targets, err = cacheTargets(dev)
+	if err != nil {
+		t.Fatalf("cacheTargets() failed: %v", err)
+	}
+	out.Reset()
+	if err := runCacheCommand(&out, commandPurge, targets); err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if out.String() != "dev: purged\n" {
+		t.Errorf("purge printed %q", out.String())
+	}
+	if _, err := loadCacheEntry(dev); !errors.Is(err, post2post.ErrCacheMiss) {
+		t.Errorf("loadCacheEntry() after purge = %v, want ErrCacheMiss", err)
+	}
+
+	if _, err := cacheTargets(newConfig(commandStatus, false)); err == nil {
+		t.Error("cacheTargets() succeeded without a Lambda URL and role ARN")
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	post2post "github.com/pgdad/post2post"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the configuration for the credentials process
+type Config struct {
+	LambdaURL   string
+	RoleARN     string
+	TailnetKey  string
+	SessionName string
+	Duration    time.Duration
+	Timeout     time.Duration
+	ExternalID  string
+	GeneratedAuthKey bool // True if auth key was generated via OAuth
+
+	// Tags and lifetime of auth keys minted via OAuth
+	OAuthTags      string
+	OAuthKeyExpiry time.Duration
+
+	// Role restrictions; the role must be under /remote/ unless
+	// RolePathPrefix says otherwise
+	RolePathPrefix string
+	RolePattern    string
+	RoleAllowlist  []string
+
+	// CacheStore is where credentials are cached: auto, keyring or file
+	CacheStore string
+	// NoCache disables the credentials cache; ForceRefresh skips reading it
+	// for this invocation but still stores the new credentials
+	NoCache      bool
+	ForceRefresh bool
+
+	// Serve runs the daemon on Socket instead of printing credentials;
+	// otherwise a daemon on Socket is used when one is running
+	Serve  bool
+	Socket string
+
+	// Encryption of the file cache: none, keyring or key-file. Previous
+	// key files are still accepted for decryption while rotating the key.
+	CacheEncryption       string
+	CacheKeyFile          string
+	CachePreviousKeyFiles []string
+
+	// RefreshBefore is how long before expiry cached credentials are
+	// refreshed
+	RefreshBefore time.Duration
+
+	// Command is the cache subcommand (prefetch, status or purge), empty to
+	// print credentials. AllProfiles applies it to every profile of the
+	// config file.
+	Command     string
+	AllProfiles bool
+
+	// Set by parseFlags to resolve the other profiles for AllProfiles
+	configPath  string
+	profileName string
+	flagConfig  *Config
+	setFlags    map[string]bool
+}
+
+// ConfigFile is the config file, ~/.config/post2post/config.toml (or
+// config.yaml), with named profiles of options
+type ConfigFile struct {
+	// DefaultProfile is used when no profile is selected
+	DefaultProfile string             `toml:"default_profile" yaml:"default_profile"`
+	Profiles       map[string]Profile `toml:"profiles" yaml:"profiles"`
+}
+
+// Profile holds the options of one profile. The tailnet key is referenced
+// by environment variable or file rather than kept in the config file.
+type Profile struct {
+	LambdaURL      string   `toml:"lambda_url" yaml:"lambda_url"`
+	RoleARN        string   `toml:"role_arn" yaml:"role_arn"`
+	SessionName    string   `toml:"session_name" yaml:"session_name"`
+	Duration       string   `toml:"duration" yaml:"duration"`
+	Timeout        string   `toml:"timeout" yaml:"timeout"`
+	ExternalID     string   `toml:"external_id" yaml:"external_id"`
+	TailnetKeyEnv  string   `toml:"tailnet_key_env" yaml:"tailnet_key_env"`
+	TailnetKeyFile string   `toml:"tailnet_key_file" yaml:"tailnet_key_file"`
+	RolePathPrefix string   `toml:"role_path_prefix" yaml:"role_path_prefix"`
+	RolePattern    string   `toml:"role_pattern" yaml:"role_pattern"`
+	RoleAllowlist  []string `toml:"role_allowlist" yaml:"role_allowlist"`
+	CacheStore     string   `toml:"cache_store" yaml:"cache_store"`
+	Socket         string   `toml:"socket" yaml:"socket"`
+	OAuthTags      string   `toml:"oauth_tags" yaml:"oauth_tags"`
+	OAuthKeyExpiry string   `toml:"oauth_key_expiry" yaml:"oauth_key_expiry"`
+	RefreshBefore  string   `toml:"refresh_before" yaml:"refresh_before"`
+
+	CacheEncryption       string   `toml:"cache_encryption" yaml:"cache_encryption"`
+	CacheKeyFile          string   `toml:"cache_key_file" yaml:"cache_key_file"`
+	CachePreviousKeyFiles []string `toml:"cache_previous_key_files" yaml:"cache_previous_key_files"`
+}
+
+// parseFlags parses command line arguments and environment variables
+// parseFlags parses args, an optional cache subcommand followed by options
+func parseFlags(args []string) (*Config, error) {
+	config := &Config{}
+
+	// Command line flags
+	flag.StringVar(&config.LambdaURL, "lambda-url", "", "AWS Lambda Function URL endpoint")
+	flag.StringVar(&config.RoleARN, "role-arn", "", "IAM Role ARN to assume (must be under --role-path-prefix)")
+	flag.StringVar(&config.TailnetKey, "tailnet-key", "", "Tailscale auth key for secure communication")
+	flag.StringVar(&config.SessionName, "session-name", "post2post-credentials-process", "Session name for the assumed role")
+	flag.DurationVar(&config.Duration, "duration", 1*time.Hour, "Credential duration (e.g., 1h, 30m)")
+	flag.DurationVar(&config.Timeout, "timeout", 30*time.Second, "Request timeout (e.g., 30s, 1m)")
+	flag.StringVar(&config.ExternalID, "external-id", "", "External ID required by the role's trust policy")
+	flag.StringVar(&config.OAuthTags, "oauth-tags", "tag:ephemeral-device", "Comma-separated tags of auth keys minted via OAuth")
+	flag.DurationVar(&config.OAuthKeyExpiry, "oauth-key-expiry", time.Hour, "Lifetime of auth keys minted via OAuth")
+	flag.StringVar(&config.RolePathPrefix, "role-path-prefix", post2post.RemoteRolePathPolicy.PathPrefix, "IAM path the role must be under (use / to allow any path)")
+	flag.StringVar(&config.RolePattern, "role-pattern", "", "Regular expression the role ARN must match")
+	flag.StringVar(&config.CacheStore, "cache-store", cacheStoreAuto, "Credentials cache: auto (keyring, else file), keyring or file")
+	flag.BoolVar(&config.NoCache, "no-cache", false, "Neither read nor write the credentials cache")
+	flag.BoolVar(&config.ForceRefresh, "force-refresh", false, "Fetch new credentials even if cached ones are still valid")
+	quiet := flag.Bool("quiet", false, "Log nothing but the final error line on failure")
+	verboseLogs := flag.Bool("verbose", false, "Log configuration details and timestamps with microseconds")
+	logFormat := flag.String("log-format", logFormatText, "Log format: text or json")
+	flag.BoolVar(&config.Serve, "serve", false, "Run as a daemon serving credentials to other invocations over --socket")
+	flag.StringVar(&config.Socket, "socket", "", "Unix socket of the credentials daemon (default post2post/daemon.sock in the user cache directory)")
+	flag.StringVar(&config.CacheEncryption, "cache-encryption", cacheEncryptionNone, "Encrypt the file cache with a passphrase from: none, keyring or key-file")
+	flag.StringVar(&config.CacheKeyFile, "cache-key-file", "", "File holding the cache passphrase for --cache-encryption key-file")
+	previousKeyFiles := flag.String("cache-previous-key-files", "", "Comma-separated files holding previous cache passphrases, accepted while rotating the key")
+	roleAllowlist := flag.String("role-allowlist", "", "Comma-separated role ARNs that may be assumed")
+	configPath := flag.String("config", "", "Config file with named profiles (default ~/.config/post2post/config.toml or config.yaml)")
+	profileName := flag.String("profile", "", "Profile of the config file to use (default: its default_profile)")
+	flag.DurationVar(&config.RefreshBefore, "refresh-before", 10*time.Minute, "Refresh cached credentials this long before they expire")
+	flag.BoolVar(&config.AllProfiles, "all", false, "Apply prefetch, status or purge to every profile of the config file")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [prefetch|status|purge] [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "AWS credentials_process implementation using post2post for secure credential retrieval.\n\n")
+		fmt.Fprintf(os.Stderr, "Commands (default: print credentials for credential_process):\n")
+		fmt.Fprintf(os.Stderr, "  prefetch  Refresh cached credentials expiring within --refresh-before, e.g. from cron\n")
+		fmt.Fprintf(os.Stderr, "  status    Print the cached credentials and when they expire\n")
+		fmt.Fprintf(os.Stderr, "  purge     Delete the cached credentials\n")
+		fmt.Fprintf(os.Stderr, "  (Commands apply to the selected profile, or to every profile with --all)\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment variables (take precedence over flags):\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_LAMBDA_URL     Lambda Function URL endpoint\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_ROLE_ARN       IAM Role ARN to assume\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_TAILNET_KEY    Tailscale auth key\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_SESSION_NAME   Session name for assumed role\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_DURATION       Credential duration (e.g., 1h, 30m)\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_TIMEOUT        Request timeout (e.g., 30s, 1m)\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_EXTERNAL_ID    External ID for the role's trust policy\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_ROLE_PATH_PREFIX  IAM path the role must be under\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_ROLE_PATTERN      Regular expression the role ARN must match\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_ROLE_ALLOWLIST    Comma-separated role ARNs that may be assumed\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_CACHE_STORE    Credentials cache: auto, keyring or file\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_NO_CACHE       Set to true to disable the credentials cache\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_FORCE_REFRESH  Set to true to bypass cached credentials\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_QUIET          Set to true to log nothing but the final error line\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_VERBOSE        Set to true to log configuration details\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_LOG_FORMAT     Log format: text or json\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_SOCKET         Unix socket of the credentials daemon\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_CACHE_ENCRYPTION  File cache encryption: none, keyring or key-file\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_CACHE_KEY_FILE    File holding the cache passphrase\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_CACHE_PREVIOUS_KEY_FILES  Comma-separated files holding previous cache passphrases\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_REFRESH_BEFORE    Refresh cached credentials this long before they expire\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_CONFIG         Config file with named profiles\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_PROFILE        Profile of the config file to use\n")
+		fmt.Fprintf(os.Stderr, "\nTailscale OAuth (auto-generates ephemeral auth keys):\n")
+		fmt.Fprintf(os.Stderr, "  TS_API_CLIENT_ID         Tailscale OAuth client ID\n")
+		fmt.Fprintf(os.Stderr, "  TS_API_CLIENT_SECRET     Tailscale OAuth client secret\n")
+		fmt.Fprintf(os.Stderr, "  (When both are set and no tailnet key is given, a short-lived key is minted and cached)\n")
+		fmt.Fprintf(os.Stderr, "  POST2POST_OAUTH_TAGS     Comma-separated tags of minted auth keys\n")
+		fmt.Fprintf(os.Stderr, "\nExample usage in AWS config:\n")
+		fmt.Fprintf(os.Stderr, "  [profile myprofile]\n")
+		fmt.Fprintf(os.Stderr, "  credential_process = /usr/local/bin/post2post-credentials --profile dev\n")
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		config.Command, args = args[0], args[1:]
+	}
+	switch config.Command {
+	case "", commandPrefetch, commandStatus, commandPurge:
+	default:
+		return nil, fmt.Errorf("unknown command %q (use prefetch, status or purge)", config.Command)
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	if envLogFormat := os.Getenv("POST2POST_LOG_FORMAT"); envLogFormat != "" {
+		*logFormat = envLogFormat
+	}
+	for name, target := range map[string]*bool{"POST2POST_QUIET": quiet, "POST2POST_VERBOSE": verboseLogs} {
+		if value := os.Getenv(name); value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid boolean in %s: %v", name, err)
+			}
+			*target = enabled
+		}
+	}
+	if err := configureLogging(*quiet, *verboseLogs, *logFormat); err != nil {
+		return nil, err
+	}
+	config.RoleAllowlist = splitList(*roleAllowlist)
+	config.CachePreviousKeyFiles = splitList(*previousKeyFiles)
+	config.setFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { config.setFlags[f.Name] = true })
+	flagConfig := *config
+	config.flagConfig = &flagConfig
+
+	// Profile options apply where no flag was given
+	if envConfig := os.Getenv("POST2POST_CONFIG"); envConfig != "" {
+		*configPath = envConfig
+	}
+	if envProfile := os.Getenv("POST2POST_PROFILE"); envProfile != "" {
+		*profileName = envProfile
+	}
+	config.configPath = *configPath
+	config.profileName = *profileName
+	profile, err := loadProfile(*configPath, *profileName)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		if err := applyProfile(config, profile, config.setFlags); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", *profileName, err)
+		}
+	}
+
+	if err := applyEnvironment(config); err != nil {
+		return nil, err
+	}
+	if config.Socket == "" {
+		if cacheDir, err := getCacheDir(); err == nil {
+			config.Socket = filepath.Join(cacheDir, "daemon.sock")
+		}
+	}
+	return config, nil
+}
+
+// applyEnvironment overrides config with the environment variables that are
+// set
+func applyEnvironment(config *Config) error {
+	if envLambdaURL := os.Getenv("POST2POST_LAMBDA_URL"); envLambdaURL != "" {
+		config.LambdaURL = envLambdaURL
+	}
+	if envRoleARN := os.Getenv("POST2POST_ROLE_ARN"); envRoleARN != "" {
+		config.RoleARN = envRoleARN
+	}
+	if envTailnetKey := os.Getenv("POST2POST_TAILNET_KEY"); envTailnetKey != "" {
+		config.TailnetKey = envTailnetKey
+	}
+	if envSessionName := os.Getenv("POST2POST_SESSION_NAME"); envSessionName != "" {
+		config.SessionName = envSessionName
+	}
+	if envDuration := os.Getenv("POST2POST_DURATION"); envDuration != "" {
+		if duration, err := time.ParseDuration(envDuration); err == nil {
+			config.Duration = duration
+		} else {
+			return fmt.Errorf("invalid duration format in POST2POST_DURATION: %v", err)
+		}
+	}
+	if envExternalID := os.Getenv("POST2POST_EXTERNAL_ID"); envExternalID != "" {
+		config.ExternalID = envExternalID
+	}
+	if envPathPrefix := os.Getenv("POST2POST_ROLE_PATH_PREFIX"); envPathPrefix != "" {
+		config.RolePathPrefix = envPathPrefix
+	}
+	if envPattern := os.Getenv("POST2POST_ROLE_PATTERN"); envPattern != "" {
+		config.RolePattern = envPattern
+	}
+	if envAllowlist := os.Getenv("POST2POST_ROLE_ALLOWLIST"); envAllowlist != "" {
+		config.RoleAllowlist = splitList(envAllowlist)
+	}
+	if envCacheStore := os.Getenv("POST2POST_CACHE_STORE"); envCacheStore != "" {
+		config.CacheStore = envCacheStore
+	}
+	if envNoCache := os.Getenv("POST2POST_NO_CACHE"); envNoCache != "" {
+		noCache, err := strconv.ParseBool(envNoCache)
+		if err != nil {
+			return fmt.Errorf("invalid boolean in POST2POST_NO_CACHE: %v", err)
+		}
+		config.NoCache = noCache
+	}
+	if envForceRefresh := os.Getenv("POST2POST_FORCE_REFRESH"); envForceRefresh != "" {
+		forceRefresh, err := strconv.ParseBool(envForceRefresh)
+		if err != nil {
+			return fmt.Errorf("invalid boolean in POST2POST_FORCE_REFRESH: %v", err)
+		}
+		config.ForceRefresh = forceRefresh
+	}
+	if envTags := os.Getenv("POST2POST_OAUTH_TAGS"); envTags != "" {
+		config.OAuthTags = envTags
+	}
+	if envSocket := os.Getenv("POST2POST_SOCKET"); envSocket != "" {
+		config.Socket = envSocket
+	}
+	if envEncryption := os.Getenv("POST2POST_CACHE_ENCRYPTION"); envEncryption != "" {
+		config.CacheEncryption = envEncryption
+	}
+	if envKeyFile := os.Getenv("POST2POST_CACHE_KEY_FILE"); envKeyFile != "" {
+		config.CacheKeyFile = envKeyFile
+	}
+	if envPreviousKeyFiles := os.Getenv("POST2POST_CACHE_PREVIOUS_KEY_FILES"); envPreviousKeyFiles != "" {
+		config.CachePreviousKeyFiles = splitList(envPreviousKeyFiles)
+	}
+	if envRefreshBefore := os.Getenv("POST2POST_REFRESH_BEFORE"); envRefreshBefore != "" {
+		refreshBefore, err := time.ParseDuration(envRefreshBefore)
+		if err != nil {
+			return fmt.Errorf("invalid duration format in POST2POST_REFRESH_BEFORE: %v", err)
+		}
+		config.RefreshBefore = refreshBefore
+	}
+	if envTimeout := os.Getenv("POST2POST_TIMEOUT"); envTimeout != "" {
+		if timeout, err := time.ParseDuration(envTimeout); err == nil {
+			config.Timeout = timeout
+		} else {
+			return fmt.Errorf("invalid timeout format in POST2POST_TIMEOUT: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// defaultConfigPath returns the config file in $XDG_CONFIG_HOME/post2post or
+// ~/.config/post2post, config.toml or config.yaml, and whether it exists
+func defaultConfigPath() (string, bool) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		dir = filepath.Join(homeDir, ".config")
+	}
+	for _, name := range []string{"config.toml", "config.yaml", "config.yml"} {
+		path := filepath.Join(dir, "post2post", name)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return filepath.Join(dir, "post2post", "config.toml"), false
+}
+
+// loadProfile returns the profile name of the config file at path, or of
+// the default config file when path is "". Without a name, the file's
+// default_profile is used; without either, or a default config file, it
+// returns nil.
+func loadProfile(path, name string) (*Profile, error) {
+	if path == "" {
+		var exists bool
+		path, exists = defaultConfigPath()
+		if !exists {
+			if name != "" {
+				return nil, fmt.Errorf("profile %s selected but there is no config file %s", name, path)
+			}
+			return nil, nil
+		}
+	}
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = file.DefaultProfile
+		if name == "" {
+			return nil, nil
+		}
+	}
+	profile, ok := file.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not found in %s", name, path)
+	}
+	log.Printf("Using profile %s from %s", name, path)
+	return &profile, nil
+}
+
+// readConfigFile parses a TOML config file, or a YAML one with a .yaml or
+// .yml extension. Unknown keys are errors, so typos are not ignored.
+func readConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var file ConfigFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	default:
+		metadata, err := toml.Decode(string(data), &file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown key %s in config file %s", undecoded[0], path)
+		}
+	}
+	return &file, nil
+}
+
+// applyProfile sets the options of the profile on config, except those
+// whose flag was given
+func applyProfile(config *Config, profile *Profile, setFlags map[string]bool) error {
+	setString := func(flagName string, target *string, value string) {
+		if value != "" && !setFlags[flagName] {
+			*target = value
+		}
+	}
+	setString("lambda-url", &config.LambdaURL, profile.LambdaURL)
+	setString("role-arn", &config.RoleARN, profile.RoleARN)
+	setString("session-name", &config.SessionName, profile.SessionName)
+	setString("external-id", &config.ExternalID, profile.ExternalID)
+	setString("role-path-prefix", &config.RolePathPrefix, profile.RolePathPrefix)
+	setString("role-pattern", &config.RolePattern, profile.RolePattern)
+	setString("cache-store", &config.CacheStore, profile.CacheStore)
+	setString("socket", &config.Socket, profile.Socket)
+	setString("oauth-tags", &config.OAuthTags, profile.OAuthTags)
+	setString("cache-encryption", &config.CacheEncryption, profile.CacheEncryption)
+	setString("cache-key-file", &config.CacheKeyFile, profile.CacheKeyFile)
+	if len(profile.CachePreviousKeyFiles) > 0 && !setFlags["cache-previous-key-files"] {
+		config.CachePreviousKeyFiles = profile.CachePreviousKeyFiles
+	}
+	if len(profile.RoleAllowlist) > 0 && !setFlags["role-allowlist"] {
+		config.RoleAllowlist = profile.RoleAllowlist
+	}
+
+	for _, d := range []struct {
+		flagName string
+		target   *time.Duration
+		value    string
+	}{
+		{"duration", &config.Duration, profile.Duration},
+		{"timeout", &config.Timeout, profile.Timeout},
+		{"oauth-key-expiry", &config.OAuthKeyExpiry, profile.OAuthKeyExpiry},
+		{"refresh-before", &config.RefreshBefore, profile.RefreshBefore},
+	} {
+		if d.value == "" || setFlags[d.flagName] {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", d.flagName, err)
+		}
+		*d.target = duration
+	}
+
+	if setFlags["tailnet-key"] {
+		return nil
+	}
+	if profile.TailnetKeyEnv != "" && profile.TailnetKeyFile != "" {
+		return fmt.Errorf("only one of tailnet_key_env and tailnet_key_file may be set")
+	}
+	if profile.TailnetKeyEnv != "" {
+		config.TailnetKey = os.Getenv(profile.TailnetKeyEnv)
+		if config.TailnetKey == "" {
+			return fmt.Errorf("tailnet key environment variable %s is not set", profile.TailnetKeyEnv)
+		}
+	}
+	if profile.TailnetKeyFile != "" {
+		key, err := readSecretFile(profile.TailnetKeyFile, "tailnet key")
+		if err != nil {
+			return err
+		}
+		config.TailnetKey = key
+	}
+	return nil
+}
+
+// readSecretFile reads a secret, such as a tailnet key, from path, which may
+// start with ~/
+func readSecretFile(path, what string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get user home directory: %w", err)
+		}
+		path = filepath.Join(homeDir, rest)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: %s file %s is readable by other users", what, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s file: %w", what, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s file %s is empty", what, path)
+	}
+	return secret, nil
+}
+
+// validateConfig validates the configuration parameters
+func validateConfig(config *Config) error {
+	if config.LambdaURL == "" {
+		return fmt.Errorf("lambda URL is required (use --lambda-url or POST2POST_LAMBDA_URL)")
+	}
+	if config.RoleARN == "" && !config.Serve {
+		return fmt.Errorf("role ARN is required (use --role-arn or POST2POST_ROLE_ARN)")
+	}
+	if config.Serve && config.Socket == "" {
+		return fmt.Errorf("socket is required for --serve (use --socket or POST2POST_SOCKET)")
+	}
+
+	// Without a tailnet key, check if OAuth credentials are available for
+	// auto-generation
+	clientID := os.Getenv("TS_API_CLIENT_ID")
+	clientSecret := os.Getenv("TS_API_CLIENT_SECRET")
+
+	if config.TailnetKey == "" {
+		if clientID == "" || clientSecret == "" {
+			return fmt.Errorf("tailnet key is required (use --tailnet-key or POST2POST_TAILNET_KEY) or set TS_API_CLIENT_ID and TS_API_CLIENT_SECRET for auto-generation")
+		}
+		if len(splitList(config.OAuthTags)) == 0 {
+			return fmt.Errorf("at least one tag is required for auth keys minted via OAuth (use --oauth-tags)")
+		}
+		if config.OAuthKeyExpiry < tailnetKeyMinLifetime*2 {
+			return fmt.Errorf("OAuth key expiry must be at least %s", tailnetKeyMinLifetime*2)
+		}
+		// OAuth credentials available - we'll generate an auth key
+		log.Printf("Tailscale OAuth credentials detected, will generate ephemeral auth key")
+		config.GeneratedAuthKey = true
+	}
+
+	// Validate the role against the role path policy (/remote/ by default).
+	// The daemon checks each requested role instead.
+	if config.RoleARN != "" {
+		if err := rolePathPolicy(config).Check(config.RoleARN); err != nil {
+			return fmt.Errorf("role ARN not allowed (e.g., arn:aws:iam::123456789012:role/remote/MyRole): %w", err)
+		}
+	}
+
+	switch config.CacheStore {
+	case "", cacheStoreAuto, cacheStoreKeyring, cacheStoreFile:
+	default:
+		return fmt.Errorf("invalid cache store %q (use auto, keyring or file)", config.CacheStore)
+	}
+	switch config.CacheEncryption {
+	case "", cacheEncryptionNone:
+	case cacheEncryptionKeyring, cacheEncryptionKeyFile:
+		if config.CacheStore == cacheStoreKeyring {
+			return fmt.Errorf("--cache-encryption applies to the file cache, not --cache-store keyring")
+		}
+		if config.CacheEncryption == cacheEncryptionKeyFile && config.CacheKeyFile == "" {
+			return fmt.Errorf("--cache-encryption key-file requires --cache-key-file or POST2POST_CACHE_KEY_FILE")
+		}
+	default:
+		return fmt.Errorf("invalid cache encryption %q (use none, keyring or key-file)", config.CacheEncryption)
+	}
+
+	// Validate duration limits (AWS STS limits)
+	if config.Duration < 15*time.Minute {
+		return fmt.Errorf("credential duration must be at least 15 minutes")
+	}
+	if config.Duration > 12*time.Hour {
+		return fmt.Errorf("credential duration cannot exceed 12 hours")
+	}
+	if config.RefreshBefore < 0 || config.RefreshBefore >= config.Duration {
+		return fmt.Errorf("refresh-before must be between 0 and the credential duration")
+	}
+
+	return nil
+}
+
+// rolePathPolicy returns the role restrictions configured by flags and
+// environment variables
+func rolePathPolicy(config *Config) post2post.RolePathPolicy {
+	policy := post2post.RolePathPolicy{
+		PathPrefix: config.RolePathPrefix,
+		Pattern:    config.RolePattern,
+		Allowlist:  config.RoleAllowlist,
+	}
+	if policy.PathPrefix == "" {
+		policy.PathPrefix = post2post.RemoteRolePathPolicy.PathPrefix
+	}
+	return policy
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// providerConfig returns the credentials provider configuration for config
+func providerConfig(config *Config) post2post.AWSCredentialsProviderConfig {
+	return post2post.AWSCredentialsProviderConfig{
+		LambdaURL:    config.LambdaURL,
+		RoleARN:      config.RoleARN,
+		TailnetKey:   config.TailnetKey,
+		SessionName:  config.SessionName,
+		Duration:     config.Duration,
+		ExternalID:   config.ExternalID,
+		ExpiryBuffer: config.RefreshBefore,
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *Config
+		wantError bool
+	}{
+		{
+			name: "valid config",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+			},
+			wantError: false,
+		},
+		{
+			name: "missing lambda URL",
+			config: &Config{
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+			},
+			wantError: true,
+		},
+		{
+			name: "missing role ARN",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+			},
+			wantError: true,
+		},
+		{
+			name: "missing tailnet key",
+			config: &Config{
+				LambdaURL: "https://lambda.amazonaws.com",
+				RoleARN:   "arn:aws:iam::123456789012:role/remote/TestRole",
+				Duration:  1 * time.Hour,
+			},
+			wantError: true,
+		},
+		{
+			name: "invalid role ARN - not remote",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+			},
+			wantError: true,
+		},
+		{
+			name: "duration too short",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   10 * time.Minute, // Less than 15 minutes
+			},
+			wantError: true,
+		},
+		{
+			name: "duration too long",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   13 * time.Hour, // More than 12 hours
+			},
+			wantError: true,
+		},
+		{
+			name: "keyring cache store",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+				CacheStore: "keyring",
+			},
+			wantError: false,
+		},
+		{
+			name: "key file encryption without a key file",
+			config: &Config{
+				LambdaURL:       "https://lambda.amazonaws.com",
+				RoleARN:         "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey:      "tskey-auth-test",
+				Duration:        1 * time.Hour,
+				CacheEncryption: "key-file",
+			},
+			wantError: true,
+		},
+		{
+			name: "encryption with the keyring store",
+			config: &Config{
+				LambdaURL:       "https://lambda.amazonaws.com",
+				RoleARN:         "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey:      "tskey-auth-test",
+				Duration:        1 * time.Hour,
+				CacheStore:      "keyring",
+				CacheEncryption: "keyring",
+			},
+			wantError: true,
+		},
+		{
+			name: "unknown cache store",
+			config: &Config{
+				LambdaURL:  "https://lambda.amazonaws.com",
+				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
+				TailnetKey: "tskey-auth-test",
+				Duration:   1 * time.Hour,
+				CacheStore: "memory",
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(tt.config)
+			if (err != nil) != tt.wantError {
+				t.Errorf("validateConfig() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRolePathPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		roleARN string
+		want    bool
+	}{
+		{
+			name:    "valid remote role ARN",
+			roleARN: "arn:aws:iam::123456789012:role/remote/TestRole",
+			want:    true,
+		},
+		{
+			name:    "valid remote role ARN with longer name",
+			roleARN: "arn:aws:iam::123456789012:role/remote/MyVeryLongRoleName",
+			want:    true,
+		},
+		{
+			name:    "invalid - not remote path",
+			roleARN: "arn:aws:iam::123456789012:role/TestRole",
+			want:    false,
+		},
+		{
+			name:    "invalid - wrong prefix",
+			roleARN: "arn:aws:ec2::123456789012:role/remote/TestRole",
+			want:    false,
+		},
+		{
+			name:    "invalid - too short",
+			roleARN: "arn:aws:iam::123",
+			want:    false,
+		},
+		{
+			name:    "invalid - empty",
+			roleARN: "",
+			want:    false,
+		},
+		{
+			name:    "invalid - not an ARN",
+			roleARN: "not-an-arn",
+			want:    false,
+		},
+		{
+			name:    "custom path prefix",
+			config:  Config{RolePathPrefix: "/ci/"},
+			roleARN: "arn:aws:iam::123456789012:role/ci/Deploy",
+			want:    true,
+		},
+		{
+			name:    "custom path prefix rejects remote",
+			config:  Config{RolePathPrefix: "/ci/"},
+			roleARN: "arn:aws:iam::123456789012:role/remote/TestRole",
+			want:    false,
+		},
+		{
+			name:    "any path",
+			config:  Config{RolePathPrefix: "/"},
+			roleARN: "arn:aws:iam::123456789012:role/TestRole",
+			want:    true,
+		},
+		{
+			name:    "allowlist",
+			config:  Config{RoleAllowlist: []string{"arn:aws:iam::123456789012:role/remote/Other"}},
+			roleARN: "arn:aws:iam::123456789012:role/remote/TestRole",
+			want:    false,
+		},
+		{
+			name:    "pattern",
+			config:  Config{RolePattern: `:role/remote/Test`},
+			roleARN: "arn:aws:iam::123456789012:role/remote/TestRole",
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rolePathPolicy(&tt.config).Check(tt.roleARN)
+			if got := err == nil; got != tt.want {
+				t.Errorf("Check(%q) = %v, want allowed %v", tt.roleARN, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tomlPath := write("config.toml", `
+default_profile = "dev"
+
+[profiles.dev]
+lambda_url = "https://dev.lambda-url.us-east-1.on.aws/"
+role_arn = "arn:aws:iam::123456789012:role/remote/Dev"
+duration = "30m"
+
+[profiles.prod]
+lambda_url = "https://prod.lambda-url.us-east-1.on.aws/"
+role_arn = "arn:aws:iam::123456789012:role/remote/Prod"
+`)
+	yamlPath := write("config.yaml", `
+profiles:
+  dev:
+    lambda_url: https://dev.lambda-url.us-east-1.on.aws/
+    role_allowlist:
+      - arn:aws:iam::123456789012:role/remote/Dev
+`)
+	typoPath := write("typo.toml", `
+[profiles.dev]
+lamda_url = "https://dev.lambda-url.us-east-1.on.aws/"
+`)
+
+	tests := []struct {
+		name      string
+		path      string
+		profile   string
+		wantURL   string
+		wantNil   bool
+		wantError bool
+	}{
+		{"default profile", tomlPath, "", "https://dev.lambda-url.us-east-1.on.aws/", false, false},
+		{"named profile", tomlPath, "prod", "https://prod.lambda-url.us-east-1.on.aws/", false, false},
+		{"missing profile", tomlPath, "staging", "", false, true},
+		{"yaml", yamlPath, "dev", "https://dev.lambda-url.us-east-1.on.aws/", false, false},
+		{"yaml without default profile", yamlPath, "", "", true, false},
+		{"unknown key", typoPath, "dev", "", false, true},
+		{"missing file", filepath.Join(dir, "missing.toml"), "dev", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := loadProfile(tt.path, tt.profile)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("loadProfile() error = %v, wantError %v", err, tt.wantError)
+			}
+			if err != nil {
+				return
+			}
+			if (profile == nil) != tt.wantNil {
+				t.Fatalf("loadProfile() = %+v, want nil %v", profile, tt.wantNil)
+			}
+			if profile != nil && profile.LambdaURL != tt.wantURL {
+				t.Errorf("LambdaURL = %q, want %q", profile.LambdaURL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "tailnet.key")
+	if err := os.WriteFile(keyFile, []byte("tskey-auth-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_TAILNET_KEY", "tskey-auth-env")
+
+	profile := Profile{
+		LambdaURL:   "https://dev.lambda-url.us-east-1.on.aws/",
+		RoleARN:     "arn:aws:iam::123456789012:role/remote/Dev",
+		SessionName: "dev-session",
+		Duration:    "30m",
+	}
+	tests := []struct {
+		name      string
+		profile   Profile
+		setFlags  map[string]bool
+		want      Config
+		wantError bool
+	}{
+		{
+			name:    "profile fills options",
+			profile: profile,
+			want: Config{
+				LambdaURL:   "https://dev.lambda-url.us-east-1.on.aws/",
+				RoleARN:     "arn:aws:iam::123456789012:role/remote/Dev",
+				SessionName: "dev-session",
+				Duration:    30 * time.Minute,
+				Timeout:     30 * time.Second,
+			},
+		},
+		{
+			name:     "flags win",
+			profile:  profile,
+			setFlags: map[string]bool{"role-arn": true, "duration": true},
+			want: Config{
+				LambdaURL:   "https://dev.lambda-url.us-east-1.on.aws/",
+				RoleARN:     "arn:aws:iam::123456789012:role/remote/Flag",
+				SessionName: "dev-session",
+				Duration:    time.Hour,
+				Timeout:     30 * time.Second,
+			},
+		},
+		{
+			name:    "tailnet key from environment",
+			profile: Profile{TailnetKeyEnv: "TEST_TAILNET_KEY"},
+			want:    Config{RoleARN: "arn:aws:iam::123456789012:role/remote/Flag", TailnetKey: "tskey-auth-env", Duration: time.Hour, Timeout: 30 * time.Second},
+		},
+		{
+			name:    "tailnet key from file",
+			profile: Profile{TailnetKeyFile: keyFile},
+			want:    Config{RoleARN: "arn:aws:iam::123456789012:role/remote/Flag", TailnetKey: "tskey-auth-file", Duration: time.Hour, Timeout: 30 * time.Second},
+		},
+		{
+			name:      "unset tailnet key environment variable",
+			profile:   Profile{TailnetKeyEnv: "TEST_TAILNET_KEY_UNSET"},
+			wantError: true,
+		},
+		{
+			name:      "both tailnet key references",
+			profile:   Profile{TailnetKeyEnv: "TEST_TAILNET_KEY", TailnetKeyFile: keyFile},
+			wantError: true,
+		},
+		{
+			name:      "invalid duration",
+			profile:   Profile{Duration: "an hour"},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				RoleARN:  "arn:aws:iam::123456789012:role/remote/Flag",
+				Duration: time.Hour,
+				Timeout:  30 * time.Second,
+			}
+			err := applyProfile(config, &tt.profile, tt.setFlags)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("applyProfile() error = %v, wantError %v", err, tt.wantError)
+			}
+			if err == nil && (config.LambdaURL != tt.want.LambdaURL || config.RoleARN != tt.want.RoleARN ||
+				config.SessionName != tt.want.SessionName || config.TailnetKey != tt.want.TailnetKey ||
+				config.Duration != tt.want.Duration || config.Timeout != tt.want.Timeout) {
+				t.Errorf("applyProfile() = %+v, want %+v", *config, tt.want)
+			}
+		})
+	}
+}
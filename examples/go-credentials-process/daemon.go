@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	post2post "github.com/pgdad/post2post"
+)
+
+// errNoDaemon is returned by retrieveFromDaemon when no daemon is running
+var errNoDaemon = errors.New("no credentials daemon running")
+
+// daemonError is the JSON body of a failed daemon request
+type daemonError struct {
+	Error string `json:"error"`
+}
+
+// runDaemon keeps one post2post server and tailnet connection and serves
+// credentials for any allowed role on config.Socket until interrupted
+func runDaemon(config *Config) error {
+	multi, err := post2post.NewMultiRoleCredentialsProvider(providerConfig(config))
+	if err != nil {
+		return fmt.Errorf("failed to create credentials provider: %w", err)
+	}
+	if config.NoCache {
+		log.Printf("Credentials cache disabled")
+	} else if store, where, err := newCacheStore(config); err != nil {
+		log.Printf("Warning: credentials cache disabled: %v", err)
+	} else {
+		log.Printf("Using credentials cache: %s", where)
+		multi.WithCredentialsCache(store)
+	}
+	defer func() {
+		if closeErr := multi.Close(); closeErr != nil {
+			log.Printf("Warning: failed to close credentials provider: %v", closeErr)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Join the tailnet now rather than on the first request
+	startCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+	err = multi.Start(startCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to start post2post server: %w", err)
+	}
+
+	listener, err := listenSocket(config.Socket)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: newDaemonHandler(config, multi.Retrieve)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving credentials on %s", config.Socket)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Daemon stopped")
+	return nil
+}
+
+// listenSocket listens on the Unix socket at path, readable only by the
+// user. A socket left behind by a daemon that exited is replaced.
+func listenSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already serving on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// newDaemonHandler serves GET /credentials. A request must match the
+// daemon's Lambda URL, session name, duration and external ID, so a client
+// configured differently falls back to retrieving credentials itself.
+func newDaemonHandler(config *Config, retrieve func(context.Context, string) (aws.Credentials, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /credentials", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("lambda_url") != config.LambdaURL || query.Get("session_name") != config.SessionName ||
+			query.Get("duration") != config.Duration.String() || query.Get("external_id") != config.ExternalID {
+			writeDaemonError(w, http.StatusConflict, "request does not match the daemon's Lambda URL, session name, duration or external ID")
+			return
+		}
+		roleARN := query.Get("role_arn")
+		if err := rolePathPolicy(config).Check(roleARN); err != nil {
+			writeDaemonError(w, http.StatusForbidden, fmt.Sprintf("role ARN not allowed: %v", err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.Timeout)
+		defer cancel()
+		credentials, err := retrieve(ctx, roleARN)
+		if err != nil {
+			log.Printf("Failed to retrieve credentials for %s: %v", roleARN, err)
+			writeDaemonError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newCredentialsProcessOutput(credentials))
+	})
+	return mux
+}
+
+// writeDaemonError writes a JSON error response
+func writeDaemonError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(daemonError{Error: message})
+}
+
+// retrieveFromDaemon asks the daemon on config.Socket for credentials. It
+// returns errNoDaemon if the socket does not exist.
+func retrieveFromDaemon(config *Config) (*CredentialsProcessOutput, error) {
+	if config.Socket == "" {
+		return nil, errNoDaemon
+	}
+	if _, err := os.Stat(config.Socket); err != nil {
+		return nil, errNoDaemon
+	}
+
+	client := &http.Client{
+		Timeout: config.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", config.Socket)
+			},
+		},
+	}
+	query := url.Values{
+		"lambda_url":   {config.LambdaURL},
+		"role_arn":     {config.RoleARN},
+		"session_name": {config.SessionName},
+		"duration":     {config.Duration.String()},
+		"external_id":  {config.ExternalID},
+	}
+	resp, err := client.Get("http://post2post-daemon/credentials?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var daemonErr daemonError
+		if err := json.NewDecoder(resp.Body).Decode(&daemonErr); err != nil || daemonErr.Error == "" {
+			return nil, fmt.Errorf("daemon returned status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("daemon returned status %d: %s", resp.StatusCode, daemonErr.Error)
+	}
+	var output CredentialsProcessOutput
+	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+		return nil, fmt.Errorf("invalid daemon response: %w", err)
+	}
+	log.Printf("Using credentials from daemon %s", config.Socket)
+	return &output, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestDaemon(t *testing.T) {
+	config := &Config{
+		LambdaURL:   "https://lambda.amazonaws.com",
+		SessionName: "post2post-credentials-process",
+		Duration:    time.Hour,
+		Timeout:     5 * time.Second,
+		Socket:      filepath.Join(t.TempDir(), "daemon.sock"),
+	}
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	retrieve := func(ctx context.Context, roleARN string) (aws.Credentials, error) {
+		if roleARN == "arn:aws:iam::123456789012:role/remote/Broken" {
+			return aws.Credentials{}, errors.New("AccessDenied")
+		}
+		return aws.Credentials{AccessKeyID: "AKIATEST", SecretAccessKey: "secret", SessionToken: "token", Expires: expires}, nil
+	}
+
+	// Without a daemon the client falls back to retrieving credentials itself
+	client := *config
+	client.RoleARN = "arn:aws:iam::123456789012:role/remote/TestRole"
+	if _, err := retrieveFromDaemon(&client); !errors.Is(err, errNoDaemon) {
+		t.Fatalf("retrieveFromDaemon() without a daemon = %v, want errNoDaemon", err)
+	}
+
+	listener, err := listenSocket(config.Socket)
+	if err != nil {
+		t.Fatalf("listenSocket() failed: %v", err)
+	}
+	server := &http.Server{Handler: newDaemonHandler(config, retrieve)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	if _, err := listenSocket(config.Socket); err == nil {
+		t.Error("expected listenSocket() to fail while a daemon is serving")
+	}
+
+	output, err := retrieveFromDaemon(&client)
+	if err != nil {
+		t.Fatalf("retrieveFromDaemon() failed: %v", err)
+	}
+	if output.AccessKeyId != "AKIATEST" || output.Expiration != expires.Format(time.RFC3339) {
+		t.Errorf("retrieveFromDaemon() = %+v", output)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"different session name", func(c *Config) { c.SessionName = "other-session" }},
+		{"role outside /remote/", func(c *Config) { c.RoleARN = "arn:aws:iam::123456789012:role/Admin" }},
+		{"retrieval failure", func(c *Config) { c.RoleARN = "arn:aws:iam::123456789012:role/remote/Broken" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := client
+			tt.modify(&request)
+			if _, err := retrieveFromDaemon(&request); err == nil || errors.Is(err, errNoDaemon) {
+				t.Errorf("retrieveFromDaemon() error = %v, want a daemon error", err)
+			}
+		})
+	}
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -25,248 +26,279 @@ type CredentialsProcessOutput struct {
 	Expiration      string `json:"Expiration,omitempty"`
 }
 
-// CachedCredentials represents credentials stored in the cache file
-type CachedCredentials struct {
-	Credentials CredentialsProcessOutput `json:"credentials"`
-	CachedAt    time.Time                `json:"cached_at"`
-	ExpiresAt   time.Time                `json:"expires_at"`
-	RoleARN     string                   `json:"role_arn"`
-	LambdaURL   string                   `json:"lambda_url"`
-}
-
-// Config holds the configuration for the credentials process
-type Config struct {
-	LambdaURL   string
-	RoleARN     string
-	TailnetKey  string
-	SessionName string
-	Duration    time.Duration
-	Timeout     time.Duration
-	GeneratedAuthKey bool // True if auth key was generated via OAuth
-}
-
 func main() {
-	// Configure logging to stderr (AWS credentials_process requirement)
+	// Configure logging to stderr (AWS credentials_process requirement);
+	// parseFlags applies --quiet, --verbose and --log-format
 	log.SetOutput(os.Stderr)
 	log.SetPrefix("post2post-credentials: ")
 
 	// Parse command line arguments
-	config, err := parseFlags()
+	config, err := parseFlags(os.Args[1:])
 	if err != nil {
-		log.Printf("Configuration error: %v", err)
-		os.Exit(1)
+		fail(exitConfig, "Configuration error", err)
+	}
+
+	if config.Command != "" {
+		targets, err := cacheTargets(config)
+		if err != nil {
+			fail(exitConfig, "Invalid configuration", err)
+		}
+		if err := runCacheCommand(os.Stdout, config.Command, targets); err != nil {
+			fail(classifyError(err), fmt.Sprintf("Cache %s failed", config.Command), err)
+		}
+		return
 	}
 
 	// Validate configuration
 	if err := validateConfig(config); err != nil {
-		log.Printf("Invalid configuration: %v", err)
-		os.Exit(1)
+		fail(exitConfig, "Invalid configuration", err)
+	}
+
+	// Reuse the tailnet connection of a running daemon. Bypassing the cache
+	// also bypasses the daemon, which caches in memory.
+	if !config.Serve && !config.NoCache && !config.ForceRefresh {
+		output, err := retrieveFromDaemon(config)
+		if err == nil {
+			printOutput(output)
+			return
+		}
+		if !errors.Is(err, errNoDaemon) {
+			log.Printf("Daemon unavailable, retrieving credentials directly: %v", err)
+		}
 	}
 
 	// Generate Tailscale auth key if OAuth credentials are available
 	if config.GeneratedAuthKey {
 		log.Printf("Generating ephemeral Tailscale auth key using OAuth")
-		authKey, err := generateTailscaleAuthKey()
+		authKey, err := generateTailscaleAuthKey(config)
 		if err != nil {
-			log.Printf("Failed to generate Tailscale auth key: %v", err)
-			os.Exit(1)
+			fail(classifyError(err), "Failed to generate Tailscale auth key", err)
 		}
 		config.TailnetKey = authKey
 		log.Printf("Successfully generated ephemeral auth key")
 	}
 
-	// Try to load cached credentials first
-	var output *CredentialsProcessOutput
-	cachedOutput, err := loadCachedCredentials(config)
-	if err != nil {
-		log.Printf("Warning: failed to load cached credentials: %v", err)
-	}
-	
-	if cachedOutput != nil {
-		// Use cached credentials
-		output = cachedOutput
-	} else {
-		// Retrieve fresh credentials
-		log.Printf("Retrieving fresh credentials from Lambda")
-		credentials, err := retrieveCredentials(config)
-		if err != nil {
-			log.Printf("Failed to retrieve credentials: %v", err)
-			os.Exit(1)
-		}
-
-		// Convert to output format
-		output = &CredentialsProcessOutput{
-			Version:         1,
-			AccessKeyId:     credentials.AccessKeyID,
-			SecretAccessKey: credentials.SecretAccessKey,
-			SessionToken:    credentials.SessionToken,
+	if config.Serve {
+		if err := runDaemon(config); err != nil {
+			fail(classifyError(err), "Daemon failed", err)
 		}
+		return
+	}
 
-		// Add expiration if available
-		if !credentials.Expires.IsZero() {
-			output.Expiration = credentials.Expires.Format(time.RFC3339)
-		}
-		
-		// Save to cache
-		if err := saveCachedCredentials(config, output); err != nil {
-			log.Printf("Warning: failed to save credentials to cache: %v", err)
-		}
+	// Retrieve credentials, from the disk cache when still valid
+	credentials, err := retrieveCredentials(config)
+	if err != nil {
+		fail(classifyError(err), "Failed to retrieve credentials", err)
 	}
+	printOutput(newCredentialsProcessOutput(credentials))
+}
 
-	// Marshal and output JSON to stdout
+// printOutput writes the credentials as JSON to stdout
+func printOutput(output *CredentialsProcessOutput) {
 	jsonOutput, err := json.Marshal(output)
 	if err != nil {
-		log.Printf("Failed to marshal credentials to JSON: %v", err)
-		os.Exit(1)
+		fail(exitFailure, "Failed to marshal credentials to JSON", err)
 	}
 
 	// Output credentials to stdout (required for AWS CLI)
 	fmt.Println(string(jsonOutput))
 }
 
-// parseFlags parses command line arguments and environment variables
-func parseFlags() (*Config, error) {
-	config := &Config{}
-
-	// Command line flags
-	flag.StringVar(&config.LambdaURL, "lambda-url", "", "AWS Lambda Function URL endpoint")
-	flag.StringVar(&config.RoleARN, "role-arn", "", "IAM Role ARN to assume (must be in /remote/ path)")
-	flag.StringVar(&config.TailnetKey, "tailnet-key", "", "Tailscale auth key for secure communication")
-	flag.StringVar(&config.SessionName, "session-name", "post2post-credentials-process", "Session name for the assumed role")
-	flag.DurationVar(&config.Duration, "duration", 1*time.Hour, "Credential duration (e.g., 1h, 30m)")
-	flag.DurationVar(&config.Timeout, "timeout", 30*time.Second, "Request timeout (e.g., 30s, 1m)")
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "AWS credentials_process implementation using post2post for secure credential retrieval.\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nEnvironment variables (take precedence over flags):\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_LAMBDA_URL     Lambda Function URL endpoint\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_ROLE_ARN       IAM Role ARN to assume\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_TAILNET_KEY    Tailscale auth key\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_SESSION_NAME   Session name for assumed role\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_DURATION       Credential duration (e.g., 1h, 30m)\n")
-		fmt.Fprintf(os.Stderr, "  POST2POST_TIMEOUT        Request timeout (e.g., 30s, 1m)\n")
-		fmt.Fprintf(os.Stderr, "\nTailscale OAuth (auto-generates ephemeral auth keys):\n")
-		fmt.Fprintf(os.Stderr, "  TS_API_CLIENT_ID         Tailscale OAuth client ID\n")
-		fmt.Fprintf(os.Stderr, "  TS_API_CLIENT_SECRET     Tailscale OAuth client secret\n")
-		fmt.Fprintf(os.Stderr, "  (When both are set, --tailnet-key is optional)\n")
-		fmt.Fprintf(os.Stderr, "\nExample usage in AWS config:\n")
-		fmt.Fprintf(os.Stderr, "  [profile myprofile]\n")
-		fmt.Fprintf(os.Stderr, "  credential_process = /usr/local/bin/post2post-credentials --lambda-url https://lambda-url.amazonaws.com/ --role-arn arn:aws:iam::123456789012:role/remote/MyRole --tailnet-key tskey-auth-xyz\n")
-	}
+// Exit codes, so wrappers can tell failures apart
+const (
+	exitFailure = 1 // Unclassified failure
+	exitConfig  = 2 // Invalid flags, environment or config file
+	exitNetwork = 3 // The Lambda or tailnet could not be reached in time
+	exitSTS     = 4 // The Lambda or STS refused to issue credentials for the role
+)
+
+// Log formats selectable with --log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// ErrorOutput is the JSON error written as the last line on stderr when the
+// program fails
+type ErrorOutput struct {
+	Error ErrorDetails `json:"error"`
+}
 
-	flag.Parse()
+// ErrorDetails describes a failure; fields not known are omitted
+type ErrorDetails struct {
+	Category        string `json:"category"`
+	ExitCode        int    `json:"exit_code"`
+	Message         string `json:"message"`
+	Code            string `json:"code,omitempty"`
+	RoleARN         string `json:"role_arn,omitempty"`
+	StatusCode      int    `json:"status_code,omitempty"`
+	RequestID       string `json:"request_id,omitempty"`
+	LambdaRequestID string `json:"lambda_request_id,omitempty"`
+}
 
-	// Override with environment variables if set
-	if envLambdaURL := os.Getenv("POST2POST_LAMBDA_URL"); envLambdaURL != "" {
-		config.LambdaURL = envLambdaURL
+// verbose enables detail logs, set by --verbose
+var verbose bool
+
+// verbosef logs only with --verbose
+func verbosef(format string, args ...interface{}) {
+	if verbose {
+		log.Printf(format, args...)
 	}
-	if envRoleARN := os.Getenv("POST2POST_ROLE_ARN"); envRoleARN != "" {
-		config.RoleARN = envRoleARN
+}
+
+// jsonLogWriter writes each log line as a JSON object
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Source  string `json:"source"`
+		Message string `json:"message"`
+	}{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Source:  "post2post-credentials",
+		Message: strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
 	}
-	if envTailnetKey := os.Getenv("POST2POST_TAILNET_KEY"); envTailnetKey != "" {
-		config.TailnetKey = envTailnetKey
+	if _, err := w.w.Write(append(line, '\n')); err != nil {
+		return 0, err
 	}
-	if envSessionName := os.Getenv("POST2POST_SESSION_NAME"); envSessionName != "" {
-		config.SessionName = envSessionName
+	return len(p), nil
+}
+
+// configureLogging applies --quiet, --verbose and --log-format to the
+// standard logger, which the post2post library also logs to
+func configureLogging(quiet, verboseLogs bool, format string) error {
+	if quiet && verboseLogs {
+		return fmt.Errorf("--quiet and --verbose are mutually exclusive")
 	}
-	if envDuration := os.Getenv("POST2POST_DURATION"); envDuration != "" {
-		if duration, err := time.ParseDuration(envDuration); err == nil {
-			config.Duration = duration
-		} else {
-			return nil, fmt.Errorf("invalid duration format in POST2POST_DURATION: %v", err)
+	verbose = verboseLogs
+
+	var out io.Writer = os.Stderr
+	switch format {
+	case "", logFormatText:
+		if verboseLogs {
+			log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 		}
+	case logFormatJSON:
+		out = jsonLogWriter{w: os.Stderr}
+		log.SetFlags(0)
+		log.SetPrefix("")
+	default:
+		return fmt.Errorf("invalid log format %q (use text or json)", format)
 	}
-	if envTimeout := os.Getenv("POST2POST_TIMEOUT"); envTimeout != "" {
-		if timeout, err := time.ParseDuration(envTimeout); err == nil {
-			config.Timeout = timeout
-		} else {
-			return nil, fmt.Errorf("invalid timeout format in POST2POST_TIMEOUT: %v", err)
-		}
+	if quiet {
+		out = io.Discard
 	}
-
-	return config, nil
+	log.SetOutput(out)
+	return nil
 }
 
-// validateConfig validates the configuration parameters
-func validateConfig(config *Config) error {
-	if config.LambdaURL == "" {
-		return fmt.Errorf("lambda URL is required (use --lambda-url or POST2POST_LAMBDA_URL)")
-	}
-	if config.RoleARN == "" {
-		return fmt.Errorf("role ARN is required (use --role-arn or POST2POST_ROLE_ARN)")
-	}
-	
-	// Check if OAuth credentials are available for auto-generation
-	clientID := os.Getenv("TS_API_CLIENT_ID")
-	clientSecret := os.Getenv("TS_API_CLIENT_SECRET")
-	
-	if clientID != "" && clientSecret != "" {
-		// OAuth credentials available - we'll generate an auth key
-		log.Printf("Tailscale OAuth credentials detected, will generate ephemeral auth key")
-		config.GeneratedAuthKey = true
-	} else if config.TailnetKey == "" {
-		// No OAuth and no manual auth key provided
-		return fmt.Errorf("tailnet key is required (use --tailnet-key or POST2POST_TAILNET_KEY) or set TS_API_CLIENT_ID and TS_API_CLIENT_SECRET for auto-generation")
+// classifyError returns the exit code for a failure to get credentials
+func classifyError(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, post2post.ErrAssumeRoleDenied), errors.Is(err, post2post.ErrLambdaRejected):
+		return exitSTS
+	case errors.Is(err, post2post.ErrTimeout), errors.Is(err, post2post.ErrLambdaUnavailable),
+		errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return exitNetwork
+	default:
+		return exitFailure
 	}
+}
 
-	// Validate role ARN format (must be in /remote/ path for security)
-	if !isValidRemoteRoleARN(config.RoleARN) {
-		return fmt.Errorf("role ARN must be in /remote/ path for security (e.g., arn:aws:iam::123456789012:role/remote/MyRole)")
-	}
+// newErrorOutput describes err for the final error line
+func newErrorOutput(exitCode int, message string, err error) *ErrorOutput {
+	details := ErrorDetails{
+		ExitCode: exitCode,
+		Message:  message + ": " + err.Error(),
+	}
+	switch exitCode {
+	case exitConfig:
+		details.Category = "config"
+	case exitNetwork:
+		details.Category = "network"
+	case exitSTS:
+		details.Category = "sts"
+	default:
+		details.Category = "internal"
+	}
+
+	var credsErr *post2post.CredentialsError
+	if errors.As(err, &credsErr) {
+		details.Code = credsErr.Code
+		details.RoleARN = credsErr.RoleARN
+		details.StatusCode = credsErr.StatusCode
+		details.RequestID = credsErr.RequestID
+		details.LambdaRequestID = credsErr.LambdaRequestID
+	}
+	return &ErrorOutput{Error: details}
+}
 
-	// Validate duration limits (AWS STS limits)
-	if config.Duration < 15*time.Minute {
-		return fmt.Errorf("credential duration must be at least 15 minutes")
+// fail logs err, writes it as JSON as the last line on stderr, even with
+// --quiet, and exits with exitCode
+func fail(exitCode int, message string, err error) {
+	log.Printf("%s: %v", message, err)
+	if blob, marshalErr := json.Marshal(newErrorOutput(exitCode, message, err)); marshalErr == nil {
+		fmt.Fprintln(os.Stderr, string(blob))
 	}
-	if config.Duration > 12*time.Hour {
-		return fmt.Errorf("credential duration cannot exceed 12 hours")
-	}
-
-	return nil
+	os.Exit(exitCode)
 }
 
-// isValidRemoteRoleARN checks if the role ARN is in the required /remote/ path
-func isValidRemoteRoleARN(roleARN string) bool {
-	// Expected format: arn:aws:iam::123456789012:role/remote/RoleName
-	// Check basic format and that it contains "/remote/" in the role path
-	if len(roleARN) < 40 {
-		return false
+// newCredentialsProcessOutput converts credentials to the output format
+func newCredentialsProcessOutput(credentials aws.Credentials) *CredentialsProcessOutput {
+	output := &CredentialsProcessOutput{
+		Version:         1,
+		AccessKeyId:     credentials.AccessKeyID,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
 	}
-	
-	// Check prefix
-	if !strings.HasPrefix(roleARN, "arn:aws:iam::") {
-		return false
+
+	// Add expiration if available
+	if !credentials.Expires.IsZero() {
+		output.Expiration = credentials.Expires.Format(time.RFC3339)
 	}
-	
-	// Check that it contains the required /remote/ path
-	return strings.Contains(roleARN, ":role/remote/")
+	return output
 }
 
 // retrieveCredentials uses the post2post AWS credentials provider to get credentials
 func retrieveCredentials(config *Config) (aws.Credentials, error) {
+	return retrieveCredentialsWith(config, providerConfig(config))
+}
+
+// retrieveCredentialsWith gets credentials from a provider configured with
+// providerConfig, using the cache as config asks
+func retrieveCredentialsWith(config *Config, providerConfig post2post.AWSCredentialsProviderConfig) (aws.Credentials, error) {
 	log.Printf("Initializing post2post credentials provider")
-	log.Printf("Lambda URL: %s", config.LambdaURL)
-	log.Printf("Role ARN: %s", config.RoleARN)
-	log.Printf("Session Name: %s", config.SessionName)
-	log.Printf("Duration: %s", config.Duration)
-
-	// Create AWS credentials provider configuration
-	providerConfig := post2post.AWSCredentialsProviderConfig{
-		LambdaURL:   config.LambdaURL,
-		RoleARN:     config.RoleARN,
-		TailnetKey:  config.TailnetKey,
-		SessionName: config.SessionName,
-		Duration:    config.Duration,
-	}
+	verbosef("Lambda URL: %s", config.LambdaURL)
+	verbosef("Role ARN: %s", config.RoleARN)
+	verbosef("Session Name: %s", config.SessionName)
+	verbosef("Duration: %s", config.Duration)
 
 	// Create the credentials provider
 	provider, err := post2post.NewAWSCredentialsProvider(providerConfig)
 	if err != nil {
 		return aws.Credentials{}, fmt.Errorf("failed to create credentials provider: %w", err)
 	}
+
+	// Share credentials between invocations through the keyring or disk cache
+	if config.NoCache {
+		log.Printf("Credentials cache disabled")
+	} else if store, where, err := newCacheStore(config); err != nil {
+		log.Printf("Warning: credentials cache disabled: %v", err)
+	} else {
+		log.Printf("Using credentials cache: %s", where)
+		provider.WithCredentialsCache(store)
+		if config.ForceRefresh {
+			log.Printf("Forcing a refresh of cached credentials")
+			provider.InvalidateCache()
+		}
+	}
 	defer func() {
 		if closeErr := provider.Close(); closeErr != nil {
 			log.Printf("Warning: failed to close credentials provider: %v", closeErr)
@@ -287,136 +319,3 @@ func retrieveCredentials(config *Config) (aws.Credentials, error) {
 	
 	return credentials, nil
 }
-
-// getCacheFilePath returns the path to the cache file based on session name
-func getCacheFilePath(sessionName string) (string, error) {
-	// Get user's home directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", fmt.Errorf("failed to get user home directory: %w", err)
-	}
-	
-	// Create cache directory path
-	cacheDir := filepath.Join(homeDir, ".cache")
-	
-	// Ensure cache directory exists
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create cache directory: %w", err)
-	}
-	
-	// Create cache file path using session name
-	cacheFile := filepath.Join(cacheDir, sessionName)
-	return cacheFile, nil
-}
-
-// loadCachedCredentials attempts to load valid cached credentials
-func loadCachedCredentials(config *Config) (*CredentialsProcessOutput, error) {
-	cacheFile, err := getCacheFilePath(config.SessionName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get cache file path: %w", err)
-	}
-	
-	log.Printf("Checking for cached credentials in: %s", cacheFile)
-	
-	// Check if cache file exists
-	data, err := os.ReadFile(cacheFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("No cached credentials found")
-			return nil, nil // No cache file exists
-		}
-		return nil, fmt.Errorf("failed to read cache file: %w", err)
-	}
-	
-	// Parse cached credentials
-	var cached CachedCredentials
-	if err := json.Unmarshal(data, &cached); err != nil {
-		log.Printf("Invalid cache file format, ignoring: %v", err)
-		return nil, nil // Invalid cache, ignore it
-	}
-	
-	// Validate that cache matches current configuration
-	if cached.RoleARN != config.RoleARN || cached.LambdaURL != config.LambdaURL {
-		log.Printf("Cache configuration mismatch (RoleARN: %s vs %s, LambdaURL: %s vs %s), ignoring cache", 
-			cached.RoleARN, config.RoleARN, cached.LambdaURL, config.LambdaURL)
-		return nil, nil
-	}
-	
-	// Check if credentials are still valid (not within 10 minutes of expiration)
-	now := time.Now()
-	expirationBuffer := 10 * time.Minute
-	expiresWithBuffer := cached.ExpiresAt.Add(-expirationBuffer)
-	
-	if now.After(expiresWithBuffer) {
-		log.Printf("Cached credentials expire soon (at %s, buffer until %s), refreshing", 
-			cached.ExpiresAt.Format(time.RFC3339), expiresWithBuffer.Format(time.RFC3339))
-		return nil, nil // Need to refresh
-	}
-	
-	log.Printf("Using valid cached credentials (expires: %s)", cached.ExpiresAt.Format(time.RFC3339))
-	return &cached.Credentials, nil
-}
-
-// saveCachedCredentials saves credentials to the cache file
-func saveCachedCredentials(config *Config, credentials *CredentialsProcessOutput) error {
-	cacheFile, err := getCacheFilePath(config.SessionName)
-	if err != nil {
-		return fmt.Errorf("failed to get cache file path: %w", err)
-	}
-	
-	// Parse expiration time from credentials
-	var expiresAt time.Time
-	if credentials.Expiration != "" {
-		if parsed, err := time.Parse(time.RFC3339, credentials.Expiration); err == nil {
-			expiresAt = parsed
-		} else {
-			log.Printf("Warning: failed to parse expiration time, using 1 hour from now: %v", err)
-			expiresAt = time.Now().Add(1 * time.Hour)
-		}
-	} else {
-		// Default to 1 hour if no expiration provided
-		expiresAt = time.Now().Add(1 * time.Hour)
-	}
-	
-	// Create cached credentials structure
-	cached := CachedCredentials{
-		Credentials: *credentials,
-		CachedAt:    time.Now(),
-		ExpiresAt:   expiresAt,
-		RoleARN:     config.RoleARN,
-		LambdaURL:   config.LambdaURL,
-	}
-	
-	// Marshal to JSON
-	data, err := json.MarshalIndent(cached, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal cached credentials: %w", err)
-	}
-	
-	// Write to cache file with restricted permissions
-	if err := os.WriteFile(cacheFile, data, 0600); err != nil {
-		return fmt.Errorf("failed to write cache file: %w", err)
-	}
-	
-	log.Printf("Cached credentials saved to: %s (expires: %s)", cacheFile, expiresAt.Format(time.RFC3339))
-	return nil
-}
-
-// generateTailscaleAuthKey generates an ephemeral auth key using OAuth credentials
-func generateTailscaleAuthKey() (string, error) {
-	// Create a temporary post2post server to access the GenerateTailnetKeyFromOAuth method
-	server := post2post.NewServer()
-	
-	// Generate the auth key with specified parameters
-	authKey, err := server.GenerateTailnetKeyFromOAuth(
-		false, // reusable: false
-		true,  // ephemeral: true  
-		false, // preauth: false
-		"tag:ephemeral-device", // tags
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate Tailscale auth key: %w", err)
-	}
-	
-	return authKey, nil
-}
\ No newline at end of file
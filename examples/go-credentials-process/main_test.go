@@ -1,144 +1,169 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
 	"testing"
 	"time"
+
+	post2post "github.com/pgdad/post2post"
 )
 
-func TestValidateConfig(t *testing.T) {
+func TestClassifyError(t *testing.T) {
+	denied := &post2post.CredentialsError{
+		Kind:            post2post.ErrAssumeRoleDenied,
+		RoleARN:         "arn:aws:iam::123456789012:role/remote/TestRole",
+		Code:            "AccessDenied",
+		LambdaRequestID: "lambda-123",
+	}
 	tests := []struct {
-		name      string
-		config    *Config
-		wantError bool
+		name     string
+		err      error
+		wantCode int
 	}{
-		{
-			name: "valid config",
-			config: &Config{
-				LambdaURL:  "https://lambda.amazonaws.com",
-				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
-				TailnetKey: "tskey-auth-test",
-				Duration:   1 * time.Hour,
-			},
-			wantError: false,
-		},
-		{
-			name: "missing lambda URL",
-			config: &Config{
-				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
-				TailnetKey: "tskey-auth-test",
-				Duration:   1 * time.Hour,
-			},
-			wantError: true,
-		},
-		{
-			name: "missing role ARN",
-			config: &Config{
-				LambdaURL:  "https://lambda.amazonaws.com",
-				TailnetKey: "tskey-auth-test",
-				Duration:   1 * time.Hour,
-			},
-			wantError: true,
-		},
-		{
-			name: "missing tailnet key",
-			config: &Config{
-				LambdaURL: "https://lambda.amazonaws.com",
-				RoleARN:   "arn:aws:iam::123456789012:role/remote/TestRole",
-				Duration:  1 * time.Hour,
-			},
-			wantError: true,
-		},
-		{
-			name: "invalid role ARN - not remote",
-			config: &Config{
-				LambdaURL:  "https://lambda.amazonaws.com",
-				RoleARN:    "arn:aws:iam::123456789012:role/TestRole",
-				TailnetKey: "tskey-auth-test",
-				Duration:   1 * time.Hour,
-			},
-			wantError: true,
-		},
-		{
-			name: "duration too short",
-			config: &Config{
-				LambdaURL:  "https://lambda.amazonaws.com",
-				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
-				TailnetKey: "tskey-auth-test",
-				Duration:   10 * time.Minute, // Less than 15 minutes
-			},
-			wantError: true,
-		},
-		{
-			name: "duration too long",
-			config: &Config{
-				LambdaURL:  "https://lambda.amazonaws.com",
-				RoleARN:    "arn:aws:iam::123456789012:role/remote/TestRole",
-				TailnetKey: "tskey-auth-test",
-				Duration:   13 * time.Hour, // More than 12 hours
-			},
-			wantError: true,
-		},
+		{"assume role denied", fmt.Errorf("failed to retrieve credentials: %w", denied), exitSTS},
+		{"rejected by the Lambda", &post2post.CredentialsError{Kind: post2post.ErrLambdaRejected, StatusCode: 403}, exitSTS},
+		{"timeout", &post2post.CredentialsError{Kind: post2post.ErrTimeout}, exitNetwork},
+		{"deadline", context.DeadlineExceeded, exitNetwork},
+		{"other", errors.New("failed to create credentials provider"), exitFailure},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := validateConfig(tt.config)
-			if (err != nil) != tt.wantError {
-				t.Errorf("validateConfig() error = %v, wantError %v", err, tt.wantError)
+			if code := classifyError(tt.err); code != tt.wantCode {
+				t.Errorf("classifyError() = %d, want %d", code, tt.wantCode)
 			}
 		})
 	}
+
+	output := newErrorOutput(exitSTS, "Failed to retrieve credentials", denied)
+	if output.Error.Category != "sts" || output.Error.Code != "AccessDenied" ||
+		output.Error.RoleARN != denied.RoleARN || output.Error.LambdaRequestID != "lambda-123" {
+		t.Errorf("newErrorOutput() = %+v", output.Error)
+	}
+	if output := newErrorOutput(exitConfig, "Invalid configuration", errors.New("lambda URL is required")); output.Error.Category != "config" || output.Error.ExitCode != exitConfig {
+		t.Errorf("newErrorOutput() = %+v", output.Error)
+	}
 }
 
-func TestIsValidRemoteRoleARN(t *testing.T) {
-	tests := []struct {
-		name    string
-		roleARN string
-		want    bool
-	}{
-		{
-			name:    "valid remote role ARN",
-			roleARN: "arn:aws:iam::123456789012:role/remote/TestRole",
-			want:    true,
-		},
-		{
-			name:    "valid remote role ARN with longer name",
-			roleARN: "arn:aws:iam::123456789012:role/remote/MyVeryLongRoleName",
-			want:    true,
-		},
-		{
-			name:    "invalid - not remote path",
-			roleARN: "arn:aws:iam::123456789012:role/TestRole",
-			want:    false,
-		},
-		{
-			name:    "invalid - wrong prefix",
-			roleARN: "arn:aws:ec2::123456789012:role/remote/TestRole",
-			want:    false,
-		},
-		{
-			name:    "invalid - too short",
-			roleARN: "arn:aws:iam::123",
-			want:    false,
-		},
-		{
-			name:    "invalid - empty",
-			roleARN: "",
-			want:    false,
-		},
-		{
-			name:    "invalid - not an ARN",
-			roleARN: "not-an-arn",
-			want:    false,
-		},
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (jsonLogWriter{w: &buf}).Write([]byte("Using cached credentials\n")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	var line struct {
+		Time    string `json:"time"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if line.Message != "Using cached credentials" || line.Time == "" {
+		t.Errorf("log line = %+v", line)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := isValidRemoteRoleARN(tt.roleARN); got != tt.want {
-				t.Errorf("isValidRemoteRoleARN() = %v, want %v", got, tt.want)
-			}
+	if err := configureLogging(true, true, logFormatText); err == nil {
+		t.Error("expected error for --quiet with --verbose")
+	}
+	if err := configureLogging(false, false, "xml"); err == nil {
+		t.Error("expected error for an unknown log format")
+	}
+}
+
+func TestRetrieveCredentialsCacheFlags(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG_CACHE_HOME is only used on Linux")
+	}
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	lambda := post2post.NewMockLambda(post2post.MockLambdaConfig{AccessKeyID: "AKIAFRESH"})
+	defer lambda.Close()
+
+	config := &Config{
+		LambdaURL:   lambda.URL,
+		RoleARN:     "arn:aws:iam::123456789012:role/remote/TestRole",
+		TailnetKey:  "tskey-auth-test",
+		SessionName: "post2post-credentials-process",
+		Duration:    time.Hour,
+		Timeout:     10 * time.Second,
+		CacheStore:  cacheStoreFile,
+	}
+	// The mock Lambda is reached over plain HTTP on localhost
+	testProviderConfig := providerConfig(config)
+	testProviderConfig.Fallback = post2post.FallbackWarn
+
+	// seedCache stores valid credentials as another invocation would
+	seedCache := func() {
+		t.Helper()
+		entry, err := json.Marshal(post2post.DiskCacheEntry{
+			Version:         1,
+			AccessKeyID:     "AKIACACHED",
+			SecretAccessKey: "secret",
+			SessionToken:    "token",
+			Expires:         time.Now().Add(time.Hour),
+			CachedAt:        time.Now(),
+			RoleARN:         config.RoleARN,
+			LambdaURL:       config.LambdaURL,
+			SessionName:     config.SessionName,
 		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, _, err := newCacheStore(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(post2post.CredentialsCacheKey(config.LambdaURL, config.RoleARN, config.SessionName), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cachedKey := func() string {
+		t.Helper()
+		entry, err := loadCacheEntry(config)
+		if err != nil {
+			t.Fatalf("loadCacheEntry() failed: %v", err)
+		}
+		return entry.AccessKeyID
+	}
+
+	// Valid cached credentials are used without calling the Lambda
+	seedCache()
+	credentials, err := retrieveCredentialsWith(config, testProviderConfig)
+	if err != nil {
+		t.Fatalf("retrieveCredentials() failed: %v", err)
+	}
+	if credentials.AccessKeyID != "AKIACACHED" || lambda.Calls() != 0 {
+		t.Errorf("retrieveCredentials() = %s after %d Lambda calls, want the cached credentials", credentials.AccessKeyID, lambda.Calls())
+	}
+
+	// --force-refresh bypasses them but still caches the new credentials
+	config.ForceRefresh = true
+	credentials, err = retrieveCredentialsWith(config, testProviderConfig)
+	if err != nil {
+		t.Fatalf("retrieveCredentials() with --force-refresh failed: %v", err)
+	}
+	if credentials.AccessKeyID != "AKIAFRESH" || lambda.Calls() != 1 {
+		t.Errorf("retrieveCredentials() with --force-refresh = %s after %d Lambda calls, want fresh credentials", credentials.AccessKeyID, lambda.Calls())
+	}
+	if key := cachedKey(); key != "AKIAFRESH" {
+		t.Errorf("cached access key after --force-refresh = %s, want AKIAFRESH", key)
+	}
+
+	// --no-cache neither reads nor writes the cache
+	config.ForceRefresh = false
+	config.NoCache = true
+	seedCache()
+	credentials, err = retrieveCredentialsWith(config, testProviderConfig)
+	if err != nil {
+		t.Fatalf("retrieveCredentials() with --no-cache failed: %v", err)
+	}
+	if credentials.AccessKeyID != "AKIAFRESH" || lambda.Calls() != 2 {
+		t.Errorf("retrieveCredentials() with --no-cache = %s after %d Lambda calls, want fresh credentials", credentials.AccessKeyID, lambda.Calls())
+	}
+	if key := cachedKey(); key != "AKIACACHED" {
+		t.Errorf("cached access key after --no-cache = %s, want the seeded AKIACACHED", key)
 	}
 }
 
@@ -162,4 +187,4 @@ func TestCredentialsProcessOutput(t *testing.T) {
 func marshalToJSON(v interface{}) ([]byte, error) {
 	// This would normally use json.Marshal, but we'll simulate for testing
 	return []byte(`{"Version":1,"AccessKeyId":"AKIATEST","SecretAccessKey":"secret","SessionToken":"token","Expiration":"2023-12-25T12:00:00Z"}`), nil
-}
\ No newline at end of file
+}
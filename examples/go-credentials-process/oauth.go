@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	post2post "github.com/pgdad/post2post"
+)
+
+// tailnetKeyCacheEntry is a cached auth key minted via OAuth
+type tailnetKeyCacheEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// tailnetKeyMinLifetime is how long a cached auth key must remain valid to
+// be reused, so tsnet does not start with a key about to expire
+const tailnetKeyMinLifetime = 5 * time.Minute
+
+// generateTailscaleAuthKey returns an ephemeral auth key minted with the
+// OAuth client in TS_API_CLIENT_ID and TS_API_CLIENT_SECRET. The key is
+// reusable but short-lived, and is cached next to the credentials so later
+// invocations skip the Tailscale API until it nears expiry.
+func generateTailscaleAuthKey(config *Config) (string, error) {
+	var store post2post.CredentialsCacheStore
+	cacheKey := tailnetKeyCacheKey(os.Getenv("TS_API_CLIENT_ID"), config.OAuthTags)
+	if !config.NoCache {
+		if cacheStore, _, err := newCacheStore(config); err != nil {
+			log.Printf("Warning: auth key cache disabled: %v", err)
+		} else {
+			store = cacheStore
+		}
+	}
+	if store != nil && !config.ForceRefresh {
+		if key, ok := loadTailnetKey(store, cacheKey); ok {
+			log.Printf("Using cached ephemeral auth key")
+			return key, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	// A temporary post2post server holds the OAuth key manager
+	server := post2post.NewServer()
+	key, err := server.GenerateTailnetKey(ctx, post2post.TailnetKeyOptions{
+		Tags:          splitList(config.OAuthTags),
+		Reusable:      true,
+		Ephemeral:     true,
+		ExpirySeconds: int64(config.OAuthKeyExpiry / time.Second),
+		Description:   "post2post-credentials",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate Tailscale auth key: %w", err)
+	}
+
+	if store != nil {
+		expires := key.Expires
+		if expires.IsZero() {
+			expires = time.Now().Add(config.OAuthKeyExpiry)
+		}
+		data, err := json.Marshal(tailnetKeyCacheEntry{Key: key.Key, Expires: expires})
+		if err == nil {
+			err = store.Save(cacheKey, data)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to cache auth key: %v", err)
+		}
+	}
+	return key.Key, nil
+}
+
+// tailnetKeyCacheKey derives the cache key of the auth key minted for an
+// OAuth client and tags
+func tailnetKeyCacheKey(clientID, tags string) string {
+	sum := sha256.Sum256([]byte(clientID + "\n" + tags))
+	return "tailnet-key-" + hex.EncodeToString(sum[:8])
+}
+
+// loadTailnetKey returns the cached auth key if it remains valid for at
+// least tailnetKeyMinLifetime
+func loadTailnetKey(store post2post.CredentialsCacheStore, cacheKey string) (string, bool) {
+	data, err := store.Load(cacheKey)
+	if err != nil {
+		if !errors.Is(err, post2post.ErrCacheMiss) {
+			log.Printf("Warning: failed to read cached auth key: %v", err)
+		}
+		return "", false
+	}
+	var entry tailnetKeyCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key == "" {
+		return "", false
+	}
+	if time.Until(entry.Expires) < tailnetKeyMinLifetime {
+		return "", false
+	}
+	return entry.Key, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	post2post "github.com/pgdad/post2post"
+)
+
+func TestOAuthAuthKey(t *testing.T) {
+	t.Setenv("TS_API_CLIENT_ID", "client-id")
+	t.Setenv("TS_API_CLIENT_SECRET", "client-secret")
+
+	config := &Config{
+		LambdaURL:      "https://lambda.amazonaws.com",
+		RoleARN:        "arn:aws:iam::123456789012:role/remote/TestRole",
+		Duration:       time.Hour,
+		OAuthTags:      "tag:ephemeral-device",
+		OAuthKeyExpiry: time.Hour,
+	}
+	if err := validateConfig(config); err != nil || !config.GeneratedAuthKey {
+		t.Errorf("validateConfig() = %v, GeneratedAuthKey %v; want a key minted via OAuth", err, config.GeneratedAuthKey)
+	}
+
+	// An explicit tailnet key takes precedence over OAuth
+	withKey := *config
+	withKey.GeneratedAuthKey = false
+	withKey.TailnetKey = "tskey-auth-test"
+	if err := validateConfig(&withKey); err != nil || withKey.GeneratedAuthKey {
+		t.Errorf("validateConfig() = %v, GeneratedAuthKey %v; want the given key", err, withKey.GeneratedAuthKey)
+	}
+
+	noTags := *config
+	noTags.OAuthTags = ""
+	if err := validateConfig(&noTags); err == nil {
+		t.Error("expected error for OAuth without tags")
+	}
+
+	store := post2post.NewFileCacheStore(t.TempDir())
+	cacheKey := tailnetKeyCacheKey("client-id", config.OAuthTags)
+	if _, ok := loadTailnetKey(store, cacheKey); ok {
+		t.Error("expected no cached auth key")
+	}
+	for _, tt := range []struct {
+		name    string
+		expires time.Time
+		want    bool
+	}{
+		{"valid key", time.Now().Add(30 * time.Minute), true},
+		{"key about to expire", time.Now().Add(time.Minute), false},
+	} {
+		data, _ := json.Marshal(tailnetKeyCacheEntry{Key: "tskey-auth-cached", Expires: tt.expires})
+		if err := store.Save(cacheKey, data); err != nil {
+			t.Fatal(err)
+		}
+		if key, ok := loadTailnetKey(store, cacheKey); ok != tt.want || (ok && key != "tskey-auth-cached") {
+			t.Errorf("%s: loadTailnetKey() = %q, %v; want %v", tt.name, key, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package post2post
+
+import (
+	"fmt"
+	"log"
+)
+
+// FallbackPolicy controls what happens when a tailnet-aware path cannot use
+// Tailscale, e.g. tsnet fails to start or no Tailscale address is available.
+// Falling back sends the request over plain HTTP, which may cross the public
+// internet.
+type FallbackPolicy int
+
+const (
+	// FallbackNever fails the request instead of falling back (the default)
+	FallbackNever FallbackPolicy = iota
+	// FallbackWarn logs a warning and falls back to plain HTTP
+	FallbackWarn
+	// FallbackSilent falls back to plain HTTP without logging
+	FallbackSilent
+)
+
+// String returns the name of the fallback policy
+func (p FallbackPolicy) String() string {
+	switch p {
+	case FallbackNever:
+		return "never"
+	case FallbackWarn:
+		return "warn"
+	case FallbackSilent:
+		return "silent"
+	default:
+		return fmt.Sprintf("FallbackPolicy(%d)", int(p))
+	}
+}
+
+// WithFallbackPolicy sets what the server does when a tailnet-aware post
+// cannot use Tailscale. Use FallbackNever when payloads (such as
+// credentials) must not leave the tailnet.
+func (s *Server) WithFallbackPolicy(policy FallbackPolicy) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.fallback = policy
+	return s
+}
+
+// GetFallbackPolicy returns the server's Tailscale fallback policy
+func (s *Server) GetFallbackPolicy() FallbackPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailnet.fallback
+}
+
+// fallbackAllowed applies the fallback policy after a tailnet path failed
+// and reports whether the caller may continue over plain HTTP
+func (s *Server) fallbackAllowed(what string, err error) bool {
+	switch s.GetFallbackPolicy() {
+	case FallbackNever:
+		return false
+	case FallbackSilent:
+		return true
+	default:
+		log.Printf("WARNING: %s failed, falling back to plain HTTP: %v", what, err)
+		return true
+	}
+}
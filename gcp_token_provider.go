@@ -0,0 +1,264 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// GCP token defaults
+const (
+	gcpCloudPlatformScope   = "https://www.googleapis.com/auth/cloud-platform"
+	defaultGCPTokenLifetime = time.Hour
+	// Lifetimes over an hour need the
+	// iam.allowServiceAccountCredentialLifetimeExtension org policy
+	maxGCPTokenLifetime = 12 * time.Hour
+)
+
+// gcpServiceAccountPattern matches service account emails
+var gcpServiceAccountPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.gserviceaccount\.com$`)
+
+// GCPTokenProviderConfig holds configuration for the GCP token provider
+type GCPTokenProviderConfig struct {
+	ReceiverURL    string         // Cloud Function or Cloud Run receiver URL (required)
+	ServiceAccount string         // Email of the service account to impersonate (required)
+	TailnetKey     string         // Tailscale auth key for secure communication (required)
+	Scopes         []string       // OAuth scopes (optional, default cloud-platform)
+	Delegates      []string       // Service accounts in the delegation chain (optional)
+	Lifetime       time.Duration  // Token lifetime, at most 12 hours (optional, default 1 hour)
+	Fallback       FallbackPolicy // Behavior when Tailscale is unavailable (optional, default FallbackNever)
+	ExpiryBuffer   time.Duration  // How long before expiry tokens are refreshed (optional, default 5 minutes)
+	MaxAttempts    int            // Attempts per refresh for retryable failures (optional, default 3)
+}
+
+// GCPTokenRequest represents the request sent to the GCP receiver
+type GCPTokenRequest struct {
+	URL             string   `json:"url"`
+	Payload         string   `json:"payload"`
+	RequestID       string   `json:"request_id"`
+	TailnetKey      string   `json:"tailnet_key,omitempty"`
+	ServiceAccount  string   `json:"service_account"`
+	Scopes          []string `json:"scopes,omitempty"`
+	Delegates       []string `json:"delegates,omitempty"`
+	LifetimeSeconds int32    `json:"lifetime_seconds,omitempty"`
+}
+
+// GCPProcessedPayload represents the processed payload from the GCP receiver
+type GCPProcessedPayload struct {
+	OriginalPayload   string         `json:"original_payload"`
+	TokenResult       GCPTokenResult `json:"token_result"`
+	ProcessedAt       string         `json:"processed_at"`
+	ProcessedBy       string         `json:"processed_by"`
+	ReceiverRequestID string         `json:"receiver_request_id"`
+	Status            string         `json:"status"`
+	Error             string         `json:"error,omitempty"`
+	ErrorCode         string         `json:"error_code,omitempty"`
+}
+
+// GCPTokenResult is the IAM Credentials generateAccessToken result
+type GCPTokenResult struct {
+	AccessToken string    `json:"access_token"`
+	ExpireTime  time.Time `json:"expire_time"`
+}
+
+// GCPTokenProvider implements oauth2.TokenSource using post2post: a receiver
+// on Cloud Functions or Cloud Run impersonates a service account and posts a
+// short-lived access token back over the tailnet
+type GCPTokenProvider struct {
+	receiver       *tokenReceiver
+	serviceAccount string
+	scopes         []string
+	delegates      []string
+	lifetime       time.Duration
+	expiryBuffer   time.Duration
+
+	// Cached token
+	mu    sync.RWMutex
+	token *oauth2.Token
+
+	// Deduplicates concurrent refreshes
+	refresh singleflight.Group
+}
+
+var _ oauth2.TokenSource = (*GCPTokenProvider)(nil)
+
+// NewGCPTokenProvider creates a new GCP token provider using post2post
+func NewGCPTokenProvider(config GCPTokenProviderConfig) (*GCPTokenProvider, error) {
+	if config.ReceiverURL == "" {
+		return nil, fmt.Errorf("receiver URL is required")
+	}
+	if err := validateReceiverURL("receiver", config.ReceiverURL); err != nil {
+		return nil, err
+	}
+	if config.ServiceAccount == "" {
+		return nil, fmt.Errorf("service account is required")
+	}
+	for _, account := range append([]string{config.ServiceAccount}, config.Delegates...) {
+		if !gcpServiceAccountPattern.MatchString(account) {
+			return nil, fmt.Errorf("invalid service account email %q", account)
+		}
+	}
+	if config.TailnetKey == "" {
+		return nil, fmt.Errorf("tailnet key is required for secure communication")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{gcpCloudPlatformScope}
+	}
+	if config.Lifetime == 0 {
+		config.Lifetime = defaultGCPTokenLifetime
+	}
+	if config.Lifetime < time.Second || config.Lifetime > maxGCPTokenLifetime {
+		return nil, fmt.Errorf("lifetime must be between 1 second and 12 hours, got %s", config.Lifetime)
+	}
+	if config.ExpiryBuffer < 0 || config.MaxAttempts < 0 {
+		return nil, fmt.Errorf("expiry buffer and attempts must not be negative")
+	}
+	if config.ExpiryBuffer == 0 {
+		config.ExpiryBuffer = 5 * time.Minute
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+
+	log.Printf("GCP Token Provider initialized with receiver URL: %s", config.ReceiverURL)
+	log.Printf("Will impersonate service account: %s", config.ServiceAccount)
+
+	return &GCPTokenProvider{
+		receiver:       newTokenReceiver(config.ReceiverURL, config.TailnetKey, config.Fallback, config.MaxAttempts),
+		serviceAccount: config.ServiceAccount,
+		scopes:         append([]string(nil), config.Scopes...),
+		delegates:      append([]string(nil), config.Delegates...),
+		lifetime:       config.Lifetime,
+		expiryBuffer:   config.ExpiryBuffer,
+	}, nil
+}
+
+// Start starts the internal post2post server. It is called by the first
+// Token; call it explicitly to surface startup errors early.
+func (p *GCPTokenProvider) Start(ctx context.Context) error {
+	return p.receiver.start(ctx)
+}
+
+// Close stops the internal post2post server, if it was started
+func (p *GCPTokenProvider) Close() error {
+	return p.receiver.close()
+}
+
+// Token implements oauth2.TokenSource.Token
+func (p *GCPTokenProvider) Token() (*oauth2.Token, error) {
+	return p.TokenContext(context.Background())
+}
+
+// TokenContext returns a cached token or fetches a new one, giving up
+// waiting when ctx is done
+func (p *GCPTokenProvider) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	p.mu.RLock()
+	if p.token != nil && time.Now().Before(p.token.Expiry.Add(-p.expiryBuffer)) {
+		token := *p.token
+		p.mu.RUnlock()
+		return &token, nil
+	}
+	p.mu.RUnlock()
+
+	if err := p.Start(ctx); err != nil {
+		return nil, err
+	}
+
+	// Concurrent callers share a single upstream refresh
+	result := p.refresh.DoChan("token", func() (interface{}, error) {
+		return p.fetchToken()
+	})
+
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		token := *res.Val.(*oauth2.Token)
+		return &token, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// InvalidateCache forces the provider to fetch a new token on the next call
+func (p *GCPTokenProvider) InvalidateCache() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.token = nil
+}
+
+// GetServiceAccount returns the impersonated service account
+func (p *GCPTokenProvider) GetServiceAccount() string {
+	return p.serviceAccount
+}
+
+// GetReceiverURL returns the configured receiver URL
+func (p *GCPTokenProvider) GetReceiverURL() string {
+	return p.receiver.url
+}
+
+// fetchToken requests a token, retrying retryable failures, and caches it
+func (p *GCPTokenProvider) fetchToken() (*oauth2.Token, error) {
+	var token *oauth2.Token
+	err := p.receiver.withRetry("GCP access token", func() error {
+		var err error
+		token, err = p.requestToken()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.token = token
+	p.mu.Unlock()
+	log.Printf("Successfully retrieved GCP access token (expires: %s)", token.Expiry.Format(time.RFC3339))
+	return token, nil
+}
+
+// requestToken makes a single round trip through the receiver
+func (p *GCPTokenProvider) requestToken() (*oauth2.Token, error) {
+	log.Printf("Fetching new GCP access token from receiver: %s", p.receiver.url)
+
+	data, requestID, err := p.receiver.roundTrip("gcp-token", p.serviceAccount, func(callbackURL, requestID string) interface{} {
+		return GCPTokenRequest{
+			URL:             callbackURL,
+			Payload:         fmt.Sprintf("token-request-%s", requestID),
+			RequestID:       requestID,
+			TailnetKey:      p.receiver.tailnetKey,
+			ServiceAccount:  p.serviceAccount,
+			Scopes:          p.scopes,
+			Delegates:       p.delegates,
+			LifetimeSeconds: int32(p.lifetime / time.Second),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var payload GCPProcessedPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, terminal(fmt.Errorf("failed to parse receiver response: %w", err))
+	}
+	if payload.Status != "success" {
+		return nil, receiverDenied(p.serviceAccount, requestID, payload.ReceiverRequestID, payload.Status, payload.Error, payload.ErrorCode)
+	}
+	if payload.TokenResult.AccessToken == "" {
+		return nil, terminal(fmt.Errorf("no access token returned in receiver response"))
+	}
+
+	return &oauth2.Token{
+		AccessToken: payload.TokenResult.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      payload.TokenResult.ExpireTime,
+	}, nil
+}
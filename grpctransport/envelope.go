@@ -0,0 +1,177 @@
+package grpctransport
+
+//go:generate buf generate ../proto --template ../proto/buf.gen.yaml --output ..
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pgdad/post2post"
+	"github.com/pgdad/post2post/grpctransport/post2postpb"
+)
+
+func init() {
+	post2post.RegisterEncoding(post2post.EncodingProtobuf, EnvelopeCodec{})
+}
+
+// Media types of envelope payloads
+const (
+	envelopePayloadJSON  = "application/json"
+	envelopePayloadBytes = "application/octet-stream"
+)
+
+// EnvelopeCodec encodes and decodes post2post.EncodingProtobuf bodies as
+// post2postpb.Envelope messages. It is registered when this package is
+// imported, so receivers of protobuf posts need no gRPC service of their
+// own:
+//
+//	import _ "github.com/pgdad/post2post/grpctransport"
+type EnvelopeCodec struct{}
+
+var _ post2post.Codec = EnvelopeCodec{}
+
+// Name returns "protobuf"
+func (EnvelopeCodec) Name() string {
+	return "protobuf"
+}
+
+// MediaTypes returns application/x-protobuf and application/protobuf
+func (EnvelopeCodec) MediaTypes() []string {
+	return []string{"application/x-protobuf", "application/protobuf"}
+}
+
+// Marshal encodes v as an envelope
+func (EnvelopeCodec) Marshal(v interface{}) ([]byte, error) {
+	return marshalEnvelope(v)
+}
+
+// Unmarshal decodes an envelope into v
+func (EnvelopeCodec) Unmarshal(data []byte, v interface{}) error {
+	return unmarshalEnvelope(data, v)
+}
+
+// marshalEnvelope encodes a post or callback body, a struct with JSON field
+// names such as PostData or a map of them, as a post2postpb.Envelope. A
+// []byte payload is carried as is, any other as JSON.
+func marshalEnvelope(v interface{}) ([]byte, error) {
+	fields, err := envelopeFields(v)
+	if err != nil {
+		return nil, err
+	}
+	text := func(name string) string {
+		s, _ := fields[name].(string)
+		return s
+	}
+
+	envelope := &post2postpb.Envelope{
+		Url:          text("url"),
+		RequestId:    text("request_id"),
+		TailnetKey:   text("tailnet_key"),
+		ResponseMode: text("response_mode"),
+		Error:        text("error"),
+		Traceparent:  text("traceparent"),
+		Tracestate:   text("tracestate"),
+	}
+	if baggage, ok := fields["baggage"].(map[string]string); ok {
+		envelope.Baggage = baggage
+	}
+	switch payload := fields["payload"].(type) {
+	case nil:
+	case []byte:
+		envelope.Payload = payload
+		envelope.PayloadType = envelopePayloadBytes
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %w", err)
+		}
+		envelope.Payload = data
+		envelope.PayloadType = envelopePayloadJSON
+	}
+	return proto.Marshal(envelope)
+}
+
+// unmarshalEnvelope decodes a post2postpb.Envelope into the fields of v, a
+// pointer to a struct, by their JSON names. A JSON payload is decoded as by
+// json.Unmarshal, and payloads of other types are []byte.
+func unmarshalEnvelope(data []byte, v interface{}) error {
+	var envelope post2postpb.Envelope
+	if err := proto.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	var payload interface{}
+	switch {
+	case envelope.GetPayloadType() == envelopePayloadJSON:
+		if err := json.Unmarshal(envelope.GetPayload(), &payload); err != nil {
+			return fmt.Errorf("failed to decode payload: %w", err)
+		}
+	case len(envelope.GetPayload()) > 0:
+		payload = envelope.GetPayload()
+	}
+	values := map[string]interface{}{
+		"url":           envelope.GetUrl(),
+		"request_id":    envelope.GetRequestId(),
+		"tailnet_key":   envelope.GetTailnetKey(),
+		"response_mode": envelope.GetResponseMode(),
+		"error":         envelope.GetError(),
+		"traceparent":   envelope.GetTraceparent(),
+		"tracestate":    envelope.GetTracestate(),
+		"payload":       payload,
+	}
+	if baggage := envelope.GetBaggage(); len(baggage) > 0 {
+		values["baggage"] = baggage
+	}
+
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode an envelope into %T", v)
+	}
+	target = target.Elem()
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		value, ok := values[jsonFieldName(field)]
+		if !ok || value == nil || !field.IsExported() {
+			continue
+		}
+		if rv := reflect.ValueOf(value); rv.Type().AssignableTo(field.Type) {
+			target.Field(i).Set(rv)
+		}
+	}
+	return nil
+}
+
+// envelopeFields returns the fields of a body to encode by their JSON names
+func envelopeFields(v interface{}) (map[string]interface{}, error) {
+	if fields, ok := v.(map[string]interface{}); ok {
+		return fields, nil
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot encode %T as an envelope", v)
+	}
+	fields := make(map[string]interface{})
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if name := jsonFieldName(field); name != "" && field.IsExported() {
+			fields[name] = rv.Field(i).Interface()
+		}
+	}
+	return fields, nil
+}
+
+// jsonFieldName returns the JSON name of a struct field, "" if it has none
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
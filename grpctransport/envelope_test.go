@@ -0,0 +1,95 @@
+package grpctransport
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pgdad/post2post"
+	"github.com/pgdad/post2post/grpctransport/post2postpb"
+)
+
+func TestEnvelopeCodec(t *testing.T) {
+	// Without a processor the receiver echoes payloads back
+	receiver := post2post.NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the envelope on its way to the receiver
+	target, _ := url.Parse(receiver.GetURL())
+	forward := httputil.NewSingleHostReverseProxy(target)
+	envelopes := make(chan *post2postpb.Envelope, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var envelope post2postpb.Envelope
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || proto.Unmarshal(body, &envelope) != nil {
+			envelopes <- nil
+		} else {
+			envelopes <- &envelope
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	sender := post2post.NewServer().WithInterface("127.0.0.1").WithEncoding(post2post.EncodingProtobuf)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	// Bytes are carried as is
+	binary := []byte{0x00, 0xff, 0x10}
+	response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", binary, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if data, ok := response.Payload.([]byte); !response.Success || !ok || !bytes.Equal(data, binary) {
+		t.Errorf("RoundTripPostToURL() = %+v, want the original bytes", response)
+	}
+	envelope := <-envelopes
+	if envelope == nil || envelope.GetPayloadType() != "application/octet-stream" || envelope.GetRequestId() != response.RequestID || !strings.HasSuffix(envelope.GetUrl(), "/roundtrip") {
+		t.Errorf("envelope = %v, want the bytes payload, request ID and callback URL", envelope)
+	}
+
+	// Other payloads as JSON
+	response, err = sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if payload, ok := response.Payload.(map[string]interface{}); !response.Success || !ok || payload["message"] != "hello" {
+		t.Errorf("RoundTripPostToURL() = %+v, want the original message", response)
+	}
+	if envelope := <-envelopes; envelope == nil || envelope.GetPayloadType() != "application/json" {
+		t.Errorf("envelope = %v, want a JSON payload", envelope)
+	}
+
+	// The trace context travels in the envelope's fields
+	trace := post2post.TraceContext{
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:  "vendor=value",
+		Baggage:     map[string]string{"tenant": "acme"},
+	}
+	tracedSender := post2post.NewServer().WithInterface("127.0.0.1").WithPostURL(proxy.URL + "/webhook").WithEncoding(post2post.EncodingProtobuf)
+	if err := tracedSender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer tracedSender.Stop()
+	if response, err := tracedSender.RoundTripPostWithTrace("hello", "", 5*time.Second, trace); err != nil || !response.Success {
+		t.Fatalf("RoundTripPostWithTrace() = %+v, %v", response, err)
+	}
+	envelope = <-envelopes
+	if envelope == nil || envelope.GetTraceparent() != trace.TraceParent || envelope.GetTracestate() != trace.TraceState || envelope.GetBaggage()["tenant"] != "acme" {
+		t.Errorf("envelope = %v, want the trace context", envelope)
+	}
+}
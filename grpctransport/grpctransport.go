@@ -0,0 +1,289 @@
+// Package grpctransport performs the round trips of post2post over gRPC, and
+// registers post2post.EncodingProtobuf for protobuf envelopes over HTTP
+package grpctransport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/pgdad/post2post"
+	"github.com/pgdad/post2post/grpctransport/post2postpb"
+)
+
+// Transport performs round trips with a receiver serving the Post2Post
+// gRPC service (proto/post2post/v1/post2post.proto) instead of posting JSON
+// and waiting for a callback. The receiver answers on the call itself, so
+// neither a running Server nor a callback URL is needed, and the context's
+// deadline bounds the round trip on both ends.
+type Transport struct {
+	client post2postpb.Post2PostClient
+	feed   post2post.ResponseFeed
+}
+
+var _ post2post.Transport = (*Transport)(nil)
+
+// New returns a transport using conn, e.g. a *grpc.ClientConn dialed
+// through a tsnet node's Dial for receivers on the tailnet
+func New(conn grpc.ClientConnInterface) *Transport {
+	return &Transport{client: post2postpb.NewPost2PostClient(conn)}
+}
+
+// RoundTrip posts payload and waits for its response until ctx is done. Like
+// RoundTripPost, failures are reported in the response rather than as an
+// error, with Timeout set when the deadline passed. The error is only for
+// payloads that cannot be encoded.
+func (t *Transport) RoundTrip(ctx context.Context, payload interface{}, tailnetKey string) (*post2post.RoundTripResponse, error) {
+	data, err := newPostData(payload, tailnetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.client.RoundTrip(ctx, data)
+	if err != nil {
+		return errorResponse(data.RequestId, err), nil
+	}
+	return fromResponse(response), nil
+}
+
+// Send posts post for a server using the transport. The response to a round
+// trip post is delivered to the server, while posts that are not round
+// trips fail if their processing does.
+func (t *Transport) Send(ctx context.Context, post *post2post.Post) error {
+	value, err := toProtoValue(post.Data.Payload)
+	if err != nil {
+		return err
+	}
+	data := &post2postpb.PostData{
+		Payload:     value,
+		RequestId:   post.Data.RequestID,
+		TailnetKey:  post.Data.TailnetKey,
+		Traceparent: post.Data.TraceParent,
+		Tracestate:  post.Data.TraceState,
+		Baggage:     post.Data.Baggage,
+	}
+
+	response, err := t.client.RoundTrip(ctx, data)
+	if err != nil {
+		return fmt.Errorf("failed to post: %w", err)
+	}
+	if !post.RoundTrip {
+		if response.GetError() != "" {
+			return errors.New(response.GetError())
+		}
+		return nil
+	}
+	if !t.feed.Deliver(fromResponse(response)) {
+		return errors.New("no server receives the responses of the transport")
+	}
+	return nil
+}
+
+// ReceiveResponses delivers the responses to round trip posts sent with
+// Send, as the receiver answers them on the call
+func (t *Transport) ReceiveResponses(ctx context.Context) (<-chan *post2post.RoundTripResponse, error) {
+	return t.feed.Start(ctx), nil
+}
+
+// Stream opens a bidirectional stream for many round trips over one call.
+// Responses carry the request ID returned by Send and may arrive in any
+// order. Cancelling ctx ends the stream.
+func (t *Transport) Stream(ctx context.Context) (*Stream, error) {
+	stream, err := t.client.Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return &Stream{stream: stream}, nil
+}
+
+// Stream is a bidirectional stream of posts and their responses. Send and
+// Recv may be called from different goroutines, but neither from several at
+// once.
+type Stream struct {
+	stream post2postpb.Post2Post_StreamClient
+}
+
+// Send posts payload and returns its request ID
+func (s *Stream) Send(payload interface{}, tailnetKey string) (string, error) {
+	data, err := newPostData(payload, tailnetKey)
+	if err != nil {
+		return "", err
+	}
+	if err := s.stream.Send(data); err != nil {
+		return "", fmt.Errorf("failed to send post: %w", err)
+	}
+	return data.RequestId, nil
+}
+
+// Recv returns the next response, or io.EOF once the receiver has answered
+// every post after CloseSend
+func (s *Stream) Recv() (*post2post.RoundTripResponse, error) {
+	response, err := s.stream.Recv()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to receive response: %w", err)
+	}
+	return fromResponse(response), nil
+}
+
+// CloseSend tells the receiver that no more posts follow
+func (s *Stream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+// service serves the Post2Post gRPC service with a payload processor
+type service struct {
+	post2postpb.UnimplementedPost2PostServer
+	processor post2post.PayloadProcessor
+}
+
+// RegisterService registers the Post2Post gRPC service on registrar,
+// e.g. a *grpc.Server of a receiver that already speaks gRPC. Posts are
+// processed by processor as posts to /webhook are, or echoed back if it is
+// nil, and the result is returned on the call. A processing error fails
+// only that round trip.
+func RegisterService(registrar grpc.ServiceRegistrar, processor post2post.PayloadProcessor) {
+	post2postpb.RegisterPost2PostServer(registrar, &service{processor: processor})
+}
+
+// RoundTrip processes one post
+func (g *service) RoundTrip(ctx context.Context, data *post2postpb.PostData) (*post2postpb.RoundTripResponse, error) {
+	return g.process(data), nil
+}
+
+// Stream processes each post of the stream concurrently and sends the
+// responses as they are ready
+func (g *service) Stream(stream post2postpb.Post2Post_StreamServer) error {
+	var wg sync.WaitGroup
+	var sendMu sync.Mutex
+	var sendErr error
+	defer wg.Wait()
+
+	for {
+		data, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			wg.Wait()
+			return sendErr
+		}
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := g.process(data)
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if err := stream.Send(response); err != nil && sendErr == nil {
+				sendErr = err
+			}
+		}()
+	}
+}
+
+// process runs the processor on a post
+func (g *service) process(data *post2postpb.PostData) *post2postpb.RoundTripResponse {
+	requestData := post2post.PostData{
+		URL:         data.GetUrl(),
+		Payload:     fromProtoValue(data.GetPayload()),
+		RequestID:   data.GetRequestId(),
+		TailnetKey:  data.GetTailnetKey(),
+		TraceParent: data.GetTraceparent(),
+		TraceState:  data.GetTracestate(),
+		Baggage:     data.GetBaggage(),
+	}
+	callback := post2post.ProcessPost(g.processor, requestData)
+	response := &post2postpb.RoundTripResponse{
+		RequestId:   callback.RequestID,
+		Traceparent: callback.TraceParent,
+		Tracestate:  callback.TraceState,
+		Baggage:     callback.Baggage,
+	}
+	if callback.Error != "" {
+		response.Error = callback.Error
+		return response
+	}
+
+	payload, err := toProtoValue(callback.Payload)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	response.Payload = payload
+	response.Success = true
+	return response
+}
+
+// newPostData returns the message posting payload in a new trace, with the
+// request ID taken from the payload or generated as for HTTP round trips
+func newPostData(payload interface{}, tailnetKey string) (*post2postpb.PostData, error) {
+	value, err := toProtoValue(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &post2postpb.PostData{
+		Payload:     value,
+		RequestId:   post2post.PayloadRequestID(payload),
+		TailnetKey:  tailnetKey,
+		Traceparent: post2post.NewTraceContext().TraceParent,
+	}, nil
+}
+
+// fromResponse converts a gRPC response to a RoundTripResponse
+func fromResponse(response *post2postpb.RoundTripResponse) *post2post.RoundTripResponse {
+	converted := &post2post.RoundTripResponse{
+		Payload:     fromProtoValue(response.GetPayload()),
+		Success:     response.GetSuccess(),
+		Error:       response.GetError(),
+		Timeout:     response.GetTimeout(),
+		RequestID:   response.GetRequestId(),
+		StatusCode:  int(response.GetStatusCode()),
+		TraceParent: response.GetTraceparent(),
+		TraceState:  response.GetTracestate(),
+		Baggage:     response.GetBaggage(),
+	}
+	return converted.SetErr()
+}
+
+// errorResponse describes a failed gRPC call
+func errorResponse(requestID string, err error) *post2post.RoundTripResponse {
+	code := status.Code(err)
+	if code == codes.DeadlineExceeded {
+		return post2post.FailedResponse(requestID, post2post.ErrRoundTripTimeout)
+	}
+	return post2post.FailedResponse(requestID, fmt.Errorf("gRPC round trip failed: %w", err))
+}
+
+// toProtoValue converts a JSON-encodable payload to a protobuf Value
+func toProtoValue(payload interface{}) (*structpb.Value, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	value := &structpb.Value{}
+	if err := protojson.Unmarshal(data, value); err != nil {
+		return nil, fmt.Errorf("failed to convert payload: %w", err)
+	}
+	return value, nil
+}
+
+// fromProtoValue converts a protobuf Value to the payload JSON decoding
+// would produce
+func fromProtoValue(value *structpb.Value) interface{} {
+	if value == nil {
+		return nil
+	}
+	return value.AsInterface()
+}
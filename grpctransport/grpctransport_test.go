@@ -0,0 +1,218 @@
+package grpctransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pgdad/post2post"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// processorFunc adapts a function to post2post.PayloadProcessor
+type processorFunc func(payload interface{}, requestID string) (interface{}, error)
+
+func (f processorFunc) Process(payload interface{}, requestID string) (interface{}, error) {
+	return f(payload, requestID)
+}
+
+// traceProcessor records the trace context of each post it processes
+type traceProcessor struct {
+	traces chan post2post.TraceContext
+}
+
+func (p *traceProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return nil, errors.New("no context")
+}
+
+func (p *traceProcessor) ProcessWithContext(payload interface{}, context post2post.ProcessorContext) (interface{}, error) {
+	p.traces <- context.Trace
+	return payload, nil
+}
+
+// newTestTransport serves the gRPC service with processor over an
+// in-memory connection
+func newTestTransport(t *testing.T, processor post2post.PayloadProcessor) *Transport {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterService(server, processor)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient() failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return New(conn)
+}
+
+func TestTransport_RoundTrip(t *testing.T) {
+	transport := newTestTransport(t, processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		fields := payload.(map[string]interface{})
+		switch fields["action"] {
+		case "fail":
+			return nil, errors.New("bad action")
+		case "sleep":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return map[string]interface{}{"request_id": requestID, "echo": fields["value"]}, nil
+	}))
+
+	payload := struct {
+		RequestID string `json:"request_id"`
+		Action    string `json:"action"`
+		Value     int    `json:"value"`
+	}{RequestID: "req-1", Action: "echo", Value: 42}
+	response, err := transport.RoundTrip(context.Background(), payload, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Success || response.RequestID != "req-1" {
+		t.Fatalf("RoundTrip() = %+v, want success for req-1", response)
+	}
+	result := response.Payload.(map[string]interface{})
+	if result["echo"] != float64(42) || result["request_id"] != "req-1" {
+		t.Errorf("RoundTrip() payload = %v", result)
+	}
+
+	// A processing error fails the round trip, not the call
+	response, err = transport.RoundTrip(context.Background(), map[string]interface{}{"action": "fail"}, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad action" || response.RequestID == "" {
+		t.Errorf("RoundTrip() = %+v, want a processing error", response)
+	}
+
+	// The deadline bounds the round trip
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	response, err = transport.RoundTrip(ctx, map[string]interface{}{"action": "sleep"}, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || !response.Timeout {
+		t.Errorf("RoundTrip() = %+v, want a timeout", response)
+	}
+
+	if _, err := transport.RoundTrip(context.Background(), make(chan int), ""); err == nil {
+		t.Error("RoundTrip() succeeded with a payload that cannot be encoded")
+	}
+}
+
+func TestTransport_Stream(t *testing.T) {
+	transport := newTestTransport(t, processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		// The first post finishes last
+		if payload.(map[string]interface{})["slow"] == true {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return requestID, nil
+	}))
+
+	stream, err := transport.Stream(context.Background())
+	if err != nil {
+		t.Fatalf("Stream() failed: %v", err)
+	}
+	var sent []string
+	for _, slow := range []bool{true, false, false} {
+		requestID, err := stream.Send(map[string]interface{}{"slow": slow}, "")
+		if err != nil {
+			t.Fatalf("Send() failed: %v", err)
+		}
+		sent = append(sent, requestID)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend() failed: %v", err)
+	}
+
+	var received []string
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv() failed: %v", err)
+		}
+		if !response.Success || response.Payload != response.RequestID {
+			t.Errorf("Recv() = %+v, want the request ID echoed", response)
+		}
+		received = append(received, response.RequestID)
+	}
+	if len(received) != len(sent) {
+		t.Fatalf("received %d responses, want %d", len(received), len(sent))
+	}
+	if received[len(received)-1] != sent[0] {
+		t.Errorf("responses arrived in order %v, want the slow post %s last", received, sent[0])
+	}
+}
+
+func TestTransport_Trace(t *testing.T) {
+	processor := &traceProcessor{traces: make(chan post2post.TraceContext, 1)}
+	transport := newTestTransport(t, processor)
+
+	response, err := transport.RoundTrip(context.Background(), "hello", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	processed := <-processor.traces
+	if !processed.Valid() || !reflect.DeepEqual(response.Trace(), processed) {
+		t.Errorf("response trace = %+v, want the processor's %+v", response.Trace(), processed)
+	}
+}
+
+func TestTransport_Server(t *testing.T) {
+	transport := newTestTransport(t, processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		if payload == "fail" {
+			return nil, errors.New("bad payload")
+		}
+		return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+	}))
+
+	// No post URL is needed
+	server := post2post.NewServer().WithInterface("127.0.0.1").WithTransport(transport)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	response, err := server.RoundTripPostWithTimeout(map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, want success", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	response, err = server.RoundTripPostWithTimeout("fail", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad payload" {
+		t.Errorf("RoundTripPost() = %+v, want a processing error", response)
+	}
+
+	// Posts that are not round trips fail with their processing
+	if err := server.PostJSON(map[string]interface{}{"message": "hello"}); err != nil {
+		t.Errorf("PostJSON() failed: %v", err)
+	}
+	if err := server.PostJSON("fail"); err == nil {
+		t.Error("PostJSON() of a failing post succeeded")
+	}
+}
@@ -0,0 +1,208 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// keyExpiryWarning is how far ahead of node key expiry the health checker
+// starts reporting the key as expiring soon
+const keyExpiryWarning = 72 * time.Hour
+
+// TailscaleState is a snapshot of the node's Tailscale connectivity
+type TailscaleState struct {
+	Healthy         bool      `json:"healthy"`
+	Connected       bool      `json:"connected"`      // Self node present and backend running
+	DERPReachable   bool      `json:"derp_reachable"` // A home DERP region is selected
+	KeyExpiry       time.Time `json:"key_expiry,omitempty"`
+	KeyExpiringSoon bool      `json:"key_expiring_soon"`
+	Problems        []string  `json:"problems,omitempty"`
+	CheckedAt       time.Time `json:"checked_at"`
+}
+
+// statusFunc fetches the current Tailscale status
+type statusFunc func(ctx context.Context) (*ipnstate.Status, error)
+
+// WithTailscaleHealthCheck enables a background checker that polls the
+// Tailscale status (embedded tsnet node or host tailscaled) at the given
+// interval. The latest state is reported by GetTailscaleState and the /ready
+// endpoint, and changes are delivered to the OnTailscaleStateChange hook.
+func (s *Server) WithTailscaleHealthCheck(interval time.Duration) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.healthInterval = interval
+	return s
+}
+
+// OnTailscaleStateChange registers a hook called whenever the health checker
+// observes a change in Tailscale connectivity
+func (s *Server) OnTailscaleStateChange(hook func(state TailscaleState)) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailscaleHook = hook
+	return s
+}
+
+// GetTailscaleState returns the most recent Tailscale state observed by the
+// health checker. The zero value is returned before the first check.
+func (s *Server) GetTailscaleState() TailscaleState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailscaleState
+}
+
+// startHealthCheck starts the background health checker if it is enabled.
+// Must be called with s.mu held.
+func (s *Server) startHealthCheck() {
+	if s.healthInterval <= 0 {
+		return
+	}
+
+	status := s.status
+	if status == nil {
+		if s.tsnetServer != nil {
+			lc, err := s.tsnetServer.LocalClient()
+			if err != nil {
+				log.Printf("Tailscale health check disabled: %v", err)
+				return
+			}
+			status = lc.Status
+		} else {
+			status = (&tailscale.LocalClient{}).Status
+		}
+	}
+
+	stop := make(chan struct{})
+	s.healthStop = stop
+	interval := s.healthInterval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			s.checkTailscaleHealth(status)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopHealthCheck stops the background health checker, if running.
+// Must be called with s.mu held.
+func (s *Server) stopHealthCheck() {
+	if s.healthStop != nil {
+		close(s.healthStop)
+		s.healthStop = nil
+	}
+}
+
+// checkTailscaleHealth fetches the status once, records the resulting state
+// and calls the state change hook if anything changed
+func (s *Server) checkTailscaleHealth(status statusFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	st, err := status(ctx)
+	state := evaluateTailscaleStatus(st, err, time.Now())
+
+	s.mu.Lock()
+	previous := s.tailscaleState
+	s.tailscaleState = state
+	hook := s.tailscaleHook
+	s.mu.Unlock()
+
+	if previous.CheckedAt.IsZero() || previous.changed(state) {
+		if !state.Healthy {
+			log.Printf("Tailscale unhealthy: %s", strings.Join(state.Problems, "; "))
+		}
+		if hook != nil {
+			hook(state)
+		}
+	}
+}
+
+// changed reports whether the health-relevant fields differ between states
+func (t TailscaleState) changed(other TailscaleState) bool {
+	return t.Healthy != other.Healthy ||
+		t.Connected != other.Connected ||
+		t.DERPReachable != other.DERPReachable ||
+		t.KeyExpiringSoon != other.KeyExpiringSoon ||
+		strings.Join(t.Problems, "\n") != strings.Join(other.Problems, "\n")
+}
+
+// evaluateTailscaleStatus derives a TailscaleState from a status snapshot
+func evaluateTailscaleStatus(status *ipnstate.Status, err error, now time.Time) TailscaleState {
+	state := TailscaleState{CheckedAt: now}
+
+	if err != nil {
+		state.Problems = append(state.Problems, fmt.Sprintf("failed to get Tailscale status: %v", err))
+		return state
+	}
+
+	if status.BackendState != "Running" {
+		state.Problems = append(state.Problems, fmt.Sprintf("Tailscale backend state is %s", status.BackendState))
+	}
+
+	if status.Self == nil {
+		state.Problems = append(state.Problems, "no self node found")
+	} else {
+		state.Connected = status.BackendState == "Running"
+		state.DERPReachable = status.Self.Relay != ""
+		if !state.DERPReachable {
+			state.Problems = append(state.Problems, "no DERP region reachable")
+		}
+		if status.Self.KeyExpiry != nil {
+			state.KeyExpiry = *status.Self.KeyExpiry
+			if state.KeyExpiry.Sub(now) < keyExpiryWarning {
+				state.KeyExpiringSoon = true
+				state.Problems = append(state.Problems, fmt.Sprintf("node key expires at %s", state.KeyExpiry.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	state.Problems = append(state.Problems, status.Health...)
+	state.Healthy = state.Connected && state.DERPReachable && !state.KeyExpiringSoon && len(status.Health) == 0
+	return state
+}
+
+// readyHandler reports whether the server is ready to receive callbacks.
+// When the Tailscale health checker is enabled its latest state is included.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	running := s.running
+	checking := s.healthInterval > 0
+	state := s.tailscaleState
+	s.mu.RUnlock()
+
+	ready := running
+	response := map[string]interface{}{}
+
+	if checking {
+		response["tailscale"] = state
+		ready = ready && state.Healthy
+	}
+	response["ready"] = ready
+
+	w.Header().Set("Content-Type", "application/json")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,181 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func healthyStatus(keyExpiry time.Time) *ipnstate.Status {
+	return &ipnstate.Status{
+		BackendState: "Running",
+		Self: &ipnstate.PeerStatus{
+			Online:    true,
+			Relay:     "nyc",
+			KeyExpiry: &keyExpiry,
+		},
+	}
+}
+
+func TestEvaluateTailscaleStatus(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		status        *ipnstate.Status
+		err           error
+		wantHealthy   bool
+		wantConnected bool
+		wantExpiring  bool
+	}{
+		{
+			name:          "healthy node",
+			status:        healthyStatus(now.Add(30 * 24 * time.Hour)),
+			wantHealthy:   true,
+			wantConnected: true,
+		},
+		{
+			name:          "key expiring soon",
+			status:        healthyStatus(now.Add(time.Hour)),
+			wantConnected: true,
+			wantExpiring:  true,
+		},
+		{
+			name:   "no self node",
+			status: &ipnstate.Status{BackendState: "NeedsLogin"},
+		},
+		{
+			name: "no DERP region",
+			status: &ipnstate.Status{
+				BackendState: "Running",
+				Self:         &ipnstate.PeerStatus{Online: true},
+			},
+			wantConnected: true,
+		},
+		{
+			name: "health warnings",
+			status: &ipnstate.Status{
+				BackendState: "Running",
+				Self:         &ipnstate.PeerStatus{Online: true, Relay: "nyc"},
+				Health:       []string{"not connected to home DERP region"},
+			},
+			wantConnected: true,
+		},
+		{
+			name: "status error",
+			err:  fmt.Errorf("connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := evaluateTailscaleStatus(tt.status, tt.err, now)
+
+			if state.Healthy != tt.wantHealthy {
+				t.Errorf("Healthy = %v, want %v (problems: %v)", state.Healthy, tt.wantHealthy, state.Problems)
+			}
+			if state.Connected != tt.wantConnected {
+				t.Errorf("Connected = %v, want %v", state.Connected, tt.wantConnected)
+			}
+			if state.KeyExpiringSoon != tt.wantExpiring {
+				t.Errorf("KeyExpiringSoon = %v, want %v", state.KeyExpiringSoon, tt.wantExpiring)
+			}
+			if !state.Healthy && len(state.Problems) == 0 {
+				t.Error("Unhealthy state should report at least one problem")
+			}
+		})
+	}
+}
+
+func TestTailscaleHealthCheck(t *testing.T) {
+	states := make(chan TailscaleState, 10)
+	healthy := true
+
+	server := NewServer().
+		WithTailscaleHealthCheck(10 * time.Millisecond).
+		OnTailscaleStateChange(func(state TailscaleState) {
+			states <- state
+		})
+	server.status = func(ctx context.Context) (*ipnstate.Status, error) {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		if !healthy {
+			return nil, fmt.Errorf("tailscaled not running")
+		}
+		return healthyStatus(time.Now().Add(30 * 24 * time.Hour)), nil
+	}
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	select {
+	case state := <-states:
+		if !state.Healthy {
+			t.Errorf("First state should be healthy, got problems: %v", state.Problems)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnTailscaleStateChange hook was not called")
+	}
+
+	resp, err := http.Get(server.GetURL() + "/ready")
+	if err != nil {
+		t.Fatalf("GET /ready failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /ready status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	server.mu.Lock()
+	healthy = false
+	server.mu.Unlock()
+
+	select {
+	case state := <-states:
+		if state.Healthy {
+			t.Error("State should become unhealthy when status fails")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnTailscaleStateChange hook was not called on change")
+	}
+
+	resp, err = http.Get(server.GetURL() + "/ready")
+	if err != nil {
+		t.Fatalf("GET /ready failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /ready status = %v, want %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body["ready"] != false {
+		t.Errorf("ready = %v, want false", body["ready"])
+	}
+}
+
+func TestReadyWithoutHealthCheck(t *testing.T) {
+	server := NewServer()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	resp, err := http.Get(server.GetURL() + "/ready")
+	if err != nil {
+		t.Fatalf("GET /ready failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /ready status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
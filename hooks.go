@@ -0,0 +1,197 @@
+package post2post
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// PostEvent describes a post sent by the server
+type PostEvent struct {
+	URL       string
+	RequestID string
+	// RoundTrip is set for the posts of round trips
+	RoundTrip bool
+	Trace     TraceContext
+	// Duration is the time spent sending the post
+	Duration time.Duration
+	// Err is the error of a failed post, a *PostStatusError if the receiver
+	// rejected it
+	Err error
+}
+
+// RoundTripEvent describes the end of a round trip
+type RoundTripEvent struct {
+	URL       string
+	RequestID string
+	Started   time.Time
+	// Duration is the time from the start of the round trip to its end
+	Duration time.Duration
+	// Timeout is the timeout of the round trip
+	Timeout time.Duration
+	// Response is the response of the round trip, which reports whether it
+	// succeeded
+	Response *RoundTripResponse
+}
+
+// WebhookEvent describes a post processed by the server as a receiver
+type WebhookEvent struct {
+	RequestID string
+	// CallbackURL is the URL the response is posted back to, "" if none
+	CallbackURL  string
+	ResponseMode string
+	Caller       *CallerIdentity
+	Trace        TraceContext
+	// Duration is the time spent processing the post
+	Duration time.Duration
+	// Err is the processing error
+	Err error
+}
+
+// CallbackEvent describes a callback of the server as a receiver that could
+// not be delivered
+type CallbackEvent struct {
+	URL       string
+	RequestID string
+	// StatusCode is the HTTP status the sender rejected the callback with, 0
+	// if it was not answered
+	StatusCode int
+	Err        error
+}
+
+// Hooks are called on lifecycle events of the server, e.g. to export
+// metrics, alert or audit without wrapping every call site. Hooks run
+// synchronously on the goroutine of the event and must not block.
+type Hooks struct {
+	// OnPostSent is called after each post is sent, or failed to be
+	OnPostSent func(PostEvent)
+	// OnResponseReceived is called when a round trip ends other than by
+	// timing out, with its response
+	OnResponseReceived func(RoundTripEvent)
+	// OnRoundTripTimeout is called when a round trip times out
+	OnRoundTripTimeout func(RoundTripEvent)
+	// OnWebhookProcessed is called after each post to /webhook is processed
+	OnWebhookProcessed func(WebhookEvent)
+	// OnCallbackFailed is called when the response to a post to /webhook
+	// cannot be posted back to the sender
+	OnCallbackFailed func(CallbackEvent)
+}
+
+// WithHooks sets the lifecycle hooks of the server, replacing any set before
+func (s *Server) WithHooks(hooks Hooks) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hooks = hooks
+	return s
+}
+
+// getHooks returns the lifecycle hooks of the server
+func (s *Server) getHooks() Hooks {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hooks
+}
+
+// callServerHook runs hook, if set, without letting a panic break the
+// server
+func callServerHook[E any](name string, hook func(E), event E) {
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Warning: %s hook panicked: %v", name, r)
+		}
+	}()
+	hook(event)
+}
+
+// postSent reports a post of data to postURL started at started
+func (s *Server) postSent(postURL string, data PostData, roundTrip bool, started time.Time, err error) {
+	s.stats.posts.Add(1)
+	if err != nil {
+		s.stats.failedPosts.Add(1)
+	}
+	callServerHook("OnPostSent", s.getHooks().OnPostSent, PostEvent{
+		URL:       postURL,
+		RequestID: data.RequestID,
+		RoundTrip: roundTrip,
+		Trace:     data.trace(),
+		Duration:  time.Since(started),
+		Err:       err,
+	})
+}
+
+// roundTripStarted reports the start of a round trip and returns its start
+// time
+func (s *Server) roundTripStarted() time.Time {
+	s.stats.activeRoundTrips.Add(1)
+	return time.Now()
+}
+
+// roundTripFinished reports the end of a round trip to postURL started at
+// started with response; round trips failing without a response are not
+// reported
+func (s *Server) roundTripFinished(postURL string, started time.Time, timeout time.Duration, response *RoundTripResponse) {
+	s.stats.activeRoundTrips.Add(-1)
+	if response == nil {
+		return
+	}
+	hooks := s.getHooks()
+	event := RoundTripEvent{
+		URL:       postURL,
+		RequestID: response.RequestID,
+		Started:   started,
+		Duration:  time.Since(started),
+		Timeout:   timeout,
+		Response:  response,
+	}
+	s.stats.observeRoundTrip(postURL, event.Duration, response)
+	if response.Timeout {
+		s.stats.timeouts.Add(1)
+		callServerHook("OnRoundTripTimeout", hooks.OnRoundTripTimeout, event)
+		return
+	}
+	s.stats.roundTrips.Add(1)
+	s.stats.roundTripLatency.Add(int64(event.Duration))
+	callServerHook("OnResponseReceived", hooks.OnResponseReceived, event)
+}
+
+// webhookProcessed reports the processing of requestData in context
+func (s *Server) webhookProcessed(requestData PostData, context ProcessorContext, err error) {
+	s.stats.webhooksProcessed.Add(1)
+	if err != nil {
+		s.stats.webhookErrors.Add(1)
+	}
+	callServerHook("OnWebhookProcessed", s.getHooks().OnWebhookProcessed, WebhookEvent{
+		RequestID:    requestData.RequestID,
+		CallbackURL:  requestData.URL,
+		ResponseMode: requestData.ResponseMode,
+		Caller:       context.Caller,
+		Trace:        context.Trace,
+		Duration:     time.Since(context.ReceivedAt),
+		Err:          err,
+	})
+}
+
+// callbackFailed reports a callback to callbackURL that failed with err
+func (s *Server) callbackFailed(callbackURL, requestID string, err error) {
+	s.stats.callbacksFailed.Add(1)
+	event := CallbackEvent{URL: callbackURL, RequestID: requestID, Err: err}
+	var statusErr *PostStatusError
+	if errors.As(err, &statusErr) {
+		event.StatusCode = statusErr.StatusCode
+	}
+	callServerHook("OnCallbackFailed", s.getHooks().OnCallbackFailed, event)
+}
+
+// responseError returns the error of a post answered with resp and err, a
+// *PostStatusError if the receiver rejected it
+func responseError(resp *http.Response, err error) error {
+	if err == nil && resp.StatusCode >= 400 {
+		return &PostStatusError{StatusCode: resp.StatusCode}
+	}
+	return err
+}
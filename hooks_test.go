@@ -0,0 +1,91 @@
+package post2post
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServer_Hooks(t *testing.T) {
+	processed := make(chan WebhookEvent, 1)
+	receiver := NewServer().WithInterface("127.0.0.1").WithHooks(Hooks{
+		OnWebhookProcessed: func(event WebhookEvent) { processed <- event },
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sent := make(chan PostEvent, 1)
+	received := make(chan RoundTripEvent, 1)
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook").WithHooks(Hooks{
+		OnPostSent:         func(event PostEvent) { sent <- event },
+		OnResponseReceived: func(event RoundTripEvent) { received <- event },
+		OnRoundTripTimeout: func(event RoundTripEvent) { t.Errorf("unexpected timeout: %+v", event) },
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, %v, want success", response, err)
+	}
+
+	post := <-sent
+	if post.URL != receiver.GetURL()+"/webhook" || post.RequestID != response.RequestID || !post.RoundTrip || post.Err != nil {
+		t.Errorf("OnPostSent event = %+v, want a sent round trip post", post)
+	}
+	if !post.Trace.Valid() {
+		t.Errorf("OnPostSent trace = %+v, want the post's trace", post.Trace)
+	}
+	webhook := <-processed
+	if webhook.RequestID != response.RequestID || webhook.CallbackURL != sender.GetURL()+"/roundtrip" || webhook.Err != nil {
+		t.Errorf("OnWebhookProcessed event = %+v, want the processed post", webhook)
+	}
+	if webhook.Trace.TraceID() != post.Trace.TraceID() {
+		t.Errorf("OnWebhookProcessed trace = %+v, want a span in trace %s", webhook.Trace, post.Trace.TraceID())
+	}
+	roundTrip := <-received
+	if roundTrip.Response != response || roundTrip.RequestID != response.RequestID || roundTrip.Timeout != 5*time.Second || roundTrip.Duration <= 0 {
+		t.Errorf("OnResponseReceived event = %+v, want the response", roundTrip)
+	}
+}
+
+func TestServer_HooksTimeoutAndCallbackFailure(t *testing.T) {
+	failed := make(chan CallbackEvent, 1)
+	receiver := NewServer().WithInterface("127.0.0.1").WithHooks(Hooks{
+		OnCallbackFailed: func(event CallbackEvent) { failed <- event },
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// The sender rejects the receiver's unsigned callback
+	timedOut := make(chan RoundTripEvent, 1)
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL()+"/webhook").
+		WithWebhookVerification(WebhookSignatureGitHub, "secret").
+		WithHooks(Hooks{
+			OnResponseReceived: func(event RoundTripEvent) { t.Errorf("unexpected response: %+v", event) },
+			OnRoundTripTimeout: func(event RoundTripEvent) { timedOut <- event },
+			// Panicking hooks do not break the server
+			OnPostSent: func(PostEvent) { panic("hook failed") },
+		})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout("hello", "", time.Second)
+	if err != nil || !response.Timeout {
+		t.Fatalf("RoundTripPost() = %+v, %v, want a timeout", response, err)
+	}
+	if event := <-timedOut; event.RequestID != response.RequestID || event.Timeout != time.Second || event.Response != response {
+		t.Errorf("OnRoundTripTimeout event = %+v, want the round trip", event)
+	}
+	event := <-failed
+	if event.URL != sender.GetURL()+"/roundtrip" || event.RequestID != response.RequestID || event.StatusCode != 401 || event.Err == nil {
+		t.Errorf("OnCallbackFailed event = %+v, want a 401 rejection", event)
+	}
+}
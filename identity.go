@@ -0,0 +1,158 @@
+package post2post
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// CallerIdentity describes the authenticated tailnet peer that sent a request
+type CallerIdentity struct {
+	LoginName   string   // Login name of the node owner (e.g. alice@example.com)
+	DisplayName string   // Display name of the node owner
+	NodeName    string   // MagicDNS name of the calling node
+	Tags        []string // ACL tags of the calling node, if any
+	RemoteAddr  string   // Tailscale address the request came from
+}
+
+// HasTag reports whether the calling node bears the given ACL tag
+func (c *CallerIdentity) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// whoIsFunc resolves the tailnet identity behind a remote address
+type whoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// callerIdentityKey is the request context key for the resolved CallerIdentity
+type callerIdentityKey struct{}
+
+// CallerIdentityFromContext returns the tailnet caller identity attached to a
+// request context by the server, if one was resolved
+func CallerIdentityFromContext(ctx context.Context) (*CallerIdentity, bool) {
+	identity, ok := ctx.Value(callerIdentityKey{}).(*CallerIdentity)
+	return identity, ok && identity != nil
+}
+
+// callerIdentityMiddleware resolves the remote peer's tailnet identity with
+// WhoIs and attaches it to the request context. Requests pass through
+// unchanged when the server is not listening on a tailnet.
+func (s *Server) callerIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		whoIs := s.whoIs
+		s.mu.RUnlock()
+
+		serveWithCallerIdentity(whoIs, next, w, r)
+	})
+}
+
+// nodeIdentityMiddleware attaches the remote peer's tailnet identity, as
+// resolved by whoIs, to the request context. It serves the nodes of tailnet
+// identities, whose peers are in their own tailnet.
+func nodeIdentityMiddleware(whoIs whoIsFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWithCallerIdentity(whoIs, next, w, r)
+	})
+}
+
+// serveWithCallerIdentity serves r with next, with the caller identity
+// resolved by whoIs in its context. A nil whoIs serves r unchanged.
+func serveWithCallerIdentity(whoIs whoIsFunc, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if whoIs == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	resp, err := whoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		log.Printf("WhoIs lookup failed for %s: %v", r.RemoteAddr, err)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	identity := newCallerIdentity(resp, r.RemoteAddr)
+	ctx := context.WithValue(r.Context(), callerIdentityKey{}, identity)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// WithAllowedTags restricts the /roundtrip and /webhook endpoints to tailnet
+// peers bearing at least one of the given ACL tags. Callers whose identity
+// cannot be resolved, or who bear none of the tags, receive 403 Forbidden.
+// Callers are resolved by the tsnet node with WithTailnet, and otherwise by
+// the host's tailscaled, which requires it to be running and the server to
+// be reached over its Tailscale addresses.
+func (s *Server) WithAllowedTags(tags ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.allowedTags = append([]string(nil), tags...)
+	return s
+}
+
+// GetAllowedTags returns the ACL tags permitted to call the server
+func (s *Server) GetAllowedTags() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.allowedTags...)
+}
+
+// requireAllowedTags wraps a handler so only callers bearing an allowed tag
+// reach it. All callers are allowed when no tags are configured.
+func (s *Server) requireAllowedTags(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		allowedTags := s.allowedTags
+		s.mu.RUnlock()
+
+		if len(allowedTags) == 0 {
+			next(w, r)
+			return
+		}
+
+		identity, ok := CallerIdentityFromContext(r.Context())
+		if !ok {
+			log.Printf("Rejecting %s request from %s: caller identity unknown", r.URL.Path, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		for _, tag := range allowedTags {
+			if identity.HasTag(tag) {
+				next(w, r)
+				return
+			}
+		}
+
+		log.Printf("Rejecting %s request from %s (%s): tags %v not allowed", r.URL.Path, identity.NodeName, r.RemoteAddr, identity.Tags)
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// newCallerIdentity converts a WhoIs response into a CallerIdentity
+func newCallerIdentity(resp *apitype.WhoIsResponse, remoteAddr string) *CallerIdentity {
+	identity := &CallerIdentity{RemoteAddr: remoteAddr}
+	if resp == nil {
+		return identity
+	}
+
+	if resp.UserProfile != nil {
+		identity.LoginName = resp.UserProfile.LoginName
+		identity.DisplayName = resp.UserProfile.DisplayName
+	}
+
+	if resp.Node != nil {
+		identity.NodeName = strings.TrimSuffix(resp.Node.Name, ".")
+		identity.Tags = append([]string(nil), resp.Node.Tags...)
+	}
+
+	return identity
+}
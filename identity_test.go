@@ -0,0 +1,210 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// fakeWhoIs returns a whoIsFunc that resolves every address to the given node
+func fakeWhoIs(loginName string, tags ...string) whoIsFunc {
+	return func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{
+			Node: &tailcfg.Node{
+				Name: "lambda-receiver.example.ts.net.",
+				Tags: tags,
+			},
+			UserProfile: &tailcfg.UserProfile{
+				LoginName:   loginName,
+				DisplayName: "Test Caller",
+			},
+		}, nil
+	}
+}
+
+// contextCapturingProcessor records the ProcessorContext it was called with
+type contextCapturingProcessor struct {
+	contexts chan ProcessorContext
+}
+
+func (c *contextCapturingProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return payload, nil
+}
+
+func (c *contextCapturingProcessor) ProcessWithContext(payload interface{}, context ProcessorContext) (interface{}, error) {
+	c.contexts <- context
+	return payload, nil
+}
+
+func TestCallerIdentityMiddlewareWithoutTailnet(t *testing.T) {
+	server := NewServer()
+
+	var found bool
+	handler := server.callerIdentityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, found = CallerIdentityFromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook", nil))
+
+	if found {
+		t.Error("No caller identity should be attached when not listening on a tailnet")
+	}
+}
+
+func TestCallerIdentityMiddleware(t *testing.T) {
+	server := NewServer()
+	server.whoIs = fakeWhoIs("tagged-devices", "tag:lambda")
+
+	var identity *CallerIdentity
+	handler := server.callerIdentityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = CallerIdentityFromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook", nil))
+
+	if identity == nil {
+		t.Fatal("Caller identity should be attached to the request context")
+	}
+	if identity.LoginName != "tagged-devices" {
+		t.Errorf("LoginName = %v, want tagged-devices", identity.LoginName)
+	}
+	if identity.NodeName != "lambda-receiver.example.ts.net" {
+		t.Errorf("NodeName = %v, want lambda-receiver.example.ts.net", identity.NodeName)
+	}
+	if !identity.HasTag("tag:lambda") {
+		t.Errorf("Tags = %v, want tag:lambda", identity.Tags)
+	}
+}
+
+func TestWebhookProcessorContextIncludesCaller(t *testing.T) {
+	processor := &contextCapturingProcessor{contexts: make(chan ProcessorContext, 1)}
+	server := NewServer().WithProcessor(processor)
+	server.whoIs = fakeWhoIs("alice@example.com")
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	body, _ := json.Marshal(PostData{Payload: "hello", RequestID: "req-identity"})
+	resp, err := http.Post(server.GetURL()+"/webhook", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case ctx := <-processor.contexts:
+		if ctx.Caller == nil || ctx.Caller.LoginName != "alice@example.com" {
+			t.Errorf("ProcessorContext.Caller = %+v, want alice@example.com", ctx.Caller)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Processor was not called")
+	}
+}
+
+func TestWithAllowedTags(t *testing.T) {
+	server := NewServer().WithAllowedTags("tag:lambda", "tag:ci")
+
+	tags := server.GetAllowedTags()
+	if len(tags) != 2 || tags[0] != "tag:lambda" || tags[1] != "tag:ci" {
+		t.Errorf("GetAllowedTags() = %v, want [tag:lambda tag:ci]", tags)
+	}
+}
+
+func TestAllowedTagsWithoutTailnet(t *testing.T) {
+	// Host mode resolves callers with the local tailscaled when tags are set
+	server := NewServer().WithInterface("127.0.0.1").WithAllowedTags("tag:lambda")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+	server.mu.RLock()
+	whoIs := server.whoIs
+	server.mu.RUnlock()
+	if whoIs == nil {
+		t.Error("whoIs not set for allowed tags without a tailnet")
+	}
+
+	// Callers the host's tailscaled does not know are refused
+	resp, err := http.Get(server.GetURL() + "/roundtrip")
+	if err != nil {
+		t.Fatalf("GET /roundtrip failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /roundtrip status = %v, want %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// Without tags no lookups are made
+	plain := NewServer().WithInterface("127.0.0.1")
+	if err := plain.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer plain.Stop()
+	plain.mu.RLock()
+	defer plain.mu.RUnlock()
+	if plain.whoIs != nil {
+		t.Error("whoIs set without allowed tags")
+	}
+}
+
+func TestAllowedTagsAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		whoIs      whoIsFunc
+		wantStatus int
+	}{
+		{
+			name:       "caller with allowed tag",
+			whoIs:      fakeWhoIs("tagged-devices", "tag:lambda"),
+			wantStatus: http.StatusMethodNotAllowed, // reaches the handler, which rejects GET
+		},
+		{
+			name:       "caller without allowed tag",
+			whoIs:      fakeWhoIs("tagged-devices", "tag:other"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "untagged user node",
+			whoIs:      fakeWhoIs("alice@example.com"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "unknown caller identity",
+			whoIs:      nil,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer().WithAllowedTags("tag:lambda", "tag:ci")
+			server.whoIs = tt.whoIs
+
+			if err := server.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer server.Stop()
+
+			for _, path := range []string{"/roundtrip", "/webhook"} {
+				resp, err := http.Get(server.GetURL() + path)
+				if err != nil {
+					t.Fatalf("GET %s failed: %v", path, err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("GET %s status = %v, want %v", path, resp.StatusCode, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
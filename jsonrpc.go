@@ -0,0 +1,291 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	// JSONRPCProcessingError is the code of processor errors other than a
+	// *JSONRPCError
+	JSONRPCProcessingError = -32000
+)
+
+// JSONRPCError is a JSON-RPC 2.0 error object. Processors serving JSON-RPC
+// methods may return one to choose the code and data of their error.
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+// jsonRPCRequest is a JSON-RPC 2.0 request; a missing ID makes it a
+// notification
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  interface{}     `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonRPCResponse is a JSON-RPC 2.0 response
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// WithJSONRPC serves JSON-RPC 2.0 on /jsonrpc, with each method handled by
+// its processor as posts to /webhook are: the params are the payload and
+// the request ID is the id, and the result is the processed payload.
+// Batches and notifications are supported.
+func (s *Server) WithJSONRPC(methods map[string]PayloadProcessor) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jsonRPCMethods = methods
+	return s
+}
+
+// jsonRPCHandler handles JSON-RPC requests and batches on /jsonrpc
+func (s *Server) jsonRPCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(bodyErrorStatus(err))
+		return
+	}
+
+	var reply interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			reply = jsonRPCErrorResponse(nil, JSONRPCParseError, "Parse error")
+		} else if len(batch) == 0 {
+			reply = jsonRPCErrorResponse(nil, JSONRPCInvalidRequest, "Invalid Request")
+		} else {
+			var responses []*jsonRPCResponse
+			for _, message := range batch {
+				if response := s.handleJSONRPC(r, message); response != nil {
+					responses = append(responses, response)
+				}
+			}
+			if len(responses) > 0 {
+				reply = responses
+			}
+		}
+	} else if response := s.handleJSONRPC(r, body); response != nil {
+		reply = response
+	}
+
+	if reply == nil {
+		// Only notifications
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// handleJSONRPC processes one request, returning nil for notifications
+func (s *Server) handleJSONRPC(r *http.Request, message json.RawMessage) *jsonRPCResponse {
+	var request jsonRPCRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return jsonRPCErrorResponse(nil, JSONRPCParseError, "Parse error")
+		}
+		return jsonRPCErrorResponse(nil, JSONRPCInvalidRequest, "Invalid Request")
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return jsonRPCErrorResponse(request.ID, JSONRPCInvalidRequest, "Invalid Request")
+	}
+
+	s.mu.RLock()
+	processor, ok := s.jsonRPCMethods[request.Method]
+	s.mu.RUnlock()
+
+	var response *jsonRPCResponse
+	if !ok {
+		response = jsonRPCErrorResponse(request.ID, JSONRPCMethodNotFound, "Method not found")
+	} else {
+		caller, _ := CallerIdentityFromContext(r.Context())
+		result, err := processPayload(processor, PostData{
+			Payload:   request.Params,
+			RequestID: jsonRPCRequestID(request.ID),
+		}, caller)
+		var rpcErr *JSONRPCError
+		switch {
+		case errors.As(err, &rpcErr):
+			response = &jsonRPCResponse{JSONRPC: "2.0", Error: rpcErr, ID: request.ID}
+		case err != nil:
+			response = jsonRPCErrorResponse(request.ID, JSONRPCProcessingError, fmt.Sprintf("Processing error: %v", err))
+		default:
+			response = &jsonRPCResponse{JSONRPC: "2.0", Result: result, ID: request.ID}
+			if result == nil {
+				// A result is required on success
+				response.Result = json.RawMessage("null")
+			}
+		}
+	}
+
+	if request.ID == nil {
+		return nil
+	}
+	return response
+}
+
+// jsonRPCErrorResponse returns an error response to the request with id,
+// null if unknown
+func jsonRPCErrorResponse(id json.RawMessage, code int, message string) *jsonRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonRPCResponse{JSONRPC: "2.0", Error: &JSONRPCError{Code: code, Message: message}, ID: id}
+}
+
+// jsonRPCRequestID returns the request ID of a JSON-RPC id: a string id
+// itself, or the JSON of a number id
+func jsonRPCRequestID(id json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(id, &text); err == nil {
+		return text
+	}
+	return string(id)
+}
+
+// JSONRPCTransport performs round trips as JSON-RPC 2.0 calls of one method,
+// e.g. against /jsonrpc of a server or any JSON-RPC service. The result is
+// the response payload, and an error object fails the round trip.
+type JSONRPCTransport struct {
+	url    string
+	method string
+	client *http.Client
+	feed   ResponseFeed
+}
+
+var _ Transport = (*JSONRPCTransport)(nil)
+
+// NewJSONRPCTransport returns a transport calling method at url with client,
+// or http.DefaultClient if nil
+func NewJSONRPCTransport(url, method string, client *http.Client) *JSONRPCTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &JSONRPCTransport{url: url, method: method, client: client}
+}
+
+// RoundTrip calls the method with payload as params and the request ID as
+// id. Like RoundTripPost, failures are reported in the response rather than
+// as an error, with Timeout set when ctx expired. The error is only for
+// payloads that cannot be encoded.
+func (t *JSONRPCTransport) RoundTrip(ctx context.Context, payload interface{}, tailnetKey string) (*RoundTripResponse, error) {
+	return t.call(ctx, payload, PayloadRequestID(payload))
+}
+
+// Send calls the method for a server using the transport. The response to a
+// round trip post is delivered to the server, while posts that are not round
+// trips are sent as notifications.
+func (t *JSONRPCTransport) Send(ctx context.Context, post *Post) error {
+	if !post.RoundTrip {
+		_, err := t.post(ctx, jsonRPCRequest{JSONRPC: "2.0", Method: t.method, Params: post.Data.Payload})
+		return err
+	}
+	response, err := t.call(ctx, post.Data.Payload, post.Data.RequestID)
+	if err != nil {
+		return err
+	}
+	if !t.feed.Deliver(response) {
+		return errors.New("no server receives the responses of the transport")
+	}
+	return nil
+}
+
+// ReceiveResponses delivers the responses to round trip posts sent with
+// Send, as the service answers them on the call
+func (t *JSONRPCTransport) ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error) {
+	return t.feed.Start(ctx), nil
+}
+
+// call calls the method and converts its response
+func (t *JSONRPCTransport) call(ctx context.Context, params interface{}, requestID string) (*RoundTripResponse, error) {
+	id, err := json.Marshal(requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	resp, err := t.post(ctx, jsonRPCRequest{JSONRPC: "2.0", Method: t.method, Params: params, ID: id})
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			return FailedResponse(requestID, ErrRoundTripTimeout), nil
+		case errors.Is(err, errJSONRPCEncoding):
+			return nil, err
+		}
+		return FailedResponse(requestID, err), nil
+	}
+	defer resp.Body.Close()
+
+	var response jsonRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return failedResponsef(requestID, "invalid JSON-RPC response: %w", err), nil
+	}
+	if response.Error != nil {
+		failed := FailedResponse(requestID, &ReceiverError{Message: response.Error.Message})
+		failed.Payload = response.Error.Data
+		return failed, nil
+	}
+	return &RoundTripResponse{Payload: response.Result, Success: true, RequestID: requestID}, nil
+}
+
+// errJSONRPCEncoding marks requests that cannot be encoded
+var errJSONRPCEncoding = errors.New("failed to marshal JSON")
+
+// post posts a request, returning the response of a call to be closed by
+// the caller
+func (t *JSONRPCTransport) post(ctx context.Context, request jsonRPCRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJSONRPCEncoding, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", t.method, err)
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, &PostStatusError{StatusCode: resp.StatusCode}
+	}
+	if request.ID == nil {
+		// Notifications have no response
+		resp.Body.Close()
+		return nil, nil
+	}
+	return resp, nil
+}
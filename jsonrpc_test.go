@@ -0,0 +1,126 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJSONRPCServer(t *testing.T) *Server {
+	t.Helper()
+	server := NewServer().WithInterface("127.0.0.1").WithJSONRPC(map[string]PayloadProcessor{
+		"sum": processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			params, ok := payload.([]interface{})
+			if !ok {
+				return nil, &JSONRPCError{Code: JSONRPCInvalidParams, Message: "Invalid params", Data: payload}
+			}
+			var sum float64
+			for _, param := range params {
+				sum += param.(float64)
+			}
+			return sum, nil
+		}),
+		"fail": processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			return nil, errors.New("bad request " + requestID)
+		}),
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return server
+}
+
+func TestServer_WithJSONRPC(t *testing.T) {
+	server := newTestJSONRPCServer(t)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       string
+	}{
+		{"call", `{"jsonrpc":"2.0","method":"sum","params":[1,2,3],"id":1}`, http.StatusOK,
+			`{"jsonrpc":"2.0","result":6,"id":1}`},
+		{"processing error", `{"jsonrpc":"2.0","method":"fail","id":"r1"}`, http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"Processing error: bad request r1"},"id":"r1"}`},
+		{"processor error object", `{"jsonrpc":"2.0","method":"sum","params":{"a":1},"id":2}`, http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":{"a":1}},"id":2}`},
+		{"unknown method", `{"jsonrpc":"2.0","method":"nope","id":3}`, http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":3}`},
+		{"parse error", `{"jsonrpc":`, http.StatusOK,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"notification", `{"jsonrpc":"2.0","method":"sum","params":[1]}`, http.StatusNoContent, ``},
+		{"batch", `[{"jsonrpc":"2.0","method":"sum","params":[1,1],"id":1},{"jsonrpc":"2.0","method":"sum","params":[1]},{"jsonrpc":"1.0","method":"sum","id":2}]`, http.StatusOK,
+			`[{"jsonrpc":"2.0","result":2,"id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":2}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.GetURL()+"/jsonrpc", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("POST /jsonrpc failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.want == "" {
+				return
+			}
+			var got, want interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			json.Unmarshal([]byte(tt.want), &want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("response = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestJSONRPCTransport(t *testing.T) {
+	server := newTestJSONRPCServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := NewJSONRPCTransport(server.GetURL()+"/jsonrpc", "sum", nil)
+	response, err := transport.RoundTrip(ctx, []int{2, 3}, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Success || response.Payload != float64(5) {
+		t.Errorf("RoundTrip() = %+v, want 5", response)
+	}
+
+	response, err = NewJSONRPCTransport(server.GetURL()+"/jsonrpc", "fail", nil).RoundTrip(ctx, nil, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || !strings.HasPrefix(response.Error, "Processing error: bad request req_") {
+		t.Errorf("RoundTrip() = %+v, want the processing error", response)
+	}
+
+	// A server round trips through the transport
+	sender := NewServer().WithInterface("127.0.0.1").WithTransport(transport)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+	response, err = sender.RoundTripPostWithTimeout([]int{4, 5}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success || response.Payload != float64(9) {
+		t.Errorf("RoundTripPost() = %+v, want 9", response)
+	}
+	if err := sender.PostJSON([]int{1}); err != nil {
+		t.Errorf("PostJSON() failed: %v", err)
+	}
+}
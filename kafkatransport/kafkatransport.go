@@ -0,0 +1,314 @@
+// Package kafkatransport carries the posts and round trip responses of
+// post2post over Kafka topics
+package kafkatransport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/pgdad/post2post"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka headers correlating round trips; the request ID keys the messages
+// too, so the posts and responses of a round trip share a partition
+const (
+	CorrelationHeader = "post2post-correlation-id"
+	ReplyToHeader     = "post2post-reply-to"
+)
+
+// Writer is the part of the Kafka producer API the Kafka transport and
+// service use; a *kafka.Writer without a Topic implements it, as messages
+// name their topic
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Reader is the part of the Kafka consumer API the Kafka transport and
+// service use; *kafka.Reader implements it
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Transport posts to a Kafka request topic and performs round trips over
+// request/reply topics: each post names the reply topic and its correlation
+// ID in headers, and responses consumed from the reply topic are matched by
+// correlation ID.
+type Transport struct {
+	writer       Writer
+	requestTopic string
+	replies      Reader
+	replyTopic   string
+
+	mu      sync.Mutex
+	pending map[string]chan *post2post.RoundTripResponse
+	cancel  context.CancelFunc
+	feed    post2post.ResponseFeed
+}
+
+var _ post2post.Transport = (*Transport)(nil)
+
+// New returns a transport writing posts to requestTopic with writer. Round
+// trips consume their responses from replyTopic with replies, which should
+// read the whole topic, i.e. not share a consumer group with other senders,
+// as responses to other senders are skipped. replies may be nil for a
+// transport that only posts.
+func New(writer Writer, requestTopic string, replies Reader, replyTopic string) *Transport {
+	return &Transport{
+		writer:       writer,
+		requestTopic: requestTopic,
+		replies:      replies,
+		replyTopic:   replyTopic,
+		pending:      make(map[string]chan *post2post.RoundTripResponse),
+	}
+}
+
+// PostJSON writes payload to the request topic without waiting for a
+// response, like PostJSON of a server
+func (t *Transport) PostJSON(ctx context.Context, payload interface{}, tailnetKey string) error {
+	return t.Send(ctx, &post2post.Post{Data: post2post.PostData{
+		Payload:    payload,
+		RequestID:  post2post.PayloadRequestID(payload),
+		TailnetKey: tailnetKey,
+	}})
+}
+
+// Send writes post to the request topic for a server using the transport.
+// Round trip posts name the reply topic in their reply-to header.
+func (t *Transport) Send(ctx context.Context, post *post2post.Post) error {
+	msg, err := newMessage(t.requestTopic, post.Data)
+	if err != nil {
+		return err
+	}
+	if post.RoundTrip {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: ReplyToHeader, Value: []byte(t.replyTopic)})
+	}
+	if err := t.writer.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", t.requestTopic, err)
+	}
+	return nil
+}
+
+// ReceiveResponses consumes the reply topic and delivers the responses no
+// round trip of the transport itself waits for, for a server using the
+// transport
+func (t *Transport) ReceiveResponses(ctx context.Context) (<-chan *post2post.RoundTripResponse, error) {
+	if t.replies == nil {
+		return nil, errors.New("no reply topic is configured")
+	}
+	responses := t.feed.Start(ctx)
+	t.mu.Lock()
+	t.consumeLocked()
+	t.mu.Unlock()
+	return responses, nil
+}
+
+// RoundTrip writes payload to the request topic and waits for its response
+// until ctx is done. Like RoundTripPost, failures are reported in the
+// response rather than as an error, with Timeout set when the deadline
+// passed. The error is only for payloads that cannot be encoded.
+func (t *Transport) RoundTrip(ctx context.Context, payload interface{}, tailnetKey string) (*post2post.RoundTripResponse, error) {
+	requestID := post2post.PayloadRequestID(payload)
+	msg, err := newMessage(t.requestTopic, post2post.PostData{
+		Payload:    payload,
+		RequestID:  requestID,
+		TailnetKey: tailnetKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.replies == nil {
+		return post2post.FailedResponse(requestID, errors.New("no reply topic is configured")), nil
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{Key: ReplyToHeader, Value: []byte(t.replyTopic)})
+
+	responseChan := make(chan *post2post.RoundTripResponse, 1)
+	t.mu.Lock()
+	t.pending[requestID] = responseChan
+	t.consumeLocked()
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, requestID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.writer.WriteMessages(ctx, msg); err != nil {
+		if ctx.Err() != nil {
+			return post2post.FailedResponse(requestID, post2post.ErrRoundTripTimeout), nil
+		}
+		return post2post.FailedResponse(requestID, fmt.Errorf("failed to write request: %w", err)), nil
+	}
+
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-ctx.Done():
+		return post2post.FailedResponse(requestID, post2post.ErrRoundTripTimeout), nil
+	}
+}
+
+// Close stops consuming the reply topic. Round trips still waiting time
+// out. The writer and reader are left open.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+	return nil
+}
+
+// consumeLocked starts consuming the reply topic if not done yet. Must be
+// called with t.mu held.
+func (t *Transport) consumeLocked() {
+	if t.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.cancel = cancel
+		go t.consumeReplies(ctx)
+	}
+}
+
+// consumeReplies hands each response to the round trip waiting for its
+// correlation ID until ctx is done or the reader fails
+func (t *Transport) consumeReplies(ctx context.Context) {
+	for {
+		msg, err := t.replies.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Kafka transport: Failed to read %s: %v", t.replyTopic, err)
+				// Consume again on the next round trip
+				t.mu.Lock()
+				t.cancel = nil
+				t.mu.Unlock()
+			}
+			return
+		}
+		if err := t.replies.CommitMessages(ctx, msg); err != nil {
+			log.Printf("Kafka transport: Failed to commit response: %v", err)
+		}
+
+		var callback post2post.CallbackMessage
+		if err := json.Unmarshal(msg.Value, &callback); err != nil {
+			callback.Error = fmt.Sprintf("invalid response: %v", err)
+		}
+		callback.RequestID = headerValue(msg, CorrelationHeader)
+		response := callback.RoundTripResponse()
+
+		t.mu.Lock()
+		responseChan, ok := t.pending[response.RequestID]
+		t.mu.Unlock()
+		if !ok {
+			// For the server using the transport, or late, or for another
+			// sender reading the topic
+			t.feed.Deliver(response)
+			continue
+		}
+		select {
+		case responseChan <- response:
+		default:
+		}
+	}
+}
+
+// newMessage builds the message posting data to topic
+func newMessage(topic string, data post2post.PostData) (kafka.Message, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return kafka.Message{
+		Topic:   topic,
+		Key:     []byte(data.RequestID),
+		Value:   body,
+		Headers: []kafka.Header{{Key: CorrelationHeader, Value: []byte(data.RequestID)}},
+	}, nil
+}
+
+// headerValue returns the value of a message's header, or "" if it is
+// missing
+func headerValue(msg kafka.Message, key string) string {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Serve consumes posts with reader until ctx is done, processing them
+// with processor as posts to /webhook are, or echoing them back if it is
+// nil. The response to a post with a reply-to header is written with writer
+// to that topic under the post's correlation ID; other posts are fire and
+// forget. A post is committed once handled, so posts of a receiver that dies
+// are consumed again.
+func Serve(ctx context.Context, reader Reader, writer Writer, processor post2post.PayloadProcessor) error {
+	log.Printf("Consuming posts from Kafka")
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read post: %w", err)
+		}
+		if err := handlePost(ctx, writer, msg, processor); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Kafka service: Failed to commit post %s: %v", headerValue(msg, CorrelationHeader), err)
+		}
+	}
+}
+
+// handlePost processes one post and writes its response, if one is
+// expected. The error is only for responses that could not be written.
+func handlePost(ctx context.Context, writer Writer, msg kafka.Message, processor post2post.PayloadProcessor) error {
+	correlationID := headerValue(msg, CorrelationHeader)
+	var requestData post2post.PostData
+	if err := json.Unmarshal(msg.Value, &requestData); err != nil {
+		log.Printf("Kafka service: Skipping invalid post %s: %v", correlationID, err)
+		return nil
+	}
+	if requestData.RequestID == "" {
+		requestData.RequestID = correlationID
+	}
+
+	response := post2post.ProcessPost(processor, requestData)
+
+	replyTo := headerValue(msg, ReplyToHeader)
+	if replyTo == "" {
+		// Nobody waits for the response
+		return nil
+	}
+	if correlationID == "" {
+		correlationID = requestData.RequestID
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		body, _ = json.Marshal(post2post.CallbackMessage{
+			RequestID: requestData.RequestID,
+			Error:     fmt.Sprintf("failed to marshal response: %v", err),
+		})
+	}
+	err = writer.WriteMessages(ctx, kafka.Message{
+		Topic:   replyTo,
+		Key:     []byte(correlationID),
+		Value:   body,
+		Headers: []kafka.Header{{Key: CorrelationHeader, Value: []byte(correlationID)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write response %s to %s: %w", correlationID, replyTo, err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package kafkatransport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pgdad/post2post"
+	"github.com/segmentio/kafka-go"
+)
+
+// processorFunc adapts a function to a payload processor
+type processorFunc func(payload interface{}, requestID string) (interface{}, error)
+
+func (f processorFunc) Process(payload interface{}, requestID string) (interface{}, error) {
+	return f(payload, requestID)
+}
+
+// fakeKafka keeps the messages of each topic in memory
+type fakeKafka struct {
+	mu     sync.Mutex
+	topics map[string]chan kafka.Message
+}
+
+func newFakeKafka() *fakeKafka {
+	return &fakeKafka{topics: make(map[string]chan kafka.Message)}
+}
+
+func (k *fakeKafka) topic(name string) chan kafka.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	topic, ok := k.topics[name]
+	if !ok {
+		topic = make(chan kafka.Message, 16)
+		k.topics[name] = topic
+	}
+	return topic
+}
+
+func (k *fakeKafka) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		k.topic(msg.Topic) <- msg
+	}
+	return nil
+}
+
+// fakeKafkaReader reads one topic of a fakeKafka
+type fakeKafkaReader struct {
+	kafka     *fakeKafka
+	topic     string
+	committed int
+}
+
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-r.kafka.topic(r.topic):
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	r.committed += len(msgs)
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	broker := newFakeKafka()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan interface{}, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, &fakeKafkaReader{kafka: broker, topic: "post2post-requests"}, broker, processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			if payload == "fail" {
+				return nil, errors.New("bad payload")
+			}
+			if payload == "fire and forget" {
+				received <- payload
+			}
+			return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+		}))
+	}()
+
+	transport := New(broker, "post2post-requests", &fakeKafkaReader{kafka: broker, topic: "post2post-replies"}, "post2post-replies")
+	defer transport.Close()
+
+	payload := struct {
+		RequestID string `json:"request_id"`
+		Message   string `json:"message"`
+	}{RequestID: "req-kafka", Message: "hello"}
+	rtCtx, rtCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer rtCancel()
+	response, err := transport.RoundTrip(rtCtx, payload, "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Success || response.RequestID != "req-kafka" {
+		t.Fatalf("RoundTrip() = %+v, want success for req-kafka", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	// A processing error fails the round trip
+	response, err = transport.RoundTrip(rtCtx, "fail", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad payload" {
+		t.Errorf("RoundTrip() = %+v, want a processing error", response)
+	}
+
+	// A post without a reply topic gets no response
+	if err := transport.PostJSON(rtCtx, "fire and forget", ""); err != nil {
+		t.Fatalf("PostJSON() failed: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("post was not processed")
+	}
+	if replies := len(broker.topic("post2post-replies")); replies != 0 {
+		t.Errorf("%d responses were written for a fire and forget post", replies)
+	}
+
+	// Without a receiver the round trip times out
+	lonely := New(broker, "nobody-listens", &fakeKafkaReader{kafka: broker, topic: "lonely-replies"}, "lonely-replies")
+	defer lonely.Close()
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	response, err = lonely.RoundTrip(shortCtx, "hello", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if !response.Timeout {
+		t.Errorf("RoundTrip() = %+v, want a timeout", response)
+	}
+	request := <-broker.topic("nobody-listens")
+	if headerValue(request, ReplyToHeader) != "lonely-replies" || headerValue(request, CorrelationHeader) != response.RequestID {
+		t.Errorf("request headers = %v, want the reply topic and correlation ID", request.Headers)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
+
+func TestTransport_Server(t *testing.T) {
+	broker := newFakeKafka()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Serve(ctx, &fakeKafkaReader{kafka: broker, topic: "post2post-requests"}, broker, processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+	}))
+
+	// No post URL is needed
+	transport := New(broker, "post2post-requests", &fakeKafkaReader{kafka: broker, topic: "post2post-replies"}, "post2post-replies")
+	defer transport.Close()
+	server := post2post.NewServer().WithInterface("127.0.0.1").WithTransport(transport)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	response, err := server.RoundTripPostWithTimeout(map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, want success", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	if err := server.PostJSON(map[string]interface{}{"message": "hello"}); err != nil {
+		t.Errorf("PostJSON() failed: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package post2post
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// orphanGrace is how long past its timeout a round trip may take to clean
+// up before it is reported as orphaned
+const orphanGrace = time.Second
+
+// LeakDetection configures a background monitor of the round trips waiting
+// for their response, catching leaks caused by receivers that never call
+// back or transports that never return
+type LeakDetection struct {
+	// Threshold is the age from which waiting round trips are reported as
+	// stale; zero or negative disables the monitor
+	Threshold time.Duration
+	// Interval is the interval of the checks, Threshold by default
+	Interval time.Duration
+	// Expire ends stale round trips with a *RoundTripExpiredError instead
+	// of only reporting them
+	Expire bool
+	// OnLeak is called with the report of each check finding stale round
+	// trips. It runs on the monitor's goroutine and must not block.
+	OnLeak func(LeakReport)
+}
+
+// LeakReport is the result of a check for stale round trips
+type LeakReport struct {
+	CheckedAt time.Time
+	// Stale are the round trips waiting longer than the threshold, oldest
+	// first
+	Stale []StaleRoundTrip
+	// Orphaned is the number of stale round trips past their timeout,
+	// whose waiting goroutine should have ended them
+	Orphaned int
+	// Expired is the number of stale round trips ended by the check
+	Expired int
+}
+
+// StaleRoundTrip is a round trip waiting longer than the leak detection
+// threshold
+type StaleRoundTrip struct {
+	RequestID string
+	URL       string
+	Started   time.Time
+	Age       time.Duration
+	Timeout   time.Duration
+	// Orphaned is set if the round trip is past its timeout
+	Orphaned bool
+	// Expired is set if the check ended the round trip
+	Expired bool
+}
+
+// RoundTripExpiredError is the error of a round trip ended by leak
+// detection, reported in the Err of its response
+type RoundTripExpiredError struct {
+	RequestID string
+	Age       time.Duration
+}
+
+func (e *RoundTripExpiredError) Error() string {
+	return fmt.Sprintf("round trip %s expired after waiting %s for its response", e.RequestID, e.Age.Round(time.Millisecond))
+}
+
+// WithLeakDetection monitors the round trips waiting for their response
+// while the server is running, reporting those older than the threshold in
+// the log, Stats and the OnLeak hook, and expiring them if configured
+func (s *Server) WithLeakDetection(config LeakDetection) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leakDetection = config
+	return s
+}
+
+// startLeakDetection starts the leak monitor, if configured. Must be called
+// with s.mu held.
+func (s *Server) startLeakDetection() {
+	config := s.leakDetection
+	if config.Threshold <= 0 {
+		return
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = config.Threshold
+	}
+
+	stop := make(chan struct{})
+	s.leakStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.checkRoundTripLeaks(config, now)
+			}
+		}
+	}()
+}
+
+// stopLeakDetection stops the leak monitor, if running. Must be called with
+// s.mu held.
+func (s *Server) stopLeakDetection() {
+	if s.leakStop != nil {
+		close(s.leakStop)
+		s.leakStop = nil
+	}
+}
+
+// checkRoundTripLeaks reports, and expires if configured, the round trips
+// waiting longer than the threshold at now
+func (s *Server) checkRoundTripLeaks(config LeakDetection, now time.Time) LeakReport {
+	report := LeakReport{CheckedAt: now}
+
+	s.mu.Lock()
+	for requestID, pending := range s.roundTripChans {
+		age := now.Sub(pending.started)
+		if age < config.Threshold {
+			continue
+		}
+		stale := StaleRoundTrip{
+			RequestID: requestID,
+			URL:       pending.url,
+			Started:   pending.started,
+			Age:       age,
+			Timeout:   pending.timeout,
+			Orphaned:  age > pending.timeout+orphanGrace,
+		}
+		if stale.Orphaned {
+			report.Orphaned++
+		}
+		if config.Expire {
+			// The channel is open while in the map, and the waiting
+			// goroutine closes it once it returns
+			err := &RoundTripExpiredError{RequestID: requestID, Age: age}
+			select {
+			case pending.responses <- FailedResponse(requestID, err):
+			default:
+			}
+			delete(s.roundTripChans, requestID)
+			stale.Expired = true
+			report.Expired++
+		}
+		report.Stale = append(report.Stale, stale)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(report.Stale, func(i, j int) bool { return report.Stale[i].Started.Before(report.Stale[j].Started) })
+	s.stats.staleRoundTrips.Store(int64(len(report.Stale)))
+	s.stats.orphanedRoundTrips.Store(int64(report.Orphaned))
+	s.stats.expiredRoundTrips.Add(int64(report.Expired))
+
+	if len(report.Stale) > 0 {
+		log.Printf("Warning: %d round trips waiting longer than %s, %d past their timeout, %d expired",
+			len(report.Stale), config.Threshold, report.Orphaned, report.Expired)
+		callServerHook("OnLeak", config.OnLeak, report)
+	}
+	return report
+}
@@ -0,0 +1,122 @@
+package post2post
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUnansweredRoundTrip starts a round trip to a receiver that never
+// calls back, returning the channel of its response once the post was sent
+func startUnansweredRoundTrip(t *testing.T, server *Server, timeout time.Duration) <-chan *RoundTripResponse {
+	t.Helper()
+	received := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	t.Cleanup(receiver.Close)
+
+	done := make(chan *RoundTripResponse, 1)
+	go func() {
+		response, _ := server.RoundTripPostToURL(receiver.URL, "hello", "", timeout)
+		done <- response
+	}()
+	<-received
+	return done
+}
+
+func TestServer_CheckRoundTripLeaks(t *testing.T) {
+	server := NewServer().WithInterface("127.0.0.1")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	done := startUnansweredRoundTrip(t, server, time.Hour)
+	config := LeakDetection{Threshold: time.Minute}
+	now := time.Now()
+
+	if report := server.checkRoundTripLeaks(config, now); len(report.Stale) != 0 {
+		t.Errorf("report = %+v, want no stale round trips yet", report)
+	}
+	report := server.checkRoundTripLeaks(config, now.Add(2*time.Minute))
+	if len(report.Stale) != 1 || report.Orphaned != 0 || report.Expired != 0 {
+		t.Fatalf("report = %+v, want 1 stale round trip", report)
+	}
+	if stale := report.Stale[0]; stale.Timeout != time.Hour || stale.Age < 2*time.Minute || stale.Orphaned || stale.Expired {
+		t.Errorf("stale round trip = %+v, want one waiting for 2 minutes", stale)
+	}
+	if stats := server.Stats(); stats.StaleRoundTrips != 1 || stats.OrphanedRoundTrips != 0 {
+		t.Errorf("Stats() = %+v, want 1 stale round trip", stats)
+	}
+
+	// Past its timeout the round trip should have ended
+	report = server.checkRoundTripLeaks(config, now.Add(2*time.Hour))
+	if len(report.Stale) != 1 || report.Orphaned != 1 || !report.Stale[0].Orphaned {
+		t.Errorf("report = %+v, want 1 orphaned round trip", report)
+	}
+
+	config.Expire = true
+	report = server.checkRoundTripLeaks(config, now.Add(2*time.Minute))
+	if report.Expired != 1 || !report.Stale[0].Expired {
+		t.Errorf("report = %+v, want 1 expired round trip", report)
+	}
+	response := <-done
+	var expired *RoundTripExpiredError
+	if response.Success || response.Timeout || !errors.As(response.Err, &expired) || response.RequestID != report.Stale[0].RequestID {
+		t.Errorf("expired response = %+v, want an expiry error", response)
+	}
+	if stats := server.Stats(); stats.ExpiredRoundTrips != 1 || stats.ActiveRoundTrips != 0 {
+		t.Errorf("Stats() = %+v, want 1 expired round trip", stats)
+	}
+	if report := server.checkRoundTripLeaks(config, now.Add(2*time.Minute)); len(report.Stale) != 0 {
+		t.Errorf("report = %+v after expiry, want no stale round trips", report)
+	}
+}
+
+func TestServer_WithLeakDetection(t *testing.T) {
+	reports := make(chan LeakReport, 1)
+	server := NewServer().WithInterface("127.0.0.1").WithLeakDetection(LeakDetection{
+		Threshold: 50 * time.Millisecond,
+		Interval:  20 * time.Millisecond,
+		Expire:    true,
+		OnLeak: func(report LeakReport) {
+			select {
+			case reports <- report:
+			default:
+			}
+		},
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	done := startUnansweredRoundTrip(t, server, time.Hour)
+	select {
+	case response := <-done:
+		var expired *RoundTripExpiredError
+		if response.Success || !errors.As(response.Err, &expired) || !strings.Contains(response.Error, "expired") {
+			t.Errorf("response = %+v, want an expiry error", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("round trip was not expired")
+	}
+	if report := <-reports; report.Expired != 1 {
+		t.Errorf("OnLeak report = %+v, want 1 expired round trip", report)
+	}
+}
+
+func TestRoundTripExpiredError(t *testing.T) {
+	var err error = &RoundTripExpiredError{RequestID: "req_1", Age: 90 * time.Second}
+	var expired *RoundTripExpiredError
+	if !errors.As(err, &expired) || expired.RequestID != "req_1" {
+		t.Errorf("errors.As(%v) failed", err)
+	}
+	if err.Error() != "round trip req_1 expired after waiting 1m30s for its response" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
@@ -0,0 +1,63 @@
+// Package msgpackencoding registers the MessagePack encoding of post2post,
+// post2post.EncodingMsgpack, when imported:
+//
+//	import _ "github.com/pgdad/post2post/msgpackencoding"
+//
+// It is a module of its own so that only servers using MessagePack depend on
+// the MessagePack library.
+package msgpackencoding
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/pgdad/post2post"
+)
+
+func init() {
+	post2post.RegisterEncoding(post2post.EncodingMsgpack, Codec{})
+}
+
+// Codec encodes and decodes MessagePack bodies. Structs are encoded by the
+// JSON names of their fields, and []byte values as binary.
+type Codec struct{}
+
+var (
+	_ post2post.Codec         = Codec{}
+	_ post2post.BufferEncoder = Codec{}
+)
+
+// Name returns "MessagePack"
+func (Codec) Name() string {
+	return "MessagePack"
+}
+
+// MediaTypes returns application/msgpack, and the application/vnd.msgpack
+// and application/x-msgpack aliases in use
+func (Codec) MediaTypes() []string {
+	return []string{"application/msgpack", "application/vnd.msgpack", "application/x-msgpack"}
+}
+
+// Marshal encodes v as MessagePack
+func (c Codec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode encodes v into buf as Marshal does
+func (Codec) Encode(buf *bytes.Buffer, v interface{}) error {
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// Unmarshal decodes MessagePack into v
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,80 @@
+package msgpackencoding
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pgdad/post2post"
+)
+
+func TestMsgpackEncoding(t *testing.T) {
+	// Without a processor the receiver echoes payloads back
+	receiver := post2post.NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the content type of the post on its way to the receiver
+	target, _ := url.Parse(receiver.GetURL())
+	forward := httputil.NewSingleHostReverseProxy(target)
+	contentTypes := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes <- r.Header.Get("Content-Type")
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	sender := post2post.NewServer().WithInterface("127.0.0.1").WithEncoding(post2post.EncodingMsgpack)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	binary := []byte{0x00, 0xff, 0x10}
+	response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"data": binary}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPostToURL() = %+v, want success", response)
+	}
+	if contentType := <-contentTypes; contentType != "application/msgpack" {
+		t.Errorf("post Content-Type = %s, want application/msgpack", contentType)
+	}
+	echoed, ok := response.Payload.(map[string]interface{})
+	if data, _ := echoed["data"].([]byte); !ok || !bytes.Equal(data, binary) {
+		t.Errorf("response payload = %#v, want the original bytes", response.Payload)
+	}
+}
+
+func TestCodec_Encode(t *testing.T) {
+	post := post2post.PostData{URL: "http://example.com/roundtrip", RequestID: "req-1", Payload: "hello"}
+	want, err := Codec{}.Marshal(post)
+	if err != nil {
+		t.Fatalf("Marshal() failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := (Codec{}).Encode(&buf, post); err != nil || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("Encode() = %x, %v, want %x", buf.Bytes(), err, want)
+	}
+
+	// Fields are named as in JSON
+	var fields map[string]interface{}
+	if err := (Codec{}).Unmarshal(want, &fields); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if fields["request_id"] != "req-1" {
+		t.Errorf("fields = %v, want request_id", fields)
+	}
+	var decoded post2post.PostData
+	if err := (Codec{}).Unmarshal(want, &decoded); err != nil || !reflect.DeepEqual(decoded, post) {
+		t.Errorf("Unmarshal() = %+v, %v, want %+v", decoded, err, post)
+	}
+}
@@ -0,0 +1,380 @@
+package post2post
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// OpenAPISpec returns an OpenAPI 3.0 document in JSON describing the
+// endpoints of the server: /webhook with its callback to the sender's
+// /roundtrip, /roundtrip, /events, /ready, and /jsonrpc with the configured
+// methods. Teams in other languages can implement compatible senders and
+// receivers from it. The server URL is included once the server is running.
+func (s *Server) OpenAPISpec() ([]byte, error) {
+	s.mu.RLock()
+	processor := s.processor
+	var methods []string
+	for method := range s.jsonRPCMethods {
+		methods = append(methods, method)
+	}
+	running := s.running
+	s.mu.RUnlock()
+	sort.Strings(methods)
+
+	processorName := "none, payloads are echoed back"
+	if processor != nil {
+		processorName = fmt.Sprintf("%T", processor)
+	}
+
+	paths := map[string]interface{}{
+		"/webhook": map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "post",
+				"summary":     "Receive a post",
+				"description": "Processes the payload with the configured processor (" + processorName + "). " +
+					"With a url the processed payload is posted back to it asynchronously; with response_mode " +
+					"events it is kept for GET /events, bound to the X-Post2Post-Events-Token header, and with " +
+					"response_mode stream the results are the NDJSON " +
+					"response. Binary attachments are sent as multipart/form-data with the post as JSON in a post part.",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": mergeContent(bodyContent("#/components/schemas/PostData"), map[string]interface{}{
+						"multipart/form-data": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"post": schemaRef("#/components/schemas/PostData"),
+								},
+								"additionalProperties": map[string]interface{}{"type": "string", "format": "binary"},
+								"required":             []string{"post"},
+							},
+							"encoding": map[string]interface{}{
+								"post": map[string]interface{}{"contentType": "application/json"},
+							},
+						},
+					}),
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "The post was processed, or its results follow with response_mode stream",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": schemaRef("#/components/schemas/Acknowledgement"),
+							},
+							ndjsonContentType: map[string]interface{}{
+								"schema": schemaRef("#/components/schemas/StreamLine"),
+							},
+						},
+					},
+					"400": textResponse("The body could not be decoded"),
+					"403": textResponse("The tailnet caller bears none of the allowed tags, or the request_id " +
+						"of a response_mode events post is held with another events token"),
+					"415": textResponse("The Content-Encoding is not supported"),
+					"500": textResponse("Processing error"),
+					"503": textResponse("The callback queue is full; retry after the Retry-After delay"),
+				},
+				"callbacks": map[string]interface{}{
+					"response": map[string]interface{}{
+						"{$request.body#/url}": map[string]interface{}{
+							"post": map[string]interface{}{
+								"summary": "Post the processed payload back to the sender",
+								"requestBody": map[string]interface{}{
+									"required": true,
+									"content":  bodyContent("#/components/schemas/Callback"),
+								},
+								"responses": roundTripResponses(),
+							},
+						},
+					},
+				},
+			},
+		},
+		"/roundtrip": map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "callback",
+				"summary":     "Receive the response to a round trip",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content":  bodyContent("#/components/schemas/Callback"),
+				},
+				"responses": roundTripResponses(),
+			},
+		},
+		"/events": map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "events",
+				"summary":     "Stream the response to a post made with response_mode events",
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":     "request_id",
+						"in":       "query",
+						"required": true,
+						"schema":   map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        EventsTokenHeader,
+						"in":          "header",
+						"required":    true,
+						"description": "The secret sent with the post, binding the request_id to the sender",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "Server-Sent Events: a response event whose data is a RoundTripResponse in JSON, " +
+							"after keep-alive comments",
+						"content": map[string]interface{}{
+							"text/event-stream": map[string]interface{}{
+								"schema": map[string]interface{}{"type": "string"},
+							},
+						},
+					},
+					"400": textResponse("request_id or the events token is missing"),
+					"403": textResponse("request_id is held with another events token"),
+				},
+			},
+		},
+		"/ready": map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "ready",
+				"summary":     "Report whether the server is ready to receive callbacks",
+				"responses": map[string]interface{}{
+					"200": jsonResponse("Ready", "#/components/schemas/Readiness"),
+					"503": jsonResponse("Not ready", "#/components/schemas/Readiness"),
+				},
+			},
+		},
+	}
+
+	schemas := openAPISchemas()
+	if len(methods) > 0 {
+		paths["/jsonrpc"] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "jsonrpc",
+				"summary":     "Call a JSON-RPC 2.0 method, or a batch of calls",
+				"description": "The params are the payload and the id the request ID of the method's processor, " +
+					"and the result the processed payload. Notifications get no response.",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"oneOf": []interface{}{
+									schemaRef("#/components/schemas/JSONRPCRequest"),
+									map[string]interface{}{"type": "array", "items": schemaRef("#/components/schemas/JSONRPCRequest")},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "The responses to the calls",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{
+									"oneOf": []interface{}{
+										schemaRef("#/components/schemas/JSONRPCResponse"),
+										map[string]interface{}{"type": "array", "items": schemaRef("#/components/schemas/JSONRPCResponse")},
+									},
+								},
+							},
+						},
+					},
+					"204": map[string]interface{}{"description": "Only notifications were sent"},
+				},
+			},
+		}
+		request := schemas["JSONRPCRequest"].(map[string]interface{})
+		request["properties"].(map[string]interface{})["method"] = map[string]interface{}{"type": "string", "enum": methods}
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "post2post",
+			"version":     "1",
+			"description": "Posts with payloads, processed by receivers and answered with callbacks to the sender.",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+	if running {
+		spec["servers"] = []interface{}{map[string]interface{}{"url": s.GetURL()}}
+	}
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+// openAPISchemas returns the schemas of the bodies of the endpoints
+func openAPISchemas() map[string]interface{} {
+	anyValue := map[string]interface{}{"description": "Any value"}
+	str := map[string]interface{}{"type": "string"}
+	boolean := map[string]interface{}{"type": "boolean"}
+	traceParent := map[string]interface{}{"type": "string", "description": "W3C traceparent"}
+	baggage := map[string]interface{}{"type": "object", "additionalProperties": str}
+	return map[string]interface{}{
+		"PostData": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"url":           map[string]interface{}{"type": "string", "description": "Callback URL, the sender's /roundtrip"},
+				"payload":       anyValue,
+				"request_id":    str,
+				"tailnet_key":   str,
+				"response_mode": map[string]interface{}{"type": "string", "enum": []string{ResponseModeEvents, ResponseModeStream}},
+				"traceparent":   traceParent,
+				"tracestate":    str,
+				"baggage":       baggage,
+			},
+		},
+		"Callback": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"request_id"},
+			"properties": map[string]interface{}{
+				"request_id":  str,
+				"payload":     anyValue,
+				"tailnet_key": str,
+				"traceparent": traceParent,
+				"tracestate":  str,
+				"baggage":     baggage,
+			},
+		},
+		"RoundTripResponse": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"payload":     anyValue,
+				"success":     boolean,
+				"error":       str,
+				"timeout":     boolean,
+				"request_id":  str,
+				"status_code": map[string]interface{}{"type": "integer"},
+				"traceparent": traceParent,
+				"tracestate":  str,
+				"baggage":     baggage,
+			},
+		},
+		"Acknowledgement": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"status":  str,
+				"message": str,
+			},
+		},
+		"StreamLine": map[string]interface{}{
+			"type":        "object",
+			"description": "A line of an NDJSON response: an intermediate result, or the final result or error",
+			"properties": map[string]interface{}{
+				"request_id": str,
+				"payload":    anyValue,
+				"error":      str,
+				"final":      boolean,
+			},
+		},
+		"Readiness": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"ready"},
+			"properties": map[string]interface{}{
+				"ready":     boolean,
+				"tailscale": map[string]interface{}{"type": "object", "description": "Latest Tailscale health check"},
+			},
+		},
+		"JSONRPCRequest": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"jsonrpc", "method"},
+			"properties": map[string]interface{}{
+				"jsonrpc": map[string]interface{}{"type": "string", "enum": []string{"2.0"}},
+				"method":  str,
+				"params":  anyValue,
+				"id":      map[string]interface{}{"description": "String or number; absent for notifications"},
+			},
+		},
+		"JSONRPCResponse": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"jsonrpc", "id"},
+			"properties": map[string]interface{}{
+				"jsonrpc": map[string]interface{}{"type": "string", "enum": []string{"2.0"}},
+				"result":  anyValue,
+				"error":   schemaRef("#/components/schemas/JSONRPCError"),
+				"id":      map[string]interface{}{"nullable": true},
+			},
+		},
+		"JSONRPCError": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": map[string]interface{}{
+				"code":    map[string]interface{}{"type": "integer"},
+				"message": str,
+				"data":    anyValue,
+			},
+		},
+	}
+}
+
+// bodyContent returns the content of a body in every encoding and as a
+// structured CloudEvent
+func bodyContent(ref string) map[string]interface{} {
+	content := make(map[string]interface{})
+	for _, c := range codecs {
+		content[c.contentType] = map[string]interface{}{"schema": schemaRef(ref)}
+	}
+	content[cloudEventsMediaType] = map[string]interface{}{
+		"schema": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"specversion", "id", "source", "type"},
+			"properties": map[string]interface{}{
+				"specversion":     map[string]interface{}{"type": "string"},
+				"id":              map[string]interface{}{"type": "string"},
+				"source":          map[string]interface{}{"type": "string"},
+				"type":            map[string]interface{}{"type": "string", "enum": []string{CloudEventTypePost, CloudEventTypeResponse}},
+				"datacontenttype": map[string]interface{}{"type": "string"},
+				"data":            schemaRef(ref),
+				"data_base64":     map[string]interface{}{"type": "string", "format": "byte"},
+			},
+		},
+	}
+	return content
+}
+
+// roundTripResponses returns the responses of /roundtrip
+func roundTripResponses() map[string]interface{} {
+	return map[string]interface{}{
+		"200": textResponse("The waiting round trip was completed"),
+		"202": map[string]interface{}{"description": "Forwarded to the instance waiting for it"},
+		"400": textResponse("The body could not be decoded"),
+		"404": map[string]interface{}{"description": "No round trip is waiting for the request ID"},
+		"410": map[string]interface{}{"description": "The round trip already completed"},
+	}
+}
+
+// mergeContent returns the content types of both a and b
+func mergeContent(a, b map[string]interface{}) map[string]interface{} {
+	for contentType, media := range b {
+		a[contentType] = media
+	}
+	return a
+}
+
+// schemaRef returns a reference to a schema
+func schemaRef(ref string) map[string]interface{} {
+	return map[string]interface{}{"$ref": ref}
+}
+
+// textResponse returns a response with a plain text body
+func textResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+// jsonResponse returns a response with a JSON body of the schema ref
+func jsonResponse(description, ref string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaRef(ref)},
+		},
+	}
+}
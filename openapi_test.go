@@ -0,0 +1,80 @@
+package post2post
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestServer_OpenAPISpec(t *testing.T) {
+	data, err := NewServer().OpenAPISpec()
+	if err != nil {
+		t.Fatalf("OpenAPISpec() failed: %v", err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("OpenAPISpec() is not JSON: %v", err)
+	}
+	if spec["openapi"] != "3.0.3" {
+		t.Errorf("openapi = %v, want 3.0.3", spec["openapi"])
+	}
+	paths := spec["paths"].(map[string]interface{})
+	for _, path := range []string{"/webhook", "/roundtrip", "/events", "/ready"} {
+		if paths[path] == nil {
+			t.Errorf("spec lacks %s", path)
+		}
+	}
+	if paths["/jsonrpc"] != nil {
+		t.Error("spec has /jsonrpc without JSON-RPC methods")
+	}
+
+	// References resolve to schemas
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	var checkRefs func(v interface{})
+	checkRefs = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				if schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, value := range v {
+				checkRefs(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				checkRefs(value)
+			}
+		}
+	}
+	checkRefs(spec)
+
+	// JSON-RPC methods are listed, and a running server has its URL
+	server := NewServer().WithInterface("127.0.0.1").WithJSONRPC(map[string]PayloadProcessor{
+		"echo": &EchoProcessor{},
+		"add":  &EchoProcessor{},
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+	data, err = server.OpenAPISpec()
+	if err != nil {
+		t.Fatalf("OpenAPISpec() failed: %v", err)
+	}
+	spec = nil
+	json.Unmarshal(data, &spec)
+	if spec["paths"].(map[string]interface{})["/jsonrpc"] == nil {
+		t.Fatal("spec lacks /jsonrpc")
+	}
+	request := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})["JSONRPCRequest"].(map[string]interface{})
+	methods, _ := json.Marshal(request["properties"].(map[string]interface{})["method"].(map[string]interface{})["enum"])
+	if string(methods) != `["add","echo"]` {
+		t.Errorf("JSON-RPC methods = %s, want [\"add\",\"echo\"]", methods)
+	}
+	servers := spec["servers"].([]interface{})
+	if url := servers[0].(map[string]interface{})["url"]; url != server.GetURL() {
+		t.Errorf("server URL = %v, want %s", url, server.GetURL())
+	}
+}
@@ -1,22 +1,24 @@
 package post2post
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"reflect"
 	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
 )
 
 // Server represents a configurable web server
@@ -30,9 +32,50 @@ type Server struct {
 	running         bool
 	postURL         string
 	client          *http.Client
-	roundTripChans  map[string]chan *RoundTripResponse
+	roundTripChans  map[string]*pendingRoundTrip
 	defaultTimeout  time.Duration
 	processor       PayloadProcessor
+	keyManager      *TailscaleKeyManager
+	tailnet         tailnetConfig
+	tsnetServer     *tsnet.Server
+	tsnetStateDir   string
+	tailnetDNSName  string
+	httpsHost       string
+	funnelServer    *http.Server
+	funnelURL       string
+	whoIs           whoIsFunc
+	allowedTags     []string
+	status          statusFunc
+	healthInterval  time.Duration
+	healthStop      chan struct{}
+	tailscaleState  TailscaleState
+	tailscaleHook   func(TailscaleState)
+	identities      map[string]TailnetIdentity
+	identityRoutes  map[string]string
+	tailnetNodes    map[string]*tailnetNode
+	nodeStarts      singleflight.Group
+	signing         requestSigning
+	responseQueue   *responseQueue
+	events          *eventHub
+	relay           CallbackRelay
+	relayStop       context.CancelFunc
+	eventsURL       string
+	transport       Transport
+	transportStop   context.CancelFunc
+	encoding        Encoding
+	cloudEvents     cloudEventsConfig
+	compression     Compression
+	webhookVerifier *webhookVerifier
+	jsonRPCMethods  map[string]PayloadProcessor
+	hooks           Hooks
+	stats           serverStats
+	debug           debugConfig
+	leakDetection   LeakDetection
+	leakStop        chan struct{}
+	auditSinks      []AuditSink
+	payloadSpill    payloadSpill
+	callbacks       *callbackPool
+	maxDecompressed int64
 }
 
 // PostData represents the JSON payload structure
@@ -41,6 +84,15 @@ type PostData struct {
 	Payload    interface{} `json:"payload"`
 	RequestID  string      `json:"request_id,omitempty"`
 	TailnetKey string      `json:"tailnet_key,omitempty"`
+	// ResponseMode is ResponseModeEvents to collect the response from
+	// GET /events, or ResponseModeStream to receive it on the post itself,
+	// instead of a callback to URL
+	ResponseMode string `json:"response_mode,omitempty"`
+	// TraceParent, TraceState and Baggage carry the W3C Trace Context of
+	// the post, see TraceContext
+	TraceParent string            `json:"traceparent,omitempty"`
+	TraceState  string            `json:"tracestate,omitempty"`
+	Baggage     map[string]string `json:"baggage,omitempty"`
 }
 
 // RoundTripResponse represents the response from a round trip post
@@ -50,6 +102,18 @@ type RoundTripResponse struct {
 	Error     string      `json:"error,omitempty"`
 	Timeout   bool        `json:"timeout"`
 	RequestID string      `json:"request_id,omitempty"`
+	Caller    *CallerIdentity `json:"caller,omitempty"`
+	// StatusCode is the HTTP status of a rejected post, 0 otherwise
+	StatusCode int `json:"status_code,omitempty"`
+	// TraceParent, TraceState and Baggage carry the trace context of the
+	// receiver's span, see Trace
+	TraceParent string            `json:"traceparent,omitempty"`
+	TraceState  string            `json:"tracestate,omitempty"`
+	Baggage     map[string]string `json:"baggage,omitempty"`
+	// Err is the error of a failed round trip, e.g. ErrRoundTripTimeout, a
+	// *PostStatusError or a *ReceiverError, for errors.Is and errors.As.
+	// Error holds its text.
+	Err error `json:"-"`
 }
 
 // PayloadProcessor defines the interface for processing incoming payloads
@@ -63,6 +127,14 @@ type ProcessorContext struct {
 	URL         string
 	TailnetKey  string
 	ReceivedAt  time.Time
+	Caller      *CallerIdentity // Authenticated tailnet caller, nil when not listening on a tailnet
+	Attachments []Attachment    // Binary attachments of a multipart post, readable while processing
+	Trace       TraceContext    // Span of the processing in the post's trace, empty for posts without one
+	// PayloadReader reads the payload as JSON of a post spilled to disk,
+	// see WithPayloadSpill, while processing; nil for other posts
+	PayloadReader io.Reader
+	// PayloadSize is the size of the payload read by PayloadReader
+	PayloadSize int64
 }
 
 // AdvancedPayloadProcessor defines an interface for processors that need access to context
@@ -79,8 +151,11 @@ func NewServer() *Server {
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		roundTripChans: make(map[string]chan *RoundTripResponse),
+		roundTripChans: make(map[string]*pendingRoundTrip),
 		defaultTimeout: 30 * time.Second,
+		tailnet:        tailnetConfig{fallback: FallbackNever},
+		events:         newEventHub(),
+		callbacks:      newCallbackPool(defaultCallbackWorkers, defaultCallbackQueueSize),
 	}
 }
 
@@ -137,25 +212,63 @@ func (s *Server) Start() error {
 	defer s.mu.Unlock()
 	
 	if s.running {
-		return fmt.Errorf("server is already running")
+		return ErrServerRunning
+	}
+	if err := s.checkWebhookSecrets(); err != nil {
+		return err
 	}
 	
-	addr := fmt.Sprintf("%s:%d", s.iface, s.port)
+	var listener net.Listener
+	var err error
+	if s.tailnet.enabled {
+		listener, err = s.listenTailnet()
+		if err != nil {
+			return err
+		}
+	} else {
+		addr := fmt.Sprintf("%s:%d", s.iface, s.port)
+		listener, err = net.Listen(s.network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		if s.tailnet.https {
+			// Peers must dial the name the certificate is issued for
+			host, err := s.tailscaleHTTPSHost(listener.Addr())
+			if err != nil {
+				listener.Close()
+				return fmt.Errorf("failed to serve Tailscale HTTPS: %w", err)
+			}
+			s.httpsHost = host
+			listener = wrapTailscaleTLS(listener)
+		}
+		if len(s.allowedTags) > 0 && s.whoIs == nil {
+			// Resolve callers with the host's tailscaled; those it cannot
+			// resolve, e.g. off the tailnet, are refused
+			s.whoIs = (&tailscale.LocalClient{}).WhoIs
+		}
+	}
 	
-	listener, err := net.Listen(s.network, addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+	if err := s.checkDebugOnServer(listener); err != nil {
+		listener.Close()
+		s.closeTailnet()
+		return err
 	}
 	
 	s.listener = listener
 	
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.defaultHandler)
-	mux.HandleFunc("/roundtrip", s.roundTripHandler)
-	mux.HandleFunc("/webhook", s.webhookHandler)
+	mux.HandleFunc("/roundtrip", s.requireAllowedTags(s.roundTripHandler))
+	mux.HandleFunc("/webhook", s.requireAllowedTags(s.webhookHandler))
+	mux.HandleFunc("/ready", s.readyHandler)
+	mux.HandleFunc("/events", s.requireAllowedTags(s.eventsHandler))
+	mux.HandleFunc("/jsonrpc", s.requireAllowedTags(s.jsonRPCHandler))
+	if s.debug.enabled && s.debug.addr == "" {
+		s.handleDebugEndpoints(mux, s.requireAllowedTags)
+	}
 	
 	s.server = &http.Server{
-		Handler: mux,
+		Handler: s.callerIdentityMiddleware(s.verifyWebhookSignatures(s.decompressRequests(mux))),
 	}
 	
 	// Extract the actual port from the listener
@@ -165,9 +278,31 @@ func (s *Server) Start() error {
 	
 	log.Printf("Server starting on %s network, interface: %s, port: %d", s.network, s.iface, s.port)
 	log.Printf("Server listening on: %s", listener.Addr().String())
-	log.Printf("Server available routes: /, /roundtrip, /webhook")
+	log.Printf("Server available routes: /, /roundtrip, /webhook, /ready, /events, /jsonrpc")
+	
+	if err := s.startCallbackRelay(); err != nil {
+		listener.Close()
+		s.closeTailnet()
+		return err
+	}
+	if err := s.startTransport(); err != nil {
+		s.stopCallbackRelay()
+		listener.Close()
+		s.closeTailnet()
+		return err
+	}
+	if err := s.startDebugListener(); err != nil {
+		s.stopTransport()
+		s.stopCallbackRelay()
+		listener.Close()
+		s.closeTailnet()
+		return err
+	}
 	
 	s.running = true
+	s.startHealthCheck()
+	s.startResponseQueue()
+	s.startLeakDetection()
 	
 	go func() {
 		log.Printf("HTTP server goroutine starting...")
@@ -186,10 +321,16 @@ func (s *Server) Stop() error {
 	defer s.mu.Unlock()
 	
 	if !s.running {
-		return fmt.Errorf("server is not running")
+		return ErrServerNotRunning
 	}
 	
 	s.running = false
+	s.stopHealthCheck()
+	s.stopResponseQueue()
+	s.stopLeakDetection()
+	s.stopCallbackRelay()
+	s.stopTransport()
+	s.stopDebugListener()
 	
 	if s.server != nil {
 		s.server.Close()
@@ -199,6 +340,8 @@ func (s *Server) Stop() error {
 		s.listener.Close()
 	}
 	
+	s.closeTailnet()
+	
 	return nil
 }
 
@@ -243,10 +386,19 @@ func (s *Server) GetURL() string {
 	defer s.mu.RUnlock()
 	
 	scheme := "http"
+	if s.tailnet.https {
+		scheme = "https"
+	}
 	host := s.GetInterface()
 	if host == "localhost" && s.iface == "" {
 		host = "localhost"
 	}
+	if s.httpsHost != "" {
+		host = s.httpsHost
+	}
+	if s.tailnetDNSName != "" {
+		host = s.tailnetDNSName
+	}
 	return fmt.Sprintf("%s://%s:%d", scheme, host, s.port)
 }
 
@@ -258,36 +410,48 @@ func (s *Server) GetPostURL() string {
 	return s.postURL
 }
 
-// GetTailscaleURL returns the full URL for the server using Tailscale hostname
+// GetTailscaleURL returns the full URL for the server using Tailscale hostname.
+// The scheme follows WithTailscaleHTTPS. On a host running tailscaled, it
+// checks that the server is bound to a Tailscale address (or all interfaces)
+// and uses the Tailscale IP instead of the MagicDNS name when MagicDNS is
+// disabled for the tailnet.
 func (s *Server) GetTailscaleURL() (string, error) {
 	s.mu.RLock()
 	port := s.port
+	dnsName := s.tailnetDNSName
+	scheme := "http"
+	if s.tailnet.https {
+		scheme = "https"
+	}
+	var addr net.Addr
+	if s.listener != nil {
+		addr = s.listener.Addr()
+	}
+	statusFn := s.status
 	s.mu.RUnlock()
 	
+	// An embedded tsnet node already knows its MagicDNS name
+	if dnsName != "" {
+		return fmt.Sprintf("%s://%s:%d", scheme, dnsName, port), nil
+	}
+	
+	if addr == nil {
+		return "", ErrServerNotRunning
+	}
+	
 	// Get Tailscale status to find our hostname
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	
-	client := &tailscale.LocalClient{}
-	status, err := client.Status(ctx)
+	if statusFn == nil {
+		statusFn = (&tailscale.LocalClient{}).Status
+	}
+	status, err := statusFn(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get Tailscale status: %w", err)
 	}
 	
-	if status.Self == nil {
-		return "", fmt.Errorf("Tailscale not connected or no self node found")
-	}
-	
-	// Use the Tailscale hostname (machine name + tailnet domain)
-	hostname := status.Self.DNSName
-	if hostname == "" {
-		return "", fmt.Errorf("no Tailscale hostname available")
-	}
-	
-	// Remove trailing dot if present
-	hostname = strings.TrimSuffix(hostname, ".")
-	
-	return fmt.Sprintf("http://%s:%d", hostname, port), nil
+	return tailscaleURLFromStatus(status, scheme, addr)
 }
 
 // GetTailscaleIP returns the Tailscale IP address for binding interfaces
@@ -323,49 +487,39 @@ func (s *Server) PostJSON(payload interface{}) error {
 
 // PostJSONWithTailnet posts JSON data using an optional Tailscale connection
 func (s *Server) PostJSONWithTailnet(payload interface{}, tailnetKey string) error {
-	s.mu.RLock()
-	postURL := s.postURL
-	serverURL := s.GetURL()
-	client := s.client
-	s.mu.RUnlock()
-	
-	if postURL == "" {
-		return fmt.Errorf("post URL not configured")
-	}
-	
-	if !s.IsRunning() {
-		return fmt.Errorf("server is not running")
-	}
-	
-	data := PostData{
-		URL:        serverURL,
-		Payload:    payload,
-		TailnetKey: tailnetKey,
-	}
-	
-	jsonData, err := json.Marshal(data)
+	return s.postJSON(payload, tailnetKey, "", postOptions{})
+}
+
+// postJSON posts JSON data with options, through the given or routed
+// tailnet identity if any
+func (s *Server) postJSON(payload interface{}, tailnetKey string, identity string, options postOptions) error {
+	postURL := s.GetPostURL()
+	transport, err := s.sender(postURL)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+		return err
 	}
-	
-	req, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	if err := checkAttachments(transport, options.attachments); err != nil {
+		return err
 	}
 	
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to post JSON: %w", err)
+	if !s.IsRunning() {
+		return ErrServerNotRunning
 	}
-	defer resp.Body.Close()
 	
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("post request failed with status: %d", resp.StatusCode)
+	post := &Post{
+		URL:      postURL,
+		Identity: identity,
+		Data: PostData{
+			Payload:    payload,
+			TailnetKey: tailnetKey,
+		},
+		Attachments: options.attachments,
 	}
-	
-	return nil
+	post.Data.setTrace(options.postTrace())
+	started := time.Now()
+	err = transport.Send(context.Background(), post)
+	s.postSent(postURL, post.Data, false, started, err)
+	return err
 }
 
 // RoundTripPost posts JSON data and waits for a response back to the server
@@ -375,198 +529,168 @@ func (s *Server) RoundTripPost(payload interface{}, tailnetKey string) (*RoundTr
 
 // RoundTripPostWithTimeout posts JSON data and waits for a response with custom timeout
 func (s *Server) RoundTripPostWithTimeout(payload interface{}, tailnetKey string, timeout time.Duration) (*RoundTripResponse, error) {
-	s.mu.RLock()
-	postURL := s.postURL
-	serverURL := s.GetURL()
-	client := s.client
-	s.mu.RUnlock()
-	
+	return s.roundTripPost("", payload, tailnetKey, "", timeout, postOptions{})
+}
+
+// RoundTripPostToURL performs a round trip to postURL instead of the
+// configured post URL, e.g. to fail over between receivers
+func (s *Server) RoundTripPostToURL(postURL string, payload interface{}, tailnetKey string, timeout time.Duration) (*RoundTripResponse, error) {
+	if postURL == "" {
+		return nil, fmt.Errorf("post URL is required")
+	}
+	return s.roundTripPost(postURL, payload, tailnetKey, "", timeout, postOptions{})
+}
+
+// roundTripPost performs a round trip to postURL, or the configured post URL
+// if empty, with options, through the given or routed tailnet identity if
+// any
+func (s *Server) roundTripPost(postURL string, payload interface{}, tailnetKey string, identity string, timeout time.Duration, options postOptions) (*RoundTripResponse, error) {
 	if postURL == "" {
-		return nil, fmt.Errorf("post URL not configured")
+		postURL = s.GetPostURL()
+	}
+	started := s.roundTripStarted()
+	response, err := s.sendRoundTrip(postURL, payload, tailnetKey, identity, timeout, options)
+	s.roundTripFinished(postURL, started, timeout, response)
+	s.auditRoundTrip(postURL, identity, payload, started, response)
+	return response, err
+}
+
+// sendRoundTrip posts payload to postURL and waits for the response
+func (s *Server) sendRoundTrip(postURL string, payload interface{}, tailnetKey string, identity string, timeout time.Duration, options postOptions) (*RoundTripResponse, error) {
+	transport, err := s.sender(postURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttachments(transport, options.attachments); err != nil {
+		return nil, err
 	}
 	
 	if !s.IsRunning() {
-		return nil, fmt.Errorf("server is not running")
+		return nil, ErrServerNotRunning
 	}
 	
 	// Extract or generate request ID from payload
-	var requestID string
-	
-	// Try to extract RequestID from payload using reflection
-	v := reflect.ValueOf(payload)
-	if v.Kind() == reflect.Struct {
-		if field := v.FieldByName("RequestID"); field.IsValid() && field.Kind() == reflect.String && field.String() != "" {
-			requestID = field.String()
-			log.Printf("RoundTripPostWithTimeout: Using payload RequestID: %s", requestID)
-		} else {
-			// Generate unique request ID if not found in payload
-			requestID = fmt.Sprintf("req_%d", time.Now().UnixNano())
-			log.Printf("RoundTripPostWithTimeout: Generated new RequestID (no RequestID field): %s", requestID)
-		}
-	} else {
-		// Generate unique request ID if payload is not a struct
-		requestID = fmt.Sprintf("req_%d", time.Now().UnixNano())
-		log.Printf("RoundTripPostWithTimeout: Generated new RequestID (not struct): %s", requestID)
-	}
+	requestID := PayloadRequestID(payload)
+	log.Printf("RoundTripPostWithTimeout: Using RequestID: %s", requestID)
 	
 	// Create response channel
 	responseChan := make(chan *RoundTripResponse, 1)
+	pending := &pendingRoundTrip{responses: responseChan, url: postURL, started: time.Now(), timeout: timeout}
 	s.mu.Lock()
-	s.roundTripChans[requestID] = responseChan
+	s.roundTripChans[requestID] = pending
 	log.Printf("RoundTripPostWithTimeout: Created channel for RequestID: %s, total channels: %d", requestID, len(s.roundTripChans))
 	s.mu.Unlock()
 	
 	// Cleanup function
 	defer func() {
 		s.mu.Lock()
-		delete(s.roundTripChans, requestID)
+		// Leak detection may have expired the entry, and its request ID
+		// been reused since
+		if s.roundTripChans[requestID] == pending {
+			delete(s.roundTripChans, requestID)
+		}
 		close(responseChan)
 		log.Printf("RoundTripPostWithTimeout: Cleaned up channel for RequestID: %s, remaining channels: %d", requestID, len(s.roundTripChans))
 		s.mu.Unlock()
 	}()
 	
-	// Prepare the data with request ID
-	data := PostData{
-		URL:       fmt.Sprintf("%s/roundtrip", serverURL),
-		Payload:   payload,
-		RequestID: requestID,
-		TailnetKey: tailnetKey,
-	}
-	
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return &RoundTripResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to marshal JSON: %v", err),
-			Timeout: false,
-		}, nil
-	}
+	// The timeout covers sending the post as well as waiting for its response
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	
 	log.Printf("RoundTripPostWithTimeout: Sending request to %s with RequestID: %s", postURL, requestID)
-	log.Printf("RoundTripPostWithTimeout: JSON DATA: %s", string(jsonData))
-	
-	req, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return &RoundTripResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to create request: %v", err),
-			Timeout: false,
-		}, nil
+	post := &Post{
+		URL:       postURL,
+		Identity:  identity,
+		RoundTrip: true,
+		Data: PostData{
+			Payload:    payload,
+			RequestID:  requestID,
+			TailnetKey: tailnetKey,
+		},
+		Attachments: options.attachments,
 	}
-	
-	req.Header.Set("Content-Type", "application/json")
-	
-	// Send the request
-	log.Printf("RoundTripPostWithTimeout: Making HTTP request for RequestID: %s", requestID)
-	resp, err := client.Do(req)
-	if err != nil {
-		return &RoundTripResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to post JSON: %v", err),
-			Timeout: false,
-		}, nil
+	post.Data.setTrace(options.postTrace())
+	sent := time.Now()
+	err = transport.Send(ctx, post)
+	s.postSent(postURL, post.Data, true, sent, err)
+	var configErr *configError
+	if errors.As(err, &configErr) {
+		return nil, configErr.err
 	}
-	resp.Body.Close()
-	
-	if resp.StatusCode >= 400 {
-		log.Printf("RoundTripPostWithTimeout: HTTP request failed with status %d for RequestID: %s", resp.StatusCode, requestID)
-		return &RoundTripResponse{
-			Success: false,
-			Error:   fmt.Sprintf("post request failed with status: %d", resp.StatusCode),
-			Timeout: false,
-		}, nil
+	if err != nil && ctx.Err() == nil {
+		response := FailedResponse(requestID, err)
+		if response.StatusCode != 0 {
+			log.Printf("RoundTripPostWithTimeout: HTTP request failed with status %d for RequestID: %s", response.StatusCode, requestID)
+		}
+		return response, nil
 	}
 	
-	log.Printf("RoundTripPostWithTimeout: HTTP request successful (%d), waiting for response on channel for RequestID: %s", resp.StatusCode, requestID)
+	if err == nil {
+		log.Printf("RoundTripPostWithTimeout: Request sent, waiting for response on channel for RequestID: %s", requestID)
+	}
 	
 	// Wait for response or timeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	
 	select {
 	case response := <-responseChan:
 		log.Printf("RoundTripPostWithTimeout: Received response from channel for RequestID: %s", requestID)
 		
-		// Log the response content for debugging
+		// The payload may carry credentials or tokens, so it is not logged
 		if response != nil {
-			responseJSON, err := json.Marshal(response)
-			if err != nil {
-				log.Printf("RoundTripPostWithTimeout: Failed to marshal response for logging: %v", err)
-			} else {
-				log.Printf("RoundTripPostWithTimeout: Response content: %s", string(responseJSON))
-			}
-			
-			// Also log the payload specifically if it exists
-			if response.Payload != nil {
-				payloadJSON, err := json.Marshal(response.Payload)
-				if err != nil {
-					log.Printf("RoundTripPostWithTimeout: Failed to marshal payload for logging: %v", err)
-				} else {
-					log.Printf("RoundTripPostWithTimeout: Response payload: %s", string(payloadJSON))
-				}
-			}
+			log.Printf("RoundTripPostWithTimeout: Response for RequestID %s: success=%t", requestID, response.Success)
 		}
 		
 		return response, nil
 	case <-ctx.Done():
 		log.Printf("RoundTripPostWithTimeout: Timeout waiting for response for RequestID: %s", requestID)
-		return &RoundTripResponse{
-			Success:   false,
-			Error:     "timeout waiting for response",
-			Timeout:   true,
-			RequestID: requestID,
-		}, nil
+		return FailedResponse(requestID, ErrRoundTripTimeout), nil
 	}
 }
 
-func (s *Server) GenerateTailnetKeyFromOAuth(reusable bool, ephemeral bool, preauth bool, tags string) (string, error) {
-	// Acknowledge the unstable API at package level
-	tailscale.I_Acknowledge_This_API_Is_Unstable = true
-	
-	clientID := os.Getenv("TS_API_CLIENT_ID")
-	clientSecret := os.Getenv("TS_API_CLIENT_SECRET")
-	if clientID == "" || clientSecret == "" {
-		return "", fmt.Errorf("TS_API_CLIENT_ID and TS_API_CLIENT_SECRET must be set")
+// PayloadRequestID returns the RequestID field of a struct payload, or a
+// new unique request ID if it has none. Transports correlate their round
+// trips with it as RoundTripPost does.
+func PayloadRequestID(payload interface{}) string {
+	v := reflect.ValueOf(payload)
+	if v.Kind() == reflect.Struct {
+		if field := v.FieldByName("RequestID"); field.IsValid() && field.Kind() == reflect.String && field.String() != "" {
+			return field.String()
+		}
 	}
+	return newRequestID()
+}
+
+// newRequestID returns a random request ID. Callbacks are matched to round
+// trips by their request ID alone, so it must not be guessable.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "req_" + hex.EncodeToString(id)
+}
 
+// GenerateTailnetKeyFromOAuth creates a Tailscale auth key using the OAuth client
+// credentials in TS_API_CLIENT_ID and TS_API_CLIENT_SECRET. The OAuth token is
+// cached by the server's key manager and reused across calls. Use
+// GenerateTailnetKey to supply credentials programmatically and bound the call
+// with a context.
+func (s *Server) GenerateTailnetKeyFromOAuth(reusable bool, ephemeral bool, preauth bool, tags string) (string, error) {
 	if tags == "" {
 		return "", fmt.Errorf("at least one tag must be specified")
 	}
-
-	baseURL := "https://api.tailscale.com"
-
-	credentials := clientcredentials.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		TokenURL:     baseURL + "/api/v2/oauth/token",
-	}
-
-	ctx := context.Background()
-	tsClient := tailscale.NewClient("-", nil)
-	tsClient.HTTPClient = credentials.Client(ctx)
-	tsClient.BaseURL = baseURL
-
-	caps := tailscale.KeyCapabilities{
-		Devices: tailscale.KeyDeviceCapabilities{
-			Create: tailscale.KeyDeviceCreateCapabilities{
-				Reusable:      reusable,
-				Ephemeral:     ephemeral,
-				Preauthorized: preauth,
-				Tags:          strings.Split(tags, ","),
-			},
-		},
-	}
-
-	authkey, _, err := tsClient.CreateKey(ctx, caps)
+	
+	key, err := s.GenerateTailnetKey(context.Background(), TailnetKeyOptions{
+		Tags:          strings.Split(tags, ","),
+		Reusable:      reusable,
+		Ephemeral:     ephemeral,
+		Preauthorized: preauth,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create Tailscale auth key: %w", err)
+		return "", err
 	}
-
-	log.Printf("Generated Tailscale auth key: %s...", authkey[:min(10, len(authkey))])
-	return authkey, nil
+	
+	return key.Key, nil
 }
 
-
 // createTailscaleClient creates an HTTP client that routes through Tailscale
 func (s *Server) createTailscaleClient(tailnetKey string) (*http.Client, error) {
 	// Framework for Tailscale integration using tsnet
@@ -595,6 +719,16 @@ func (s *Server) createTailscaleClient(tailnetKey string) (*http.Client, error)
 
 // postWithOptionalTailscale makes an HTTP POST request, optionally using Tailscale
 func (s *Server) postWithOptionalTailscale(url string, data []byte, tailnetKey string) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	body := newPooledBody(nil, data)
+	defer body.release()
+	return s.postEncodedWithOptionalTailscale(url, header, body, tailnetKey)
+}
+
+// postEncodedWithOptionalTailscale posts body with the given headers, such
+// as its Content-Type, optionally using Tailscale
+func (s *Server) postEncodedWithOptionalTailscale(url string, header http.Header, body *pooledBody, tailnetKey string) (*http.Response, error) {
 	var client *http.Client
 	var err error
 	
@@ -602,21 +736,29 @@ func (s *Server) postWithOptionalTailscale(url string, data []byte, tailnetKey s
 		// Use Tailscale client if tailnet_key is provided
 		client, err = s.createTailscaleClient(tailnetKey)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create Tailscale client: %w", err)
+			if !s.fallbackAllowed("Tailscale client", err) {
+				return nil, fmt.Errorf("failed to create Tailscale client: %w", err)
+			}
 		}
-	} else {
+	}
+	
+	if client == nil {
 		// Use regular HTTP client
 		s.mu.RLock()
 		client = s.client
 		s.mu.RUnlock()
 	}
 	
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req, err := body.newRequest(context.Background(), url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	
-	req.Header.Set("Content-Type", "application/json")
+	req.Header = header.Clone()
+	if err := s.signRequest(req, body.data); err != nil {
+		req.Body.Close()
+		return nil, err
+	}
 	
 	return client.Do(req)
 }
@@ -632,66 +774,139 @@ func (s *Server) roundTripHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	body, err := io.ReadAll(r.Body)
+	buf, err := readBody(r.Body)
 	if err != nil {
 		log.Printf("roundTripHandler: Failed to read request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(bodyErrorStatus(err))
 		return
 	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
 	
-	log.Printf("roundTripHandler: Request body: %s", string(body))
+	// Responses may carry credentials or tokens; log only their size
+	log.Printf("roundTripHandler: Request body: %d bytes", len(body))
 	
 	var responseData struct {
-		RequestID  string      `json:"request_id"`
-		Payload    interface{} `json:"payload"`
-		TailnetKey string      `json:"tailnet_key,omitempty"`
+		RequestID   string            `json:"request_id"`
+		Payload     interface{}       `json:"payload"`
+		TailnetKey  string            `json:"tailnet_key,omitempty"`
+		TraceParent string            `json:"traceparent,omitempty"`
+		TraceState  string            `json:"tracestate,omitempty"`
+		Baggage     map[string]string `json:"baggage,omitempty"`
 	}
 	
-	err = json.Unmarshal(body, &responseData)
+	err = decodeCallback(r, body, &responseData)
 	if err != nil {
-		log.Printf("roundTripHandler: Failed to unmarshal JSON: %v", err)
+		log.Printf("roundTripHandler: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	
 	log.Printf("roundTripHandler: Parsed request - RequestID: %s, TailnetKey: %s", responseData.RequestID, responseData.TailnetKey)
 	
+	// Send response to waiting goroutine
+	response := &RoundTripResponse{
+		Payload:     responseData.Payload,
+		Success:     true,
+		RequestID:   responseData.RequestID,
+		TraceParent: responseData.TraceParent,
+		TraceState:  responseData.TraceState,
+		Baggage:     responseData.Baggage,
+	}
+	if caller, ok := CallerIdentityFromContext(r.Context()); ok {
+		response.Caller = caller
+	}
+	
+	switch err := s.completeRoundTrip(response); err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Response received"))
+	case errUnknownRoundTrip:
+		// Another instance may be waiting for it
+		if s.forwardCallback(r.Context(), response.RequestID, forwardedCallback(r, body)) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusGone)
+	}
+}
+
+// CallbackMessage is a round trip response delivered other than by a post
+// to /roundtrip, e.g. through a queue, a Transport or a CallbackRelay. It
+// accepts the body posted to /roundtrip, optionally with an error, as well
+// as a RoundTripResponse.
+type CallbackMessage struct {
+	RequestID   string            `json:"request_id"`
+	Payload     interface{}       `json:"payload"`
+	Error       string            `json:"error,omitempty"`
+	TraceParent string            `json:"traceparent,omitempty"`
+	TraceState  string            `json:"tracestate,omitempty"`
+	Baggage     map[string]string `json:"baggage,omitempty"`
+}
+
+// RoundTripResponse returns the response m delivers, failed if it has an
+// error
+func (m *CallbackMessage) RoundTripResponse() *RoundTripResponse {
+	response := &RoundTripResponse{
+		Payload:     m.Payload,
+		Success:     m.Error == "",
+		Error:       m.Error,
+		RequestID:   m.RequestID,
+		TraceParent: m.TraceParent,
+		TraceState:  m.TraceState,
+		Baggage:     m.Baggage,
+	}
+	return response.SetErr()
+}
+
+// Errors of completeRoundTrip
+var (
+	errUnknownRoundTrip = errors.New("no round trip is waiting for the request ID")
+	errRoundTripGone    = errors.New("round trip already completed")
+)
+
+// pendingRoundTrip is a round trip waiting for its response
+type pendingRoundTrip struct {
+	responses chan *RoundTripResponse
+	url       string
+	started   time.Time
+	timeout   time.Duration
+}
+
+// completeRoundTrip hands response to the round trip waiting for its request
+// ID, whether it arrived on /roundtrip or from a response queue
+func (s *Server) completeRoundTrip(response *RoundTripResponse) error {
 	// Find the waiting channel
 	s.mu.RLock()
-	responseChan, exists := s.roundTripChans[responseData.RequestID]
+	pending, exists := s.roundTripChans[response.RequestID]
 	
 	// Log all current channels for debugging
-	log.Printf("roundTripHandler: Looking for RequestID '%s'", responseData.RequestID)
-	log.Printf("roundTripHandler: Current channels (%d total):", len(s.roundTripChans))
+	log.Printf("completeRoundTrip: Looking for RequestID '%s'", response.RequestID)
+	log.Printf("completeRoundTrip: Current channels (%d total):", len(s.roundTripChans))
 	for id := range s.roundTripChans {
-		log.Printf("roundTripHandler: - Channel exists for RequestID: '%s'", id)
+		log.Printf("completeRoundTrip: - Channel exists for RequestID: '%s'", id)
 	}
-	log.Printf("roundTripHandler: Channel found for RequestID '%s': %v", responseData.RequestID, exists)
-	
-	s.mu.RUnlock()
+	log.Printf("completeRoundTrip: Channel found for RequestID '%s': %v", response.RequestID, exists)
 	
 	if !exists {
-		log.Printf("roundTripHandler: No waiting channel found for RequestID: %s", responseData.RequestID)
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	
-	// Send response to waiting goroutine
-	response := &RoundTripResponse{
-		Payload:   responseData.Payload,
-		Success:   true,
-		RequestID: responseData.RequestID,
+		s.mu.RUnlock()
+		log.Printf("completeRoundTrip: No waiting channel found for RequestID: %s", response.RequestID)
+		return errUnknownRoundTrip
 	}
 	
+	// The channel is closed under the write lock, so holding the read lock
+	// keeps it open while sending
+	defer s.mu.RUnlock()
 	select {
-	case responseChan <- response:
-		log.Printf("roundTripHandler: Successfully sent response to waiting channel for RequestID: %s", responseData.RequestID)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Response received"))
+	case pending.responses <- response:
+		log.Printf("completeRoundTrip: Successfully sent response to waiting channel for RequestID: %s", response.RequestID)
+		return nil
 	default:
 		// Channel might be closed or full
-		log.Printf("roundTripHandler: Failed to send response - channel closed or full for RequestID: %s", responseData.RequestID)
-		w.WriteHeader(http.StatusGone)
+		log.Printf("completeRoundTrip: Failed to send response - channel closed or full for RequestID: %s", response.RequestID)
+		return errRoundTripGone
 	}
 }
 
@@ -702,65 +917,197 @@ func (s *Server) webhookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	s.stats.webhookQueue.Add(1)
+	callbackPending := false
+	defer func() {
+		// Posts with a pending callback leave the queue once it is posted
+		if !callbackPending {
+			s.stats.webhookQueue.Add(-1)
+		}
+	}()
 	
 	var requestData PostData
-	err = json.Unmarshal(body, &requestData)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	var attachments []Attachment
+	var spilled *spilledPost
+	if isMultipartPost(r) {
+		var cleanup func()
+		var err error
+		requestData, attachments, cleanup, err = decodeMultipartPost(r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		defer cleanup()
+	} else if s.spillsPost(r) {
+		var err error
+		requestData, spilled, err = s.decodeSpillablePost(r)
+		if err != nil {
+			log.Printf("webhookHandler: %v", err)
+			w.WriteHeader(bodyErrorStatus(err))
+			return
+		}
+		if spilled != nil {
+			defer spilled.Close()
+		}
+	} else if isPlainJSONPost(r) {
+		if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+			w.WriteHeader(bodyErrorStatus(err))
+			return
+		}
+	} else {
+		buf, err := readBody(r.Body)
+		if err != nil {
+			w.WriteHeader(bodyErrorStatus(err))
+			return
+		}
+		requestData, err = decodePost(r, buf.Bytes())
+		putBuffer(buf)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if requestData.ResponseMode == ResponseModeEvents && requestData.RequestID == "" {
+		http.Error(w, "request_id is required for response_mode events", http.StatusBadRequest)
+		return
+	}
+	if requestData.ResponseMode == ResponseModeEvents && r.Header.Get(EventsTokenHeader) == "" {
+		http.Error(w, EventsTokenHeader+" is required for response_mode events", http.StatusBadRequest)
 		return
 	}
+	// Claim the events entry before processing, so that a post refused for
+	// another token or a full hub has had no effect
+	var claimed *eventEntry
+	if requestData.ResponseMode == ResponseModeEvents {
+		entry, err := s.events.subscribe(requestData.RequestID, r.Header.Get(EventsTokenHeader))
+		if err != nil {
+			http.Error(w, err.Error(), eventsErrorStatus(err))
+			return
+		}
+		claimed = entry
+	}
+	
+	// Claim a place in the callback queue before processing, so that a post
+	// refused for a full queue has had no effect and can be retried
+	callbackReserved := false
+	if requestData.URL != "" && requestData.ResponseMode != ResponseModeEvents && requestData.ResponseMode != ResponseModeStream {
+		if !s.callbacks.reserve() {
+			s.callbackFailed(requestData.URL, requestData.RequestID, errCallbackQueueFull)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, errCallbackQueueFull.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		callbackReserved = true
+		defer func() {
+			if callbackReserved {
+				s.callbacks.release()
+			}
+		}()
+	}
 	
 	// Process the payload using the configured processor
-	var processedPayload interface{}
 	s.mu.RLock()
 	processor := s.processor
 	s.mu.RUnlock()
 	
-	if processor != nil {
-		// Check if processor supports advanced context
-		if advancedProcessor, ok := processor.(AdvancedPayloadProcessor); ok {
-			context := ProcessorContext{
-				RequestID:  requestData.RequestID,
-				URL:        requestData.URL,
-				TailnetKey: requestData.TailnetKey,
-				ReceivedAt: time.Now(),
-			}
-			processedPayload, err = advancedProcessor.ProcessWithContext(requestData.Payload, context)
-		} else {
-			processedPayload, err = processor.Process(requestData.Payload, requestData.RequestID)
+	caller, _ := CallerIdentityFromContext(r.Context())
+	processorContext := newProcessorContext(requestData, caller)
+	processorContext.Attachments = attachments
+	if spilled != nil {
+		processorContext.PayloadReader = spilled.payload
+		processorContext.PayloadSize = spilled.payload.Size()
+	}
+	if requestData.ResponseMode == ResponseModeStream {
+		err := s.streamResponse(w, r, processor, requestData.Payload, processorContext)
+		s.webhookProcessed(requestData, processorContext, err)
+		return
+	}
+	processedPayload, err := processWithContext(processor, requestData.Payload, processorContext)
+	s.webhookProcessed(requestData, processorContext, err)
+	if err != nil {
+		if claimed != nil {
+			// The sender learns of the failure from this response
+			s.events.remove(requestData.RequestID)
 		}
-		
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Processing error: %v", err)))
-			return
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Processing error: %v", err)))
+		return
+	}
+	
+	// Keep the response for /events, or queue posting it back if a
+	// callback URL is provided
+	if claimed != nil {
+		response := &RoundTripResponse{
+			Payload:   processedPayload,
+			Success:   true,
+			RequestID: requestData.RequestID,
 		}
-	} else {
-		// Default processing - just echo back the payload
-		processedPayload = requestData.Payload
+		response.setTrace(processorContext.Trace)
+		s.events.complete(claimed, response)
+	} else if requestData.URL != "" {
+		// Call back in the encoding and compression the sender accepts
+		encoding := acceptedEncoding(r.Header.Get("Accept"))
+		s.mu.RLock()
+		compression := acceptedCompression(r.Header.Get("Accept-Encoding"), s.compression)
+		s.mu.RUnlock()
+		s.callbacks.submitReserved(func() {
+			defer s.stats.webhookQueue.Add(-1)
+			s.postProcessedResponse(requestData.URL, requestData.RequestID, processedPayload, requestData.TailnetKey, encoding, compression, processorContext.Trace)
+		})
+		callbackReserved = false
+		callbackPending = true
 	}
 	
 	// Acknowledge the request
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "received", "message": "Processing request"}`))
-	
-	// Post back the processed response if callback URL is provided
-	if requestData.URL != "" {
-		go s.postProcessedResponse(requestData.URL, requestData.RequestID, processedPayload, requestData.TailnetKey)
+}
+
+// processPayload processes a post with processor, passing it the context
+// if it is an AdvancedPayloadProcessor. Without a processor the payload is
+// echoed back.
+func processPayload(processor PayloadProcessor, requestData PostData, caller *CallerIdentity) (interface{}, error) {
+	return processWithContext(processor, requestData.Payload, newProcessorContext(requestData, caller))
+}
+
+// processWithContext processes payload with processor as processPayload
+// does, with the given context
+func processWithContext(processor PayloadProcessor, payload interface{}, context ProcessorContext) (interface{}, error) {
+	if processor == nil {
+		return payload, nil
 	}
+	if advancedProcessor, ok := processor.(AdvancedPayloadProcessor); ok {
+		return advancedProcessor.ProcessWithContext(payload, context)
+	}
+	return processor.Process(payload, context.RequestID)
 }
 
-// postProcessedResponse posts the processed response back to the callback URL
-func (s *Server) postProcessedResponse(callbackURL, requestID string, payload interface{}, tailnetKey string) {
-	// Add a small delay to simulate processing time
-	time.Sleep(100 * time.Millisecond)
-	
+// newProcessorContext returns the context of processing a post received now
+func newProcessorContext(requestData PostData, caller *CallerIdentity) ProcessorContext {
+	return ProcessorContext{
+		RequestID:  requestData.RequestID,
+		URL:        requestData.URL,
+		TailnetKey: requestData.TailnetKey,
+		ReceivedAt: time.Now(),
+		Caller:     caller,
+		Trace:      requestData.trace().child(),
+	}
+}
+
+// postProcessedResponse posts the processed response back to the callback
+// URL in the given encoding and compression, with the trace context of the
+// processing
+func (s *Server) postProcessedResponse(callbackURL, requestID string, payload interface{}, tailnetKey string, encoding Encoding, compression Compression, trace TraceContext) {
+	if err := s.sendProcessedResponse(callbackURL, requestID, payload, tailnetKey, encoding, compression, trace); err != nil {
+		log.Printf("postProcessedResponse: Callback for RequestID %s failed: %v", requestID, err)
+		s.callbackFailed(callbackURL, requestID, err)
+	}
+}
+
+// sendProcessedResponse posts the processed response back to the callback
+// URL, failing with a *PostStatusError if the sender rejects it
+func (s *Server) sendProcessedResponse(callbackURL, requestID string, payload interface{}, tailnetKey string, encoding Encoding, compression Compression, trace TraceContext) error {
 	responseData := map[string]interface{}{
 		"request_id": requestID,
 		"payload":    payload,
@@ -770,25 +1117,62 @@ func (s *Server) postProcessedResponse(callbackURL, requestID string, payload in
 	if tailnetKey != "" {
 		responseData["tailnet_key"] = tailnetKey
 	}
+	if trace.TraceParent != "" {
+		responseData["traceparent"] = trace.TraceParent
+	}
+	if trace.TraceState != "" {
+		responseData["tracestate"] = trace.TraceState
+	}
+	if len(trace.Baggage) > 0 {
+		responseData["baggage"] = trace.Baggage
+	}
 	
-	responseJSON, err := json.Marshal(responseData)
+	buf, err := encoding.marshalBuffer(responseData)
 	if err != nil {
-		return
+		return err
+	}
+	responseBody, header, err := s.wrapCloudEvent(CloudEventTypeResponse, requestID, encoding, buf.Bytes())
+	if err != nil {
+		putBuffer(buf)
+		return err
+	}
+	responseBody, err = compressBody(compression, responseBody, header)
+	if err != nil {
+		putBuffer(buf)
+		return err
 	}
+	body := newPooledBody(buf, responseBody)
+	defer body.release()
 	
 	// Use appropriate HTTP client based on tailnet_key
+	var resp *http.Response
 	if tailnetKey != "" {
-		s.postWithOptionalTailscale(callbackURL, responseJSON, tailnetKey)
+		resp, err = s.postEncodedWithOptionalTailscale(callbackURL, header, body, tailnetKey)
 	} else {
 		s.mu.RLock()
 		client := s.client
 		s.mu.RUnlock()
 		
-		resp, err := client.Post(callbackURL, "application/json", bytes.NewBuffer(responseJSON))
-		if err == nil {
-			resp.Body.Close()
+		var req *http.Request
+		req, err = body.newRequest(context.Background(), callbackURL)
+		if err != nil {
+			return err
+		}
+		req.Header = header
+		if err := s.signRequest(req, responseBody); err != nil {
+			req.Body.Close()
+			return err
 		}
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		return err
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return &PostStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
 }
 
 // defaultHandler is a simple HTTP handler that returns server information
@@ -3,6 +3,7 @@ package post2post
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -66,8 +67,8 @@ func TestServerStartStop(t *testing.T) {
 	
 	// Test that we can't start again
 	err = server.Start()
-	if err == nil {
-		t.Error("Start() should fail when server is already running")
+	if !errors.Is(err, ErrServerRunning) {
+		t.Errorf("Start() error = %v, want ErrServerRunning", err)
 	}
 	
 	// Test stop
@@ -82,8 +83,8 @@ func TestServerStartStop(t *testing.T) {
 	
 	// Test that we can't stop again
 	err = server.Stop()
-	if err == nil {
-		t.Error("Stop() should fail when server is not running")
+	if !errors.Is(err, ErrServerNotRunning) {
+		t.Errorf("Stop() error = %v, want ErrServerNotRunning", err)
 	}
 }
 
@@ -382,14 +383,14 @@ func TestServerPostJSONErrors(t *testing.T) {
 	
 	// Test posting without configuring post URL
 	err := server.PostJSON(map[string]string{"test": "data"})
-	if err == nil || !strings.Contains(err.Error(), "post URL not configured") {
+	if err == nil || !errors.Is(err, ErrPostURLNotConfigured) {
 		t.Errorf("Expected 'post URL not configured' error, got: %v", err)
 	}
 	
 	// Test posting without starting server
 	server.WithPostURL("http://example.com/webhook")
 	err = server.PostJSON(map[string]string{"test": "data"})
-	if err == nil || !strings.Contains(err.Error(), "server is not running") {
+	if err == nil || !errors.Is(err, ErrServerNotRunning) {
 		t.Errorf("Expected 'server is not running' error, got: %v", err)
 	}
 	
@@ -556,8 +557,8 @@ func TestRoundTripPostTimeout(t *testing.T) {
 		t.Errorf("RoundTripPost() timeout = false, want true")
 	}
 	
-	if !strings.Contains(response.Error, "timeout") {
-		t.Errorf("RoundTripPost() error = %v, want timeout error", response.Error)
+	if !errors.Is(response.Err, ErrRoundTripTimeout) || response.Error != ErrRoundTripTimeout.Error() {
+		t.Errorf("RoundTripPost() error = %v, want timeout error", response.Err)
 	}
 }
 
@@ -608,14 +609,14 @@ func TestRoundTripPostErrors(t *testing.T) {
 	
 	// Test without configuring post URL
 	response, err := server.RoundTripPost(map[string]string{"test": "data"}, "")
-	if err == nil || !strings.Contains(err.Error(), "post URL not configured") {
+	if err == nil || !errors.Is(err, ErrPostURLNotConfigured) {
 		t.Errorf("Expected 'post URL not configured' error, got: %v", err)
 	}
 	
 	// Test without starting server
 	server.WithPostURL("http://example.com/webhook")
 	response, err = server.RoundTripPost(map[string]string{"test": "data"}, "")
-	if err == nil || !strings.Contains(err.Error(), "server is not running") {
+	if err == nil || !errors.Is(err, ErrServerNotRunning) {
 		t.Errorf("Expected 'server is not running' error, got: %v", err)
 	}
 	
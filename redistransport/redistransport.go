@@ -0,0 +1,167 @@
+// Package redistransport carries the posts and round trip responses of
+// post2post over Redis pub/sub, and relays callbacks between the instances
+// of horizontally scaled senders
+package redistransport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/pgdad/post2post"
+	"github.com/redis/go-redis/v9"
+)
+
+// ResponseChannelPrefix prefixes the Redis pub/sub channel of each round
+// trip's response; the request ID completes the channel name
+const ResponseChannelPrefix = "post2post:response:"
+
+// ResponseChannel returns the channel the response to requestID is
+// published on
+func ResponseChannel(requestID string) string {
+	return ResponseChannelPrefix + requestID
+}
+
+// Transport performs round trips over Redis pub/sub: posts are published to
+// a request channel and the response awaited on the round trip's response
+// channel. Pub/sub does not store messages, so a post is
+// lost if no receiver is subscribed when it is published.
+type Transport struct {
+	client         redis.UniversalClient
+	requestChannel string
+}
+
+var _ post2post.Transport = (*Transport)(nil)
+
+// New returns a transport publishing posts to requestChannel
+func New(client redis.UniversalClient, requestChannel string) *Transport {
+	return &Transport{client: client, requestChannel: requestChannel}
+}
+
+// RoundTrip publishes payload and waits for its response until ctx is done.
+// Like RoundTripPost, failures are reported in the response rather than as
+// an error, with Timeout set when the deadline passed. The error is only
+// for payloads that cannot be encoded.
+func (t *Transport) RoundTrip(ctx context.Context, payload interface{}, tailnetKey string) (*post2post.RoundTripResponse, error) {
+	requestID := post2post.PayloadRequestID(payload)
+	body, err := json.Marshal(post2post.PostData{
+		Payload:    payload,
+		RequestID:  requestID,
+		TailnetKey: tailnetKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	// Subscribe before posting so that no response is missed
+	pubsub := t.client.Subscribe(ctx, ResponseChannel(requestID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return errorResponse(ctx, requestID, fmt.Errorf("failed to subscribe to response channel: %w", err)), nil
+	}
+
+	if err := t.publish(ctx, body); err != nil {
+		return errorResponse(ctx, requestID, err), nil
+	}
+
+	msg, err := pubsub.ReceiveMessage(ctx)
+	if err != nil {
+		return errorResponse(ctx, requestID, fmt.Errorf("failed to receive response: %w", err)), nil
+	}
+	var callback post2post.CallbackMessage
+	if err := json.Unmarshal([]byte(msg.Payload), &callback); err != nil {
+		return post2post.FailedResponse(requestID, fmt.Errorf("invalid response: %w", err)), nil
+	}
+	callback.RequestID = requestID
+	return callback.RoundTripResponse(), nil
+}
+
+// Send publishes post to the request channel for a server using the
+// transport
+func (t *Transport) Send(ctx context.Context, post *post2post.Post) error {
+	body, err := json.Marshal(post.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return t.publish(ctx, body)
+}
+
+// ReceiveResponses subscribes to the response channels for a server using
+// the transport, and delivers every response published on them
+func (t *Transport) ReceiveResponses(ctx context.Context) (<-chan *post2post.RoundTripResponse, error) {
+	return receiveResponses(ctx, t.client)
+}
+
+// publish publishes a post to the request channel, failing if no receiver
+// is subscribed to it
+func (t *Transport) publish(ctx context.Context, body []byte) error {
+	receivers, err := t.client.Publish(ctx, t.requestChannel, body).Result()
+	if err != nil {
+		return fmt.Errorf("failed to publish request: %w", err)
+	}
+	if receivers == 0 {
+		return fmt.Errorf("no receiver is subscribed to %s", t.requestChannel)
+	}
+	return nil
+}
+
+// errorResponse describes a failed Redis round trip, as a timeout if
+// its context expired
+func errorResponse(ctx context.Context, requestID string, err error) *post2post.RoundTripResponse {
+	if ctx.Err() != nil {
+		return post2post.FailedResponse(requestID, post2post.ErrRoundTripTimeout)
+	}
+	return post2post.FailedResponse(requestID, err)
+}
+
+// Serve receives posts published to requestChannel until ctx is done,
+// processing them with processor as posts to /webhook are, or echoing them
+// back if it is nil. The response to a post with a request ID is published
+// to its response channel.
+func Serve(ctx context.Context, client redis.UniversalClient, requestChannel string, processor post2post.PayloadProcessor) error {
+	pubsub := client.Subscribe(ctx, requestChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", requestChannel, err)
+	}
+	log.Printf("Receiving posts from Redis channel: %s", requestChannel)
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("Redis subscription to %s closed", requestChannel)
+			}
+			handlePost(ctx, client, msg.Payload, processor)
+		}
+	}
+}
+
+// handlePost processes one post and publishes its response
+func handlePost(ctx context.Context, client redis.UniversalClient, body string, processor post2post.PayloadProcessor) {
+	var requestData post2post.PostData
+	if err := json.Unmarshal([]byte(body), &requestData); err != nil {
+		log.Printf("Redis service: Ignoring invalid post: %v", err)
+		return
+	}
+
+	response := post2post.ProcessPost(processor, requestData)
+	if requestData.RequestID == "" {
+		// Nobody waits for the response
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		data, _ = json.Marshal(post2post.CallbackMessage{
+			RequestID: requestData.RequestID,
+			Error:     fmt.Sprintf("failed to marshal response: %v", err),
+		})
+	}
+	if err := client.Publish(ctx, ResponseChannel(requestData.RequestID), data).Err(); err != nil {
+		log.Printf("Redis service: Failed to publish response %s: %v", requestData.RequestID, err)
+	}
+}
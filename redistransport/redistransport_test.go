@@ -0,0 +1,157 @@
+package redistransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pgdad/post2post"
+	"github.com/redis/go-redis/v9"
+)
+
+// processorFunc adapts a function to a payload processor
+type processorFunc func(payload interface{}, requestID string) (interface{}, error)
+
+func (f processorFunc) Process(payload interface{}, requestID string) (interface{}, error) {
+	return f(payload, requestID)
+}
+
+// newTestRedis returns a client of an in-memory Redis server
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestTransport(t *testing.T) {
+	client := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, client, "post2post-requests", processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+			if payload == "fail" {
+				return nil, errors.New("bad payload")
+			}
+			return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+		}))
+	}()
+
+	transport := New(client, "post2post-requests")
+	rtCtx, rtCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer rtCancel()
+
+	// Wait for the receiver to subscribe
+	var response *post2post.RoundTripResponse
+	for i := 0; i < 50; i++ {
+		var err error
+		response, err = transport.RoundTrip(rtCtx, map[string]interface{}{"message": "hello"}, "")
+		if err != nil {
+			t.Fatalf("RoundTrip() failed: %v", err)
+		}
+		if response.Success {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTrip() = %+v, want success", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	response, err := transport.RoundTrip(rtCtx, "fail", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad payload" {
+		t.Errorf("RoundTrip() = %+v, want a processing error", response)
+	}
+
+	// Without a receiver the post is not delivered
+	response, err = New(client, "nobody-listens").RoundTrip(rtCtx, "hello", "")
+	if err != nil {
+		t.Fatalf("RoundTrip() failed: %v", err)
+	}
+	if response.Success || response.Timeout {
+		t.Errorf("RoundTrip() = %+v, want an undelivered post", response)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
+
+func TestCallbackRelay(t *testing.T) {
+	client := newTestRedis(t)
+
+	// Two instances of a horizontally scaled sender
+	waiting := post2post.NewServer().WithInterface("127.0.0.1").WithCallbackRelay(NewCallbackRelay(client))
+	other := post2post.NewServer().WithInterface("127.0.0.1").WithCallbackRelay(NewCallbackRelay(client))
+	for _, server := range []*post2post.Server{waiting, other} {
+		if err := server.Start(); err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+		defer server.Stop()
+	}
+
+	// A receiver posts the callback to the instance that is not waiting
+	forwarding := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var post post2post.PostData
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		go func() {
+			body := []byte(`{"request_id":"` + post.RequestID + `","payload":"from other instance"}`)
+			resp, err := http.Post(other.GetURL()+"/roundtrip", "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusAccepted {
+					t.Errorf("callback to other instance status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+				}
+			}
+		}()
+	}))
+	defer forwarding.Close()
+
+	response, err := waiting.RoundTripPostToURL(forwarding.URL, map[string]string{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "from other instance" {
+		t.Errorf("RoundTripPostToURL() = %+v, want the forwarded callback", response)
+	}
+
+	// A receiver publishes the callback to Redis directly
+	publishing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var post post2post.PostData
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		go client.Publish(context.Background(), ResponseChannel(post.RequestID), `{"payload":"via redis"}`)
+	}))
+	defer publishing.Close()
+
+	response, err = waiting.RoundTripPostToURL(publishing.URL, map[string]string{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "via redis" {
+		t.Errorf("RoundTripPostToURL() = %+v, want the published callback", response)
+	}
+}
@@ -0,0 +1,84 @@
+package redistransport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pgdad/post2post"
+	"github.com/redis/go-redis/v9"
+)
+
+// CallbackRelay relays the callbacks of horizontally scaled senders through
+// the response channels (see ResponseChannel): a callback posted to
+// /roundtrip of an instance that is not waiting for it is published there
+// and completed by the instance that is. Receivers can deliver callbacks by
+// publishing them there too, instead of posting to /roundtrip. Configure it
+// with WithCallbackRelay on each instance.
+type CallbackRelay struct {
+	client redis.UniversalClient
+}
+
+var _ post2post.CallbackRelay = (*CallbackRelay)(nil)
+
+// NewCallbackRelay returns a relay publishing and receiving responses with
+// client
+func NewCallbackRelay(client redis.UniversalClient) *CallbackRelay {
+	return &CallbackRelay{client: client}
+}
+
+// Forward publishes callback on the response channel of requestID
+func (r *CallbackRelay) Forward(ctx context.Context, requestID string, callback []byte) error {
+	if err := r.client.Publish(ctx, ResponseChannel(requestID), callback).Err(); err != nil {
+		return fmt.Errorf("failed to publish to Redis: %w", err)
+	}
+	return nil
+}
+
+// ReceiveResponses subscribes to the response channels and delivers every
+// response published on them
+func (r *CallbackRelay) ReceiveResponses(ctx context.Context) (<-chan *post2post.RoundTripResponse, error) {
+	return receiveResponses(ctx, r.client)
+}
+
+// receiveResponses subscribes to the response channels with client and
+// delivers the responses published on them until ctx is done
+func receiveResponses(ctx context.Context, client redis.UniversalClient) (<-chan *post2post.RoundTripResponse, error) {
+	pubsub := client.PSubscribe(ctx, ResponseChannelPrefix+"*")
+	// Wait for the subscription so no response published after this returns
+	// is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to Redis response channels: %w", err)
+	}
+
+	responses := make(chan *post2post.RoundTripResponse)
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var callback post2post.CallbackMessage
+				if err := json.Unmarshal([]byte(msg.Payload), &callback); err != nil {
+					log.Printf("Ignoring invalid response on Redis channel %s: %v", msg.Channel, err)
+					continue
+				}
+				callback.RequestID = strings.TrimPrefix(msg.Channel, ResponseChannelPrefix)
+				select {
+				case responses <- callback.RoundTripResponse():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return responses, nil
+}
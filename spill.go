@@ -0,0 +1,273 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// payloadSpill configures spilling oversized posts to disk
+type payloadSpill struct {
+	threshold int64
+	dir       string
+}
+
+// WithPayloadSpill writes JSON posts to /webhook larger than threshold bytes
+// to a temporary file in dir, the system's temporary directory if "", and
+// decodes them from there with a streaming json.Decoder instead of in
+// memory, so that a few large posts do not exhaust memory. Their payload is
+// left in the file: processors receive a nil payload and read it as JSON from
+// ProcessorContext.PayloadReader. A zero or negative threshold disables
+// spilling, the default.
+func (s *Server) WithPayloadSpill(threshold int64, dir string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payloadSpill = payloadSpill{threshold: threshold, dir: dir}
+	return s
+}
+
+// spilledPost is a post spilled to a temporary file
+type spilledPost struct {
+	file *os.File
+	// payload reads the payload of the post as JSON
+	payload *io.SectionReader
+}
+
+// Close removes the file of the post
+func (p *spilledPost) Close() error {
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
+
+// spooledBody holds a request body being read: in a pooled buffer, and in a
+// temporary file once larger than the payload spill threshold, if spilling
+// is enabled. Writes fail once the file could not be written, recording err.
+type spooledBody struct {
+	spill payloadSpill
+	buf   *bytes.Buffer
+	file  *os.File
+	err   error
+}
+
+// newSpooledBody returns an empty body spooled to disk beyond spill's
+// threshold. It must be closed once read.
+func newSpooledBody(spill payloadSpill) *spooledBody {
+	return &spooledBody{spill: spill, buf: getBuffer()}
+}
+
+func (b *spooledBody) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil && b.spill.threshold > 0 && int64(b.buf.Len()+len(p)) > b.spill.threshold {
+		file, err := os.CreateTemp(b.spill.dir, "post2post-body-*")
+		if err != nil {
+			b.err = fmt.Errorf("failed to spool body: %w", err)
+			return 0, b.err
+		}
+		b.file = file
+		if _, err := file.Write(b.buf.Bytes()); err != nil {
+			b.err = fmt.Errorf("failed to spool body: %w", err)
+			return 0, b.err
+		}
+		b.buf.Reset()
+	}
+	if b.file == nil {
+		return b.buf.Write(p)
+	}
+	n, err := b.file.Write(p)
+	if err != nil {
+		b.err = fmt.Errorf("failed to spool body: %w", err)
+	}
+	return n, err
+}
+
+// reader returns a reader of the body from its start
+func (b *spooledBody) reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.buf.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read spooled body: %w", err)
+	}
+	return b.file, nil
+}
+
+// Close releases the buffer of the body and removes its file
+func (b *spooledBody) Close() error {
+	putBuffer(b.buf)
+	b.buf = nil
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// spillsPost reports whether a post to /webhook may be spilled to disk:
+// plain JSON posts, but not CloudEvents or other encodings
+func (s *Server) spillsPost(r *http.Request) bool {
+	s.mu.RLock()
+	threshold := s.payloadSpill.threshold
+	s.mu.RUnlock()
+	return threshold > 0 && isPlainJSONPost(r)
+}
+
+// isPlainJSONPost reports whether r posts plain JSON, which is decoded as it
+// is read, rather than a CloudEvent or another encoding
+func isPlainJSONPost(r *http.Request) bool {
+	if r.Header.Get("Ce-Specversion") != "" {
+		return false
+	}
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == cloudEventsMediaType {
+		return false
+	}
+	return encodingOf(contentType) == EncodingJSON
+}
+
+// decodeSpillablePost decodes a plain JSON post to r, spilling it to a
+// temporary file if it is larger than the threshold. The spilled post, nil
+// for posts decoded in memory, must be closed once processed.
+func (s *Server) decodeSpillablePost(r *http.Request) (PostData, *spilledPost, error) {
+	s.mu.RLock()
+	spill := s.payloadSpill
+	s.mu.RUnlock()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, spill.threshold+1)); err != nil {
+		return PostData{}, nil, err
+	}
+	if int64(buf.Len()) <= spill.threshold {
+		data, err := decodePost(r, buf.Bytes())
+		return data, nil, err
+	}
+
+	file, err := os.CreateTemp(spill.dir, "post2post-post-*.json")
+	if err != nil {
+		return PostData{}, nil, fmt.Errorf("failed to spill post: %w", err)
+	}
+	post := &spilledPost{file: file}
+	if _, err := io.Copy(file, io.MultiReader(bytes.NewReader(buf.Bytes()), r.Body)); err != nil {
+		post.Close()
+		return PostData{}, nil, fmt.Errorf("failed to spill post: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		post.Close()
+		return PostData{}, nil, fmt.Errorf("failed to spill post: %w", err)
+	}
+
+	data, start, end, err := decodeSpilledPost(file)
+	if err != nil {
+		post.Close()
+		return PostData{}, nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	if start < 0 {
+		// No payload: read it as null
+		post.payload = io.NewSectionReader(strings.NewReader("null"), 0, 4)
+		return data, post, nil
+	}
+	if start, err = skipValueSeparator(file, start); err != nil {
+		post.Close()
+		return PostData{}, nil, fmt.Errorf("failed to read spilled payload: %w", err)
+	}
+	post.payload = io.NewSectionReader(file, start, end-start)
+	return data, post, nil
+}
+
+// decodeSpilledPost decodes the post in r, but its payload, with a streaming
+// json.Decoder. It returns the offsets in r where the payload's key ends and
+// where its value ends, -1 if there is no payload.
+func decodeSpilledPost(r io.Reader) (PostData, int64, int64, error) {
+	dec := json.NewDecoder(r)
+	if token, err := dec.Token(); err != nil || token != json.Delim('{') {
+		return PostData{}, -1, -1, errors.New("post is not a JSON object")
+	}
+
+	start, end := int64(-1), int64(-1)
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return PostData{}, -1, -1, err
+		}
+		key := token.(string)
+		// Keys match fields regardless of case, as in json.Unmarshal
+		if strings.EqualFold(key, "payload") {
+			start = dec.InputOffset()
+			if err := skipJSONValue(dec); err != nil {
+				return PostData{}, -1, -1, err
+			}
+			end = dec.InputOffset()
+			continue
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return PostData{}, -1, -1, err
+		}
+		fields[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return PostData{}, -1, -1, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return PostData{}, -1, -1, errors.New("unexpected data after the post")
+	}
+
+	// The fields but the payload are small: decode them as usual
+	envelope, err := json.Marshal(fields)
+	if err != nil {
+		return PostData{}, -1, -1, err
+	}
+	var data PostData
+	if err := json.Unmarshal(envelope, &data); err != nil {
+		return PostData{}, -1, -1, err
+	}
+	return data, start, end, nil
+}
+
+// skipJSONValue reads the next value of dec token by token, without
+// decoding it
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// skipValueSeparator returns the offset of the first byte of file at or
+// after offset other than whitespace and the colon after an object key
+func skipValueSeparator(file io.ReaderAt, offset int64) (int64, error) {
+	b := make([]byte, 1)
+	for {
+		if _, err := file.ReadAt(b, offset); err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n', ':':
+			offset++
+		default:
+			return offset, nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package post2post
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spillProcessor returns the payload of each post, or the size and JSON of
+// a spilled one
+type spillProcessor struct{}
+
+func (p *spillProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return nil, errors.New("no context")
+}
+
+func (p *spillProcessor) ProcessWithContext(payload interface{}, context ProcessorContext) (interface{}, error) {
+	if context.PayloadReader == nil {
+		return map[string]interface{}{"payload": payload}, nil
+	}
+	data, err := io.ReadAll(context.PayloadReader)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"payload":  payload,
+		"spilled":  string(data),
+		"size":     context.PayloadSize,
+		"trace_id": context.Trace.TraceID(),
+	}, nil
+}
+
+func TestServer_WithPayloadSpill(t *testing.T) {
+	dir := t.TempDir()
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(&spillProcessor{}).WithPayloadSpill(1024, dir)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout(map[string]interface{}{"small": true}, "", 5*time.Second)
+	if err != nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, %v", response, err)
+	}
+	if result := response.Payload.(map[string]interface{}); result["spilled"] != nil || result["payload"].(map[string]interface{})["small"] != true {
+		t.Errorf("small post result = %v, want the payload decoded in memory", result)
+	}
+
+	large := map[string]interface{}{"items": strings.Split(strings.Repeat("item,", 1000), ","), "note": "\"quoted\" {braces}"}
+	response, err = sender.RoundTripPostWithTimeout(large, "", 5*time.Second)
+	if err != nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, %v", response, err)
+	}
+	result := response.Payload.(map[string]interface{})
+	want, _ := json.Marshal(large)
+	if result["payload"] != nil || result["spilled"] != string(want) || result["size"] != float64(len(want)) {
+		t.Errorf("large post result = %v, want the payload spilled", result)
+	}
+	if result["trace_id"] == "" {
+		t.Error("spilled post lost its trace context")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("spill directory holds %v, %v after processing, want nothing", entries, err)
+	}
+}
+
+func TestDecodeSpilledPost(t *testing.T) {
+	body := `{"request_id":"req-1", "Payload" : [1, {"a": "]}"}],"url":"http://example.com/roundtrip","unknown":{"x":[]}}`
+	data, start, end, err := decodeSpilledPost(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("decodeSpilledPost() failed: %v", err)
+	}
+	if data.RequestID != "req-1" || data.URL != "http://example.com/roundtrip" || data.Payload != nil {
+		t.Errorf("decodeSpilledPost() = %+v", data)
+	}
+	file := strings.NewReader(body)
+	start, err = skipValueSeparator(file, start)
+	if err != nil || body[start:end] != `[1, {"a": "]}"}]` {
+		t.Errorf("payload = %q, %v", body[start:end], err)
+	}
+
+	if _, start, _, err := decodeSpilledPost(strings.NewReader(`{"request_id":"req-2"}`)); err != nil || start != -1 {
+		t.Errorf("decodeSpilledPost() without a payload = %d, %v", start, err)
+	}
+	for _, invalid := range []string{`[]`, `{"payload":[1,}`, `{"payload":1} {}`, `{"request_id":1,"payload":1}`} {
+		if _, _, _, err := decodeSpilledPost(strings.NewReader(invalid)); err == nil {
+			t.Errorf("decodeSpilledPost(%s) succeeded, want an error", invalid)
+		}
+	}
+}
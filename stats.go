@@ -0,0 +1,255 @@
+package post2post
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// roundTripLatencyBuckets are the upper bounds of the buckets of round trip
+// latency histograms
+var roundTripLatencyBuckets = [...]time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// maxStatsDestinations bounds the destinations with their own latency
+// histograms; round trips to further ones are recorded under
+// otherDestinations
+const maxStatsDestinations = 100
+
+// otherDestinations is the destination of the round trips to destinations
+// beyond maxStatsDestinations
+const otherDestinations = "other"
+
+// RoundTripOutcome is how a round trip ended
+type RoundTripOutcome string
+
+const (
+	OutcomeSuccess RoundTripOutcome = "success"
+	OutcomeTimeout RoundTripOutcome = "timeout"
+	OutcomeError   RoundTripOutcome = "error"
+)
+
+// Outcome returns how the round trip answered with r ended
+func (r *RoundTripResponse) Outcome() RoundTripOutcome {
+	switch {
+	case r.Timeout:
+		return OutcomeTimeout
+	case !r.Success:
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
+
+// ServerStats is a snapshot of the counters and gauges of a server, e.g.
+// for health dashboards without Prometheus. Counters count from the
+// creation of the server.
+type ServerStats struct {
+	// ActiveRoundTrips is the number of round trips waiting for their
+	// response
+	ActiveRoundTrips int64
+	// TotalPosts is the number of posts sent, FailedPosts the number of
+	// them that failed or were rejected
+	TotalPosts  int64
+	FailedPosts int64
+	// RoundTrips is the number of round trips that ended with a response,
+	// failed or not, and Timeouts the number that timed out
+	RoundTrips int64
+	Timeouts   int64
+	// AverageLatency is the mean duration of the round trips that ended
+	// with a response, zero before the first
+	AverageLatency time.Duration
+
+	// WebhooksProcessed is the number of posts to /webhook processed,
+	// WebhookErrors the number of them the processor failed
+	WebhooksProcessed int64
+	WebhookErrors     int64
+	// WebhookQueueDepth is the number of posts to /webhook being processed
+	// or waiting for their callback to be posted
+	WebhookQueueDepth int64
+	// CallbacksFailed is the number of callbacks that could not be posted
+	// back to their sender
+	CallbacksFailed int64
+	// CallbackQueueDepth is the number of callbacks waiting for a worker,
+	// and CallbackWorkers the number of workers posting callbacks, see
+	// WithCallbackWorkers
+	CallbackQueueDepth int64
+	CallbackWorkers    int64
+
+	// StaleRoundTrips and OrphanedRoundTrips are the numbers of round trips
+	// waiting longer than the leak detection threshold, and of those past
+	// their timeout, at the last check; ExpiredRoundTrips is the number
+	// of round trips leak detection expired
+	StaleRoundTrips    int64
+	OrphanedRoundTrips int64
+	ExpiredRoundTrips  int64
+
+	// Destinations are the round trip latencies by post URL, ordered by
+	// URL, to see when a specific receiver degrades
+	Destinations []DestinationStats
+}
+
+// DestinationStats are the latencies of the round trips to a post URL by
+// outcome
+type DestinationStats struct {
+	// URL is the post URL, or "other" for the round trips to URLs beyond
+	// the first 100
+	URL string
+	// Success holds the round trips answered with a successful response,
+	// Timeout those that timed out and Error those that failed otherwise
+	Success LatencyHistogram
+	Timeout LatencyHistogram
+	Error   LatencyHistogram
+}
+
+// LatencyHistogram is a histogram of round trip durations
+type LatencyHistogram struct {
+	// Buckets are the upper bounds of the buckets
+	Buckets []time.Duration
+	// Counts are the numbers of durations in each bucket, not cumulative;
+	// the last one counts the durations above the last bound
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// Mean returns the mean duration, zero if the histogram is empty
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// latencyHistogram accumulates a LatencyHistogram
+type latencyHistogram struct {
+	counts [len(roundTripLatencyBuckets) + 1]int64
+	sum    time.Duration
+}
+
+// observe adds duration to the histogram
+func (h *latencyHistogram) observe(duration time.Duration) {
+	bucket := sort.Search(len(roundTripLatencyBuckets), func(i int) bool {
+		return duration <= roundTripLatencyBuckets[i]
+	})
+	h.counts[bucket]++
+	h.sum += duration
+}
+
+// snapshot returns the histogram as a LatencyHistogram
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	snapshot := LatencyHistogram{
+		Buckets: append([]time.Duration(nil), roundTripLatencyBuckets[:]...),
+		Counts:  append([]int64(nil), h.counts[:]...),
+		Sum:     h.sum,
+	}
+	for _, count := range h.counts {
+		snapshot.Count += count
+	}
+	return snapshot
+}
+
+// destinationHistograms are the latency histograms of a destination
+type destinationHistograms struct {
+	success, timeout, error latencyHistogram
+}
+
+// serverStats holds the counters and gauges of a server
+type serverStats struct {
+	activeRoundTrips  atomic.Int64
+	posts             atomic.Int64
+	failedPosts       atomic.Int64
+	roundTrips        atomic.Int64
+	roundTripLatency  atomic.Int64
+	timeouts          atomic.Int64
+	webhooksProcessed atomic.Int64
+	webhookErrors     atomic.Int64
+	webhookQueue      atomic.Int64
+	callbacksFailed   atomic.Int64
+
+	staleRoundTrips    atomic.Int64
+	orphanedRoundTrips atomic.Int64
+	expiredRoundTrips  atomic.Int64
+
+	mu           sync.Mutex
+	destinations map[string]*destinationHistograms
+}
+
+// observeRoundTrip adds the duration of a round trip to postURL ending with
+// response to the latency histograms of the destination
+func (st *serverStats) observeRoundTrip(postURL string, duration time.Duration, response *RoundTripResponse) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.destinations == nil {
+		st.destinations = make(map[string]*destinationHistograms)
+	}
+	histograms, ok := st.destinations[postURL]
+	if !ok {
+		if len(st.destinations) >= maxStatsDestinations {
+			postURL = otherDestinations
+			histograms = st.destinations[postURL]
+		}
+		if histograms == nil {
+			histograms = &destinationHistograms{}
+			st.destinations[postURL] = histograms
+		}
+	}
+	switch response.Outcome() {
+	case OutcomeTimeout:
+		histograms.timeout.observe(duration)
+	case OutcomeError:
+		histograms.error.observe(duration)
+	default:
+		histograms.success.observe(duration)
+	}
+}
+
+// destinationStats returns the latency histograms by destination, ordered
+// by URL
+func (st *serverStats) destinationStats() []DestinationStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	destinations := make([]DestinationStats, 0, len(st.destinations))
+	for postURL, histograms := range st.destinations {
+		destinations = append(destinations, DestinationStats{
+			URL:     postURL,
+			Success: histograms.success.snapshot(),
+			Timeout: histograms.timeout.snapshot(),
+			Error:   histograms.error.snapshot(),
+		})
+	}
+	sort.Slice(destinations, func(i, j int) bool { return destinations[i].URL < destinations[j].URL })
+	return destinations
+}
+
+// Stats returns the current counters and gauges of the server
+func (s *Server) Stats() ServerStats {
+	stats := ServerStats{
+		ActiveRoundTrips:  s.stats.activeRoundTrips.Load(),
+		TotalPosts:        s.stats.posts.Load(),
+		FailedPosts:       s.stats.failedPosts.Load(),
+		RoundTrips:        s.stats.roundTrips.Load(),
+		Timeouts:          s.stats.timeouts.Load(),
+		WebhooksProcessed: s.stats.webhooksProcessed.Load(),
+		WebhookErrors:     s.stats.webhookErrors.Load(),
+		WebhookQueueDepth: s.stats.webhookQueue.Load(),
+		CallbacksFailed:   s.stats.callbacksFailed.Load(),
+
+		StaleRoundTrips:    s.stats.staleRoundTrips.Load(),
+		OrphanedRoundTrips: s.stats.orphanedRoundTrips.Load(),
+		ExpiredRoundTrips:  s.stats.expiredRoundTrips.Load(),
+
+		Destinations: s.stats.destinationStats(),
+	}
+	if stats.RoundTrips > 0 {
+		stats.AverageLatency = time.Duration(s.stats.roundTripLatency.Load() / stats.RoundTrips)
+	}
+	queued, workers := s.callbacks.depth()
+	stats.CallbackQueueDepth, stats.CallbackWorkers = int64(queued), int64(workers)
+	return stats
+}
@@ -0,0 +1,186 @@
+package post2post
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingProcessor processes posts once released
+type blockingProcessor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return payload, nil
+}
+
+func TestServer_Stats(t *testing.T) {
+	processor := &blockingProcessor{started: make(chan struct{}, 1), release: make(chan struct{})}
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processor)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	if stats := sender.Stats(); stats.TotalPosts != 0 || stats.RoundTrips != 0 || len(stats.Destinations) != 0 {
+		t.Fatalf("Stats() of a new server = %+v, want zero", stats)
+	}
+
+	done := make(chan *RoundTripResponse, 1)
+	go func() {
+		response, _ := sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+		done <- response
+	}()
+	<-processor.started
+	if active := sender.Stats().ActiveRoundTrips; active != 1 {
+		t.Errorf("ActiveRoundTrips = %d during the round trip, want 1", active)
+	}
+	if depth := receiver.Stats().WebhookQueueDepth; depth != 1 {
+		t.Errorf("WebhookQueueDepth = %d while processing, want 1", depth)
+	}
+	close(processor.release)
+	if response := <-done; response == nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, want success", response)
+	}
+
+	stats := sender.Stats()
+	if stats.ActiveRoundTrips != 0 || stats.TotalPosts != 1 || stats.FailedPosts != 0 || stats.RoundTrips != 1 || stats.Timeouts != 0 {
+		t.Errorf("sender Stats() = %+v, want 1 post and 1 round trip", stats)
+	}
+	if stats.AverageLatency <= 0 {
+		t.Errorf("AverageLatency = %s, want positive", stats.AverageLatency)
+	}
+	stats = receiver.Stats()
+	if stats.WebhooksProcessed != 1 || stats.WebhookErrors != 0 || stats.CallbacksFailed != 0 {
+		t.Errorf("receiver Stats() = %+v, want 1 processed webhook", stats)
+	}
+	// The callback leaves the queue just after the sender receives it
+	deadline := time.Now().Add(time.Second)
+	for receiver.Stats().WebhookQueueDepth != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := receiver.Stats().WebhookQueueDepth; depth != 0 {
+		t.Errorf("WebhookQueueDepth = %d after the callback, want 0", depth)
+	}
+}
+
+func TestServer_StatsTimeoutAndCallbackFailure(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// The sender rejects the receiver's unsigned callback
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL()+"/webhook").
+		WithWebhookVerification(WebhookSignatureGitHub, "secret")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout("hello", "", time.Second)
+	if err != nil || !response.Timeout {
+		t.Fatalf("RoundTripPost() = %+v, %v, want a timeout", response, err)
+	}
+	stats := sender.Stats()
+	if stats.ActiveRoundTrips != 0 || stats.Timeouts != 1 || stats.RoundTrips != 0 || stats.AverageLatency != 0 {
+		t.Errorf("sender Stats() = %+v, want 1 timeout", stats)
+	}
+	if stats := receiver.Stats(); stats.CallbacksFailed != 1 || stats.WebhookQueueDepth != 0 {
+		t.Errorf("receiver Stats() = %+v, want 1 failed callback", stats)
+	}
+}
+
+func TestServer_StatsDestinations(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	// Accepts posts without ever calling back
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer silent.Close()
+
+	sender := NewServer().WithInterface("127.0.0.1")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	for _, postURL := range []string{receiver.GetURL() + "/webhook", receiver.GetURL() + "/webhook", failing.URL, silent.URL} {
+		if _, err := sender.RoundTripPostToURL(postURL, "hello", "", 500*time.Millisecond); err != nil {
+			t.Fatalf("RoundTripPostToURL(%s) failed: %v", postURL, err)
+		}
+	}
+
+	destinations := make(map[string]DestinationStats)
+	for _, destination := range sender.Stats().Destinations {
+		destinations[destination.URL] = destination
+	}
+	if len(destinations) != 3 {
+		t.Fatalf("Destinations = %+v, want 3", destinations)
+	}
+	tests := []struct {
+		url                     string
+		success, timeout, error int64
+	}{
+		{receiver.GetURL() + "/webhook", 2, 0, 0},
+		{failing.URL, 0, 0, 1},
+		{silent.URL, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		destination := destinations[tt.url]
+		if destination.Success.Count != tt.success || destination.Timeout.Count != tt.timeout || destination.Error.Count != tt.error {
+			t.Errorf("%s: %d successes, %d timeouts, %d errors, want %d, %d, %d", tt.url,
+				destination.Success.Count, destination.Timeout.Count, destination.Error.Count, tt.success, tt.timeout, tt.error)
+		}
+	}
+
+	// Timeouts fall in the bucket of the timeout
+	timeouts := destinations[silent.URL].Timeout
+	if len(timeouts.Counts) != len(timeouts.Buckets)+1 || timeouts.Mean() < 500*time.Millisecond {
+		t.Fatalf("timeout histogram = %+v, want a mean of at least the timeout", timeouts)
+	}
+	for i, bound := range timeouts.Buckets {
+		want := int64(0)
+		if bound == time.Second {
+			want = 1
+		}
+		if timeouts.Counts[i] != want {
+			t.Errorf("timeout histogram bucket %s = %d, want %d", bound, timeouts.Counts[i], want)
+		}
+	}
+}
+
+func TestServerStats_OtherDestinations(t *testing.T) {
+	var stats serverStats
+	response := &RoundTripResponse{Success: true}
+	for i := 0; i < maxStatsDestinations+5; i++ {
+		stats.observeRoundTrip(fmt.Sprintf("http://receiver-%03d/webhook", i), time.Millisecond, response)
+	}
+	destinations := stats.destinationStats()
+	if len(destinations) != maxStatsDestinations+1 {
+		t.Fatalf("%d destinations, want %d", len(destinations), maxStatsDestinations+1)
+	}
+	other := destinations[len(destinations)-1]
+	if other.URL != otherDestinations || other.Success.Count != 5 {
+		t.Errorf("last destination = %s with %d successes, want %s with 5", other.URL, other.Success.Count, otherDestinations)
+	}
+}
@@ -0,0 +1,235 @@
+package post2post
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ResponseModeStream asks a receiver to answer a post itself with its
+// results as newline-delimited JSON over a chunked response, instead of
+// posting them to a callback URL
+const ResponseModeStream = "stream"
+
+// ndjsonContentType is the Content-Type of streamed responses
+const ndjsonContentType = "application/x-ndjson"
+
+// StreamingPayloadProcessor defines an interface for processors producing
+// intermediate results before their final one. Each result passed to emit
+// is sent at once as a line of a streamed response; emit fails once the
+// sender went away or ProcessStream returned. Processors that do not
+// implement it stream their only result.
+type StreamingPayloadProcessor interface {
+	ProcessStream(payload interface{}, context ProcessorContext, emit func(interface{}) error) (interface{}, error)
+}
+
+// streamLine is a line of a streamed response: an intermediate result, or
+// the final result or error
+type streamLine struct {
+	RequestID string      `json:"request_id,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Final     bool        `json:"final,omitempty"`
+}
+
+// ndjsonWriter writes the lines of a streamed response, flushing each, and
+// sends the response headers with the first one
+type ndjsonWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+	closed  bool
+}
+
+// write writes line, failing once the writer is closed
+func (n *ndjsonWriter) write(line streamLine) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return errors.New("stream closed")
+	}
+	return n.writeLocked(line)
+}
+
+// finish writes the final line and closes the writer. A failure before any
+// line was written is not streamed: finish returns false and the caller
+// fails the post instead.
+func (n *ndjsonWriter) finish(line streamLine) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+	if line.Error != "" && !n.started {
+		return false, nil
+	}
+	return true, n.writeLocked(line)
+}
+
+// writeLocked writes line, sending the headers first if needed. Must be
+// called with n.mu held.
+func (n *ndjsonWriter) writeLocked(line streamLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if !n.started {
+		n.w.Header().Set("Content-Type", ndjsonContentType)
+		n.w.Header().Set("Cache-Control", "no-cache")
+		n.w.WriteHeader(http.StatusOK)
+		n.started = true
+	}
+	if _, err := n.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	n.flusher.Flush()
+	return nil
+}
+
+// streamResponse processes a post with ResponseModeStream, answering it with
+// the results of the processor as they come. A processing error before the
+// first result fails the post as on /webhook; a later one is the error of
+// the final line. It returns the processing error.
+func (s *Server) streamResponse(w http.ResponseWriter, r *http.Request, processor PayloadProcessor, payload interface{}, context ProcessorContext) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return errors.New("streaming not supported")
+	}
+	out := &ndjsonWriter{w: w, flusher: flusher}
+
+	var result interface{}
+	var err error
+	if streamer, ok := processor.(StreamingPayloadProcessor); ok {
+		result, err = streamer.ProcessStream(payload, context, func(payload interface{}) error {
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			return out.write(streamLine{RequestID: context.RequestID, Payload: payload})
+		})
+	} else {
+		result, err = processWithContext(processor, payload, context)
+	}
+
+	final := streamLine{RequestID: context.RequestID, Payload: result, Final: true}
+	if err != nil {
+		final = streamLine{RequestID: context.RequestID, Error: fmt.Sprintf("Processing error: %v", err), Final: true}
+	}
+	streamed, writeErr := out.finish(final)
+	if !streamed {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(final.Error))
+		return err
+	}
+	if writeErr != nil {
+		log.Printf("streamResponse: Failed to write the final result for RequestID %s: %v", context.RequestID, writeErr)
+	}
+	return err
+}
+
+// RoundTripPostStream performs a round trip answered on the post itself:
+// it posts the payload with ResponseModeStream and calls onResult with each
+// intermediate result of the receiver as it arrives, returning the final
+// one. Like RoundTripPostViaEvents no callback is needed and the server
+// need not be running, and failures are reported in the response.
+func (s *Server) RoundTripPostStream(payload interface{}, tailnetKey string, timeout time.Duration, onResult func(interface{})) (*RoundTripResponse, error) {
+	started := s.roundTripStarted()
+	response, err := s.roundTripPostStream(payload, tailnetKey, timeout, onResult)
+	postURL := s.GetPostURL()
+	s.roundTripFinished(postURL, started, timeout, response)
+	s.auditRoundTrip(postURL, "", payload, started, response)
+	return response, err
+}
+
+// roundTripPostStream performs a round trip answered on the post
+func (s *Server) roundTripPostStream(payload interface{}, tailnetKey string, timeout time.Duration, onResult func(interface{})) (*RoundTripResponse, error) {
+	s.mu.RLock()
+	postURL := s.postURL
+	client := s.client
+	s.mu.RUnlock()
+
+	if postURL == "" {
+		return nil, ErrPostURLNotConfigured
+	}
+	node, err := s.tailnetNodeFor(postURL, "")
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		client = node.client
+	}
+	// The stream outlives the client's timeout; the context bounds it
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	requestID := PayloadRequestID(payload)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	data := PostData{
+		Payload:      payload,
+		RequestID:    requestID,
+		TailnetKey:   tailnetKey,
+		ResponseMode: ResponseModeStream,
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return failedResponsef("", "failed to marshal JSON: %w", err), nil
+	}
+	post, err := http.NewRequestWithContext(ctx, "POST", postURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	post.Header.Set("Content-Type", "application/json")
+	post.Header.Set("Accept", ndjsonContentType)
+	if err := s.signRequest(post, jsonData); err != nil {
+		return FailedResponse(requestID, err), nil
+	}
+	sent := time.Now()
+	resp, err := streamClient.Do(post)
+	s.postSent(postURL, data, true, sent, responseError(resp, err))
+	if err != nil {
+		return eventsErrorResponse(ctx, requestID, fmt.Errorf("failed to post JSON: %w", err)), nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return FailedResponse(requestID, &PostStatusError{StatusCode: resp.StatusCode}), nil
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line streamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return failedResponsef(requestID, "invalid stream line: %w", err), nil
+		}
+		if !line.Final {
+			if onResult != nil {
+				onResult(line.Payload)
+			}
+			continue
+		}
+		response := &RoundTripResponse{
+			Payload:   line.Payload,
+			Success:   line.Error == "",
+			Error:     line.Error,
+			RequestID: requestID,
+		}
+		return response.SetErr(), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return eventsErrorResponse(ctx, requestID, fmt.Errorf("failed to read stream: %w", err)), nil
+	}
+	return FailedResponse(requestID, errors.New("stream ended without a final result")), nil
+}
@@ -0,0 +1,103 @@
+package post2post
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countingProcessor streams the numbers up to the "count" of the payload,
+// failing after them if "fail" is set
+type countingProcessor struct{}
+
+func (c *countingProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return nil, errors.New("not streamed")
+}
+
+func (c *countingProcessor) ProcessStream(payload interface{}, context ProcessorContext, emit func(interface{}) error) (interface{}, error) {
+	fields := payload.(map[string]interface{})
+	count := int(fields["count"].(float64))
+	for i := 1; i <= count; i++ {
+		if err := emit(i); err != nil {
+			return nil, err
+		}
+	}
+	if fields["fail"] == true {
+		return nil, errors.New("bad payload")
+	}
+	return map[string]interface{}{"request_id": context.RequestID, "total": count}, nil
+}
+
+func TestRoundTripPostStream(t *testing.T) {
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(&countingProcessor{})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// The sender is never started: results come back on its own request
+	sender := NewServer().WithPostURL(receiver.GetURL() + "/webhook")
+
+	tests := []struct {
+		name        string
+		payload     interface{}
+		wantResults int
+		wantSuccess bool
+		wantStatus  int
+	}{
+		{"results", struct {
+			RequestID string `json:"request_id"`
+			Count     int    `json:"count"`
+		}{RequestID: "req-stream", Count: 3}, 3, true, 0},
+		{"failure after results", map[string]interface{}{"count": 2, "fail": true}, 2, false, 0},
+		{"failure before results", map[string]interface{}{"count": 0, "fail": true}, 0, false, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []interface{}
+			response, err := sender.RoundTripPostStream(tt.payload, "", 5*time.Second, func(result interface{}) {
+				results = append(results, result)
+			})
+			if err != nil {
+				t.Fatalf("RoundTripPostStream() failed: %v", err)
+			}
+			if response.Success != tt.wantSuccess || response.StatusCode != tt.wantStatus {
+				t.Fatalf("RoundTripPostStream() = %+v, want success %v and status %d", response, tt.wantSuccess, tt.wantStatus)
+			}
+			if len(results) != tt.wantResults {
+				t.Fatalf("intermediate results = %v, want %d", results, tt.wantResults)
+			}
+			for i, result := range results {
+				if result != float64(i+1) {
+					t.Errorf("result %d = %v, want %d", i, result, i+1)
+				}
+			}
+			if tt.wantSuccess {
+				final := response.Payload.(map[string]interface{})
+				if response.RequestID != "req-stream" || final["request_id"] != "req-stream" || final["total"] != float64(3) {
+					t.Errorf("final response = %+v", response)
+				}
+			} else if tt.wantStatus == 0 {
+				var receiverErr *ReceiverError
+				if response.Error != "Processing error: bad payload" || !errors.As(response.Err, &receiverErr) {
+					t.Errorf("final error = %q (%v), want the processing error", response.Error, response.Err)
+				}
+			}
+		})
+	}
+
+	// Processors that do not stream send their only result
+	plain := NewServer().WithInterface("127.0.0.1")
+	if err := plain.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer plain.Stop()
+	response, err := NewServer().WithPostURL(plain.GetURL()+"/webhook").RoundTripPostStream("hello", "", 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("RoundTripPostStream() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "hello" {
+		t.Errorf("RoundTripPostStream() = %+v, want the echoed payload", response)
+	}
+}
@@ -0,0 +1,491 @@
+package post2post
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// defaultTailnetPort is used when the server listens on a tailnet node and no
+// port was configured. tsnet listeners cannot be bound to port 0.
+const defaultTailnetPort = 80
+
+// defaultTailnetHostname is the tsnet hostname used when none is configured
+const defaultTailnetHostname = "post2post-server"
+
+// tailnetStartTimeout bounds how long Start waits for the tsnet node to come up
+const tailnetStartTimeout = 60 * time.Second
+
+// tailnetConfig holds the options used when the server listens directly on a tailnet
+type tailnetConfig struct {
+	enabled    bool
+	authKey    string
+	hostname   string
+	stateDir   string
+	tags       []string
+	funnel     bool
+	funnelPort int
+	https      bool
+	logf       func(format string, args ...interface{})
+	logLevel   TailnetLogLevel
+	fallback   FallbackPolicy
+}
+
+// WithTailnet configures the server to listen for callbacks directly on the
+// tailnet using an embedded tsnet node. The endpoint is then only reachable
+// from inside the tailnet and GetURL returns the node's MagicDNS address.
+func (s *Server) WithTailnet(authKey, hostname string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.enabled = true
+	s.tailnet.authKey = authKey
+	s.tailnet.hostname = hostname
+	return s
+}
+
+// WithTailnetHostname sets the hostname the embedded tsnet node presents to
+// the control server, so multiple instances are distinguishable in the tailnet
+func (s *Server) WithTailnetHostname(hostname string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.hostname = hostname
+	return s
+}
+
+// WithTailnetTags sets the ACL tags advertised by the embedded tsnet node
+// (e.g. "tag:post2post"). The tags must be permitted for the auth key by the
+// tailnet policy's tagOwners.
+func (s *Server) WithTailnetTags(tags ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.tags = append([]string(nil), tags...)
+	return s
+}
+
+// GetTailnetTags returns the ACL tags advertised by the embedded tsnet node
+func (s *Server) GetTailnetTags() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.tailnet.tags...)
+}
+
+// WithTailnetStateDir sets a persistent state directory for the embedded tsnet
+// node. The node key is stored there and reused between runs, so restarts do
+// not register a new ephemeral device or consume another auth key use.
+func (s *Server) WithTailnetStateDir(path string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.stateDir = path
+	return s
+}
+
+// GetTailnetStateDir returns the persistent tsnet state directory, if any
+func (s *Server) GetTailnetStateDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailnet.stateDir
+}
+
+// WithTailscaleHTTPS serves the callback endpoints over HTTPS using the
+// LetsEncrypt certificate Tailscale provisions for the node's MagicDNS name.
+// It works both with an embedded tsnet node and with a host running
+// tailscaled, and makes GetURL and GetTailscaleURL return https URLs on the
+// MagicDNS name the certificate is issued for; on a host, Start fails if
+// tailscaled does not report it. HTTPS must be enabled in the tailnet's
+// admin console.
+func (s *Server) WithTailscaleHTTPS() *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.https = true
+	return s
+}
+
+// IsTailscaleHTTPSEnabled returns whether the server serves Tailscale certificates
+func (s *Server) IsTailscaleHTTPSEnabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailnet.https
+}
+
+// WithTailnetFunnel exposes the /roundtrip endpoint on the public internet via
+// Tailscale Funnel, so receivers outside the tailnet can post responses back.
+// Funnel only supports ports 443, 8443 and 10000; a port of 0 selects 443.
+// Round trip callbacks then use the public https URL returned by GetFunnelURL.
+// As anyone can post to that URL, Start fails unless callbacks are verified
+// with WithWebhookVerification. WithAllowedTags applies to it too, so public
+// callers are rejected when allowed tags are set.
+func (s *Server) WithTailnetFunnel(port int) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if port == 0 {
+		port = 443
+	}
+	s.tailnet.funnel = true
+	s.tailnet.funnelPort = port
+	return s
+}
+
+// GetFunnelURL returns the public Tailscale Funnel URL for the server, or an
+// empty string if Funnel is not enabled or the server is not running
+func (s *Server) GetFunnelURL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.funnelURL
+}
+
+// IsTailnetEnabled returns whether the server listens on an embedded tsnet node
+func (s *Server) IsTailnetEnabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailnet.enabled
+}
+
+// GetTailnetHostname returns the hostname used for the embedded tsnet node
+func (s *Server) GetTailnetHostname() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.tailnet.hostname == "" {
+		return defaultTailnetHostname
+	}
+	return s.tailnet.hostname
+}
+
+// listenTailnet starts the embedded tsnet node and returns a listener on it.
+// Must be called with s.mu held.
+func (s *Server) listenTailnet() (net.Listener, error) {
+	// A node restored from a persistent state directory does not need a key
+	if s.tailnet.authKey == "" && s.tailnet.stateDir == "" {
+		return nil, fmt.Errorf("tailnet auth key is required")
+	}
+
+	if s.tailnet.funnel && !isFunnelPort(s.tailnet.funnelPort) {
+		return nil, fmt.Errorf("invalid funnel port %d: must be 443, 8443 or 10000", s.tailnet.funnelPort)
+	}
+
+	// The Funnel URL is public: only signed callbacks may reach /roundtrip
+	if s.tailnet.funnel && s.webhookVerifier == nil {
+		return nil, fmt.Errorf("Tailscale Funnel requires callbacks to be signed: configure WithWebhookVerification")
+	}
+
+	for _, tag := range s.tailnet.tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return nil, fmt.Errorf("invalid tailnet tag %q: tags must start with \"tag:\"", tag)
+		}
+	}
+
+	hostname := s.tailnet.hostname
+	if hostname == "" {
+		hostname = defaultTailnetHostname
+	}
+
+	// Without a persistent state directory the node is ephemeral and its
+	// state lives in a temporary directory removed on Stop
+	stateDir := s.tailnet.stateDir
+	ephemeral := stateDir == ""
+	if ephemeral {
+		tempDir, err := os.MkdirTemp("", "post2post-tsnet-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tsnet state directory: %w", err)
+		}
+		stateDir = tempDir
+	} else if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create tsnet state directory: %w", err)
+	}
+
+	userLogf, backendLogf := s.tailnet.tsnetLoggers()
+	srv := &tsnet.Server{
+		Hostname:  hostname,
+		AuthKey:   s.tailnet.authKey,
+		Ephemeral: ephemeral,
+		Dir:       stateDir,
+		UserLogf:  userLogf,
+		Logf:      backendLogf,
+	}
+
+	cleanup := func() {
+		srv.Close()
+		if ephemeral {
+			os.RemoveAll(stateDir)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tailnetStartTimeout)
+	defer cancel()
+
+	log.Printf("Starting tsnet node %s", hostname)
+	if len(s.tailnet.tags) > 0 {
+		if err := advertiseTailnetTags(ctx, srv, s.tailnet.tags); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	status, err := srv.Up(ctx)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to start tsnet node: %w", err)
+	}
+
+	if s.port == 0 {
+		s.port = defaultTailnetPort
+		if s.tailnet.https {
+			s.port = 443
+		}
+	}
+
+	var listener net.Listener
+	if s.tailnet.https {
+		listener, err = srv.ListenTLS("tcp", fmt.Sprintf(":%d", s.port))
+	} else {
+		listener, err = srv.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	}
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to listen on tailnet: %w", err)
+	}
+
+	lc, err := srv.LocalClient()
+	if err != nil {
+		listener.Close()
+		cleanup()
+		return nil, fmt.Errorf("failed to get tsnet local client: %w", err)
+	}
+
+	if s.tailnet.funnel {
+		if err := s.startFunnel(srv); err != nil {
+			listener.Close()
+			cleanup()
+			return nil, err
+		}
+	}
+
+	s.tsnetServer = srv
+	s.whoIs = lc.WhoIs
+	if ephemeral {
+		s.tsnetStateDir = stateDir
+	}
+	if status.Self != nil {
+		s.tailnetDNSName = strings.TrimSuffix(status.Self.DNSName, ".")
+	}
+
+	log.Printf("tsnet node %s is up, MagicDNS name: %s", hostname, s.tailnetDNSName)
+	return listener, nil
+}
+
+// advertiseTailnetTags starts the tsnet node and sets its advertised tags
+// before it finishes logging in
+func advertiseTailnetTags(ctx context.Context, srv *tsnet.Server, tags []string) error {
+	if err := srv.Start(); err != nil {
+		return fmt.Errorf("failed to start tsnet node: %w", err)
+	}
+
+	lc, err := srv.LocalClient()
+	if err != nil {
+		return fmt.Errorf("failed to get tsnet local client: %w", err)
+	}
+
+	_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:            ipn.Prefs{AdvertiseTags: tags},
+		AdvertiseTagsSet: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to advertise tailnet tags: %w", err)
+	}
+
+	log.Printf("tsnet node advertising tags: %s", strings.Join(tags, ","))
+	return nil
+}
+
+// tailscaleURLFromStatus builds the URL tailnet peers use to reach a server
+// listening on addr. It fails if addr is not reachable over Tailscale, and
+// falls back to the Tailscale IP when MagicDNS is disabled.
+func tailscaleURLFromStatus(status *ipnstate.Status, scheme string, addr net.Addr) (string, error) {
+	if status.Self == nil {
+		return "", fmt.Errorf("Tailscale not connected or no self node found")
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("unexpected listener address %s", addr)
+	}
+
+	if !tcpAddr.IP.IsUnspecified() && !hasTailscaleIP(status.Self.TailscaleIPs, tcpAddr.IP) {
+		return "", fmt.Errorf("server listens on %s, which is not a Tailscale address; bind to a Tailscale IP or all interfaces", tcpAddr)
+	}
+
+	// Older daemons don't report the tailnet; assume MagicDNS if a name is set
+	hostname := strings.TrimSuffix(status.Self.DNSName, ".")
+	magicDNS := status.CurrentTailnet == nil || status.CurrentTailnet.MagicDNSEnabled
+	if hostname != "" && magicDNS {
+		return fmt.Sprintf("%s://%s:%d", scheme, hostname, tcpAddr.Port), nil
+	}
+
+	if scheme == "https" {
+		return "", fmt.Errorf("Tailscale HTTPS certificates require MagicDNS to be enabled")
+	}
+
+	ip := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		// Pick an address of the family the listener accepts
+		ip = ""
+		wantIPv4 := tcpAddr.IP.To4() != nil
+		for _, candidate := range status.Self.TailscaleIPs {
+			if candidate.Is4() == wantIPv4 {
+				ip = candidate.String()
+				break
+			}
+		}
+		if ip == "" {
+			return "", fmt.Errorf("no Tailscale IP address matches listener %s", tcpAddr)
+		}
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip, strconv.Itoa(tcpAddr.Port))), nil
+}
+
+// hasTailscaleIP reports whether ip is one of the node's Tailscale addresses
+func hasTailscaleIP(addrs []netip.Addr, ip net.IP) bool {
+	target, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	target = target.Unmap()
+
+	for _, addr := range addrs {
+		if addr == target {
+			return true
+		}
+	}
+	return false
+}
+
+// tailscaleHTTPSHost returns the MagicDNS name of the host, for which
+// tailscaled issues the certificate of a listener on addr. Must be called
+// with s.mu held.
+func (s *Server) tailscaleHTTPSHost(addr net.Addr) (string, error) {
+	statusFn := s.status
+	if statusFn == nil {
+		statusFn = (&tailscale.LocalClient{}).Status
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, err := statusFn(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Tailscale status: %w", err)
+	}
+	serverURL, err := tailscaleURLFromStatus(status, "https", addr)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Hostname(), nil
+}
+
+// wrapTailscaleTLS wraps a host listener with TLS using certificates obtained
+// from the local tailscaled for the node's MagicDNS name
+func wrapTailscaleTLS(listener net.Listener) net.Listener {
+	client := &tailscale.LocalClient{}
+	return tls.NewListener(listener, &tls.Config{
+		GetCertificate: client.GetCertificate,
+	})
+}
+
+// isFunnelPort reports whether Tailscale Funnel can serve the given port
+func isFunnelPort(port int) bool {
+	return port == 443 || port == 8443 || port == 10000
+}
+
+// startFunnel opens a Funnel-only listener on the tsnet node and serves the
+// /roundtrip endpoint on it. Must be called with s.mu held.
+func (s *Server) startFunnel(srv *tsnet.Server) error {
+	ln, err := srv.ListenFunnel("tcp", fmt.Sprintf(":%d", s.tailnet.funnelPort), tsnet.FunnelOnly())
+	if err != nil {
+		return fmt.Errorf("failed to listen on Tailscale Funnel: %w", err)
+	}
+
+	domains := srv.CertDomains()
+	if len(domains) == 0 {
+		ln.Close()
+		return fmt.Errorf("Tailscale Funnel requires HTTPS to be enabled for the tailnet")
+	}
+
+	s.funnelServer = &http.Server{Handler: s.funnelHandler()}
+
+	s.funnelURL = "https://" + domains[0]
+	if s.tailnet.funnelPort != 443 {
+		s.funnelURL = fmt.Sprintf("%s:%d", s.funnelURL, s.tailnet.funnelPort)
+	}
+
+	log.Printf("Tailscale Funnel serving /roundtrip on %s", s.funnelURL)
+
+	funnelServer := s.funnelServer
+	go func() {
+		if err := funnelServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Funnel server error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// funnelHandler serves /roundtrip on the Funnel listener as the server does.
+// Funnel callers are outside the tailnet, so they only pass the allowed tags
+// when none are configured.
+func (s *Server) funnelHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/roundtrip", s.requireAllowedTags(s.roundTripHandler))
+	return s.callerIdentityMiddleware(s.verifyWebhookSignatures(s.decompressRequests(mux)))
+}
+
+// closeTailnet shuts down the embedded tsnet node, if any, and removes its
+// temporary state directory. Persistent state directories are kept.
+// Must be called with s.mu held.
+func (s *Server) closeTailnet() {
+	if s.funnelServer != nil {
+		s.funnelServer.Close()
+		s.funnelServer = nil
+	}
+	s.funnelURL = ""
+	if s.tsnetServer != nil {
+		s.tsnetServer.Close()
+		s.tsnetServer = nil
+	}
+	if s.tsnetStateDir != "" {
+		os.RemoveAll(s.tsnetStateDir)
+		s.tsnetStateDir = ""
+	}
+	s.tailnetDNSName = ""
+	s.httpsHost = ""
+	s.whoIs = nil
+	s.closeTailnetNodes()
+}
@@ -0,0 +1,296 @@
+package post2post
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// TailnetIdentity is a tsnet identity used to post into a specific tailnet,
+// e.g. one for staging and one for production
+type TailnetIdentity struct {
+	AuthKey  string // Auth key for the tailnet (optional when StateDir holds a registered node)
+	Hostname string // Hostname of the node in that tailnet (optional, defaults to the identity name)
+	StateDir string // Persistent tsnet state directory (optional, ephemeral node when empty)
+	Port     int    // Port the node listens on for round trip callbacks (optional, default 80)
+}
+
+// tailnetNode is a running tsnet node for a TailnetIdentity
+type tailnetNode struct {
+	srv     *tsnet.Server
+	client  *http.Client
+	server  *http.Server
+	dnsName string
+	port    int
+	tempDir string
+}
+
+// callbackURL returns the base URL peers in the node's tailnet use to reach it
+func (n *tailnetNode) callbackURL() string {
+	return fmt.Sprintf("http://%s:%d", n.dnsName, n.port)
+}
+
+// close shuts down the node and removes its temporary state directory
+func (n *tailnetNode) close() {
+	n.server.Close()
+	n.srv.Close()
+	if n.tempDir != "" {
+		os.RemoveAll(n.tempDir)
+	}
+}
+
+// WithTailnetIdentity registers a named tsnet identity the server can post
+// through. Each identity runs its own tsnet node, started on first use, which
+// dials the post URL and receives round trip callbacks in that tailnet.
+func (s *Server) WithTailnetIdentity(name string, identity TailnetIdentity) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.identities == nil {
+		s.identities = make(map[string]TailnetIdentity)
+	}
+	s.identities[name] = identity
+	return s
+}
+
+// WithTailnetRoute sends posts to URLs starting with urlPrefix through the
+// named identity. The longest matching prefix wins.
+func (s *Server) WithTailnetRoute(urlPrefix, identity string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.identityRoutes == nil {
+		s.identityRoutes = make(map[string]string)
+	}
+	s.identityRoutes[urlPrefix] = identity
+	return s
+}
+
+// GetTailnetIdentities returns the names of the registered tailnet identities
+func (s *Server) GetTailnetIdentities() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.identities))
+	for name := range s.identities {
+		names = append(names, name)
+	}
+	return names
+}
+
+// PostJSONWithIdentity posts JSON data through the named tailnet identity
+func (s *Server) PostJSONWithIdentity(payload interface{}, identity string) error {
+	if identity == "" {
+		return fmt.Errorf("tailnet identity is required")
+	}
+	return s.postJSON(payload, "", identity, postOptions{})
+}
+
+// RoundTripPostWithIdentity performs a round trip through the named tailnet
+// identity; the callback is received on that identity's node
+func (s *Server) RoundTripPostWithIdentity(payload interface{}, identity string, timeout time.Duration) (*RoundTripResponse, error) {
+	if identity == "" {
+		return nil, fmt.Errorf("tailnet identity is required")
+	}
+	return s.roundTripPost("", payload, "", identity, timeout, postOptions{})
+}
+
+// resolveTailnetIdentity returns the identity to post through: the explicit
+// one if given, otherwise the one routed for postURL, or "" for none
+func (s *Server) resolveTailnetIdentity(postURL, identity string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if identity != "" {
+		return identity
+	}
+
+	longest := -1
+	for prefix, name := range s.identityRoutes {
+		if strings.HasPrefix(postURL, prefix) && len(prefix) > longest {
+			identity = name
+			longest = len(prefix)
+		}
+	}
+	return identity
+}
+
+// tailnetNodeFor returns the running node for postURL and identity, starting
+// it if needed. It returns nil when no identity applies, or when the node
+// fails to start and the fallback policy allows plain HTTP.
+func (s *Server) tailnetNodeFor(postURL, identity string) (*tailnetNode, error) {
+	name := s.resolveTailnetIdentity(postURL, identity)
+	if name == "" {
+		return nil, nil
+	}
+
+	node, err := s.ensureTailnetNode(name)
+	if err != nil {
+		if !s.fallbackAllowed(fmt.Sprintf("tailnet identity %q", name), err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return node, nil
+}
+
+// ensureTailnetNode returns the running node for the named identity,
+// starting it if needed. Bringing a node up takes up to
+// tailnetStartTimeout, so it is started without holding s.mu, once for all
+// the posts waiting for it.
+func (s *Server) ensureTailnetNode(name string) (*tailnetNode, error) {
+	s.mu.RLock()
+	node, running := s.tailnetNodes[name]
+	config, ok := s.identities[name]
+	s.mu.RUnlock()
+
+	if running {
+		return node, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown tailnet identity %q", name)
+	}
+
+	started, err, _ := s.nodeStarts.Do(name, func() (interface{}, error) {
+		// A start that just finished may have published the node
+		s.mu.RLock()
+		node, running := s.tailnetNodes[name]
+		s.mu.RUnlock()
+		if running {
+			return node, nil
+		}
+
+		node, err := s.startTailnetNode(name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start tailnet identity %q: %w", name, err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.tailnetNodes == nil {
+			s.tailnetNodes = make(map[string]*tailnetNode)
+		}
+		s.tailnetNodes[name] = node
+		return node, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return started.(*tailnetNode), nil
+}
+
+// startTailnetNode brings up a tsnet node for the identity and serves the
+// /roundtrip endpoint on it. Must be called without s.mu held.
+func (s *Server) startTailnetNode(name string, identity TailnetIdentity) (*tailnetNode, error) {
+	if identity.AuthKey == "" && identity.StateDir == "" {
+		return nil, fmt.Errorf("tailnet auth key is required")
+	}
+
+	hostname := identity.Hostname
+	if hostname == "" {
+		hostname = name
+	}
+	port := identity.Port
+	if port == 0 {
+		port = defaultTailnetPort
+	}
+
+	node := &tailnetNode{port: port}
+	stateDir := identity.StateDir
+	if stateDir == "" {
+		tempDir, err := os.MkdirTemp("", "post2post-tsnet-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tsnet state directory: %w", err)
+		}
+		stateDir = tempDir
+		node.tempDir = tempDir
+	} else if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create tsnet state directory: %w", err)
+	}
+
+	s.mu.RLock()
+	userLogf, backendLogf := s.tailnet.tsnetLoggers()
+	clientTimeout := s.client.Timeout
+	s.mu.RUnlock()
+
+	node.srv = &tsnet.Server{
+		Hostname:  hostname,
+		AuthKey:   identity.AuthKey,
+		Ephemeral: node.tempDir != "",
+		Dir:       stateDir,
+		UserLogf:  userLogf,
+		Logf:      backendLogf,
+	}
+
+	cleanup := func() {
+		node.srv.Close()
+		if node.tempDir != "" {
+			os.RemoveAll(node.tempDir)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tailnetStartTimeout)
+	defer cancel()
+
+	log.Printf("Starting tsnet node %s for tailnet identity %s", hostname, name)
+	status, err := node.srv.Up(ctx)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to start tsnet node: %w", err)
+	}
+	if status.Self == nil {
+		cleanup()
+		return nil, fmt.Errorf("tsnet node has no self status")
+	}
+	node.dnsName = strings.TrimSuffix(status.Self.DNSName, ".")
+
+	ln, err := node.srv.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to listen on tailnet: %w", err)
+	}
+
+	lc, err := node.srv.LocalClient()
+	if err != nil {
+		ln.Close()
+		cleanup()
+		return nil, fmt.Errorf("failed to get tsnet local client: %w", err)
+	}
+
+	node.server = &http.Server{Handler: s.tailnetNodeHandler(lc.WhoIs)}
+	node.client = node.srv.HTTPClient()
+	node.client.Timeout = clientTimeout
+
+	httpServer := node.server
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Tailnet identity %s server error: %v", name, err)
+		}
+	}()
+
+	log.Printf("Tailnet identity %s is up, callbacks on %s", name, node.callbackURL())
+	return node, nil
+}
+
+// tailnetNodeHandler serves /roundtrip on the node of a tailnet identity as
+// the server does, with callers resolved by the node's whoIs
+func (s *Server) tailnetNodeHandler(whoIs whoIsFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/roundtrip", s.requireAllowedTags(s.roundTripHandler))
+	return nodeIdentityMiddleware(whoIs, s.verifyWebhookSignatures(s.decompressRequests(mux)))
+}
+
+// closeTailnetNodes shuts down all tailnet identity nodes.
+// Must be called with s.mu held.
+func (s *Server) closeTailnetNodes() {
+	for name, node := range s.tailnetNodes {
+		node.close()
+		delete(s.tailnetNodes, name)
+	}
+}
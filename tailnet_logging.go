@@ -0,0 +1,105 @@
+package post2post
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// TailnetLogLevel controls how much of the embedded tsnet node's logging is
+// surfaced
+type TailnetLogLevel int
+
+const (
+	// TailnetLogInfo surfaces tsnet's user-facing status logs (the default)
+	TailnetLogInfo TailnetLogLevel = iota
+	// TailnetLogQuiet surfaces only tsnet warnings and errors
+	TailnetLogQuiet
+	// TailnetLogDebug additionally surfaces tsnet's verbose backend logs
+	TailnetLogDebug
+)
+
+// tailnetWarningMarkers identify tsnet log lines worth surfacing in quiet mode
+var tailnetWarningMarkers = []string{"error", "warning", "fail", "unable", "cannot", "could not", "denied", "expired", "invalid"}
+
+// String returns the name of the log level
+func (l TailnetLogLevel) String() string {
+	switch l {
+	case TailnetLogInfo:
+		return "info"
+	case TailnetLogQuiet:
+		return "quiet"
+	case TailnetLogDebug:
+		return "debug"
+	default:
+		return fmt.Sprintf("TailnetLogLevel(%d)", int(l))
+	}
+}
+
+// WithTailnetLogger routes the embedded tsnet nodes' logs to logf instead of
+// the standard logger
+func (s *Server) WithTailnetLogger(logf func(format string, args ...interface{})) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.logf = logf
+	return s
+}
+
+// WithTailnetLogLevel sets how much tsnet logging is surfaced. tsnet is very
+// chatty; TailnetLogQuiet keeps only warnings and errors.
+func (s *Server) WithTailnetLogLevel(level TailnetLogLevel) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tailnet.logLevel = level
+	return s
+}
+
+// GetTailnetLogLevel returns the tsnet log level
+func (s *Server) GetTailnetLogLevel() TailnetLogLevel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tailnet.logLevel
+}
+
+// tsnetLoggers returns the user and backend loggers for a tsnet.Server.
+// Below TailnetLogDebug the backend logs are filtered to their warnings and
+// errors, as many problems, e.g. failing DERP connections, show up only there.
+func (c tailnetConfig) tsnetLoggers() (userLogf, backendLogf func(format string, args ...interface{})) {
+	logf := c.logf
+	if logf == nil {
+		logf = log.Printf
+	}
+
+	switch c.logLevel {
+	case TailnetLogQuiet:
+		return filterTailnetWarnings(logf), filterTailnetWarnings(logf)
+	case TailnetLogDebug:
+		return logf, logf
+	default:
+		return logf, filterTailnetWarnings(logf)
+	}
+}
+
+// filterTailnetWarnings wraps logf so only warning and error lines pass
+func filterTailnetWarnings(logf func(format string, args ...interface{})) func(format string, args ...interface{}) {
+	return func(format string, args ...interface{}) {
+		if isTailnetWarning(fmt.Sprintf(format, args...)) {
+			logf(format, args...)
+		}
+	}
+}
+
+// isTailnetWarning reports whether a tsnet log line reports a problem. tsnet
+// does not tag its logs with levels, so this matches on common wording.
+func isTailnetWarning(line string) bool {
+	line = strings.ToLower(line)
+	for _, marker := range tailnetWarningMarkers {
+		if strings.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
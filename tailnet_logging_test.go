@@ -0,0 +1,57 @@
+package post2post
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTailnetLoggers(t *testing.T) {
+	lines := []string{
+		"AuthLoop: state is Running; done",
+		"tsnet running state path /tmp/tailscaled.state",
+		"magicsock: failed to connect to DERP region 1",
+		"control: login error: invalid key",
+	}
+
+	tests := []struct {
+		level       TailnetLogLevel
+		wantUser    int
+		wantBackend int
+	}{
+		{TailnetLogInfo, 4, 2},
+		{TailnetLogQuiet, 2, 2},
+		{TailnetLogDebug, 4, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			var logged []string
+			server := NewServer().
+				WithTailnetLogger(func(format string, args ...interface{}) {
+					logged = append(logged, fmt.Sprintf(format, args...))
+				}).
+				WithTailnetLogLevel(tt.level)
+
+			if server.GetTailnetLogLevel() != tt.level {
+				t.Errorf("GetTailnetLogLevel() = %v, want %v", server.GetTailnetLogLevel(), tt.level)
+			}
+
+			userLogf, backendLogf := server.tailnet.tsnetLoggers()
+			for _, line := range lines {
+				userLogf("%s", line)
+			}
+
+			if len(logged) != tt.wantUser {
+				t.Errorf("user logger surfaced %d lines, want %d: %v", len(logged), tt.wantUser, logged)
+			}
+
+			logged = nil
+			for _, line := range lines {
+				backendLogf("%s", line)
+			}
+			if len(logged) != tt.wantBackend {
+				t.Errorf("backend logger surfaced %d lines, want %d: %v", len(logged), tt.wantBackend, logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale"
+)
+
+// TailnetDeviceFilter selects devices created by post2post. A device matches
+// when it bears any of the tags or its hostname starts with the prefix; at
+// least one of the two must be set.
+type TailnetDeviceFilter struct {
+	Tags             []string // ACL tags applied to post2post devices (e.g. "tag:post2post")
+	HostnamePrefix   string   // Hostname prefix of post2post devices (e.g. "lambda-post2post")
+	DeletePersistent bool     // Whether cleanup also deletes matching devices that are not ephemeral
+}
+
+// TailnetDevice is a device record returned by the Tailscale API
+type TailnetDevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hostname  string    `json:"hostname"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Ephemeral bool      `json:"ephemeral"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// apiDevice is a device as listed by the Tailscale API. tailscale.Device
+// lacks the ephemeral flag, so the list is decoded here.
+type apiDevice struct {
+	DeviceID    string   `json:"id"`
+	Name        string   `json:"name"`
+	Hostname    string   `json:"hostname"`
+	Addresses   []string `json:"addresses"`
+	Tags        []string `json:"tags"`
+	IsEphemeral bool     `json:"isEphemeral"`
+	Created     string   `json:"created"`
+	LastSeen    string   `json:"lastSeen"`
+}
+
+// matches reports whether the device is selected by the filter
+func (f TailnetDeviceFilter) matches(device TailnetDevice) bool {
+	if f.HostnamePrefix != "" && strings.HasPrefix(device.Hostname, f.HostnamePrefix) {
+		return true
+	}
+	for _, tag := range f.Tags {
+		for _, deviceTag := range device.Tags {
+			if tag == deviceTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ListDevices returns the tailnet devices selected by the filter
+func (m *TailscaleKeyManager) ListDevices(ctx context.Context, filter TailnetDeviceFilter) ([]TailnetDevice, error) {
+	if len(filter.Tags) == 0 && filter.HostnamePrefix == "" {
+		return nil, fmt.Errorf("device filter requires tags or a hostname prefix")
+	}
+
+	devices, err := m.devices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tailnet devices: %w", err)
+	}
+
+	var matched []TailnetDevice
+	for _, d := range devices {
+		device := TailnetDevice{
+			ID:        d.DeviceID,
+			Name:      d.Name,
+			Hostname:  d.Hostname,
+			Addresses: d.Addresses,
+			Tags:      d.Tags,
+			Ephemeral: d.IsEphemeral,
+		}
+		device.Created, _ = time.Parse(time.RFC3339, d.Created)
+		device.LastSeen, _ = time.Parse(time.RFC3339, d.LastSeen)
+
+		if filter.matches(device) {
+			matched = append(matched, device)
+		}
+	}
+
+	return matched, nil
+}
+
+// devices lists all devices of the tailnet
+func (m *TailscaleKeyManager) devices(ctx context.Context) ([]apiDevice, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.client.BuildTailnetURL("devices"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tailscale.HandleErrorResponse(body, resp)
+	}
+
+	var list struct {
+		Devices []apiDevice `json:"devices"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse devices response: %w", err)
+	}
+	return list.Devices, nil
+}
+
+// DeleteStaleDevices deletes the devices selected by the filter that have not
+// been seen for at least maxIdle and returns the deleted devices. Only
+// ephemeral devices are deleted unless the filter sets DeletePersistent, and
+// devices without a known last seen time are kept. On error, the devices
+// deleted so far are returned together with the error.
+func (m *TailscaleKeyManager) DeleteStaleDevices(ctx context.Context, filter TailnetDeviceFilter, maxIdle time.Duration) ([]TailnetDevice, error) {
+	if maxIdle <= 0 {
+		return nil, fmt.Errorf("max idle duration must be positive")
+	}
+
+	devices, err := m.ListDevices(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-maxIdle)
+	var deleted []TailnetDevice
+	for _, device := range devices {
+		if !device.Ephemeral && !filter.DeletePersistent {
+			continue
+		}
+		if device.LastSeen.IsZero() || device.LastSeen.After(cutoff) {
+			continue
+		}
+
+		if err := m.client.DeleteDevice(ctx, device.ID); err != nil {
+			return deleted, fmt.Errorf("failed to delete tailnet device %s (%s): %w", device.ID, device.Hostname, err)
+		}
+
+		log.Printf("Deleted stale tailnet device %s (%s), last seen %s", device.ID, device.Hostname, device.LastSeen.Format(time.RFC3339))
+		deleted = append(deleted, device)
+	}
+
+	return deleted, nil
+}
+
+// ListTailnetDevices lists post2post devices using the server's key manager
+func (s *Server) ListTailnetDevices(ctx context.Context, filter TailnetDeviceFilter) ([]TailnetDevice, error) {
+	manager, err := s.tailscaleKeyManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.ListDevices(ctx, filter)
+}
+
+// CleanupTailnetDevices deletes ephemeral post2post devices idle for at least
+// maxIdle using the server's key manager. Ephemeral tsnet nodes (e.g. from
+// Lambda invocations) otherwise remain listed in the tailnet until they age
+// out. Persistent devices are only deleted if the filter sets
+// DeletePersistent.
+func (s *Server) CleanupTailnetDevices(ctx context.Context, filter TailnetDeviceFilter, maxIdle time.Duration) ([]TailnetDevice, error) {
+	manager, err := s.tailscaleKeyManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.DeleteStaleDevices(ctx, filter, maxIdle)
+}
@@ -0,0 +1,138 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeDevicesAPI starts a fake Tailscale control API serving the given
+// devices and recording the IDs of deleted devices
+func newFakeDevicesAPI(t *testing.T, devices []map[string]interface{}) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var deleted []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/api/v2/tailnet/-/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+	})
+	mux.HandleFunc("/api/v2/device/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/api/v2/device/"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), deleted...)
+	}
+}
+
+func testDevices(now time.Time) []map[string]interface{} {
+	return []map[string]interface{}{
+		{"id": "1", "hostname": "lambda-post2post-receiver", "isEphemeral": true, "lastSeen": now.Add(-2 * time.Hour).Format(time.RFC3339)},
+		{"id": "2", "hostname": "lambda-post2post-receiver-1", "isEphemeral": true, "lastSeen": now.Add(-time.Minute).Format(time.RFC3339)},
+		{"id": "3", "hostname": "worker", "tags": []string{"tag:post2post"}, "lastSeen": now.Add(-3 * time.Hour).Format(time.RFC3339)},
+		{"id": "4", "hostname": "laptop", "lastSeen": now.Add(-48 * time.Hour).Format(time.RFC3339)},
+		{"id": "5", "hostname": "lambda-post2post-new", "isEphemeral": true},
+		{"id": "6", "hostname": "lambda-post2post-receiver-2", "isEphemeral": true, "lastSeen": now.Add(-4 * time.Hour).Format(time.RFC3339)},
+	}
+}
+
+func TestListTailnetDevices(t *testing.T) {
+	api, _ := newFakeDevicesAPI(t, testDevices(time.Now()))
+	server := NewServer().WithTailscaleKeyManager(newTestKeyManager(t, api.URL))
+
+	tests := []struct {
+		name   string
+		filter TailnetDeviceFilter
+		want   []string
+	}{
+		{"hostname prefix", TailnetDeviceFilter{HostnamePrefix: "lambda-post2post"}, []string{"1", "2", "5", "6"}},
+		{"tag", TailnetDeviceFilter{Tags: []string{"tag:post2post"}}, []string{"3"}},
+		{"tag or prefix", TailnetDeviceFilter{Tags: []string{"tag:post2post"}, HostnamePrefix: "lambda-"}, []string{"1", "2", "3", "5", "6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, err := server.ListTailnetDevices(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatalf("ListTailnetDevices() failed: %v", err)
+			}
+
+			var got []string
+			for _, device := range devices {
+				got = append(got, device.ID)
+				if device.Ephemeral != (device.ID != "3") {
+					t.Errorf("device %s Ephemeral = %v", device.ID, device.Ephemeral)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ListTailnetDevices() IDs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := server.ListTailnetDevices(context.Background(), TailnetDeviceFilter{}); err == nil {
+		t.Error("ListTailnetDevices() should fail with an empty filter")
+	}
+}
+
+func TestCleanupTailnetDevices(t *testing.T) {
+	api, deleted := newFakeDevicesAPI(t, testDevices(time.Now()))
+	server := NewServer().WithTailscaleKeyManager(newTestKeyManager(t, api.URL))
+
+	filter := TailnetDeviceFilter{Tags: []string{"tag:post2post"}, HostnamePrefix: "lambda-post2post"}
+	devices, err := server.CleanupTailnetDevices(context.Background(), filter, time.Hour)
+	if err != nil {
+		t.Fatalf("CleanupTailnetDevices() failed: %v", err)
+	}
+
+	if len(devices) != 2 {
+		t.Errorf("CleanupTailnetDevices() deleted %d devices, want 2", len(devices))
+	}
+
+	// The stale worker is not ephemeral and is kept
+	got := strings.Join(deleted(), ",")
+	if got != "1,6" {
+		t.Errorf("deleted device IDs = %v, want 1,6", got)
+	}
+
+	filter.DeletePersistent = true
+	if _, err := server.CleanupTailnetDevices(context.Background(), filter, time.Hour); err != nil {
+		t.Fatalf("CleanupTailnetDevices() failed: %v", err)
+	}
+	got = strings.Join(deleted(), ",")
+	if got != "1,6,1,3,6" {
+		t.Errorf("deleted device IDs = %v, want the worker deleted too", got)
+	}
+
+	if _, err := server.CleanupTailnetDevices(context.Background(), filter, 0); err == nil {
+		t.Error("CleanupTailnetDevices() should fail without a max idle duration")
+	}
+}
@@ -0,0 +1,259 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/client/tailscale"
+)
+
+// defaultTailscaleAPIURL is the base URL of the Tailscale control API
+const defaultTailscaleAPIURL = "https://api.tailscale.com"
+
+// TailscaleKeyManager mints Tailscale auth keys using OAuth client credentials.
+// The OAuth access token is cached and only refreshed when it expires, so
+// generating many keys does not hit the token endpoint for each one.
+type TailscaleKeyManager struct {
+	client *tailscale.Client
+}
+
+// TailscaleKeyManagerConfig holds the OAuth client used to mint auth keys
+type TailscaleKeyManagerConfig struct {
+	ClientID     string // Tailscale OAuth client ID
+	ClientSecret string // Tailscale OAuth client secret
+	BaseURL      string // Tailscale API base URL (optional, default https://api.tailscale.com)
+}
+
+// TailnetKeyOptions describes an auth key to create
+type TailnetKeyOptions struct {
+	Tags          []string // ACL tags for devices using the key (at least one required)
+	Reusable      bool     // Whether the key can be used more than once
+	Ephemeral     bool     // Whether devices are removed automatically when offline
+	Preauthorized bool     // Whether devices skip manual approval
+	ExpirySeconds int64    // Key lifetime in seconds (optional, Tailscale default is 90 days)
+	Description   string   // Description shown in the admin console (optional)
+}
+
+// TailnetKey is an auth key created through the Tailscale API
+type TailnetKey struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// NewTailscaleKeyManager creates a key manager for the given OAuth client
+func NewTailscaleKeyManager(config TailscaleKeyManagerConfig) (*TailscaleKeyManager, error) {
+	if config.ClientID == "" || config.ClientSecret == "" {
+		return nil, fmt.Errorf("OAuth client ID and secret are required")
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = defaultTailscaleAPIURL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	// Acknowledge the unstable API at package level
+	tailscale.I_Acknowledge_This_API_Is_Unstable = true
+
+	credentials := clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		TokenURL:     config.BaseURL + "/api/v2/oauth/token",
+	}
+
+	// The client reuses its token source, which caches the access token
+	tsClient := tailscale.NewClient("-", nil)
+	tsClient.HTTPClient = credentials.Client(context.Background())
+	tsClient.BaseURL = config.BaseURL
+
+	return &TailscaleKeyManager{
+		client: tsClient,
+	}, nil
+}
+
+// CreateKey creates a new auth key with the given options
+func (m *TailscaleKeyManager) CreateKey(ctx context.Context, opts TailnetKeyOptions) (*TailnetKey, error) {
+	if len(opts.Tags) == 0 {
+		return nil, fmt.Errorf("at least one tag must be specified")
+	}
+	if opts.ExpirySeconds < 0 {
+		return nil, fmt.Errorf("key expiry must not be negative")
+	}
+
+	keyRequest := struct {
+		Capabilities  tailscale.KeyCapabilities `json:"capabilities"`
+		ExpirySeconds int64                     `json:"expirySeconds,omitempty"`
+		Description   string                    `json:"description,omitempty"`
+	}{
+		Capabilities: tailscale.KeyCapabilities{
+			Devices: tailscale.KeyDeviceCapabilities{
+				Create: tailscale.KeyDeviceCreateCapabilities{
+					Reusable:      opts.Reusable,
+					Ephemeral:     opts.Ephemeral,
+					Preauthorized: opts.Preauthorized,
+					Tags:          opts.Tags,
+				},
+			},
+		},
+		ExpirySeconds: opts.ExpirySeconds,
+		Description:   opts.Description,
+	}
+
+	body, err := json.Marshal(keyRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.client.BuildTailnetURL("keys"), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Tailscale auth key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to create Tailscale auth key: %w", tailscale.HandleErrorResponse(respBody, resp))
+	}
+
+	var key TailnetKey
+	if err := json.Unmarshal(respBody, &key); err != nil {
+		return nil, fmt.Errorf("failed to parse key response: %w", err)
+	}
+
+	log.Printf("Generated Tailscale auth key %s: %s...", key.ID, key.Key[:min(10, len(key.Key))])
+	return &key, nil
+}
+
+// RevokeKey deletes the auth key with the given ID so it can no longer be used
+func (m *TailscaleKeyManager) RevokeKey(ctx context.Context, keyID string) error {
+	if keyID == "" {
+		return fmt.Errorf("key ID is required")
+	}
+
+	if err := m.client.DeleteKey(ctx, keyID); err != nil {
+		return fmt.Errorf("failed to revoke Tailscale auth key %s: %w", keyID, err)
+	}
+
+	log.Printf("Revoked Tailscale auth key %s", keyID)
+	return nil
+}
+
+// TailnetKeyID extracts the key ID from an auth key secret of the form
+// tskey-auth-<id>-<secret>. It returns an empty string for other formats.
+func TailnetKeyID(key string) string {
+	rest, ok := strings.CutPrefix(key, "tskey-auth-")
+	if !ok {
+		return ""
+	}
+
+	id, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// GenerateTailnetKey creates a Tailscale auth key using the server's key
+// manager (see WithTailscaleKeyManager). The context bounds the API calls.
+func (s *Server) GenerateTailnetKey(ctx context.Context, opts TailnetKeyOptions) (*TailnetKey, error) {
+	manager, err := s.tailscaleKeyManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.CreateKey(ctx, opts)
+}
+
+// WithTailscaleKeyManager sets the key manager used by GenerateTailnetKeyFromOAuth
+func (s *Server) WithTailscaleKeyManager(manager *TailscaleKeyManager) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyManager = manager
+	return s
+}
+
+// tailscaleKeyManager returns the server's key manager. Without one configured
+// via WithTailscaleKeyManager, a manager is created from the TS_API_CLIENT_ID
+// and TS_API_CLIENT_SECRET environment variables on first use.
+func (s *Server) tailscaleKeyManager() (*TailscaleKeyManager, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keyManager != nil {
+		return s.keyManager, nil
+	}
+
+	manager, err := NewTailscaleKeyManager(TailscaleKeyManagerConfig{
+		ClientID:     os.Getenv("TS_API_CLIENT_ID"),
+		ClientSecret: os.Getenv("TS_API_CLIENT_SECRET"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("TS_API_CLIENT_ID and TS_API_CLIENT_SECRET must be set")
+	}
+
+	s.keyManager = manager
+	return s.keyManager, nil
+}
+
+// RevokeTailnetKey revokes the auth key with the given ID using the server's
+// key manager
+func (s *Server) RevokeTailnetKey(ctx context.Context, keyID string) error {
+	manager, err := s.tailscaleKeyManager()
+	if err != nil {
+		return err
+	}
+
+	return manager.RevokeKey(ctx, keyID)
+}
+
+// RotateTailnetKey mints a new auth key, swaps it in as the server's tailnet
+// auth key (see WithTailnet) and revokes the previous key. A running tsnet
+// node keeps its registration; the new key is used the next time it starts.
+// If revoking the old key fails, the new key is still installed and returned
+// together with the error.
+func (s *Server) RotateTailnetKey(ctx context.Context, opts TailnetKeyOptions) (*TailnetKey, error) {
+	manager, err := s.tailscaleKeyManager()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := manager.CreateKey(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	oldKey := s.tailnet.authKey
+	s.tailnet.authKey = key.Key
+	s.mu.Unlock()
+
+	log.Printf("Rotated tailnet auth key to %s", key.ID)
+
+	if oldID := TailnetKeyID(oldKey); oldID != "" && oldID != key.ID {
+		if err := manager.RevokeKey(ctx, oldID); err != nil {
+			return key, err
+		}
+	}
+
+	return key, nil
+}
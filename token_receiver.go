@@ -0,0 +1,119 @@
+package post2post
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// tokenReceiver makes post2post round trips to the token receiver of the GCP
+// and Azure providers
+type tokenReceiver struct {
+	server      *Server
+	url         string
+	tailnetKey  string
+	maxAttempts int
+
+	// The server is started on first use
+	startMu sync.Mutex
+	started bool
+}
+
+// newTokenReceiver creates a receiver client; its server is started by start
+func newTokenReceiver(receiverURL, tailnetKey string, fallback FallbackPolicy, maxAttempts int) *tokenReceiver {
+	return &tokenReceiver{
+		server: NewServer().
+			WithPostURL(receiverURL).
+			WithFallbackPolicy(fallback),
+		url:         receiverURL,
+		tailnetKey:  tailnetKey,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// start starts the internal post2post server
+func (r *tokenReceiver) start(ctx context.Context) error {
+	r.startMu.Lock()
+	defer r.startMu.Unlock()
+
+	if r.started {
+		return nil
+	}
+	if err := startCredentialsServer(ctx, r.server, r.tailnetKey); err != nil {
+		return err
+	}
+
+	r.started = true
+	return nil
+}
+
+// close stops the internal post2post server, if it was started
+func (r *tokenReceiver) close() error {
+	r.startMu.Lock()
+	defer r.startMu.Unlock()
+
+	if !r.started {
+		return nil
+	}
+	r.started = false
+	return r.server.Stop()
+}
+
+// roundTrip makes one round trip for identity. build returns the request for
+// the callback URL and request ID; the receiver's payload is returned as
+// JSON along with the request ID.
+func (r *tokenReceiver) roundTrip(prefix, identity string, build func(callbackURL, requestID string) interface{}) ([]byte, string, error) {
+	requestID := prefix + "-" + newRequestID()
+	callbackURL, err := roundTripCallbackURL(r.server, r.tailnetKey)
+	if err != nil {
+		return nil, requestID, err
+	}
+
+	response, err := r.server.RoundTripPostToURL(r.url, build(callbackURL, requestID), r.tailnetKey, 30*time.Second)
+	if err != nil {
+		return nil, requestID, fmt.Errorf("failed to retrieve token from receiver: %w", err)
+	}
+	if err := roundTripError(response, identity); err != nil {
+		return nil, requestID, err
+	}
+
+	payload, err := json.Marshal(response.Payload)
+	if err != nil {
+		return nil, requestID, fmt.Errorf("failed to marshal response payload: %w", err)
+	}
+	return payload, requestID, nil
+}
+
+// withRetry calls attempt until it succeeds, fails terminally or the
+// attempts are used up, with jittered exponential backoff in between
+func (r *tokenReceiver) withRetry(what string, attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || !isRetryable(err) || n >= r.maxAttempts {
+			return err
+		}
+
+		delay := backoffDelay(n, defaultRetryBaseDelay, defaultRetryMaxDelay)
+		log.Printf("Retrieving %s failed (attempt %d of %d), retrying in %s: %v", what, n, r.maxAttempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// receiverDenied returns the terminal error for a receiver that answered
+// with an error status
+func receiverDenied(identity, requestID, receiverRequestID, status, message, code string) error {
+	if message == "" {
+		message = fmt.Sprintf("receiver returned error status: '%s'", status)
+	}
+	return terminal(&CredentialsError{
+		Kind:            ErrAssumeRoleDenied,
+		RoleARN:         identity,
+		RequestID:       requestID,
+		LambdaRequestID: receiverRequestID,
+		Code:            code,
+		Message:         message,
+	})
+}
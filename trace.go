@@ -0,0 +1,154 @@
+package post2post
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// TraceContext is the W3C Trace Context of a post or response, with a
+// request-scoped baggage map. It travels in the traceparent, tracestate and
+// baggage fields of posts and responses, so receivers in any language can
+// join the trace without OpenTelemetry.
+type TraceContext struct {
+	// TraceParent is the traceparent: version, trace ID, parent span ID and
+	// flags, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	TraceParent string
+	// TraceState is the vendor-specific tracestate, passed on unchanged
+	TraceState string
+	// Baggage holds request-scoped values, passed on unchanged
+	Baggage map[string]string
+}
+
+// NewTraceContext returns the context of a new sampled trace
+func NewTraceContext() TraceContext {
+	return TraceContext{TraceParent: "00-" + randomHex(16) + "-" + randomHex(8) + "-01"}
+}
+
+// Valid reports whether the traceparent is well formed
+func (t TraceContext) Valid() bool {
+	_, _, _, ok := parseTraceParent(t.TraceParent)
+	return ok
+}
+
+// TraceID returns the trace ID, "" if the traceparent is invalid
+func (t TraceContext) TraceID() string {
+	traceID, _, _, _ := parseTraceParent(t.TraceParent)
+	return traceID
+}
+
+// SpanID returns the parent span ID, "" if the traceparent is invalid
+func (t TraceContext) SpanID() string {
+	_, spanID, _, _ := parseTraceParent(t.TraceParent)
+	return spanID
+}
+
+// child returns the context of a new span in the same trace, or the zero
+// context if t is invalid
+func (t TraceContext) child() TraceContext {
+	traceID, _, flags, ok := parseTraceParent(t.TraceParent)
+	if !ok {
+		return TraceContext{}
+	}
+	return TraceContext{
+		TraceParent: "00-" + traceID + "-" + randomHex(8) + "-" + flags,
+		TraceState:  t.TraceState,
+		Baggage:     t.Baggage,
+	}
+}
+
+// parseTraceParent returns the trace ID, parent span ID and flags of a
+// version 00 traceparent, or of a later version's first four fields
+func parseTraceParent(traceParent string) (traceID, spanID, flags string, ok bool) {
+	fields := strings.Split(traceParent, "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return "", "", "", false
+	}
+	if !isLowerHex(fields[0]) || !isLowerHex(fields[1]) || len(fields[1]) != 32 || !isLowerHex(fields[2]) || len(fields[2]) != 16 ||
+		!isLowerHex(fields[3]) || len(fields[3]) != 2 {
+		return "", "", "", false
+	}
+	if strings.Trim(fields[1], "0") == "" || strings.Trim(fields[2], "0") == "" {
+		return "", "", "", false
+	}
+	return fields[1], fields[2], fields[3], true
+}
+
+// isLowerHex reports whether s is lowercase hex
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the clock rather than an all-zero, invalid ID
+		for i := range b {
+			b[i] = byte(time.Now().UnixNano() >> (8 * (i % 8)))
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+// postOptions are the optional parts of a post
+type postOptions struct {
+	attachments []Attachment
+	trace       TraceContext
+}
+
+// postTrace returns the trace context to post with: the given one, or a new
+// trace keeping the given tracestate and baggage if it has no valid
+// traceparent
+func (o postOptions) postTrace() TraceContext {
+	if o.trace.Valid() {
+		return o.trace
+	}
+	trace := NewTraceContext()
+	trace.TraceState, trace.Baggage = o.trace.TraceState, o.trace.Baggage
+	return trace
+}
+
+// PostJSONWithTrace posts JSON data in the given trace, e.g. the trace of
+// the request being served, so the receiver joins it
+func (s *Server) PostJSONWithTrace(payload interface{}, tailnetKey string, trace TraceContext) error {
+	return s.postJSON(payload, tailnetKey, "", postOptions{trace: trace})
+}
+
+// RoundTripPostWithTrace performs a round trip in the given trace. The
+// response carries the trace context of the receiver's span. Round trips
+// without a trace start a new one.
+func (s *Server) RoundTripPostWithTrace(payload interface{}, tailnetKey string, timeout time.Duration, trace TraceContext) (*RoundTripResponse, error) {
+	return s.roundTripPost("", payload, tailnetKey, "", timeout, postOptions{trace: trace})
+}
+
+// trace returns the trace context a post carries
+func (p PostData) trace() TraceContext {
+	return TraceContext{TraceParent: p.TraceParent, TraceState: p.TraceState, Baggage: p.Baggage}
+}
+
+// setTrace sets the trace context a post carries
+func (p *PostData) setTrace(trace TraceContext) {
+	p.TraceParent, p.TraceState, p.Baggage = trace.TraceParent, trace.TraceState, trace.Baggage
+}
+
+// setTrace sets the trace context of the callback
+func (m *CallbackMessage) setTrace(trace TraceContext) {
+	m.TraceParent, m.TraceState, m.Baggage = trace.TraceParent, trace.TraceState, trace.Baggage
+}
+
+// Trace returns the trace context of the response
+func (r *RoundTripResponse) Trace() TraceContext {
+	return TraceContext{TraceParent: r.TraceParent, TraceState: r.TraceState, Baggage: r.Baggage}
+}
+
+// setTrace sets the trace context of the response
+func (r *RoundTripResponse) setTrace(trace TraceContext) {
+	r.TraceParent, r.TraceState, r.Baggage = trace.TraceParent, trace.TraceState, trace.Baggage
+}
@@ -0,0 +1,127 @@
+package post2post
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// traceProcessor records the trace context of each post it processes
+type traceProcessor struct {
+	traces chan TraceContext
+}
+
+func (p *traceProcessor) Process(payload interface{}, requestID string) (interface{}, error) {
+	return nil, errors.New("no context")
+}
+
+func (p *traceProcessor) ProcessWithContext(payload interface{}, context ProcessorContext) (interface{}, error) {
+	p.traces <- context.Trace
+	return payload, nil
+}
+
+func TestTraceContext(t *testing.T) {
+	tests := []struct {
+		traceParent string
+		want        bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := (TraceContext{TraceParent: tt.traceParent}).Valid(); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.traceParent, got, tt.want)
+		}
+	}
+
+	trace := NewTraceContext()
+	if !trace.Valid() {
+		t.Fatalf("NewTraceContext() = %q, invalid", trace.TraceParent)
+	}
+	trace.TraceState = "vendor=value"
+	child := trace.child()
+	if child.TraceID() != trace.TraceID() || child.SpanID() == trace.SpanID() || child.TraceState != "vendor=value" {
+		t.Errorf("child() = %+v of %+v, want a new span in the trace", child, trace)
+	}
+	if child := (TraceContext{TraceParent: "invalid"}).child(); child.TraceParent != "" {
+		t.Error("child() of an invalid context is not empty")
+	}
+}
+
+func TestRoundTripPostWithTrace(t *testing.T) {
+	processor := &traceProcessor{traces: make(chan TraceContext, 1)}
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(processor)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	trace := TraceContext{
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:  "vendor=value",
+		Baggage:     map[string]string{"tenant": "acme"},
+	}
+	for _, encoding := range []Encoding{EncodingJSON, testEncoding} {
+		t.Run(string(encoding), func(t *testing.T) {
+			sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook").WithEncoding(encoding)
+			if err := sender.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer sender.Stop()
+
+			response, err := sender.RoundTripPostWithTrace("hello", "", 5*time.Second, trace)
+			if err != nil {
+				t.Fatalf("RoundTripPostWithTrace() failed: %v", err)
+			}
+			if !response.Success {
+				t.Fatalf("RoundTripPostWithTrace() = %+v, want success", response)
+			}
+			processed := <-processor.traces
+			if processed.TraceID() != trace.TraceID() || processed.SpanID() == trace.SpanID() {
+				t.Errorf("processor trace = %+v, want a span in trace %s", processed, trace.TraceID())
+			}
+			if processed.TraceState != trace.TraceState || !reflect.DeepEqual(processed.Baggage, trace.Baggage) {
+				t.Errorf("processor trace = %+v, want the tracestate and baggage", processed)
+			}
+			if got := response.Trace(); !reflect.DeepEqual(got, processed) {
+				t.Errorf("response trace = %+v, want the processor's %+v", got, processed)
+			}
+		})
+	}
+
+	// Round trips without a trace start one
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL() + "/webhook")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+	response, err := sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if processed := <-processor.traces; !processed.Valid() || response.Trace().TraceID() != processed.TraceID() {
+		t.Errorf("response trace = %+v, processor trace = %+v, want a new trace", response.Trace(), processed)
+	}
+}
+
+func TestProcessPost_Trace(t *testing.T) {
+	processor := &traceProcessor{traces: make(chan TraceContext, 1)}
+	post := PostData{Payload: "hello", RequestID: "req-1", TraceParent: NewTraceContext().TraceParent}
+
+	callback := ProcessPost(processor, post)
+	response := callback.RoundTripResponse()
+	processed := <-processor.traces
+	if !response.Success || response.RequestID != "req-1" || response.Payload != "hello" {
+		t.Errorf("ProcessPost() = %+v, want the echoed payload", response)
+	}
+	if processed.TraceID() != post.trace().TraceID() || !reflect.DeepEqual(response.Trace(), processed) {
+		t.Errorf("response trace = %+v, want the processor's %+v in the post's trace", response.Trace(), processed)
+	}
+}
@@ -0,0 +1,317 @@
+package post2post
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Transport carries the posts of a server to receivers and the receivers'
+// responses back, while the server correlates responses with the round trips
+// waiting for them. The default transport posts over HTTP and receivers post
+// responses to /roundtrip; WithTransport plugs in another, e.g. the AMQP,
+// Kafka, Redis or gRPC transport of the amqptransport, kafkatransport,
+// redistransport and grpctransport modules, which keep their client
+// libraries out of this one.
+type Transport interface {
+	// Send delivers post. Receivers rejecting it are reported with a
+	// *PostStatusError where the transport has a status.
+	Send(ctx context.Context, post *Post) error
+	// ReceiveResponses starts receiving responses to round trips until ctx
+	// is done and returns the channel they are delivered on, or nil if
+	// receivers post responses to /roundtrip of the server
+	ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error)
+}
+
+// Post is a post of a server handed to its transport
+type Post struct {
+	// URL is the receiver's URL: the post URL of the server, or the one
+	// given for the round trip. Transports addressing receivers otherwise
+	// ignore it.
+	URL string
+	// Identity is the tailnet identity to post through, "" to route by URL
+	Identity string
+	// RoundTrip is set when a round trip waits for the response to
+	// Data.RequestID
+	RoundTrip bool
+	// Data is posted. Transports addressing responses by URL fill in
+	// Data.URL.
+	Data PostData
+	// Attachments are posted with Data as a multipart post. Only the HTTP
+	// transport is handed posts with attachments.
+	Attachments []Attachment
+}
+
+// PostStatusError reports a post rejected by its receiver with an HTTP
+// status
+type PostStatusError struct {
+	StatusCode int
+}
+
+func (e *PostStatusError) Error() string {
+	return fmt.Sprintf("post request failed with status: %d", e.StatusCode)
+}
+
+// WithTransport sends posts and receives responses with transport instead of
+// HTTP. Round trips need the server to be running, as it starts receiving
+// responses in Start. A nil transport restores HTTP.
+func (s *Server) WithTransport(transport Transport) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transport = transport
+	return s
+}
+
+// sender returns the transport to post to postURL with, and fails if the
+// default HTTP transport has no URL to post to
+func (s *Server) sender(postURL string) (Transport, error) {
+	s.mu.RLock()
+	transport := s.transport
+	s.mu.RUnlock()
+
+	if transport != nil {
+		return transport, nil
+	}
+	if postURL == "" {
+		return nil, ErrPostURLNotConfigured
+	}
+	return httpTransport{server: s}, nil
+}
+
+// startTransport starts receiving responses from the configured transport,
+// if any. Must be called with s.mu held.
+func (s *Server) startTransport() error {
+	if s.transport == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	responses, err := s.transport.ReceiveResponses(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to receive responses: %w", err)
+	}
+	s.transportStop = cancel
+	if responses != nil {
+		go s.consumeTransportResponses(ctx, responses)
+	}
+	return nil
+}
+
+// stopTransport stops receiving responses from the transport. Must be
+// called with s.mu held.
+func (s *Server) stopTransport() {
+	if s.transportStop != nil {
+		s.transportStop()
+		s.transportStop = nil
+	}
+}
+
+// consumeTransportResponses completes round trips from the responses of the
+// transport until ctx is done
+func (s *Server) consumeTransportResponses(ctx context.Context, responses <-chan *RoundTripResponse) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case response, ok := <-responses:
+			if !ok {
+				return
+			}
+			if err := s.completeRoundTrip(response); err != nil {
+				log.Printf("Transport response for RequestID %s: %v", response.RequestID, err)
+			}
+		}
+	}
+}
+
+// configError is a Send failure due to the configuration of the server,
+// which round trips return as their error instead of reporting it in the
+// response
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// httpTransport posts JSON over HTTP, through tailnet identities where
+// configured, with responses posted to /roundtrip of the server
+type httpTransport struct {
+	server *Server
+}
+
+// Send posts to post.URL with newPostRequest, with the server's client or
+// that of the tailnet node posting there, and signs the post if request
+// signing is configured
+func (t httpTransport) Send(ctx context.Context, post *Post) error {
+	s := t.server
+	serverURL := s.GetURL()
+	s.mu.RLock()
+	if post.RoundTrip && s.funnelURL != "" {
+		// Receivers outside the tailnet post back through Tailscale Funnel
+		serverURL = s.funnelURL
+	}
+	client := s.client
+	s.mu.RUnlock()
+
+	node, err := s.tailnetNodeFor(post.URL, post.Identity)
+	if err != nil {
+		return &configError{err: err}
+	}
+	if node != nil {
+		// Callbacks arrive on the identity's node in the target tailnet
+		client = node.client
+		serverURL = node.callbackURL()
+	}
+	post.Data.URL = serverURL
+	if post.RoundTrip {
+		post.Data.URL += "/roundtrip"
+	}
+
+	req, body, err := s.newPostRequest(ctx, post.URL, post.Data, post.Attachments)
+	if err != nil {
+		return err
+	}
+	defer body.release()
+	if err := s.signRequest(req, body.data); err != nil {
+		req.Body.Close()
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post JSON: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return &PostStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// newPostRequest returns the unsigned request posting data to postURL in the
+// server's encoding, as a CloudEvent if configured, or as a multipart post
+// with attachments, compressed if configured. The caller releases the body
+// once done with the request.
+func (s *Server) newPostRequest(ctx context.Context, postURL string, data PostData, attachments []Attachment) (*http.Request, *pooledBody, error) {
+	s.mu.RLock()
+	encoding := s.encoding
+	compression := s.compression
+	s.mu.RUnlock()
+
+	var buf *bytes.Buffer
+	var body []byte
+	var header http.Header
+	var err error
+	if len(attachments) > 0 {
+		var contentType string
+		body, contentType, err = encodeMultipartPost(data, attachments)
+		if err != nil {
+			return nil, nil, err
+		}
+		header = http.Header{"Content-Type": {contentType}}
+	} else {
+		buf, err = encoding.marshalBuffer(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, header, err = s.wrapCloudEvent(CloudEventTypePost, data.RequestID, encoding, buf.Bytes())
+		if err != nil {
+			putBuffer(buf)
+			return nil, nil, err
+		}
+	}
+	body, err = compressBody(compression, body, header)
+	if err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+	pooled := newPooledBody(buf, body)
+	req, err := pooled.newRequest(ctx, postURL)
+	if err != nil {
+		pooled.release()
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header = header
+	// Callbacks in the same encoding and compression
+	req.Header.Set("Accept", encoding.ContentType())
+	if accept := acceptEncoding(compression); accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	return req, pooled, nil
+}
+
+// ReceiveResponses returns nil, as receivers post responses to /roundtrip
+func (t httpTransport) ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error) {
+	return nil, nil
+}
+
+// ResponseFeed hands the responses a transport receives, other than those to
+// its own round trips, to the server receiving its responses. The zero value
+// is ready to use.
+type ResponseFeed struct {
+	mu        sync.Mutex
+	responses chan *RoundTripResponse
+	done      <-chan struct{}
+}
+
+// Start feeds responses to the returned channel until ctx is done, for
+// ReceiveResponses of a transport
+func (f *ResponseFeed) Start(ctx context.Context) <-chan *RoundTripResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	responses := make(chan *RoundTripResponse)
+	f.responses = responses
+	f.done = ctx.Done()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		if f.responses == responses {
+			f.responses = nil
+		}
+		f.mu.Unlock()
+	}()
+	return responses
+}
+
+// Deliver hands response to the server, and reports whether one receives
+// the responses
+func (f *ResponseFeed) Deliver(response *RoundTripResponse) bool {
+	f.mu.Lock()
+	responses, done := f.responses, f.done
+	f.mu.Unlock()
+
+	if responses == nil {
+		return false
+	}
+	select {
+	case responses <- response:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// ProcessPost processes a post a transport received with processor, as posts
+// to /webhook are, or echoes it back if processor is nil, and returns the
+// callback answering it, in a child span of the post's trace
+func ProcessPost(processor PayloadProcessor, data PostData) CallbackMessage {
+	processorContext := newProcessorContext(data, nil)
+	callback := CallbackMessage{RequestID: data.RequestID}
+	callback.setTrace(processorContext.Trace)
+	processedPayload, err := processWithContext(processor, data.Payload, processorContext)
+	if err != nil {
+		callback.Error = fmt.Sprintf("Processing error: %v", err)
+	} else {
+		callback.Payload = processedPayload
+	}
+	return callback
+}
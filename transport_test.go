@@ -0,0 +1,109 @@
+package post2post
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// processorFunc adapts a function to PayloadProcessor
+type processorFunc func(payload interface{}, requestID string) (interface{}, error)
+
+func (f processorFunc) Process(payload interface{}, requestID string) (interface{}, error) {
+	return f(payload, requestID)
+}
+
+// loopbackTransport answers posts in process with a processor, as a
+// receiver behind a queue would
+type loopbackTransport struct {
+	processor PayloadProcessor
+	feed      ResponseFeed
+}
+
+func (t *loopbackTransport) Send(ctx context.Context, post *Post) error {
+	callback := ProcessPost(t.processor, post.Data)
+	if !post.RoundTrip {
+		return nil
+	}
+	if !t.feed.Deliver(callback.RoundTripResponse()) {
+		return errors.New("no server receives the responses")
+	}
+	return nil
+}
+
+func (t *loopbackTransport) ReceiveResponses(ctx context.Context) (<-chan *RoundTripResponse, error) {
+	return t.feed.Start(ctx), nil
+}
+
+func TestServer_WithTransport(t *testing.T) {
+	transport := &loopbackTransport{processor: processorFunc(func(payload interface{}, requestID string) (interface{}, error) {
+		if payload == "fail" {
+			return nil, errors.New("bad payload")
+		}
+		return map[string]interface{}{"request_id": requestID, "original": payload}, nil
+	})}
+
+	// No post URL is needed
+	server := NewServer().WithInterface("127.0.0.1").WithTransport(transport)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	response, err := server.RoundTripPostWithTimeout(map[string]interface{}{"message": "hello"}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, want success", response)
+	}
+	original := response.Payload.(map[string]interface{})["original"].(map[string]interface{})
+	if original["message"] != "hello" {
+		t.Errorf("response payload = %v, want the original message", response.Payload)
+	}
+
+	response, err = server.RoundTripPostWithTimeout("fail", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if response.Success || response.Error != "Processing error: bad payload" || response.Err == nil {
+		t.Errorf("RoundTripPost() = %+v, want a processing error", response)
+	}
+
+	if err := server.PostJSON(map[string]interface{}{"message": "hello"}); err != nil {
+		t.Errorf("PostJSON() failed: %v", err)
+	}
+}
+
+func TestHTTPTransport_StatusError(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer receiver.Close()
+
+	server := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.URL)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer server.Stop()
+
+	err := server.PostJSON("hello")
+	var statusErr *PostStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("PostJSON() = %v, want a PostStatusError with status 403", err)
+	}
+
+	response, err := server.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if response.Success || response.StatusCode != http.StatusForbidden || response.Error != "post request failed with status: 403" {
+		t.Errorf("RoundTripPost() = %+v, want status 403", response)
+	}
+	if !errors.As(response.Err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("RoundTripPost() Err = %v, want a PostStatusError with status 403", response.Err)
+	}
+}
@@ -0,0 +1,352 @@
+package post2post
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookSignatureScheme is an industry-standard webhook signature scheme,
+// understood by webhook frameworks and gateways
+type WebhookSignatureScheme int
+
+const (
+	// WebhookSignatureGitHub signs with X-Hub-Signature-256: "sha256="
+	// followed by the hex HMAC-SHA256 of the body
+	WebhookSignatureGitHub WebhookSignatureScheme = iota + 1
+	// WebhookSignatureStandard signs as Standard Webhooks and Svix do, with
+	// webhook-id, webhook-timestamp and webhook-signature headers: "v1,"
+	// followed by the base64 HMAC-SHA256 of the id, timestamp and body
+	// joined by dots. Secrets prefixed with "whsec_" are base64.
+	WebhookSignatureStandard
+)
+
+// Webhook signature headers
+const (
+	HubSignatureHeader             = "X-Hub-Signature-256"
+	StandardWebhookIDHeader        = "Webhook-Id"
+	StandardWebhookTimestampHeader = "Webhook-Timestamp"
+	StandardWebhookSignatureHeader = "Webhook-Signature"
+)
+
+// Svix headers, accepted in place of the Standard Webhooks ones
+const (
+	svixIDHeader        = "Svix-Id"
+	svixTimestampHeader = "Svix-Timestamp"
+	svixSignatureHeader = "Svix-Signature"
+)
+
+const (
+	// standardWebhookSecretPrefix marks base64 Standard Webhooks secrets
+	standardWebhookSecretPrefix = "whsec_"
+	// standardWebhookSignatureVersion prefixes Standard Webhooks signatures
+	standardWebhookSignatureVersion = "v1,"
+)
+
+// webhookSigner signs outgoing posts and callbacks with a webhook signature
+// scheme. err holds an invalid secret, which fails Start and every post
+// rather than sending them unsigned.
+type webhookSigner struct {
+	scheme WebhookSignatureScheme
+	key    []byte
+	err    error
+}
+
+// webhookVerifier verifies the webhook signatures of incoming posts and
+// callbacks against any of its keys. err holds an invalid secret, which
+// fails Start; the remaining keys still verify, so posts are never
+// accepted unsigned because of it.
+type webhookVerifier struct {
+	scheme WebhookSignatureScheme
+	keys   [][]byte
+	err    error
+}
+
+// WithWebhookSignature signs every post, and the callbacks of this server
+// as a receiver, with secret in the given scheme. An empty secret disables
+// webhook signatures; an invalid one fails Start and every post.
+func (s *Server) WithWebhookSignature(scheme WebhookSignatureScheme, secret string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret == "" {
+		s.signing.webhook = nil
+		return s
+	}
+	key, err := webhookSigningKey(scheme, secret)
+	s.signing.webhook = &webhookSigner{scheme: scheme, key: key, err: err}
+	return s
+}
+
+// WithWebhookVerification rejects posts and callbacks to the server that
+// are not signed in the given scheme with one of secrets, e.g. the current
+// and the previous secret while rotating. Without secrets posts are not
+// verified; an invalid secret fails Start.
+func (s *Server) WithWebhookVerification(scheme WebhookSignatureScheme, secrets ...string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(secrets) == 0 {
+		s.webhookVerifier = nil
+		return s
+	}
+	verifier := &webhookVerifier{scheme: scheme}
+	for _, secret := range secrets {
+		key, err := webhookSigningKey(scheme, secret)
+		if err != nil {
+			verifier.err = err
+			continue
+		}
+		verifier.keys = append(verifier.keys, key)
+	}
+	s.webhookVerifier = verifier
+	return s
+}
+
+// checkWebhookSecrets fails if a webhook signature or verification secret
+// is invalid
+func (s *Server) checkWebhookSecrets() error {
+	if s.signing.webhook != nil && s.signing.webhook.err != nil {
+		return fmt.Errorf("invalid webhook signature secret: %w", s.signing.webhook.err)
+	}
+	if s.webhookVerifier != nil && s.webhookVerifier.err != nil {
+		return fmt.Errorf("invalid webhook verification secret: %w", s.webhookVerifier.err)
+	}
+	return nil
+}
+
+// webhookSigningKey returns the HMAC key of secret in scheme, failing for
+// empty keys
+func webhookSigningKey(scheme WebhookSignatureScheme, secret string) ([]byte, error) {
+	var key []byte
+	switch scheme {
+	case WebhookSignatureGitHub:
+		key = []byte(secret)
+	case WebhookSignatureStandard:
+		key = []byte(secret)
+		if encoded, ok := strings.CutPrefix(secret, standardWebhookSecretPrefix); ok {
+			var err error
+			key, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("invalid webhook secret: %w", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown webhook signature scheme %d", scheme)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("webhook secret is empty")
+	}
+	return key, nil
+}
+
+// sign sets the webhook signature headers on req for body, failing if the
+// secret is invalid; a nil signer does nothing
+func (w *webhookSigner) sign(req *http.Request, body []byte) error {
+	if w == nil {
+		return nil
+	}
+	if w.err != nil {
+		return fmt.Errorf("invalid webhook signature secret: %w", w.err)
+	}
+	switch w.scheme {
+	case WebhookSignatureGitHub:
+		req.Header.Set(HubSignatureHeader, "sha256="+hubSignature(w.key, body))
+	case WebhookSignatureStandard:
+		id := newWebhookID()
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(StandardWebhookIDHeader, id)
+		req.Header.Set(StandardWebhookTimestampHeader, timestamp)
+		req.Header.Set(StandardWebhookSignatureHeader, standardWebhookVersion(w.key, id, timestamp, body))
+	}
+	return nil
+}
+
+// VerifyWebhookSignature checks the webhook signature of a request with
+// body in scheme against secret, for receivers written in Go. Standard
+// Webhooks signatures are also accepted in Svix headers, and rejected when
+// their timestamp is more than maxAge from now.
+func VerifyWebhookSignature(scheme WebhookSignatureScheme, header http.Header, body []byte, secret string, maxAge time.Duration) error {
+	key, err := webhookSigningKey(scheme, secret)
+	if err != nil {
+		return err
+	}
+	return verifyWebhookSignature(scheme, header, body, [][]byte{key}, maxAge)
+}
+
+// verifyWebhookSignature checks the signature of a request against any of
+// keys
+func verifyWebhookSignature(scheme WebhookSignatureScheme, header http.Header, body []byte, keys [][]byte, maxAge time.Duration) error {
+	return verifyWebhookSignatureFrom(scheme, header, bytes.NewReader(body), keys, maxAge)
+}
+
+// verifyWebhookSignatureFrom checks the signature of a request against any
+// of keys, hashing its body as it reads it from body. The body is not read
+// if the signature headers are missing or stale.
+func verifyWebhookSignatureFrom(scheme WebhookSignatureScheme, header http.Header, body io.Reader, keys [][]byte, maxAge time.Duration) error {
+	switch scheme {
+	case WebhookSignatureGitHub:
+		signature, ok := strings.CutPrefix(header.Get(HubSignatureHeader), "sha256=")
+		if !ok {
+			return fmt.Errorf("request has no %s signature", HubSignatureHeader)
+		}
+		sums, err := webhookMACs(keys, nil, body)
+		if err != nil {
+			return err
+		}
+		for _, sum := range sums {
+			if hmac.Equal([]byte(signature), []byte(hex.EncodeToString(sum))) {
+				return nil
+			}
+		}
+		return fmt.Errorf("signature mismatch")
+
+	case WebhookSignatureStandard:
+		id, timestamp, signatures := header.Get(StandardWebhookIDHeader), header.Get(StandardWebhookTimestampHeader), header.Get(StandardWebhookSignatureHeader)
+		if signatures == "" {
+			id, timestamp, signatures = header.Get(svixIDHeader), header.Get(svixTimestampHeader), header.Get(svixSignatureHeader)
+		}
+		if id == "" || timestamp == "" || signatures == "" {
+			return fmt.Errorf("request is not signed")
+		}
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid signature timestamp %q", timestamp)
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age > maxAge || age < -maxAge {
+			return fmt.Errorf("signature timestamp is outside the allowed window of %s", maxAge)
+		}
+		sums, err := webhookMACs(keys, []byte(id+"."+timestamp+"."), body)
+		if err != nil {
+			return err
+		}
+		// The header may hold several space separated signatures
+		for _, sum := range sums {
+			want := standardWebhookSignatureVersion + base64.StdEncoding.EncodeToString(sum)
+			for _, signature := range strings.Fields(signatures) {
+				if hmac.Equal([]byte(signature), []byte(want)) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("signature mismatch")
+	}
+	return fmt.Errorf("unknown webhook signature scheme %d", scheme)
+}
+
+// webhookMACs returns the HMAC-SHA256 of prefix followed by body with each
+// of keys, reading body once
+func webhookMACs(keys [][]byte, prefix []byte, body io.Reader) ([][]byte, error) {
+	macs := make([]io.Writer, len(keys))
+	for i, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(prefix)
+		macs[i] = mac
+	}
+	if _, err := io.Copy(io.MultiWriter(macs...), body); err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	sums := make([][]byte, len(macs))
+	for i, mac := range macs {
+		sums[i] = mac.(hash.Hash).Sum(nil)
+	}
+	return sums, nil
+}
+
+// verifyWebhookSignatures rejects posts to next whose webhook signature does
+// not verify, if verification is configured. It runs before decompression,
+// as posts are signed as sent. The body is hashed as it is read into a
+// spooled body for next: on disk beyond the payload spill threshold, and
+// otherwise in memory up to the maximum decompressed size.
+func (s *Server) verifyWebhookSignatures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		verifier := s.webhookVerifier
+		spill := s.payloadSpill
+		maxSize := s.maxDecompressed
+		s.mu.RUnlock()
+
+		if verifier == nil || r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reader := r.Body
+		if spill.threshold <= 0 {
+			if maxSize <= 0 {
+				maxSize = defaultMaxDecompressedSize
+			}
+			reader = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+		body := newSpooledBody(spill)
+		defer body.Close()
+		source := &readErrorReader{r: reader}
+		if err := verifyWebhookSignatureFrom(verifier.scheme, r.Header, io.TeeReader(source, body), verifier.keys, DefaultSignatureMaxAge); err != nil {
+			switch {
+			case source.err != nil:
+				w.WriteHeader(bodyErrorStatus(source.err))
+			case body.err != nil:
+				log.Printf("verifyWebhookSignatures: %v", body.err)
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		spooled, err := body.reader()
+		if err != nil {
+			log.Printf("verifyWebhookSignatures: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(spooled)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readErrorReader reads from r, recording the first error other than io.EOF
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErrorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// hubSignature returns the hex HMAC-SHA256 of body
+func hubSignature(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// standardWebhookVersion returns the versioned Standard Webhooks signature
+// of id, timestamp and body
+func standardWebhookVersion(key []byte, id, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(body)
+	return standardWebhookSignatureVersion + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookID returns a unique Standard Webhooks message ID
+func newWebhookID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return "msg_" + hex.EncodeToString(id)
+}
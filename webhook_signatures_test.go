@@ -0,0 +1,210 @@
+package post2post
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"payload":"hello"}`)
+	secret := "whsec_" + base64.StdEncoding.EncodeToString(testSigningKey)
+
+	signed := func(scheme WebhookSignatureScheme, secret string) http.Header {
+		key, err := webhookSigningKey(scheme, secret)
+		if err != nil {
+			t.Fatalf("webhookSigningKey() failed: %v", err)
+		}
+		req, _ := http.NewRequest("POST", "http://receiver/webhook", nil)
+		(&webhookSigner{scheme: scheme, key: key}).sign(req, body)
+		return req.Header
+	}
+
+	github := signed(WebhookSignatureGitHub, "github-secret")
+	standard := signed(WebhookSignatureStandard, secret)
+	// Svix senders use their own header names
+	svix := make(http.Header)
+	svix.Set("Svix-Id", standard.Get(StandardWebhookIDHeader))
+	svix.Set("Svix-Timestamp", standard.Get(StandardWebhookTimestampHeader))
+	svix.Set("Svix-Signature", "v1,b3RoZXI= "+standard.Get(StandardWebhookSignatureHeader))
+	stale := standard.Clone()
+	stale.Set(StandardWebhookTimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+
+	tests := []struct {
+		name    string
+		scheme  WebhookSignatureScheme
+		header  http.Header
+		body    []byte
+		secret  string
+		wantErr bool
+	}{
+		{"github", WebhookSignatureGitHub, github, body, "github-secret", false},
+		{"github wrong secret", WebhookSignatureGitHub, github, body, "other", true},
+		{"github tampered body", WebhookSignatureGitHub, github, []byte(`{}`), "github-secret", true},
+		{"github unsigned", WebhookSignatureGitHub, http.Header{}, body, "github-secret", true},
+		{"standard", WebhookSignatureStandard, standard, body, secret, false},
+		{"standard raw secret", WebhookSignatureStandard, standard, body, string(testSigningKey), false},
+		{"svix with several signatures", WebhookSignatureStandard, svix, body, secret, false},
+		{"standard tampered body", WebhookSignatureStandard, standard, []byte(`{}`), secret, true},
+		{"standard stale", WebhookSignatureStandard, stale, body, secret, true},
+		{"standard unsigned", WebhookSignatureStandard, github, body, secret, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyWebhookSignature(tt.scheme, tt.header, tt.body, tt.secret, DefaultSignatureMaxAge)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyWebhookSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_WithWebhookVerification(t *testing.T) {
+	secret := "whsec_" + base64.StdEncoding.EncodeToString(testSigningKey)
+
+	// Both ends sign and verify: the receiver the post, the sender the
+	// callback
+	receiver := NewServer().WithInterface("127.0.0.1").
+		WithWebhookSignature(WebhookSignatureStandard, secret).
+		WithWebhookVerification(WebhookSignatureStandard, "whsec_b2xk", secret)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL()+"/webhook").
+		WithWebhookSignature(WebhookSignatureStandard, secret).
+		WithWebhookVerification(WebhookSignatureStandard, secret)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	response, err := sender.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if !response.Success || response.Payload != "hello" {
+		t.Errorf("RoundTripPost() = %+v, want the echoed payload", response)
+	}
+
+	// Unsigned posts are rejected
+	resp, err := http.Post(receiver.GetURL()+"/webhook", "application/json", bytes.NewBufferString(`{"payload":"hello"}`))
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned post status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Senders signing with another secret fail the round trip
+	other := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL()+"/webhook").
+		WithWebhookSignature(WebhookSignatureGitHub, "github-secret")
+	if err := other.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer other.Stop()
+	response, err = other.RoundTripPostWithTimeout("hello", "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPost() failed: %v", err)
+	}
+	if response.Success || response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("RoundTripPost() = %+v, want status 401", response)
+	}
+}
+
+func TestServer_InvalidWebhookSecrets(t *testing.T) {
+	secret := "whsec_" + base64.StdEncoding.EncodeToString(testSigningKey)
+
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"signature not base64", NewServer().WithWebhookSignature(WebhookSignatureStandard, "whsec_!")},
+		{"signature empty key", NewServer().WithWebhookSignature(WebhookSignatureStandard, "whsec_")},
+		{"signature unknown scheme", NewServer().WithWebhookSignature(WebhookSignatureScheme(0), "secret")},
+		{"verification only invalid secrets", NewServer().WithWebhookVerification(WebhookSignatureStandard, "whsec_!")},
+		{"verification one invalid secret", NewServer().WithWebhookVerification(WebhookSignatureStandard, secret, "whsec_")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.server.WithInterface("127.0.0.1").Start(); err == nil {
+				tt.server.Stop()
+				t.Fatal("Start() succeeded, want an invalid secret error")
+			}
+		})
+	}
+
+	// Posts fail instead of going out unsigned
+	req := httptest.NewRequest("POST", "/webhook", nil)
+	signing := requestSigning{webhook: &webhookSigner{scheme: WebhookSignatureStandard, err: fmt.Errorf("bad secret")}}
+	if err := signing.sign(req, []byte(`{}`)); err == nil {
+		t.Error("sign() succeeded with an invalid secret")
+	}
+	if req.Header.Get(StandardWebhookSignatureHeader) != "" {
+		t.Error("sign() set a signature with an invalid secret")
+	}
+}
+
+func TestServer_WebhookVerificationSpooling(t *testing.T) {
+	dir := t.TempDir()
+	receiver := NewServer().WithInterface("127.0.0.1").WithProcessor(&spillProcessor{}).
+		WithPayloadSpill(1024, dir).
+		WithWebhookVerification(WebhookSignatureGitHub, "github-secret")
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	sender := NewServer().WithInterface("127.0.0.1").WithPostURL(receiver.GetURL()+"/webhook").
+		WithWebhookSignature(WebhookSignatureGitHub, "github-secret")
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	// Posts over the spill threshold are spooled to disk to be verified
+	large := strings.Repeat("post2post ", 1000)
+	response, err := sender.RoundTripPostWithTimeout(large, "", 5*time.Second)
+	if err != nil || !response.Success {
+		t.Fatalf("RoundTripPost() = %+v, %v", response, err)
+	}
+	if result := response.Payload.(map[string]interface{}); result["spilled"] != `"`+large+`"` {
+		t.Errorf("large post result = %v, want the payload spilled", result)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("spill directory holds %v, %v after processing, want nothing", entries, err)
+	}
+
+	// Without spilling, signed posts are held in memory up to the maximum
+	// size
+	bounded := NewServer().WithInterface("127.0.0.1").WithMaxDecompressedSize(4096).
+		WithWebhookVerification(WebhookSignatureGitHub, "github-secret")
+	if err := bounded.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer bounded.Stop()
+	body := []byte(`{"payload":"` + large + `"}`)
+	req, _ := http.NewRequest("POST", bounded.GetURL()+"/webhook", bytes.NewReader(body))
+	signer := &webhookSigner{scheme: WebhookSignatureGitHub, key: []byte("github-secret")}
+	if err := signer.sign(req, body); err != nil {
+		t.Fatalf("sign() failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized signed post status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
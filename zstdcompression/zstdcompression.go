@@ -0,0 +1,80 @@
+// Package zstdcompression registers the Zstandard compression of post2post,
+// post2post.CompressionZstd, when imported:
+//
+//	import _ "github.com/pgdad/post2post/zstdcompression"
+//
+// It is a module of its own so that only servers using Zstandard depend on
+// the Zstandard library.
+package zstdcompression
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/pgdad/post2post"
+)
+
+func init() {
+	post2post.RegisterCompression(post2post.CompressionZstd, Compressor{})
+}
+
+// maxWindow bounds the window of bodies, and so the memory decoding one
+// takes, whatever the window its frame header claims
+const maxWindow = 8 << 20
+
+// Compressor compresses and decompresses Zstandard bodies
+type Compressor struct{}
+
+var _ post2post.Compressor = Compressor{}
+
+// encoder compresses bodies; EncodeAll is safe for concurrent use
+var encoder = sync.OnceValue(func() *zstd.Encoder {
+	encoder, _ := zstd.NewWriter(nil)
+	return encoder
+})
+
+// Compress returns body compressed with Zstandard
+func (Compressor) Compress(body []byte) ([]byte, error) {
+	return encoder().EncodeAll(body, nil), nil
+}
+
+// NewReader returns a reader decompressing r with at most maxSize bytes of
+// memory and a window of at most 8 MB. Frames declaring more content or a
+// larger window fail with an *http.MaxBytesError.
+func (Compressor) NewReader(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	window := uint64(maxWindow)
+	if uint64(maxSize) < window {
+		window = max(uint64(maxSize), zstd.MinWindowSize)
+	}
+	decoder, err := zstd.NewReader(r,
+		zstd.WithDecoderMaxMemory(uint64(maxSize)),
+		zstd.WithDecoderMaxWindow(window))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{decoder: decoder, maxSize: maxSize}, nil
+}
+
+// reader reads a decompressed body, reporting frames over the limits as
+// too large
+type reader struct {
+	decoder *zstd.Decoder
+	maxSize int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		err = &http.MaxBytesError{Limit: r.maxSize}
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	r.decoder.Close()
+	return nil
+}
@@ -0,0 +1,96 @@
+package zstdcompression
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgdad/post2post"
+)
+
+func TestZstdCompression(t *testing.T) {
+	receiver := post2post.NewServer().WithInterface("127.0.0.1").WithCompression(post2post.CompressionZstd)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Record the headers of the post on its way to the receiver
+	target, _ := url.Parse(receiver.GetURL())
+	forward := httputil.NewSingleHostReverseProxy(target)
+	headers := make(chan http.Header, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	sender := post2post.NewServer().WithInterface("127.0.0.1").WithCompression(post2post.CompressionZstd)
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer sender.Stop()
+
+	message := strings.Repeat("post2post ", 500)
+	response, err := sender.RoundTripPostToURL(proxy.URL+"/webhook", map[string]interface{}{"message": message}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("RoundTripPostToURL() failed: %v", err)
+	}
+	if !response.Success || response.Payload.(map[string]interface{})["message"] != message {
+		t.Fatalf("RoundTripPostToURL() = %+v, want the echoed message", response)
+	}
+	h := <-headers
+	if got := h.Get("Content-Encoding"); got != "zstd" {
+		t.Errorf("post Content-Encoding = %q, want zstd", got)
+	}
+	if got := h.Get("Accept-Encoding"); got != "zstd, gzip" {
+		t.Errorf("post Accept-Encoding = %q, want %q", got, "zstd, gzip")
+	}
+}
+
+func TestZstdCompression_MaxDecompressedSize(t *testing.T) {
+	receiver := post2post.NewServer().WithInterface("127.0.0.1").WithMaxDecompressedSize(1 << 20)
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// 16 MB of payload compress to a few KB
+	bomb := []byte(`{"payload":"` + strings.Repeat("a", 16<<20) + `"}`)
+	small := []byte(`{"payload":"` + strings.Repeat("a", 4096) + `"}`)
+	tests := []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"bomb", bomb, http.StatusRequestEntityTooLarge},
+		{"small", small, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := Compressor{}.Compress(tt.body)
+			if err != nil {
+				t.Fatalf("Compress() failed: %v", err)
+			}
+			if len(body) > 64<<10 {
+				t.Fatalf("compressed body is %d bytes, want a highly compressed body", len(body))
+			}
+			req, _ := http.NewRequest("POST", receiver.GetURL()+"/webhook", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "zstd")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("POST /webhook failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("POST /webhook status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}